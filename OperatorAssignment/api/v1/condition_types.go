@@ -0,0 +1,118 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ConditionReady reports whether the object reached its desired state.
+	ConditionReady = "Ready"
+	// ConditionCatalogSynced reports whether the tmsources generated from the
+	// metric catalog of a site match it.
+	ConditionCatalogSynced = "CatalogSynced"
+	// ConditionDependenciesReady reports whether the sites a site depends on
+	// are Ready. The sources of the site do not run while it is False.
+	ConditionDependenciesReady = "DependenciesReady"
+	// ConditionDraining reports whether a disabled site keeps its sources
+	// running until the sites depending on it stopped theirs.
+	ConditionDraining = "Draining"
+	// ConditionFlowing reports whether the metric of a running tmsource is
+	// received on NATS, only set when the flow probe is enabled.
+	ConditionFlowing = "Flowing"
+	// ConditionInSync reports whether the tmsources and pods of a site match
+	// its desired state, status.drift details the differences.
+	ConditionInSync = "InSync"
+	// ConditionPropagated reports whether a site and its tmsources were
+	// written to all the member clusters of its placement, in hub mode.
+	ConditionPropagated = "Propagated"
+)
+
+// Condition describes one aspect of the observed state of a Site or TmSource
+type Condition struct {
+	// Type of the condition, e.g. Ready.
+	// +kubebuilder:validation:Pattern=`^[A-Z][A-Za-z]*$`
+	Type string `json:"type"`
+	// Status of the condition, one of True, False, Unknown.
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	Status metav1.ConditionStatus `json:"status"`
+	// LastTransitionTime is the last time the status changed.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason is a CamelCase word explaining the last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Message is a human readable description of the last transition.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// FindCondition returns the condition of the given type, or nil if absent.
+func FindCondition(conditions []Condition, conditionType string) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// IsConditionStatus reports whether the condition of the given type exists
+// with the given status.
+func IsConditionStatus(conditions []Condition, conditionType string, status metav1.ConditionStatus) bool {
+	c := FindCondition(conditions, conditionType)
+	return c != nil && c.Status == status
+}
+
+// RemoveCondition removes the condition of the given type from the list.
+// Returns true if it was present.
+func RemoveCondition(conditions *[]Condition, conditionType string) bool {
+	for i := range *conditions {
+		if (*conditions)[i].Type == conditionType {
+			*conditions = append((*conditions)[:i], (*conditions)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetCondition adds or updates a condition in the list.
+// The transition time is only bumped when the status changes.
+// Returns true if anything was modified.
+func SetCondition(conditions *[]Condition, condition Condition) bool {
+	existing := FindCondition(*conditions, condition.Type)
+	if existing == nil {
+		if condition.LastTransitionTime.IsZero() {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		*conditions = append(*conditions, condition)
+		return true
+	}
+
+	if existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+		return false
+	}
+
+	if existing.Status != condition.Status {
+		existing.LastTransitionTime = metav1.Now()
+	}
+	existing.Status = condition.Status
+	existing.Reason = condition.Reason
+	existing.Message = condition.Message
+	return true
+}
@@ -0,0 +1,73 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Placement selects the member clusters a site and its tmsources are
+// propagated to by an operator running in hub mode.
+type Placement struct {
+	// Clusters are the names of the member clusters, each one a Secret of the
+	// hub members namespace holding a kubeconfig.
+	// +optional
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+// MemberSiteStatus is the status of a site in a member cluster.
+type MemberSiteStatus struct {
+	// Cluster is the name of the member cluster.
+	Cluster string `json:"cluster"`
+
+	// Mode the site runs in on the member.
+	// +optional
+	Mode SiteMode `json:"mode,omitempty"`
+
+	// Sources is the number of tmsources of the site on the member.
+	// +optional
+	Sources int32 `json:"sources,omitempty"`
+
+	// Ready is the Ready condition status of the site on the member, Unknown
+	// when the member could not be reached.
+	Ready metav1.ConditionStatus `json:"ready"`
+
+	// Message explains Ready.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastSyncTime is when the site was last propagated to the member.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+}
+
+// MemberSourceStatus is the status of a tmsource in a member cluster.
+type MemberSourceStatus struct {
+	// Cluster is the name of the member cluster.
+	Cluster string `json:"cluster"`
+
+	// Phase of the tmsource on the member.
+	// +optional
+	Phase TmSourcePhase `json:"phase,omitempty"`
+
+	// Pod publishing the metric on the member.
+	// +optional
+	Pod string `json:"pod,omitempty"`
+
+	// Ready is the Ready condition status of the tmsource on the member.
+	Ready metav1.ConditionStatus `json:"ready"`
+}
@@ -0,0 +1,75 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodExtensions are added to the generated source pods. Those of a site apply
+// to all its tmsources, a tmsource entry overrides the site entry of the same
+// name, or mount path for volume mounts.
+type PodExtensions struct {
+	// Sidecars run next to the rocket-source container, e.g. a local buffer
+	// or forwarder.
+	// +optional
+	Sidecars []corev1.Container `json:"sidecars,omitempty"`
+
+	// InitContainers run before the rocket-source container, e.g. to wait
+	// for NATS.
+	// +optional
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+
+	// Volumes of the source pod.
+	// +optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+
+	// VolumeMounts of the rocket-source container.
+	// +optional
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+}
+
+// PodSecurity overrides the secure defaults of the generated source pods. A
+// field set by a tmsource overrides the same field of its site, which
+// overrides the default.
+type PodSecurity struct {
+	// ServiceAccountName runs the source pods with an existing service account
+	// instead of the one the operator manages for their site.
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// AutomountServiceAccountToken mounts the token of the service account in
+	// the source pods. Defaults to false, rocket-source does not call the API.
+	// +optional
+	AutomountServiceAccountToken *bool `json:"automountServiceAccountToken,omitempty"`
+
+	// PodSecurityContext of the source pods, merged field by field over the
+	// default: runAsNonRoot with user and group 1000.
+	// +optional
+	PodSecurityContext *corev1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+
+	// SecurityContext of the rocket-source container, merged field by field
+	// over the default: read-only root filesystem, no privilege escalation and
+	// all capabilities dropped. Sidecars and init containers get it for the
+	// fields they do not set.
+	// +optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+
+	// SeccompProfile of the source pods. Defaults to runtime/default.
+	// +optional
+	SeccompProfile string `json:"seccompProfile,omitempty"`
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -28,7 +31,292 @@ type SiteSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	Enabled bool `json:"enabled"`
+	// TemplateRef merges the defaults of a SiteTemplate of the namespace
+	// under the spec of the site.
+	// +optional
+	TemplateRef *SiteTemplateRef `json:"templateRef,omitempty"`
+
+	// Enabled runs the tmsources of the site when true and stops them when
+	// false. Mode takes precedence when set.
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Mode of the site: Enabled runs all its tmsources, Degraded only the ones
+	// kept by the degraded policy and Disabled none. Defaults to Enabled or
+	// Disabled after the enabled field.
+	// +optional
+	Mode SiteMode `json:"mode,omitempty"`
+
+	// Degraded selects the tmsources kept running in Degraded mode.
+	// +optional
+	Degraded *DegradedPolicy `json:"degraded,omitempty"`
+
+	// DependsOn lists sites of the same namespace which must be Ready before
+	// the tmsources of this site run. A disabled site keeps its tmsources
+	// running until the sites depending on it stopped theirs.
+	// +optional
+	DependsOn []SiteName `json:"dependsOn,omitempty"`
+
+	// Catalog of metrics for which the site generates and prunes its own
+	// tmsources. A hand-authored tmsource of the site with the same metric
+	// overrides the generated one.
+	// +optional
+	Catalog *MetricCatalog `json:"catalog,omitempty"`
+
+	// Limits caps the tmsources the site runs. Tmsources over a limit are
+	// admitted oldest first, the others stay pending.
+	// +optional
+	Limits *SiteLimits `json:"limits,omitempty"`
+
+	// Rollout upgrades the rocket-source image of the tmsources of the site,
+	// a canary share first.
+	// +optional
+	Rollout *ImageRollout `json:"rollout,omitempty"`
+
+	// Placement propagates the site and its tmsources to member clusters,
+	// only read by an operator running in hub mode.
+	// +optional
+	Placement *Placement `json:"placement,omitempty"`
+
+	// Image is the rocket-source image of the tmsources of the site. A
+	// rollout takes precedence once started, as long as it is set. Defaults
+	// to maxthom/rocket-source:latest.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Resources of the rocket-source container of the tmsources of the site
+	// which set none.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// DrainCommand is run in the rocket-source container of the tmsources of
+	// the site which set none before it is sent SIGTERM. No command is run by
+	// default.
+	// +optional
+	DrainCommand []string `json:"drainCommand,omitempty"`
+
+	// NATS is the server the source pods of the site publish to.
+	// +optional
+	NATS *NatsEndpoint `json:"nats,omitempty"`
+
+	// NetworkPolicy generates a NetworkPolicy restricting the source pods of
+	// the site to NATS and DNS egress and to ingress from monitoring.
+	// +optional
+	NetworkPolicy *SiteNetworkPolicy `json:"networkPolicy,omitempty"`
+
+	// PodExtensions add sidecars, init containers and volumes to the source
+	// pods of all the tmsources of the site.
+	PodExtensions `json:",inline"`
+
+	// PodSecurity overrides the service account and security contexts of the
+	// source pods of all the tmsources of the site.
+	PodSecurity `json:",inline"`
+}
+
+// AnnotationReason is the annotation of a site explaining its last change,
+// copied in the history of the site.
+const AnnotationReason = "tm.rocketlab.global/reason"
+
+// SiteName is the name of a site.
+// +kubebuilder:validation:MinLength=1
+// +kubebuilder:validation:MaxLength=253
+// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+type SiteName string
+
+// SiteMode is which tmsources of a site run.
+// +kubebuilder:validation:Enum=Enabled;Degraded;Disabled
+type SiteMode string
+
+const (
+	SiteModeEnabled  SiteMode = "Enabled"
+	SiteModeDegraded SiteMode = "Degraded"
+	SiteModeDisabled SiteMode = "Disabled"
+)
+
+// DegradedPolicy selects the essential tmsources of a site. A tmsource is kept
+// when it matches the selector or has at least MinPriority. With neither, only
+// Critical tmsources are kept.
+type DegradedPolicy struct {
+	// Selector keeps the tmsources whose labels match.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// MinPriority keeps the tmsources of this priority or higher.
+	// +optional
+	MinPriority TmSourcePriority `json:"minPriority,omitempty"`
+}
+
+// SiteLimits are the maximum resources used by the tmsources of a site.
+type SiteLimits struct {
+	// MaxSources is the number of tmsources running at most.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxSources *int32 `json:"maxSources,omitempty"`
+
+	// CPU is the sum of the cpu requests of the source pods at most.
+	// +optional
+	CPU *resource.Quantity `json:"cpu,omitempty"`
+
+	// Memory is the sum of the memory requests of the source pods at most.
+	// +optional
+	Memory *resource.Quantity `json:"memory,omitempty"`
+}
+
+// SiteUsage is what the admitted tmsources of a site use.
+type SiteUsage struct {
+	// Sources is the number of admitted tmsources.
+	Sources int32 `json:"sources"`
+
+	// CPU is the sum of the cpu requests of the admitted tmsources.
+	CPU resource.Quantity `json:"cpu"`
+
+	// Memory is the sum of the memory requests of the admitted tmsources.
+	Memory resource.Quantity `json:"memory"`
+
+	// Pending is the number of tmsources held back by the limits.
+	// +optional
+	Pending int32 `json:"pending,omitempty"`
+}
+
+// ImageRollout is a canary rollout of a rocket-source image.
+type ImageRollout struct {
+	// Image is the rocket-source image to roll out.
+	// +kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+
+	// CanaryPercent of the running tmsources upgraded first, at least one.
+	// Defaults to 10.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	CanaryPercent int32 `json:"canaryPercent,omitempty"`
+
+	// BakeTime the canaries must stay ready before the other tmsources are
+	// upgraded. Defaults to 5 minutes.
+	// +optional
+	BakeTime *metav1.Duration `json:"bakeTime,omitempty"`
+
+	// ProgressDeadline is how long the canaries may take to be ready before
+	// the rollout is rolled back. Defaults to 10 minutes.
+	// +optional
+	ProgressDeadline *metav1.Duration `json:"progressDeadline,omitempty"`
+}
+
+// NatsEndpoint is the NATS server of the source pods of a site.
+type NatsEndpoint struct {
+	// Address of the server as host:port, given to rocket-source. Defaults to
+	// nats-server-service.default.svc.cluster.local:4222.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// PodSelector selects the server pods the network policy of the site
+	// allows egress to, in the namespaces of NamespaceSelector or else in the
+	// namespace of the site. With neither, egress to the port of Address is
+	// allowed to any destination.
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// NamespaceSelector selects the namespaces of the server pods.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+// SiteNetworkPolicy is the NetworkPolicy generated for the source pods of a
+// site.
+type SiteNetworkPolicy struct {
+	// Monitoring lists the peers allowed to reach the source pods, such as the
+	// Prometheus pods. Without peers no ingress is allowed.
+	// +optional
+	Monitoring []networkingv1.NetworkPolicyPeer `json:"monitoring,omitempty"`
+}
+
+// RolloutPhase is where an image rollout is.
+// +kubebuilder:validation:Enum=Canary;Complete;RolledBack
+type RolloutPhase string
+
+const (
+	// RolloutCanary means the canaries run the new image and bake.
+	RolloutCanary RolloutPhase = "Canary"
+	// RolloutComplete means every tmsource runs the new image.
+	RolloutComplete RolloutPhase = "Complete"
+	// RolloutRolledBack means the canaries failed and went back to the
+	// stable image, until the rollout image changes.
+	RolloutRolledBack RolloutPhase = "RolledBack"
+)
+
+// RolloutStatus tracks the image rollout of a site.
+type RolloutStatus struct {
+	// Image being, or last, rolled out.
+	Image string `json:"image"`
+
+	// StableImage is the image of the tmsources which are not canaries, the
+	// canaries go back to it on rollback.
+	StableImage string `json:"stableImage"`
+
+	// Phase of the rollout.
+	Phase RolloutPhase `json:"phase"`
+
+	// Canaries are the tmsources running Image during the Canary phase.
+	// +optional
+	Canaries []string `json:"canaries,omitempty"`
+
+	// StartTime is when the rollout started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// BakeStartTime is when all the canaries were first ready.
+	// +optional
+	BakeStartTime *metav1.Time `json:"bakeStartTime,omitempty"`
+
+	// Message explains the phase.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// MetricCatalog lists metric names inline and/or from a ConfigMap.
+type MetricCatalog struct {
+	// Metrics published by the site, one tmsource each.
+	// +optional
+	Metrics []string `json:"metrics,omitempty"`
+
+	// ConfigMapRef points to a ConfigMap of the site namespace holding more
+	// metric names, one per line.
+	// +optional
+	ConfigMapRef *CatalogConfigMapRef `json:"configMapRef,omitempty"`
+}
+
+// CatalogConfigMapRef selects a key of a ConfigMap.
+type CatalogConfigMapRef struct {
+	// Name of the ConfigMap.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Key holding the metric names. Defaults to metrics.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// SiteDrift lists where the cluster differs from the desired state of a
+// site. Every list is sorted and bounded to the first 20 names.
+type SiteDrift struct {
+	// SourcesWithoutPods are running tmsources of the site without any pod.
+	// +optional
+	SourcesWithoutPods []string `json:"sourcesWithoutPods,omitempty"`
+
+	// PodsWithoutSources are source pods labelled with the site whose
+	// tmsource does not exist.
+	// +optional
+	PodsWithoutSources []string `json:"podsWithoutSources,omitempty"`
+
+	// OutdatedPods are pods of the tmsources of the site built from another
+	// template than the current one.
+	// +optional
+	OutdatedPods []string `json:"outdatedPods,omitempty"`
+
+	// UnlinkedSources are tmsources of the namespace whose site does not
+	// exist, reported by every site of the namespace.
+	// +optional
+	UnlinkedSources []string `json:"unlinkedSources,omitempty"`
 }
 
 // SiteStatus defines the observed state of Site
@@ -37,9 +325,81 @@ type SiteStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	Completed        bool         `json:"completed,omitempty"`
 	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// Sources is the number of tmsources linked to the site.
+	// +optional
+	Sources int32 `json:"sources,omitempty"`
+
+	// Mode the site runs in.
+	// +optional
+	Mode SiteMode `json:"mode,omitempty"`
+
+	// Shed is the number of tmsources stopped by the Degraded mode.
+	// +optional
+	Shed int32 `json:"shed,omitempty"`
+
+	// Usage of the site against its limits.
+	// +optional
+	Usage *SiteUsage `json:"usage,omitempty"`
+
+	// Rollout is the state of the image rollout of the site.
+	// +optional
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+
+	// Drift of the tmsources and pods from the desired state of the site,
+	// empty when they match.
+	// +optional
+	Drift *SiteDrift `json:"drift,omitempty"`
+
+	// Members is the status of the site in the member clusters it is placed
+	// on, set in hub mode.
+	// +optional
+	Members []MemberSiteStatus `json:"members,omitempty"`
+
+	// History of the mode transitions of the site, oldest first, bounded to
+	// the last 10.
+	// +optional
+	History []SiteTransition `json:"history,omitempty"`
+
+	// Conditions of the site, e.g. Ready.
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// SiteTransition is a change of the mode of a site.
+type SiteTransition struct {
+	// Time the controller observed the change.
+	Time metav1.Time `json:"time"`
+
+	// From is the previous mode, empty for the first mode observed.
+	// +optional
+	From SiteMode `json:"from,omitempty"`
+
+	// To is the new mode.
+	To SiteMode `json:"to"`
+
+	// Reason is the tm.rocketlab.global/reason annotation of the site.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Manager is the field manager which last set spec.mode or spec.enabled.
+	// +optional
+	Manager string `json:"manager,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=site,categories=rocket
+// +kubebuilder:printcolumn:name="Mode",type=string,JSONPath=`.status.mode`
+// +kubebuilder:printcolumn:name="Sources",type=integer,JSONPath=`.status.sources`
+// +kubebuilder:printcolumn:name="Shed",type=integer,JSONPath=`.status.shed`,priority=1
+// +kubebuilder:printcolumn:name="Pending",type=integer,JSONPath=`.status.usage.pending`,priority=1
+// +kubebuilder:printcolumn:name="CPU",type=string,JSONPath=`.status.usage.cpu`,priority=1
+// +kubebuilder:printcolumn:name="Memory",type=string,JSONPath=`.status.usage.memory`,priority=1
+// +kubebuilder:printcolumn:name="Rollout",type=string,JSONPath=`.status.rollout.phase`,priority=1
+// +kubebuilder:printcolumn:name="InSync",type=string,JSONPath=`.status.conditions[?(@.type=="InSync")].status`,priority=1
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Site is the Schema for the sites API
 type Site struct {
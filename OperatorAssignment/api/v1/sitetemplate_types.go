@@ -0,0 +1,78 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SiteTemplateSpec holds the defaults of the sites referencing the template.
+// A field set by a site overrides the template field, field by field for
+// nats and catalog.
+type SiteTemplateSpec struct {
+	// Image is the rocket-source image of the tmsources of the sites.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Resources of the rocket-source container of the tmsources which set
+	// none.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// NATS is the server the source pods of the sites publish to.
+	// +optional
+	NATS *NatsEndpoint `json:"nats,omitempty"`
+
+	// Catalog of metrics generated for each site.
+	// +optional
+	Catalog *MetricCatalog `json:"catalog,omitempty"`
+}
+
+// SiteTemplateRef references a SiteTemplate of the namespace of the site.
+type SiteTemplateRef struct {
+	// Name of the SiteTemplate.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=sitetpl,categories=rocket
+// +kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.spec.image`
+// +kubebuilder:printcolumn:name="NATS",type=string,JSONPath=`.spec.nats.address`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// SiteTemplate is the Schema for the sitetemplates API
+type SiteTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SiteTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// SiteTemplateList contains a list of SiteTemplate
+type SiteTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SiteTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SiteTemplate{}, &SiteTemplateList{})
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -28,19 +29,179 @@ type TmSourceSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	Site       string `json:"site"`
+	// Site is the name of the site, in the same namespace, which controls the source.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=253
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	Site string `json:"site"`
+	// MetricName is the metric published by the source pod.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=128
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9_.-]+$`
 	MetricName string `json:"metricname"`
+	// TerminationGracePeriodSeconds given to the source pod to drain its
+	// telemetry before being killed. Defaults to 20 seconds.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+	// DrainCommand is run in the rocket-source container before it is sent
+	// SIGTERM, e.g. to flush its buffered telemetry, and must return within
+	// the grace period. It replaces the one of the site. Without any, the
+	// container only gets the grace period after SIGTERM.
+	// +optional
+	DrainCommand []string `json:"drainCommand,omitempty"`
+	// Resources of the rocket-source container. The cpu and memory requests
+	// default to 10m and 16Mi and count against the limits of the site.
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Priority of the source within its site. Higher priority sources start
+	// first and are shed last, their pods get a matching PriorityClass.
+	// Defaults to Normal.
+	// +optional
+	Priority TmSourcePriority `json:"priority,omitempty"`
+	// Remediation acts on a source pod which keeps restarting or never gets
+	// ready. Without it, the kubelet restarts the containers forever.
+	// +optional
+	Remediation *RemediationPolicy `json:"remediation,omitempty"`
+
+	// PodExtensions add sidecars, init containers and volumes to the source
+	// pod, on top of those of the site.
+	PodExtensions `json:",inline"`
+
+	// PodSecurity overrides the service account and security contexts of the
+	// source pod of the tmsource.
+	PodSecurity `json:",inline"`
 }
 
+// TmSourcePriority ranks the sources of a site.
+// +kubebuilder:validation:Enum=Critical;High;Normal;Low
+type TmSourcePriority string
+
+const (
+	TmSourcePriorityCritical TmSourcePriority = "Critical"
+	TmSourcePriorityHigh     TmSourcePriority = "High"
+	TmSourcePriorityNormal   TmSourcePriority = "Normal"
+	TmSourcePriorityLow      TmSourcePriority = "Low"
+)
+
+// RemediationAction is what is done to a source pod restarting too often.
+// +kubebuilder:validation:Enum=RecreatePod;BackOff;Fail
+type RemediationAction string
+
+const (
+	// RemediationRecreatePod deletes the pod, a new one is created at once.
+	RemediationRecreatePod RemediationAction = "RecreatePod"
+	// RemediationBackOff deletes the pod and waits before creating a new one.
+	RemediationBackOff RemediationAction = "BackOff"
+	// RemediationFail deletes the pod and marks the tmsource Failed until its
+	// spec changes.
+	RemediationFail RemediationAction = "Fail"
+)
+
+// RemediationPolicy of the source pod. Attempts back off exponentially, from
+// 10 seconds to 10 minutes, so a bad image does not recreate pods in a loop.
+type RemediationPolicy struct {
+	// MaxRestarts of the containers of the pod within Window before it is
+	// remediated. Defaults to 5.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxRestarts int32 `json:"maxRestarts,omitempty"`
+	// Window the restarts are counted over. Defaults to 10 minutes.
+	// +optional
+	Window *metav1.Duration `json:"window,omitempty"`
+	// StalledAfter remediates a pod which is not ready that long after its
+	// creation, e.g. pulling a missing image. Disabled when not set.
+	// +optional
+	StalledAfter *metav1.Duration `json:"stalledAfter,omitempty"`
+	// Action taken on the pod.
+	Action RemediationAction `json:"action"`
+}
+
+// TmSourcePhase is a simple summary of where the source pod is in its lifecycle.
+// +kubebuilder:validation:Enum=Pending;Running;Recreating;Stopped;Failed
+type TmSourcePhase string
+
+const (
+	// TmSourcePending means the pod is requested but not running yet.
+	TmSourcePending TmSourcePhase = "Pending"
+	// TmSourceRunning means the pod is running.
+	TmSourceRunning TmSourcePhase = "Running"
+	// TmSourceRecreating means the pod drifted and is being replaced.
+	TmSourceRecreating TmSourcePhase = "Recreating"
+	// TmSourceStopped means the site is disabled and no pod runs.
+	TmSourceStopped TmSourcePhase = "Stopped"
+	// TmSourceFailed means the source cannot be reconciled without a change.
+	TmSourceFailed TmSourcePhase = "Failed"
+)
+
 // TmSourceStatus defines the observed state of TmSource
 type TmSourceStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	Completed        bool         `json:"completed,omitempty"`
 	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// Phase of the source pod.
+	// +optional
+	Phase TmSourcePhase `json:"phase,omitempty"`
+	// Pod is the name of the pod publishing the metric, empty when stopped.
+	// +optional
+	Pod string `json:"pod,omitempty"`
+
+	// Conditions of the tmsource, e.g. Ready.
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+
+	// Remediation tracks the remediation policy of the tmsource.
+	// +optional
+	Remediation *RemediationStatus `json:"remediation,omitempty"`
+
+	// Members is the status of the tmsource in the member clusters its site
+	// is placed on, set in hub mode.
+	// +optional
+	Members []MemberSourceStatus `json:"members,omitempty"`
+}
+
+// RemediationStatus counts the remediations of the source pod since the spec
+// of the tmsource last changed.
+type RemediationStatus struct {
+	// ObservedGeneration of the tmsource the attempts are counted for.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Attempts is the number of remediations.
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+	// LastAttemptTime is when the pod was last remediated.
+	// +optional
+	LastAttemptTime *metav1.Time `json:"lastAttemptTime,omitempty"`
+	// RetryAfter ends the backoff of the last attempt. The pod is not
+	// remediated again, nor recreated when backing off, before.
+	// +optional
+	RetryAfter *metav1.Time `json:"retryAfter,omitempty"`
+	// Message explains the last attempt.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Suspended is true while the tmsource gets no pod, backing off or failed.
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
+	// WindowStart is when the restarts started to be counted.
+	// +optional
+	WindowStart *metav1.Time `json:"windowStart,omitempty"`
+	// WindowRestarts is the restart count of the pod at WindowStart.
+	// +optional
+	WindowRestarts int32 `json:"windowRestarts,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=tms,categories=rocket
+// +kubebuilder:printcolumn:name="Site",type=string,JSONPath=`.spec.site`
+// +kubebuilder:printcolumn:name="Metric",type=string,JSONPath=`.spec.metricname`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Pod",type=string,JSONPath=`.status.pod`
+// +kubebuilder:printcolumn:name="Priority",type=string,JSONPath=`.spec.priority`,priority=1
+// +kubebuilder:printcolumn:name="Remediations",type=integer,JSONPath=`.status.remediation.attempts`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // TmSource is the Schema for the tmsources API
 type TmSource struct {
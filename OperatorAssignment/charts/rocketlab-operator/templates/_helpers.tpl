@@ -0,0 +1,17 @@
+{{/*
+Expand the name of the chart.
+*/}}
+{{- define "rocketlab-operator.name" -}}
+{{- default .Chart.Name .Values.nameOverride | trunc 63 | trimSuffix "-" }}
+{{- end }}
+
+{{/*
+Fully qualified app name, used as prefix of every object of the release.
+*/}}
+{{- define "rocketlab-operator.fullname" -}}
+{{- if .Values.fullnameOverride }}
+{{- .Values.fullnameOverride | trunc 40 | trimSuffix "-" }}
+{{- else }}
+{{- printf "%s-%s" .Release.Name (include "rocketlab-operator.name" .) | trunc 40 | trimSuffix "-" }}
+{{- end }}
+{{- end }}
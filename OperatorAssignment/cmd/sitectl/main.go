@@ -0,0 +1,171 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command sitectl exports a site with its tmsources into a single bundle
+// file, and imports such a bundle into another namespace or cluster.
+//
+//	sitectl export -namespace default -site site-lc-1 -o site-lc-1.yaml
+//	sitectl import -f site-lc-1.yaml -namespace staging -rename site-lc-1=site-lc-9 -dry-run
+//
+// The cluster is the one of KUBECONFIG, or ~/.kube/config.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/topology"
+)
+
+const usage = `usage:
+  sitectl export -site NAME [-namespace NS] [-format yaml|json] [-o FILE]
+  sitectl import -f FILE [-namespace NS] [-rename OLD=NEW,...] [-dry-run]`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(os.Args[2:])
+	case "import":
+		err = importBundle(os.Args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sitectl "+os.Args[1]+":", err)
+		os.Exit(1)
+	}
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	namespace := fs.String("namespace", "default", "Namespace of the site.")
+	site := fs.String("site", "", "Name of the site to export.")
+	format := fs.String("format", "yaml", "Format of the bundle, yaml or json.")
+	out := fs.String("o", "", "File to write the bundle to, standard output when empty.")
+	_ = fs.Parse(args)
+	if *site == "" {
+		return fmt.Errorf("-site is required")
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	b, err := topology.Export(context.Background(), c, *namespace, *site)
+	if err != nil {
+		return err
+	}
+	data, err := topology.Marshal(b, *format)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*out, data, 0644)
+}
+
+func importBundle(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	file := fs.String("f", "", "Bundle file to import, - for standard input.")
+	namespace := fs.String("namespace", "", "Namespace to import into, the exported one when empty.")
+	rename := fs.String("rename", "", "Comma separated OLD=NEW names of the site, tmsources, SiteTemplates and ConfigMaps to rename.")
+	dryRun := fs.Bool("dry-run", false, "Print the changes the import would make without making them.")
+	_ = fs.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("-f is required")
+	}
+
+	names, err := parseRenames(*rename)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if *file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	b, err := topology.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	b = b.Remap(*namespace, names)
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	var changes []topology.Change
+	if *dryRun {
+		changes, err = topology.Plan(context.Background(), c, b)
+	} else {
+		changes, err = topology.Apply(context.Background(), c, b)
+	}
+	for _, change := range changes {
+		fmt.Print(change)
+	}
+	return err
+}
+
+// parseRenames reads OLD=NEW pairs separated by commas.
+func parseRenames(s string) (map[string]string, error) {
+	names := map[string]string{}
+	if s == "" {
+		return names, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid rename %q, expected OLD=NEW", pair)
+		}
+		names[parts[0]] = parts[1]
+	}
+	return names, nil
+}
+
+func newClient() (client.Client, error) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = tmv1.AddToScheme(scheme)
+
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	return client.New(cfg, client.Options{Scheme: scheme})
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// backoff computes per object exponential delays for transient failures.
+// The delay doubles on each consecutive failure up to max and is reset
+// once the object reconciles successfully.
+type backoff struct {
+	mu       sync.Mutex
+	base     time.Duration
+	max      time.Duration
+	failures map[types.NamespacedName]int
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{
+		base:     base,
+		max:      max,
+		failures: map[types.NamespacedName]int{},
+	}
+}
+
+// next records a failure for key and returns how long to wait before retrying.
+func (b *backoff) next(key types.NamespacedName) time.Duration {
+	if b == nil {
+		return transientBackoffBase
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delay := b.base
+	for i := 0; i < b.failures[key] && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.failures[key]++
+
+	return delay
+}
+
+// reset forgets the failures recorded for key.
+func (b *backoff) reset(key types.NamespacedName) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.failures, key)
+}
@@ -1,18 +1,24 @@
 package controllers
 
-const (
-	podTerminationWaitTimeSec = 20
-	tmSourceFinalizerName     = "tmsource.finalizers.rocket.global"
-	siteFinalizerName         = "site.finalizers.rocket.global"
+import (
+	"time"
+
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+)
 
-	tmLabelSiteKey  = "site"
-	tmLabelAppKey   = "app"
-	tmLabelAppValue = "rocket-source-pod"
-	tmNamePrefix    = "rocket-source-pod-"
+const (
+	defaultRequeueDelay   = 5 * time.Second
+	transientBackoffBase  = 1 * time.Second
+	transientBackoffMax   = 5 * time.Minute
+	tmSourceFinalizerName = "tmsource.finalizers.rocket.global"
+	siteFinalizerName     = "site.finalizers.rocket.global"
+	// federationFinalizerName withdraws a hub site from its members first
+	federationFinalizerName = "federation.finalizers.rocket.global"
 
-	tmContainerName         = "rocket-source"
-	tmContainerPath         = "maxthom/rocket-source:latest"
-	tmContainerEnvMetricKey = "METRIC_NAME"
-	tmContainerEnvNatKey    = "NATS_SERVICE_PORT"
-	tmContainerEnvNatValue  = "nats-server-service.default.svc.cluster.local:4222"
+	// Pod naming and labels are owned by the desired package
+	tmLabelAppKey           = desired.LabelAppKey
+	tmLabelAppValue         = desired.LabelAppValue
+	tmLabelSourceKey        = desired.LabelSourceKey
+	tmLabelSiteKey          = desired.LabelSiteKey
+	tmContainerEnvMetricKey = desired.ContainerEnvMetricKey
 )
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// RequeueError asks for the request to be processed again after a delay.
+// It is not a failure: the reconciler is waiting on something to settle.
+type RequeueError struct {
+	After time.Duration
+}
+
+func (e *RequeueError) Error() string {
+	return fmt.Sprintf("requeue after %s", e.After)
+}
+
+// TransientError wraps a failure which is expected to go away on retry.
+// Transient errors are retried with an exponential backoff.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return "transient: " + e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// TerminalError wraps a failure that retrying will not fix, such as an
+// invalid pod spec. Terminal errors are surfaced as a condition on the object
+// and the request is not retried until the object changes.
+type TerminalError struct {
+	Reason string
+	Err    error
+}
+
+func (e *TerminalError) Error() string {
+	return "terminal (" + e.Reason + "): " + e.Err.Error()
+}
+
+func (e *TerminalError) Unwrap() error {
+	return e.Err
+}
+
+func requeueAfter(after time.Duration) error {
+	return &RequeueError{After: after}
+}
+
+func transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TransientError{Err: err}
+}
+
+func terminal(reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TerminalError{Reason: reason, Err: err}
+}
+
+// classifyAPIError maps an error returned by the api server to our taxonomy.
+// Errors already classified are returned as is.
+func classifyAPIError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var requeue *RequeueError
+	var trans *TransientError
+	var term *TerminalError
+	if errors.As(err, &requeue) || errors.As(err, &trans) || errors.As(err, &term) {
+		return err
+	}
+
+	switch {
+	case apierrors.IsInvalid(err):
+		return terminal("Invalid", err)
+	case apierrors.IsForbidden(err):
+		return terminal("Forbidden", err)
+	case apierrors.IsBadRequest(err):
+		return terminal("BadRequest", err)
+	case apierrors.IsAlreadyExists(err), apierrors.IsConflict(err):
+		return requeueAfter(defaultRequeueDelay)
+	default:
+		return transient(err)
+	}
+}
+
+// reconcileResult converts the outcome of a reconcile pass into a ctrl.Result.
+// Transient failures are requeued with an exponential backoff instead of being
+// returned, terminal ones are handed back so the caller can surface them.
+func reconcileResult(log logr.Logger, b *backoff, key types.NamespacedName, err error) (ctrl.Result, *TerminalError) {
+	err = classifyAPIError(err)
+	if err == nil {
+		b.reset(key)
+		return ctrl.Result{}, nil
+	}
+
+	var requeue *RequeueError
+	if errors.As(err, &requeue) {
+		log.Info("Requeuing " + key.Name + " in " + requeue.After.String() + ".")
+		return ctrl.Result{RequeueAfter: requeue.After}, nil
+	}
+
+	var term *TerminalError
+	if errors.As(err, &term) {
+		b.reset(key)
+		log.Error(err, "Terminal failure on "+key.Name+", not retrying.")
+		return ctrl.Result{}, term
+	}
+
+	delay := b.next(key)
+	log.Error(err, "Transient failure on "+key.Name+", retrying in "+delay.String()+".")
+	return ctrl.Result{RequeueAfter: delay}, nil
+}
+
+// requeueSooner requeues result after the given duration unless it already
+// comes back earlier. A zero duration leaves result unchanged.
+func requeueSooner(result ctrl.Result, after time.Duration) ctrl.Result {
+	if after <= 0 || result.Requeue && result.RequeueAfter == 0 {
+		return result
+	}
+	if result.RequeueAfter == 0 || after < result.RequeueAfter {
+		result.RequeueAfter = after
+	}
+	return result
+}
@@ -0,0 +1,366 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/federation"
+)
+
+// FederationReconciler propagates the sites of a hub cluster and their
+// tmsources to the member clusters of their placement, and aggregates the
+// member status back into the hub objects. It replaces the site and tmsource
+// reconcilers in hub mode, the hub runs no source pod.
+type FederationReconciler struct {
+	client.Client
+	Log     logr.Logger
+	Scheme  *runtime.Scheme
+	Members *federation.Members
+	// SyncInterval between two reads of the member status.
+	SyncInterval time.Duration
+
+	backoff *backoff
+}
+
+func (r *FederationReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	r.Log.Info("Event " + req.Name + " on " + req.Namespace)
+
+	var site tmv1.Site
+	if err := r.Get(ctx, req.NamespacedName, &site); err != nil {
+		return ResolveIfNotFound(err)
+	}
+
+	if !site.DeletionTimestamp.IsZero() {
+		if !containsString(site.Finalizers, federationFinalizerName) {
+			return ctrl.Result{}, nil
+		}
+		// Withdraw the site from its members, then delete its tmsources
+		if err := r.withdrawSite(ctx, &site); err != nil {
+			result, _ := reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+			return result, nil
+		}
+		controllerutil.RemoveFinalizer(&site, federationFinalizerName)
+		if err := r.Update(ctx, &site); err != nil {
+			result, _ := reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+			return result, nil
+		}
+		r.backoff.reset(req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+
+	if !containsString(site.Finalizers, federationFinalizerName) {
+		controllerutil.AddFinalizer(&site, federationFinalizerName)
+		if err := r.Update(ctx, &site); err != nil {
+			result, _ := reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+			return result, nil
+		}
+	}
+	status := site.Status.DeepCopy()
+	spec := site.Spec.DeepCopy()
+
+	err := r.propagateSite(ctx, &site)
+	result, term := reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+	if term != nil {
+		tmv1.SetCondition(&site.Status.Conditions, tmv1.Condition{
+			Type:    tmv1.ConditionReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  term.Reason,
+			Message: term.Err.Error(),
+		})
+	}
+	// The spec merged with the template is never written back
+	site.Spec = *spec
+	// Only push the status when something changed during this pass
+	if !equality.Semantic.DeepEqual(status, &site.Status) {
+		if err := r.Status().Update(ctx, &site); err != nil {
+			result, _ = reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+		}
+	}
+	// The members are not watched, their status is read again periodically
+	return requeueSooner(result, r.SyncInterval), nil
+}
+
+func (r *FederationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.backoff = newBackoff(transientBackoffBase, transientBackoffMax)
+	// The member Secrets are watched in their namespace only
+	secrets, err := r.Members.Secrets.GetInformer(&v1.Secret{})
+	if err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("federation").
+		For(&tmv1.Site{}).
+		Watches(&source.Kind{Type: &tmv1.TmSource{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(tmSourceToHubSite),
+		}).
+		Watches(&source.Informer{Informer: secrets}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.secretToSites),
+		}).
+		Watches(&source.Kind{Type: &tmv1.SiteTemplate{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.templateToSites),
+		}).
+		Complete(r)
+}
+
+// tmSourceToHubSite maps tmsource events to their site, which propagates them.
+func tmSourceToHubSite(obj handler.MapObject) []reconcile.Request {
+	tm, ok := obj.Object.(*tmv1.TmSource)
+	if !ok || tm.Spec.Site == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: tm.Spec.Site, Namespace: tm.Namespace}}}
+}
+
+// secretToSites maps events of a member Secret to the sites placed on its
+// cluster.
+func (r *FederationReconciler) secretToSites(obj handler.MapObject) []reconcile.Request {
+	if obj.Meta.GetNamespace() != r.Members.Namespace {
+		return nil
+	}
+	var sites tmv1.SiteList
+	if err := r.List(context.Background(), &sites); err != nil {
+		r.Log.Error(err, "unable to list sites for member secret "+obj.Meta.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range sites.Items {
+		if containsString(federation.Clusters(&sites.Items[i]), obj.Meta.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: sites.Items[i].Name, Namespace: sites.Items[i].Namespace}})
+		}
+	}
+	return requests
+}
+
+// templateToSites maps SiteTemplate events to the sites referencing it, whose
+// members get the new defaults.
+func (r *FederationReconciler) templateToSites(obj handler.MapObject) []reconcile.Request {
+	requests, err := templateSiteRequests(context.Background(), r.Client, obj.Meta.GetNamespace(), obj.Meta.GetName())
+	if err != nil {
+		r.Log.Error(err, "unable to list sites for sitetemplate "+obj.Meta.GetName())
+	}
+	return requests
+}
+
+// propagateSite writes a site and its tmsources to the members of its
+// placement, withdraws it from the members it left and sets the member
+// status of the site and its tmsources. An unreachable member does not fail
+// the pass, it is reported in the status.
+func (r *FederationReconciler) propagateSite(ctx context.Context, site *tmv1.Site) error {
+	// Members get the spec merged with the template of the hub
+	if err := resolveSiteTemplate(ctx, r.Client, site); err != nil {
+		return err
+	}
+	hubSources, err := listSiteSources(ctx, r.Client, site.Namespace, site.Name)
+	if err != nil {
+		return err
+	}
+	sources := federation.Sources(site, hubSources)
+	now := metav1.Now()
+
+	placed := map[string]bool{}
+	var members []tmv1.MemberSiteStatus
+	sourceMembers := map[string][]tmv1.MemberSourceStatus{}
+	var failed []string
+	for _, cluster := range federation.Clusters(site) {
+		placed[cluster] = true
+		status, sourceStatus, err := r.syncMember(ctx, cluster, site, sources, now)
+		if err != nil {
+			r.Log.Error(err, "unable to propagate site "+site.Name+" to cluster "+cluster)
+			members = append(members, federation.Unreachable(cluster, err))
+			failed = append(failed, cluster)
+			continue
+		}
+		members = append(members, status)
+		for name, s := range sourceStatus {
+			sourceMembers[name] = append(sourceMembers[name], s)
+		}
+	}
+
+	// Members which left the placement lose the site, it is kept in the
+	// status until the withdrawal succeeds
+	for _, m := range site.Status.Members {
+		if placed[m.Cluster] {
+			continue
+		}
+		if err := r.withdrawMember(ctx, m.Cluster, site); err != nil {
+			r.Log.Error(err, "unable to withdraw site "+site.Name+" from cluster "+m.Cluster)
+			members = append(members, federation.Unreachable(m.Cluster, err))
+			failed = append(failed, m.Cluster)
+			continue
+		}
+		r.Log.Info("Withdrew site " + site.Name + " from cluster " + m.Cluster + ".")
+	}
+	site.Status.Members = members
+
+	var firstErr error
+	for i := range sources {
+		tm := &sources[i]
+		if equality.Semantic.DeepEqual(tm.Status.Members, sourceMembers[tm.Name]) {
+			continue
+		}
+		tm.Status.Members = sourceMembers[tm.Name]
+		if err := r.Status().Update(ctx, tm); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	conditions := &site.Status.Conditions
+	switch {
+	case len(placed) == 0:
+		r.setCondition(conditions, tmv1.ConditionPropagated, metav1.ConditionFalse, "NoPlacement", "Site is not placed on any member cluster.")
+	case len(failed) > 0:
+		r.setCondition(conditions, tmv1.ConditionPropagated, metav1.ConditionFalse, "MemberUnreachable", "Could not sync clusters "+strings.Join(failed, ", ")+".")
+	default:
+		r.setCondition(conditions, tmv1.ConditionPropagated, metav1.ConditionTrue, "Propagated", fmt.Sprintf("Site and %d tmsources propagated to %d member clusters.", len(sources), len(placed)))
+	}
+	status, reason, message := federation.Ready(members)
+	r.setCondition(conditions, tmv1.ConditionReady, status, reason, message)
+
+	return firstErr
+}
+
+// syncMember writes a site and its tmsources to a member, prunes the
+// tmsources the hub no longer has and returns their member status.
+func (r *FederationReconciler) syncMember(ctx context.Context, cluster string, site *tmv1.Site, sources []tmv1.TmSource, now metav1.Time) (tmv1.MemberSiteStatus, map[string]tmv1.MemberSourceStatus, error) {
+	c, err := r.Members.Client(ctx, cluster)
+	if err != nil {
+		return tmv1.MemberSiteStatus{}, nil, err
+	}
+
+	// A new member may not have the namespace yet
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: site.Namespace}}
+	if err := c.Create(ctx, ns); err != nil && !errors.IsAlreadyExists(err) {
+		return tmv1.MemberSiteStatus{}, nil, err
+	}
+
+	member := &tmv1.Site{ObjectMeta: metav1.ObjectMeta{Name: site.Name, Namespace: site.Namespace}}
+	if _, err := controllerutil.CreateOrUpdate(ctx, c, member, func() error {
+		federation.SetSite(member, site)
+		return nil
+	}); err != nil {
+		return tmv1.MemberSiteStatus{}, nil, err
+	}
+
+	keep := map[string]bool{}
+	statuses := map[string]tmv1.MemberSourceStatus{}
+	for i := range sources {
+		hub := &sources[i]
+		keep[hub.Name] = true
+		tm := &tmv1.TmSource{ObjectMeta: metav1.ObjectMeta{Name: hub.Name, Namespace: hub.Namespace}}
+		if _, err := controllerutil.CreateOrUpdate(ctx, c, tm, func() error {
+			federation.SetSource(tm, hub)
+			return nil
+		}); err != nil {
+			return tmv1.MemberSiteStatus{}, nil, err
+		}
+		statuses[hub.Name] = federation.SourceStatus(cluster, tm)
+	}
+
+	var propagated tmv1.TmSourceList
+	if err := c.List(ctx, &propagated, client.InNamespace(site.Namespace), client.MatchingLabels{federation.LabelHubKey: federation.LabelHubValue}); err != nil {
+		return tmv1.MemberSiteStatus{}, nil, err
+	}
+	for i := range propagated.Items {
+		tm := &propagated.Items[i]
+		if tm.Spec.Site != site.Name || keep[tm.Name] {
+			continue
+		}
+		r.Log.Info("Pruning TmSource " + tm.Name + " from cluster " + cluster)
+		if err := c.Delete(ctx, tm); err != nil && !errors.IsNotFound(err) {
+			return tmv1.MemberSiteStatus{}, nil, err
+		}
+	}
+
+	return federation.SiteStatus(cluster, member, now), statuses, nil
+}
+
+// withdrawMember deletes a site from a member, whose operator deletes its
+// tmsources. A member without Secret is considered gone.
+func (r *FederationReconciler) withdrawMember(ctx context.Context, cluster string, site *tmv1.Site) error {
+	c, err := r.Members.Client(ctx, cluster)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	member := &tmv1.Site{ObjectMeta: metav1.ObjectMeta{Name: site.Name, Namespace: site.Namespace}}
+	if err := c.Delete(ctx, member); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// withdrawSite withdraws a deleted site from all its members, then deletes its
+// tmsources on the hub.
+func (r *FederationReconciler) withdrawSite(ctx context.Context, site *tmv1.Site) error {
+	clusters := federation.Clusters(site)
+	for _, m := range site.Status.Members {
+		if !containsString(clusters, m.Cluster) {
+			clusters = append(clusters, m.Cluster)
+		}
+	}
+	for _, cluster := range clusters {
+		r.Log.Info("Withdrawing site " + site.Name + " from cluster " + cluster + "...")
+		if err := r.withdrawMember(ctx, cluster, site); err != nil {
+			return err
+		}
+	}
+
+	sources, err := listSiteSources(ctx, r.Client, site.Namespace, site.Name)
+	if err != nil {
+		return err
+	}
+	for i := range sources {
+		r.Log.Info("Deleting TmSource " + sources[i].Name)
+		if err := r.Delete(ctx, &sources[i]); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *FederationReconciler) setCondition(conditions *[]tmv1.Condition, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	tmv1.SetCondition(conditions, tmv1.Condition{
+		Type:    conditionType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
@@ -0,0 +1,165 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/federation"
+)
+
+// kubeconfig points to the envtest api server of cfg, which serves plain http.
+func kubeconfig(cfg *rest.Config) []byte {
+	return []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: member
+  cluster:
+    server: http://` + cfg.Host + `
+contexts:
+- name: member
+  context:
+    cluster: member
+current-context: member
+`)
+}
+
+// The control plane of the suite, running the site and tmsource reconcilers,
+// is the member of a second control plane running in hub mode.
+var _ = Describe("Federation controller", func() {
+	var (
+		ctx       context.Context
+		hubEnv    *envtest.Environment
+		hubClient client.Client
+		stopHub   chan struct{}
+		namespace string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		By("starting the hub control plane")
+		hubEnv = &envtest.Environment{
+			CRDDirectoryPaths: []string{crdDirectory},
+		}
+		hubCfg, err := hubEnv.Start()
+		Expect(err).ToNot(HaveOccurred())
+		hubClient, err = client.New(hubCfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(hubClient.Create(ctx, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "members"}})).To(Succeed())
+		Expect(hubClient.Create(ctx, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "edge-1", Namespace: "members"},
+			Data:       map[string][]byte{federation.SecretKey: kubeconfig(cfg)},
+		})).To(Succeed())
+
+		mgr, err := ctrl.NewManager(hubCfg, ctrl.Options{Scheme: scheme.Scheme, MetricsBindAddress: "0"})
+		Expect(err).ToNot(HaveOccurred())
+		members, err := federation.NewMembers(mgr, "members")
+		Expect(err).ToNot(HaveOccurred())
+		err = (&FederationReconciler{
+			Client:       mgr.GetClient(),
+			Log:          ctrl.Log.WithName("controllers").WithName("Federation"),
+			Scheme:       mgr.GetScheme(),
+			Members:      members,
+			SyncInterval: time.Second,
+		}).SetupWithManager(mgr)
+		Expect(err).ToNot(HaveOccurred())
+
+		stopHub = make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(stopHub)).To(Succeed())
+		}()
+
+		// The namespace is only created on the hub, the member gets it from
+		// the federation
+		namespaceCount++
+		namespace = fmt.Sprintf("hub-%d-%d", time.Now().Unix(), namespaceCount)
+		Expect(hubClient.Create(ctx, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})).To(Succeed())
+	}, 60)
+
+	AfterEach(func() {
+		close(stopHub)
+		Expect(hubEnv.Stop()).To(Succeed())
+	})
+
+	It("propagates placed sites and tmsources and aggregates their member status", func() {
+		site := newSite(namespace, "site-edge", true)
+		site.Spec.Placement = &tmv1.Placement{Clusters: []string{"edge-1"}}
+		Expect(hubClient.Create(ctx, site)).To(Succeed())
+		rock := newTmSource(namespace, "edge-rock", site.Name, "rock")
+		paper := newTmSource(namespace, "edge-paper", site.Name, "paper")
+		Expect(hubClient.Create(ctx, rock)).To(Succeed())
+		Expect(hubClient.Create(ctx, paper)).To(Succeed())
+
+		By("creating the site and its tmsources on the member, which runs their pods")
+		siteKey := types.NamespacedName{Name: site.Name, Namespace: namespace}
+		var member tmv1.Site
+		Eventually(objectExists(siteKey, &member), timeout, interval).Should(BeTrue())
+		Expect(member.Labels).To(HaveKeyWithValue(federation.LabelHubKey, federation.LabelHubValue))
+		Expect(member.Spec.Placement).To(BeNil())
+		Eventually(podExists(rock), timeout, interval).Should(BeTrue())
+		Eventually(podExists(paper), timeout, interval).Should(BeTrue())
+
+		By("reading the member status back into the hub objects")
+		Eventually(func() []string {
+			var hub tmv1.Site
+			_ = hubClient.Get(ctx, siteKey, &hub)
+			var members []string
+			for _, m := range hub.Status.Members {
+				members = append(members, fmt.Sprintf("%s %s %d", m.Cluster, m.Ready, m.Sources))
+			}
+			return members
+		}, timeout, interval).Should(Equal([]string{"edge-1 True 2"}))
+		Eventually(func() []string {
+			var hub tmv1.TmSource
+			_ = hubClient.Get(ctx, types.NamespacedName{Name: rock.Name, Namespace: namespace}, &hub)
+			var members []string
+			for _, m := range hub.Status.Members {
+				members = append(members, m.Cluster)
+			}
+			return members
+		}, timeout, interval).Should(Equal([]string{"edge-1"}))
+
+		By("pruning a tmsource deleted from the hub")
+		Expect(hubClient.Delete(ctx, paper)).To(Succeed())
+		Eventually(objectExists(types.NamespacedName{Name: paper.Name, Namespace: namespace}, &tmv1.TmSource{}), timeout, interval).Should(BeFalse())
+
+		By("withdrawing the site from a member leaving its placement")
+		var hub tmv1.Site
+		Expect(hubClient.Get(ctx, siteKey, &hub)).To(Succeed())
+		hub.Spec.Placement = nil
+		Expect(hubClient.Update(ctx, &hub)).To(Succeed())
+		Eventually(objectExists(siteKey, &tmv1.Site{}), timeout, interval).Should(BeFalse())
+		Eventually(podExists(rock), timeout, interval).Should(BeFalse())
+	})
+})
@@ -0,0 +1,103 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+)
+
+// PodGarbageCollector periodically deletes the source pods left behind by
+// the reconcilers, e.g. when a tmsource finalizer was removed by hand. It only
+// runs on the leader.
+type PodGarbageCollector struct {
+	client.Client
+	Log logr.Logger
+
+	// Interval between two sweeps.
+	Interval time.Duration
+	// MinAge protects pods created since, their tmsource may not be cached yet.
+	MinAge time.Duration
+	// DryRun reports the orphans without deleting them.
+	DryRun bool
+	// MissingSite is the policy of the tmsources whose site does not exist,
+	// their pods are orphans unless it is Run.
+	MissingSite desired.MissingSitePolicy
+}
+
+func (gc *PodGarbageCollector) SetupWithManager(mgr ctrl.Manager) error {
+	return mgr.Add(gc)
+}
+
+// Start sweeps every Interval until stop is closed.
+func (gc *PodGarbageCollector) Start(stop <-chan struct{}) error {
+	gc.Log.Info("Sweeping orphan pods every " + gc.Interval.String() + ".")
+	wait.Until(func() {
+		if _, err := gc.Sweep(context.Background()); err != nil {
+			gc.Log.Error(err, "unable to sweep orphan pods")
+		}
+	}, gc.Interval, stop)
+	return nil
+}
+
+// Sweep deletes the orphan source pods, or only reports them in dry-run, and
+// returns them.
+func (gc *PodGarbageCollector) Sweep(ctx context.Context) ([]desired.Orphan, error) {
+	var pods v1.PodList
+	if err := gc.List(ctx, &pods, client.MatchingLabels{tmLabelAppKey: tmLabelAppValue}); err != nil {
+		return nil, err
+	}
+	var sources tmv1.TmSourceList
+	if err := gc.List(ctx, &sources); err != nil {
+		return nil, err
+	}
+	var sites tmv1.SiteList
+	if err := gc.List(ctx, &sites); err != nil {
+		return nil, err
+	}
+
+	orphans := desired.Orphans(sites.Items, sources.Items, pods.Items, gc.MissingSite, time.Now().Add(-gc.MinAge))
+	var firstErr error
+	for _, o := range orphans {
+		name := o.Pod.Namespace + "/" + o.Pod.Name
+		if gc.DryRun {
+			gc.Log.Info("Would delete orphan pod " + name + " (" + o.Reason + ").")
+			continue
+		}
+
+		gc.Log.Info("Deleting orphan pod " + name + " (" + o.Reason + ")...")
+		// The UID guards against a pod recreated under the same name meanwhile
+		uid := o.Pod.UID
+		if err := gc.Delete(ctx, o.Pod, client.Preconditions{UID: &uid}); client.IgnoreNotFound(err) != nil {
+			gc.Log.Info("Could not delete orphan pod " + name + ".")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return orphans, firstErr
+}
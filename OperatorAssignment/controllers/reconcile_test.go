@@ -0,0 +1,1327 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+	"github.com/maxthom/rocketlab-controller/pkg/flow"
+)
+
+// These tests drive the reconcilers against controller-runtime's fake client,
+// they run without a control plane.
+
+// faultyClient lets a test inject api errors in front of the fake client.
+type faultyClient struct {
+	client.Client
+	createErr       func(obj runtime.Object) error
+	deleteErr       func(obj runtime.Object) error
+	statusUpdateErr func(obj runtime.Object) error
+}
+
+// faultyStatusWriter injects the status update errors of a faultyClient.
+type faultyStatusWriter struct {
+	client.StatusWriter
+	c *faultyClient
+}
+
+func (c *faultyClient) Status() client.StatusWriter {
+	return &faultyStatusWriter{StatusWriter: c.Client.Status(), c: c}
+}
+
+func (w *faultyStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if w.c.statusUpdateErr != nil {
+		if err := w.c.statusUpdateErr(obj); err != nil {
+			return err
+		}
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func (c *faultyClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	if c.createErr != nil {
+		if err := c.createErr(obj); err != nil {
+			return err
+		}
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *faultyClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	if c.deleteErr != nil {
+		if err := c.deleteErr(obj); err != nil {
+			return err
+		}
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+var podResource = schema.GroupResource{Resource: "pods"}
+
+// newFakeClient returns a fake client holding the given objects and the service
+// accounts the site reconciler creates for the given sites.
+func newFakeClient(objs ...runtime.Object) *faultyClient {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+	_ = tmv1.AddToScheme(s)
+	given := map[string]bool{}
+	for _, obj := range objs {
+		if account, ok := obj.(*v1.ServiceAccount); ok {
+			given[account.Name] = true
+		}
+	}
+	for _, obj := range objs {
+		if site, ok := obj.(*tmv1.Site); ok {
+			if account := desired.ServiceAccount(site); account != nil && !given[account.Name] {
+				objs = append(objs, account)
+			}
+		}
+	}
+	return &faultyClient{Client: fake.NewFakeClientWithScheme(s, objs...)}
+}
+
+func fakeSite(name string, enabled bool) *tmv1.Site {
+	return &tmv1.Site{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       tmv1.SiteSpec{Enabled: enabled},
+	}
+}
+
+func fakeTmSource(name, site, metric string) *tmv1.TmSource {
+	return &tmv1.TmSource{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       tmv1.TmSourceSpec{Site: site, MetricName: metric},
+	}
+}
+
+func newFakeTmSourceReconciler(c client.Client) *TmSourceReconciler {
+	return &TmSourceReconciler{
+		Client:  c,
+		Log:     ctrl.Log.WithName("test").WithName("TmSource"),
+		backoff: newBackoff(transientBackoffBase, transientBackoffMax),
+	}
+}
+
+func newFakeSiteReconciler(c client.Client) *SiteReconciler {
+	return &SiteReconciler{
+		Client:  c,
+		Log:     ctrl.Log.WithName("test").WithName("Site"),
+		backoff: newBackoff(transientBackoffBase, transientBackoffMax),
+	}
+}
+
+// sitePodObject returns the pod generated for a tmsource of a site without
+// extensions or security overrides.
+func sitePodObject(tm tmv1.TmSource) *v1.Pod {
+	return desired.SitePod(fakeSite(tm.Spec.Site, true), tm)
+}
+
+// podKeyFor returns the key of the pod generated for a tmsource.
+func podKeyFor(name, site, metric string) types.NamespacedName {
+	pod := sitePodObject(*fakeTmSource(name, site, metric))
+	return types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}
+}
+
+func requestFor(name string) ctrl.Request {
+	return ctrl.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: "default"}}
+}
+
+func readyCondition(g *WithT, c client.Client, obj runtime.Object, name string) *tmv1.Condition {
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "default"}, obj)).To(Succeed())
+	switch o := obj.(type) {
+	case *tmv1.TmSource:
+		return tmv1.FindCondition(o.Status.Conditions, tmv1.ConditionReady)
+	case *tmv1.Site:
+		return tmv1.FindCondition(o.Status.Conditions, tmv1.ConditionReady)
+	}
+	return nil
+}
+
+func TestTmSourceReconcileCreatesPod(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(fakeSite("site-lc-1", true), fakeTmSource("tm-1", "site-lc-1", "rock"))
+	r := newFakeTmSourceReconciler(c)
+
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result).To(Equal(ctrl.Result{}))
+
+	var pod v1.Pod
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &pod)).To(Succeed())
+	g.Expect(pod.Spec.Containers[0].Env).To(ContainElement(v1.EnvVar{Name: tmContainerEnvMetricKey, Value: "rock"}))
+
+	var tm tmv1.TmSource
+	cond := readyCondition(g, c, &tm, "tm-1")
+	g.Expect(tm.Finalizers).To(ContainElement(tmSourceFinalizerName))
+	g.Expect(cond).ToNot(BeNil())
+	g.Expect(cond.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(tm.Status.Phase).To(Equal(tmv1.TmSourcePending))
+	g.Expect(tm.Status.Pod).To(Equal(podKeyFor("tm-1", "site-lc-1", "rock").Name))
+}
+
+func TestTmSourceReconcileWaitsForServiceAccountOfSite(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"))
+	account := desired.ServiceAccount(site)
+	g.Expect(c.Delete(context.Background(), account)).To(Succeed())
+	r := newFakeTmSourceReconciler(c)
+
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(defaultRequeueDelay))
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{}))).To(BeTrue())
+	var tm tmv1.TmSource
+	cond := readyCondition(g, c, &tm, "tm-1")
+	g.Expect(cond.Reason).To(Equal("ServiceAccountPending"))
+	g.Expect(tm.Status.Phase).To(Equal(tmv1.TmSourcePending))
+
+	// The site reconciler creates it
+	_, err = newFakeSiteReconciler(c).Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{})).To(Succeed())
+	g.Expect(readyCondition(g, c, &tm, "tm-1").Status).To(Equal(metav1.ConditionTrue))
+}
+
+func TestTmSourceReconcileReplacesDriftedPodOnceReady(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(
+		fakeSite("site-lc-1", true),
+		fakeTmSource("tm-1", "site-lc-1", "paper"),
+		sitePodObject(*fakeTmSource("tm-1", "site-lc-1", "rock")),
+	)
+	r := newFakeTmSourceReconciler(c)
+	oldKey := podKeyFor("tm-1", "site-lc-1", "rock")
+	newKey := podKeyFor("tm-1", "site-lc-1", "paper")
+
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result).To(Equal(ctrl.Result{}))
+
+	// The new pod runs next to the old one
+	var pod v1.Pod
+	g.Expect(c.Get(context.Background(), newKey, &pod)).To(Succeed())
+	g.Expect(pod.Spec.Containers[0].Env).To(ContainElement(v1.EnvVar{Name: tmContainerEnvMetricKey, Value: "paper"}))
+	g.Expect(c.Get(context.Background(), oldKey, &v1.Pod{})).To(Succeed())
+
+	var tm tmv1.TmSource
+	cond := readyCondition(g, c, &tm, "tm-1")
+	g.Expect(cond.Reason).To(Equal("PodRecreating"))
+	g.Expect(tm.Status.Phase).To(Equal(tmv1.TmSourceRecreating))
+
+	// Not ready yet, nothing changes
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Get(context.Background(), oldKey, &v1.Pod{})).To(Succeed())
+
+	// Once ready the old pod goes away
+	pod.Status.Phase = v1.PodRunning
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	g.Expect(c.Status().Update(context.Background(), &pod)).To(Succeed())
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), oldKey, &v1.Pod{}))).To(BeTrue())
+	g.Expect(c.Get(context.Background(), newKey, &v1.Pod{})).To(Succeed())
+
+	// And the next pass reports the source running
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	cond = readyCondition(g, c, &tm, "tm-1")
+	g.Expect(cond.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(tm.Status.Phase).To(Equal(tmv1.TmSourceRunning))
+}
+
+func TestTmSourceReconcileDisabledSiteDeletesPod(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(
+		fakeSite("site-lc-1", false),
+		fakeTmSource("tm-1", "site-lc-1", "rock"),
+		sitePodObject(*fakeTmSource("tm-1", "site-lc-1", "rock")),
+	)
+	r := newFakeTmSourceReconciler(c)
+
+	_, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{}))).To(BeTrue())
+
+	var tm tmv1.TmSource
+	cond := readyCondition(g, c, &tm, "tm-1")
+	g.Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(cond.Reason).To(Equal("SiteDisabled"))
+	g.Expect(tm.Status.Phase).To(Equal(tmv1.TmSourceStopped))
+	g.Expect(tm.Status.Pod).To(BeEmpty())
+}
+
+func TestTmSourceReconcileCreateConflictRequeues(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(fakeSite("site-lc-1", true), fakeTmSource("tm-1", "site-lc-1", "rock"))
+	c.createErr = func(obj runtime.Object) error {
+		// Another pass created the pod between our Get and Create
+		return apierrors.NewAlreadyExists(podResource, "rocket-source-pod-tm-1")
+	}
+	r := newFakeTmSourceReconciler(c)
+
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(defaultRequeueDelay))
+}
+
+func TestTmSourceReconcileTransientErrorBacksOff(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(fakeSite("site-lc-1", true), fakeTmSource("tm-1", "site-lc-1", "rock"))
+	c.createErr = func(obj runtime.Object) error {
+		return apierrors.NewServiceUnavailable("etcd is unhappy")
+	}
+	r := newFakeTmSourceReconciler(c)
+
+	first, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	second, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(first.RequeueAfter).To(Equal(transientBackoffBase))
+	g.Expect(second.RequeueAfter).To(Equal(2 * transientBackoffBase))
+
+	// Recovering resets the backoff
+	c.createErr = nil
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result).To(Equal(ctrl.Result{}))
+	g.Expect(r.backoff.next(requestFor("tm-1").NamespacedName)).To(Equal(transientBackoffBase))
+}
+
+func TestTmSourceReconcileTerminalErrorSetsCondition(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(fakeSite("site-lc-1", true), fakeTmSource("tm-1", "site-lc-1", "rock"))
+	c.createErr = func(obj runtime.Object) error {
+		return apierrors.NewForbidden(podResource, "rocket-source-pod-tm-1", nil)
+	}
+	r := newFakeTmSourceReconciler(c)
+
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result).To(Equal(ctrl.Result{}))
+
+	var tm tmv1.TmSource
+	cond := readyCondition(g, c, &tm, "tm-1")
+	g.Expect(cond).ToNot(BeNil())
+	g.Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(cond.Reason).To(Equal("Forbidden"))
+	g.Expect(tm.Status.Phase).To(Equal(tmv1.TmSourceFailed))
+}
+
+func TestTmSourceReconcileNotFoundRaces(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// The tmsource is gone by the time the event is processed
+	r := newFakeTmSourceReconciler(newFakeClient())
+	result, err := r.Reconcile(requestFor("tm-gone"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result).To(Equal(ctrl.Result{}))
+
+	// The pod vanishes between our Get and Delete
+	c := newFakeClient(
+		fakeSite("site-lc-1", false),
+		fakeTmSource("tm-1", "site-lc-1", "rock"),
+		sitePodObject(*fakeTmSource("tm-1", "site-lc-1", "rock")),
+	)
+	c.deleteErr = func(obj runtime.Object) error {
+		return apierrors.NewNotFound(podResource, "rocket-source-pod-tm-1")
+	}
+	r = newFakeTmSourceReconciler(c)
+	result, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result).To(Equal(ctrl.Result{}))
+}
+
+func TestTmSourceReconcileDeletionRemovesFinalizer(t *testing.T) {
+	g := NewGomegaWithT(t)
+	tm := fakeTmSource("tm-1", "site-lc-1", "rock")
+	now := metav1.Now()
+	tm.DeletionTimestamp = &now
+	tm.Finalizers = []string{tmSourceFinalizerName}
+	c := newFakeClient(fakeSite("site-lc-1", true), tm, sitePodObject(*tm), sitePodObject(*fakeTmSource("tm-1", "site-lc-1", "paper")))
+	r := newFakeTmSourceReconciler(c)
+
+	_, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{}))).To(BeTrue())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "paper"), &v1.Pod{}))).To(BeTrue())
+
+	var latest tmv1.TmSource
+	g.Expect(c.Get(context.Background(), requestFor("tm-1").NamespacedName, &latest)).To(Succeed())
+	g.Expect(latest.Finalizers).ToNot(ContainElement(tmSourceFinalizerName))
+}
+
+func TestSiteReconcileFansOut(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(
+		fakeSite("site-lc-1", true),
+		fakeTmSource("tm-1", "site-lc-1", "rock"),
+		fakeTmSource("tm-2", "site-lc-1", "paper"),
+		fakeTmSource("tm-3", "site-lc-2", "scissors"),
+	)
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var pods v1.PodList
+	g.Expect(c.List(context.Background(), &pods)).To(Succeed())
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	g.Expect(names).To(ConsistOf(podKeyFor("tm-1", "site-lc-1", "rock").Name, podKeyFor("tm-2", "site-lc-1", "paper").Name))
+
+	var site tmv1.Site
+	cond := readyCondition(g, c, &site, "site-lc-1")
+	g.Expect(cond.Status).To(Equal(metav1.ConditionTrue))
+	g.Expect(site.Status.Sources).To(Equal(int32(2)))
+}
+
+func TestSiteReconcileKeepsGoingOnCreateFailure(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(
+		fakeSite("site-lc-1", true),
+		fakeTmSource("tm-1", "site-lc-1", "rock"),
+		fakeTmSource("tm-2", "site-lc-1", "paper"),
+	)
+	c.createErr = func(obj runtime.Object) error {
+		if pod, ok := obj.(*v1.Pod); ok && pod.Labels[tmLabelSourceKey] == "tm-1" {
+			return apierrors.NewConflict(podResource, pod.Name, nil)
+		}
+		return nil
+	}
+	r := newFakeSiteReconciler(c)
+
+	result, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(defaultRequeueDelay))
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-2", "site-lc-1", "paper"), &v1.Pod{})).To(Succeed())
+}
+
+func TestSiteReconcileDeletionCascades(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	now := metav1.Now()
+	site.DeletionTimestamp = &now
+	site.Finalizers = []string{siteFinalizerName}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"), fakeTmSource("tm-3", "site-lc-2", "scissors"))
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), requestFor("tm-1").NamespacedName, &tmv1.TmSource{}))).To(BeTrue())
+	g.Expect(c.Get(context.Background(), requestFor("tm-3").NamespacedName, &tmv1.TmSource{})).To(Succeed())
+
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1").NamespacedName, &latest)).To(Succeed())
+	g.Expect(latest.Finalizers).ToNot(ContainElement(siteFinalizerName))
+}
+
+func TestSiteReconcileGeneratesCatalogSources(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.Catalog = &tmv1.MetricCatalog{
+		Metrics:      []string{"rock"},
+		ConfigMapRef: &tmv1.CatalogConfigMapRef{Name: "site-lc-1-catalog"},
+	}
+	catalog := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "site-lc-1-catalog", Namespace: "default"},
+		Data:       map[string]string{"metrics": "paper\nsmoke\n"},
+	}
+	c := newFakeClient(site, catalog, fakeTmSource("tm-1", "site-lc-1", "paper"))
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// paper is overridden by the hand-authored tm-1
+	var generated tmv1.TmSource
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1-rock").NamespacedName, &generated)).To(Succeed())
+	g.Expect(generated.Spec).To(Equal(tmv1.TmSourceSpec{Site: "site-lc-1", MetricName: "rock"}))
+	g.Expect(metav1.GetControllerOf(&generated).Name).To(Equal("site-lc-1"))
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1-smoke").NamespacedName, &tmv1.TmSource{})).To(Succeed())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), requestFor("site-lc-1-paper").NamespacedName, &tmv1.TmSource{}))).To(BeTrue())
+
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1").NamespacedName, &latest)).To(Succeed())
+	g.Expect(latest.Status.Sources).To(Equal(int32(3)))
+	g.Expect(tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionCatalogSynced).Status).To(Equal(metav1.ConditionTrue))
+
+	// Removing a metric from the ConfigMap prunes its tmsource
+	catalog.Data["metrics"] = "paper\n"
+	g.Expect(c.Update(context.Background(), catalog)).To(Succeed())
+	_, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), requestFor("site-lc-1-smoke").NamespacedName, &tmv1.TmSource{}))).To(BeTrue())
+	g.Expect(c.Get(context.Background(), requestFor("tm-1").NamespacedName, &tmv1.TmSource{})).To(Succeed())
+}
+
+func TestSiteReconcileKeepsConvergingWhenCatalogSourceFails(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.Catalog = &tmv1.MetricCatalog{Metrics: []string{"rock", "smoke"}}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "paper"))
+	c.createErr = func(obj runtime.Object) error {
+		if tm, ok := obj.(*tmv1.TmSource); ok && tm.Name == "site-lc-1-rock" {
+			return apierrors.NewForbidden(schema.GroupResource{Resource: "tmsources"}, tm.Name, errors.New("exceeded quota"))
+		}
+		return nil
+	}
+	r := newFakeSiteReconciler(c)
+
+	result, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(defaultRequeueDelay))
+
+	// The other tmsources and their pods are not held by the failure
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1-smoke").NamespacedName, &tmv1.TmSource{})).To(Succeed())
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "paper"), &v1.Pod{})).To(Succeed())
+
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1").NamespacedName, &latest)).To(Succeed())
+	cond := tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionCatalogSynced)
+	g.Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(cond.Reason).To(Equal("SyncFailed"))
+	g.Expect(cond.Message).To(ContainSubstring("site-lc-1-rock"))
+	g.Expect(tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionReady).Status).To(Equal(metav1.ConditionTrue))
+
+	// The failed tmsource is generated once the api server accepts it
+	c.createErr = nil
+	_, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1-rock").NamespacedName, &tmv1.TmSource{})).To(Succeed())
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1").NamespacedName, &latest)).To(Succeed())
+	g.Expect(tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionCatalogSynced).Status).To(Equal(metav1.ConditionTrue))
+}
+
+func TestSiteReconcileKeepsCatalogSourcesWithoutConfigMap(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.Catalog = &tmv1.MetricCatalog{ConfigMapRef: &tmv1.CatalogConfigMapRef{Name: "missing"}}
+	c := newFakeClient(site, desired.CatalogSource(site, "rock"))
+	r := newFakeSiteReconciler(c)
+
+	result, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result).To(Equal(ctrl.Result{}))
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1-rock").NamespacedName, &tmv1.TmSource{})).To(Succeed())
+
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), requestFor("site-lc-1").NamespacedName, &latest)).To(Succeed())
+	cond := tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionCatalogSynced)
+	g.Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(cond.Reason).To(Equal("ConfigMapNotFound"))
+}
+
+func orphanScenario() *faultyClient {
+	return newFakeClient(
+		fakeSite("site-lc-1", true),
+		fakeSite("site-lc-2", false),
+		fakeTmSource("tm-1", "site-lc-1", "rock"),
+		fakeTmSource("tm-2", "site-lc-2", "paper"),
+		sitePodObject(*fakeTmSource("tm-1", "site-lc-1", "rock")),
+		sitePodObject(*fakeTmSource("tm-2", "site-lc-2", "paper")),
+		sitePodObject(*fakeTmSource("tm-renamed", "site-lc-1", "smoke")),
+	)
+}
+
+func newFakePodGarbageCollector(c client.Client, dryRun bool) *PodGarbageCollector {
+	return &PodGarbageCollector{
+		Client: c,
+		Log:    ctrl.Log.WithName("test").WithName("PodGC"),
+		DryRun: dryRun,
+	}
+}
+
+func TestPodGarbageCollectorDeletesOrphans(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := orphanScenario()
+
+	orphans, err := newFakePodGarbageCollector(c, false).Sweep(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(2))
+
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{})).To(Succeed())
+	for _, key := range []types.NamespacedName{podKeyFor("tm-2", "site-lc-2", "paper"), podKeyFor("tm-renamed", "site-lc-1", "smoke")} {
+		g.Expect(apierrors.IsNotFound(c.Get(context.Background(), key, &v1.Pod{}))).To(BeTrue(), key.Name)
+	}
+}
+
+func TestPodGarbageCollectorFollowsMissingSitePolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+	newClient := func() *faultyClient {
+		return newFakeClient(
+			fakeTmSource("tm-1", "site-missing", "rock"),
+			sitePodObject(*fakeTmSource("tm-1", "site-missing", "rock")),
+		)
+	}
+
+	// Run starts the pods of a tmsource without site, they are no orphans
+	gc := newFakePodGarbageCollector(newClient(), false)
+	gc.MissingSite = desired.MissingSiteRun
+	orphans, err := gc.Sweep(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(orphans).To(BeEmpty())
+
+	c := newClient()
+	gc = newFakePodGarbageCollector(c, false)
+	gc.MissingSite = desired.MissingSiteWait
+	orphans, err = gc.Sweep(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(1))
+	g.Expect(orphans[0].Reason).To(Equal(desired.OrphanSiteNotFound))
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "site-missing", "rock"), &v1.Pod{}))).To(BeTrue())
+}
+
+func TestPodGarbageCollectorDryRunKeepsPods(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := orphanScenario()
+
+	orphans, err := newFakePodGarbageCollector(c, true).Sweep(context.Background())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(orphans).To(HaveLen(2))
+
+	var pods v1.PodList
+	g.Expect(c.List(context.Background(), &pods)).To(Succeed())
+	g.Expect(pods.Items).To(HaveLen(3))
+}
+
+func TestPodGarbageCollectorKeepsGoingOnDeleteFailure(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := orphanScenario()
+	renamed := podKeyFor("tm-renamed", "site-lc-1", "smoke").Name
+	c.deleteErr = func(obj runtime.Object) error {
+		if pod, ok := obj.(*v1.Pod); ok && pod.Name == renamed {
+			return apierrors.NewServiceUnavailable("etcd leader changed")
+		}
+		return nil
+	}
+
+	_, err := newFakePodGarbageCollector(c, false).Sweep(context.Background())
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-2", "site-lc-2", "paper"), &v1.Pod{}))).To(BeTrue())
+}
+
+func TestTmSourceReconcileOverQuotaStaysPending(t *testing.T) {
+	g := NewGomegaWithT(t)
+	one := int32(1)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.Limits = &tmv1.SiteLimits{MaxSources: &one}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"), fakeTmSource("tm-2", "site-lc-1", "paper"))
+	r := newFakeTmSourceReconciler(c)
+
+	_, err := r.Reconcile(requestFor("tm-2"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-2", "site-lc-1", "paper"), &v1.Pod{}))).To(BeTrue())
+	// Only the reconciled source gets a pod
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{}))).To(BeTrue())
+
+	var tm tmv1.TmSource
+	cond := readyCondition(g, c, &tm, "tm-2")
+	g.Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(cond.Reason).To(Equal("QuotaExceeded"))
+	g.Expect(cond.Message).To(ContainSubstring("at most 1 tmsources"))
+	g.Expect(tm.Status.Phase).To(Equal(tmv1.TmSourcePending))
+
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{})).To(Succeed())
+}
+
+func TestSiteReconcileReportsUsage(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cpu := resource.MustParse("15m")
+	site := fakeSite("site-lc-1", true)
+	site.Spec.Limits = &tmv1.SiteLimits{CPU: &cpu}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"), fakeTmSource("tm-2", "site-lc-1", "paper"))
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{})).To(Succeed())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-2", "site-lc-1", "paper"), &v1.Pod{}))).To(BeTrue())
+
+	var latest tmv1.Site
+	cond := readyCondition(g, c, &latest, "site-lc-1")
+	g.Expect(cond.Reason).To(Equal("SourcesLimited"))
+	g.Expect(latest.Status.Usage.Sources).To(Equal(int32(1)))
+	g.Expect(latest.Status.Usage.Pending).To(Equal(int32(1)))
+	g.Expect(latest.Status.Usage.CPU.String()).To(Equal("10m"))
+	g.Expect(latest.Status.Usage.Memory.String()).To(Equal("16Mi"))
+}
+
+// degradedScenario runs tm-1, labeled essential, and tm-2 on a site degraded
+// to its essential tmsources.
+func degradedScenario() *faultyClient {
+	site := fakeSite("site-lc-1", true)
+	site.Spec.Mode = tmv1.SiteModeDegraded
+	site.Spec.Degraded = &tmv1.DegradedPolicy{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"essential": "true"}}}
+	essential := fakeTmSource("tm-1", "site-lc-1", "rock")
+	essential.Labels = map[string]string{"essential": "true"}
+
+	return newFakeClient(
+		site,
+		essential,
+		fakeTmSource("tm-2", "site-lc-1", "paper"),
+		sitePodObject(*fakeTmSource("tm-1", "site-lc-1", "rock")),
+		sitePodObject(*fakeTmSource("tm-2", "site-lc-1", "paper")),
+	)
+}
+
+func TestSiteReconcileDegradedShedsSources(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := degradedScenario()
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{})).To(Succeed())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-2", "site-lc-1", "paper"), &v1.Pod{}))).To(BeTrue())
+
+	var latest tmv1.Site
+	cond := readyCondition(g, c, &latest, "site-lc-1")
+	g.Expect(cond.Reason).To(Equal("SiteDegraded"))
+	g.Expect(latest.Status.Mode).To(Equal(tmv1.SiteModeDegraded))
+	g.Expect(latest.Status.Shed).To(Equal(int32(1)))
+}
+
+func TestTmSourceReconcileDegradedSiteStopsShedSource(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := degradedScenario()
+	r := newFakeTmSourceReconciler(c)
+
+	_, err := r.Reconcile(requestFor("tm-2"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-2", "site-lc-1", "paper"), &v1.Pod{}))).To(BeTrue())
+
+	var tm tmv1.TmSource
+	cond := readyCondition(g, c, &tm, "tm-2")
+	g.Expect(cond.Reason).To(Equal("SiteDegraded"))
+	g.Expect(tm.Status.Phase).To(Equal(tmv1.TmSourceStopped))
+
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	cond = readyCondition(g, c, &tm, "tm-1")
+	g.Expect(cond.Reason).To(Equal("PodActive"))
+}
+
+type recordingSink struct {
+	transitions []tmv1.SiteTransition
+}
+
+func (s *recordingSink) Record(ctx context.Context, site *tmv1.Site, transition tmv1.SiteTransition) error {
+	s.transitions = append(s.transitions, transition)
+	return nil
+}
+
+func TestSiteReconcileRecordsTransitions(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", false)
+	site.Annotations = map[string]string{tmv1.AnnotationReason: "pad maintenance"}
+	site.Status.Mode = tmv1.SiteModeEnabled
+	c := newFakeClient(site)
+	sink := &recordingSink{}
+	r := newFakeSiteReconciler(c)
+	r.Audit = sink
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	g.Expect(latest.Status.History).To(HaveLen(1))
+	g.Expect(latest.Status.History[0].From).To(Equal(tmv1.SiteModeEnabled))
+	g.Expect(latest.Status.History[0].To).To(Equal(tmv1.SiteModeDisabled))
+	g.Expect(latest.Status.History[0].Reason).To(Equal("pad maintenance"))
+	g.Expect(sink.transitions).To(HaveLen(1))
+}
+
+func readySite(name string, ready bool, deps ...tmv1.SiteName) *tmv1.Site {
+	site := fakeSite(name, true)
+	site.Spec.DependsOn = deps
+	site.Status.Mode = tmv1.SiteModeEnabled
+	status := metav1.ConditionFalse
+	if ready {
+		status = metav1.ConditionTrue
+	}
+	site.Status.Conditions = []tmv1.Condition{{Type: tmv1.ConditionReady, Status: status}}
+	return site
+}
+
+func setSiteReady(g *WithT, c client.Client, name string, status metav1.ConditionStatus) {
+	var site tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "default"}, &site)).To(Succeed())
+	tmv1.SetCondition(&site.Status.Conditions, tmv1.Condition{Type: tmv1.ConditionReady, Status: status})
+	g.Expect(c.Status().Update(context.Background(), &site)).To(Succeed())
+}
+
+func TestSiteReconcileWaitsForDependencies(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(readySite("ground", false), readySite("pad", false, "ground"), fakeTmSource("tm-1", "pad", "rock"))
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("pad"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "pad", "rock"), &v1.Pod{}))).To(BeTrue())
+	var latest tmv1.Site
+	cond := readyCondition(g, c, &latest, "pad")
+	g.Expect(cond.Reason).To(Equal("DependenciesNotReady"))
+	g.Expect(cond.Message).To(ContainSubstring("ground"))
+
+	setSiteReady(g, c, "ground", metav1.ConditionTrue)
+	_, err = r.Reconcile(requestFor("pad"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "pad", "rock"), &v1.Pod{})).To(Succeed())
+	cond = readyCondition(g, c, &latest, "pad")
+	g.Expect(cond.Status).To(Equal(metav1.ConditionTrue))
+}
+
+func TestSiteReconcileDetectsDependencyCycle(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := newFakeClient(readySite("site-a", true, "site-b"), readySite("site-b", true, "site-a"))
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-a"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-a", Namespace: "default"}, &latest)).To(Succeed())
+	cond := tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionDependenciesReady)
+	g.Expect(cond.Reason).To(Equal("DependencyCycle"))
+	g.Expect(cond.Message).To(ContainSubstring("site-a -> site-b -> site-a"))
+}
+
+func TestSiteReconcileDrainsDependentsFirst(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ground := readySite("ground", true)
+	ground.Spec.Enabled = false
+	c := newFakeClient(ground, readySite("pad", true, "ground"), fakeTmSource("tm-1", "ground", "rock"), sitePodObject(*fakeTmSource("tm-1", "ground", "rock")))
+	r := newFakeSiteReconciler(c)
+
+	// The pad still runs, the ground station keeps its tmsources
+	_, err := r.Reconcile(requestFor("ground"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "ground", "rock"), &v1.Pod{})).To(Succeed())
+	var latest tmv1.Site
+	cond := readyCondition(g, c, &latest, "ground")
+	g.Expect(cond.Reason).To(Equal("SiteDraining"))
+	g.Expect(latest.Status.Mode).To(Equal(tmv1.SiteModeEnabled))
+
+	setSiteReady(g, c, "pad", metav1.ConditionFalse)
+	_, err = r.Reconcile(requestFor("ground"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "ground", "rock"), &v1.Pod{}))).To(BeTrue())
+	cond = readyCondition(g, c, &latest, "ground")
+	g.Expect(cond.Reason).To(Equal("SiteDisabled"))
+	g.Expect(latest.Status.Mode).To(Equal(tmv1.SiteModeDisabled))
+	g.Expect(tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionDraining)).To(BeNil())
+}
+
+func TestSiteReconcileRollsPodsForSiteSidecars(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.InitContainers = []v1.Container{{Name: "wait-for-nats", Image: "busybox"}}
+	site.Spec.Sidecars = []v1.Container{{Name: "log-shipper", Image: "fluent-bit:1.6"}}
+	tm := fakeTmSource("tm-1", "site-lc-1", "rock")
+	c := newFakeClient(site, tm, sitePodObject(*tm))
+
+	_, err := newFakeSiteReconciler(c).Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The extended pod runs next to the old one until it is ready
+	extended := desired.SitePod(site, *tm)
+	var pod v1.Pod
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: extended.Name, Namespace: "default"}, &pod)).To(Succeed())
+	g.Expect(pod.Spec.Containers).To(HaveLen(2))
+	g.Expect(pod.Spec.Containers[1].Name).To(Equal("log-shipper"))
+	g.Expect(pod.Spec.InitContainers).To(HaveLen(1))
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{})).To(Succeed())
+
+	// The tmsource reconciler wants the same pod
+	_, err = newFakeTmSourceReconciler(c).Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var latest tmv1.TmSource
+	readyCondition(g, c, &latest, "tm-1")
+	g.Expect(latest.Status.Pod).To(Equal(extended.Name))
+}
+
+func TestTmSourceReconcileReportsFlow(t *testing.T) {
+	g := NewGomegaWithT(t)
+	srv := runNatsServer(g)
+	defer srv.Shutdown()
+
+	probe := &flow.Probe{URL: srv.ClientURL(), StaleAfter: 30 * time.Second, Log: ctrl.Log.WithName("test").WithName("Flow")}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() { _ = probe.Start(stop) }()
+
+	// The source pods publish to the NATS of the probe
+	site := fakeSite("site-lc-1", true)
+	site.Spec.NATS = &tmv1.NatsEndpoint{Address: strings.TrimPrefix(srv.ClientURL(), "nats://")}
+	pod := desired.SitePod(site, *fakeTmSource("tm-1", "site-lc-1", "rock"))
+	pod.Status.Phase = v1.PodRunning
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"), pod)
+	r := newFakeTmSourceReconciler(c)
+	r.Flow = probe
+
+	flowing := func() *tmv1.Condition {
+		_, err := r.Reconcile(requestFor("tm-1"))
+		g.Expect(err).ToNot(HaveOccurred())
+		var tm tmv1.TmSource
+		g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "tm-1", Namespace: "default"}, &tm)).To(Succeed())
+		return tmv1.FindCondition(tm.Status.Conditions, tmv1.ConditionFlowing)
+	}
+
+	// Nothing published yet, the source is checked again
+	g.Eventually(func() string { return flowing().Reason }, 5*time.Second).Should(Equal(flow.ReasonWaiting))
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(15 * time.Second))
+
+	publishMetric(g, srv, "rock")
+	g.Eventually(func() string { return flowing().Reason }, 5*time.Second).Should(Equal(flow.ReasonFlowing))
+	g.Expect(flowing().Status).To(Equal(metav1.ConditionTrue))
+
+	// A source publishing to another NATS is not watched, the probe cannot
+	// see its messages
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	latest.Spec.NATS.Address = "nats.telemetry.svc:4222"
+	g.Expect(c.Update(context.Background(), &latest)).To(Succeed())
+	g.Expect(flowing().Reason).To(Equal(flow.ReasonNotProbed))
+	g.Expect(flowing().Status).To(Equal(metav1.ConditionUnknown))
+	g.Expect(flowing().Message).To(ContainSubstring("nats.telemetry.svc:4222"))
+
+	// A stopped source is not watched anymore
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	latest.Spec.NATS = site.Spec.NATS
+	g.Expect(c.Update(context.Background(), &latest)).To(Succeed())
+	g.Expect(flowing().Reason).To(Equal(flow.ReasonWaiting))
+	latest.Spec.Enabled = false
+	g.Expect(c.Update(context.Background(), &latest)).To(Succeed())
+	g.Expect(flowing()).To(BeNil())
+}
+
+// runNatsServer starts an embedded nats-server on a random port.
+func runNatsServer(g *WithT) *server.Server {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	go s.Start()
+	g.Expect(s.ReadyForConnections(5 * time.Second)).To(BeTrue())
+	return s
+}
+
+func publishMetric(g *WithT, s *server.Server, subject string) {
+	nc, err := nats.Connect(s.ClientURL())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer nc.Close()
+	g.Expect(nc.Publish(subject, []byte("42"))).To(Succeed())
+	g.Expect(nc.Flush()).To(Succeed())
+}
+
+func TestTmSourceReconcileBacksOffCrashloopingPod(t *testing.T) {
+	g := NewGomegaWithT(t)
+	tm := fakeTmSource("tm-1", "site-lc-1", "rock")
+	tm.Spec.Remediation = &tmv1.RemediationPolicy{MaxRestarts: 3, Action: tmv1.RemediationBackOff}
+	c := newFakeClient(fakeSite("site-lc-1", true), tm)
+	r := newFakeTmSourceReconciler(c)
+	key := podKeyFor("tm-1", "site-lc-1", "rock")
+
+	_, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The pod keeps crashing
+	var pod v1.Pod
+	g.Expect(c.Get(context.Background(), key, &pod)).To(Succeed())
+	pod.CreationTimestamp = metav1.Now()
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "rocket-source", RestartCount: 3}}
+	g.Expect(c.Status().Update(context.Background(), &pod)).To(Succeed())
+
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(desired.RemediationBackoffBase))
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), key, &v1.Pod{}))).To(BeTrue())
+
+	var latest tmv1.TmSource
+	cond := readyCondition(g, c, &latest, "tm-1")
+	g.Expect(cond.Reason).To(Equal(desired.RemediationReasonBackOff))
+	g.Expect(latest.Status.Phase).To(Equal(tmv1.TmSourcePending))
+	g.Expect(latest.Status.Remediation.Attempts).To(Equal(int32(1)))
+
+	// Neither reconciler brings the pod back before the end of the backoff
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = newFakeSiteReconciler(c).Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), key, &v1.Pod{}))).To(BeTrue())
+}
+
+func TestTmSourceReconcileKeepsPodWhenRemediationIsNotRecorded(t *testing.T) {
+	g := NewGomegaWithT(t)
+	tm := fakeTmSource("tm-1", "site-lc-1", "rock")
+	tm.Spec.Remediation = &tmv1.RemediationPolicy{MaxRestarts: 3, Action: tmv1.RemediationBackOff}
+	c := newFakeClient(fakeSite("site-lc-1", true), tm)
+	r := newFakeTmSourceReconciler(c)
+	key := podKeyFor("tm-1", "site-lc-1", "rock")
+
+	_, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var pod v1.Pod
+	g.Expect(c.Get(context.Background(), key, &pod)).To(Succeed())
+	pod.CreationTimestamp = metav1.Now()
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "rocket-source", RestartCount: 3}}
+	g.Expect(c.Status().Update(context.Background(), &pod)).To(Succeed())
+
+	// The attempt cannot be recorded, the pod is kept
+	c.statusUpdateErr = func(obj runtime.Object) error {
+		if _, ok := obj.(*tmv1.TmSource); ok {
+			return apierrors.NewServiceUnavailable("etcd is unhappy")
+		}
+		return nil
+	}
+	result, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+	g.Expect(c.Get(context.Background(), key, &v1.Pod{})).To(Succeed())
+	var latest tmv1.TmSource
+	g.Expect(c.Get(context.Background(), requestFor("tm-1").NamespacedName, &latest)).To(Succeed())
+	g.Expect(latest.Status.Remediation.Attempts).To(BeZero())
+
+	// The next pass records it, then deletes the pod
+	c.statusUpdateErr = nil
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), key, &v1.Pod{}))).To(BeTrue())
+	g.Expect(c.Get(context.Background(), requestFor("tm-1").NamespacedName, &latest)).To(Succeed())
+	g.Expect(latest.Status.Remediation.Attempts).To(Equal(int32(1)))
+}
+
+func TestSiteReconcileRollsOutImageToCanaries(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.Rollout = &tmv1.ImageRollout{Image: "maxthom/rocket-source:v2", CanaryPercent: 50}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"), fakeTmSource("tm-2", "site-lc-1", "paper"))
+	r := newFakeSiteReconciler(c)
+
+	result, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(desired.RolloutCheckInterval))
+
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	g.Expect(latest.Status.Rollout.Phase).To(Equal(tmv1.RolloutCanary))
+	g.Expect(latest.Status.Rollout.Canaries).To(Equal([]string{"tm-2"}))
+
+	images := func() map[string]string {
+		var pods v1.PodList
+		g.Expect(c.List(context.Background(), &pods)).To(Succeed())
+		out := map[string]string{}
+		for _, pod := range pods.Items {
+			out[pod.Name] = desired.SourceOf(&pod) + "=" + pod.Spec.Containers[0].Image
+		}
+		return out
+	}
+	g.Expect(images()).To(ConsistOf("tm-1="+desired.ContainerImage, "tm-2=maxthom/rocket-source:v2"))
+
+	// The canary crashes, it goes back to the stable image
+	var canary v1.Pod
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: desired.SitePod(&latest, *fakeTmSource("tm-2", "site-lc-1", "paper")).Name, Namespace: "default"}, &canary)).To(Succeed())
+	canary.Status.ContainerStatuses = []v1.ContainerStatus{{Name: desired.ContainerName, RestartCount: 1}}
+	g.Expect(c.Status().Update(context.Background(), &canary)).To(Succeed())
+
+	result, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeZero())
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	g.Expect(latest.Status.Rollout.Phase).To(Equal(tmv1.RolloutRolledBack))
+	g.Expect(images()).To(ContainElement("tm-2=" + desired.ContainerImage))
+}
+
+func TestSiteReconcileReportsDrift(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	orphan := desired.SitePod(site, *fakeTmSource("tm-gone", "site-lc-1", "rock"))
+	c := newFakeClient(site, fakeSite("site-lc-2", true), fakeTmSource("tm-1", "site-lc-1", "rock"),
+		fakeTmSource("tm-2", "site-lc-9", "paper"), orphan)
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	g.Expect(latest.Status.Drift).To(Equal(&tmv1.SiteDrift{
+		SourcesWithoutPods: []string{"tm-1"},
+		PodsWithoutSources: []string{orphan.Name},
+		UnlinkedSources:    []string{"tm-2"},
+	}))
+	inSync := tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionInSync)
+	g.Expect(inSync.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(inSync.Reason).To(Equal("Drifted"))
+
+	// The missing pod was created, the others are not the site's to fix
+	_, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var converged tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &converged)).To(Succeed())
+	g.Expect(converged.Status.Drift.SourcesWithoutPods).To(BeEmpty())
+	g.Expect(converged.Status.Drift.PodsWithoutSources).To(Equal([]string{orphan.Name}))
+
+	// A tmsource of a missing site is reported by every site of its namespace
+	requests := r.tmSourceToSites(handler.MapObject{Object: fakeTmSource("tm-2", "site-lc-9", "paper")})
+	g.Expect(requests).To(ConsistOf(requestFor("site-lc-1"), requestFor("site-lc-2")))
+	requests = r.podToSite(handler.MapObject{Object: orphan})
+	g.Expect(requests).To(Equal([]reconcile.Request{requestFor("site-lc-1")}))
+}
+
+func TestTmSourceReconcileHoldsSourcesOfMissingSite(t *testing.T) {
+	g := NewGomegaWithT(t)
+	tm := fakeTmSource("tm-1", "site-lc-1", "rock")
+	c := newFakeClient(tm, getPodObject(*tm))
+	r := newFakeTmSourceReconciler(c)
+	r.MissingSite = desired.MissingSiteWait
+
+	_, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var latest tmv1.TmSource
+	ready := readyCondition(g, c, &latest, "tm-1")
+	g.Expect(ready.Reason).To(Equal("SiteNotFound"))
+	g.Expect(latest.Status.Phase).To(Equal(tmv1.TmSourcePending))
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{}))).To(BeTrue())
+
+	r.MissingSite = desired.MissingSiteFail
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var failed tmv1.TmSource
+	readyCondition(g, c, &failed, "tm-1")
+	g.Expect(failed.Status.Phase).To(Equal(tmv1.TmSourceFailed))
+
+	// The site is created disabled, the waiting tmsource is enqueued and stops
+	site := fakeSite("site-lc-1", false)
+	g.Expect(c.Create(context.Background(), site)).To(Succeed())
+	g.Expect(r.siteToTmSources(handler.MapObject{Meta: site, Object: site})).To(Equal([]reconcile.Request{requestFor("tm-1")}))
+	_, err = r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var stopped tmv1.TmSource
+	ready = readyCondition(g, c, &stopped, "tm-1")
+	g.Expect(ready.Reason).To(Equal("SiteDisabled"))
+	g.Expect(stopped.Status.Phase).To(Equal(tmv1.TmSourceStopped))
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &v1.Pod{}))).To(BeTrue())
+}
+
+func TestSiteReconcileSyncsNetworkPolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.NetworkPolicy = &tmv1.SiteNetworkPolicy{}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"))
+	r := newFakeSiteReconciler(c)
+	key := types.NamespacedName{Name: "rocket-source-site-lc-1", Namespace: "default"}
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var policy networkingv1.NetworkPolicy
+	g.Expect(c.Get(context.Background(), key, &policy)).To(Succeed())
+	g.Expect(policy.Spec.Egress[0].Ports[0].Port.IntValue()).To(Equal(4222))
+
+	// A new NATS address moves the egress rule and starts replacement pods
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	latest.Spec.NATS = &tmv1.NatsEndpoint{Address: "nats.telemetry.svc:4333"}
+	g.Expect(c.Update(context.Background(), &latest)).To(Succeed())
+	_, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var updated networkingv1.NetworkPolicy
+	g.Expect(c.Get(context.Background(), key, &updated)).To(Succeed())
+	g.Expect(updated.Spec.Egress[0].Ports[0].Port.IntValue()).To(Equal(4333))
+	var pods v1.PodList
+	g.Expect(c.List(context.Background(), &pods, client.InNamespace("default"))).To(Succeed())
+	var addresses []string
+	for _, pod := range pods.Items {
+		addresses = append(addresses, pod.Spec.Containers[0].Env[0].Value)
+	}
+	g.Expect(addresses).To(ConsistOf(desired.ContainerEnvNatValue, "nats.telemetry.svc:4333"))
+
+	// Without networkPolicy the policy is deleted
+	var disabled tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &disabled)).To(Succeed())
+	disabled.Spec.NetworkPolicy = nil
+	g.Expect(c.Update(context.Background(), &disabled)).To(Succeed())
+	_, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), key, &networkingv1.NetworkPolicy{}))).To(BeTrue())
+}
+
+func TestSiteReconcileKeepsForeignNetworkPolicy(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.NetworkPolicy = &tmv1.SiteNetworkPolicy{}
+	foreign := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "rocket-source-site-lc-1", Namespace: "default"}}
+	c := newFakeClient(site, foreign, fakeTmSource("tm-1", "site-lc-1", "rock"))
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	ready := tmv1.FindCondition(latest.Status.Conditions, tmv1.ConditionReady)
+	g.Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(ready.Reason).To(Equal("NetworkPolicyConflict"))
+	var policy networkingv1.NetworkPolicy
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "rocket-source-site-lc-1", Namespace: "default"}, &policy)).To(Succeed())
+	g.Expect(policy.Spec.Egress).To(BeEmpty())
+
+	// The pods do not start without their policy
+	var pods v1.PodList
+	g.Expect(c.List(context.Background(), &pods, client.InNamespace("default"))).To(Succeed())
+	g.Expect(pods.Items).To(BeEmpty())
+}
+
+func TestSiteReconcileManagesServiceAccount(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"))
+	r := newFakeSiteReconciler(c)
+	key := types.NamespacedName{Name: "rocket-source-site-lc-1", Namespace: "default"}
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var account v1.ServiceAccount
+	g.Expect(c.Get(context.Background(), key, &account)).To(Succeed())
+	g.Expect(*account.AutomountServiceAccountToken).To(BeFalse())
+	var pod v1.Pod
+	g.Expect(c.Get(context.Background(), podKeyFor("tm-1", "site-lc-1", "rock"), &pod)).To(Succeed())
+	g.Expect(pod.Spec.ServiceAccountName).To(Equal(key.Name))
+	g.Expect(*pod.Spec.SecurityContext.RunAsNonRoot).To(BeTrue())
+
+	// A site running its pods with its own account does not need ours
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	latest.Spec.ServiceAccountName = "telemetry"
+	g.Expect(c.Update(context.Background(), &latest)).To(Succeed())
+	_, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(apierrors.IsNotFound(c.Get(context.Background(), key, &v1.ServiceAccount{}))).To(BeTrue())
+}
+
+func TestSiteReconcileKeepsForeignServiceAccount(t *testing.T) {
+	g := NewGomegaWithT(t)
+	foreign := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "rocket-source-site-lc-1", Namespace: "default"}}
+	c := newFakeClient(fakeSite("site-lc-1", true), foreign, fakeTmSource("tm-1", "site-lc-1", "rock"))
+	r := newFakeSiteReconciler(c)
+
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var latest tmv1.Site
+	ready := readyCondition(g, c, &latest, "site-lc-1")
+	g.Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(ready.Reason).To(Equal("ServiceAccountConflict"))
+	var account v1.ServiceAccount
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "rocket-source-site-lc-1", Namespace: "default"}, &account)).To(Succeed())
+	g.Expect(account.AutomountServiceAccountToken).To(BeNil())
+}
+
+func TestSiteReconcileAppliesTemplate(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.TemplateRef = &tmv1.SiteTemplateRef{Name: "launch-complex"}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"))
+	r := newFakeSiteReconciler(c)
+
+	// Nothing runs until the template exists
+	_, err := r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var waiting tmv1.Site
+	ready := readyCondition(g, c, &waiting, "site-lc-1")
+	g.Expect(ready.Reason).To(Equal("TemplateNotFound"))
+	var pods v1.PodList
+	g.Expect(c.List(context.Background(), &pods, client.InNamespace("default"))).To(Succeed())
+	g.Expect(pods.Items).To(BeEmpty())
+
+	template := &tmv1.SiteTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "launch-complex", Namespace: "default"},
+		Spec: tmv1.SiteTemplateSpec{
+			Image:   "maxthom/rocket-source:v2",
+			Catalog: &tmv1.MetricCatalog{Metrics: []string{"smoke"}},
+		},
+	}
+	g.Expect(c.Create(context.Background(), template)).To(Succeed())
+	g.Expect(r.templateToSites(handler.MapObject{Meta: template, Object: template})).To(Equal([]reconcile.Request{requestFor("site-lc-1")}))
+
+	_, err = r.Reconcile(requestFor("site-lc-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var generated tmv1.TmSource
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1-smoke", Namespace: "default"}, &generated)).To(Succeed())
+	g.Expect(c.List(context.Background(), &pods, client.InNamespace("default"))).To(Succeed())
+	g.Expect(pods.Items).ToNot(BeEmpty())
+	for _, pod := range pods.Items {
+		g.Expect(pod.Spec.Containers[0].Image).To(Equal("maxthom/rocket-source:v2"))
+	}
+
+	// The merged spec is never written back to the site
+	var latest tmv1.Site
+	g.Expect(c.Get(context.Background(), types.NamespacedName{Name: "site-lc-1", Namespace: "default"}, &latest)).To(Succeed())
+	g.Expect(latest.Spec.Image).To(BeEmpty())
+	g.Expect(latest.Spec.Catalog).To(BeNil())
+}
+
+func TestTmSourceReconcileWaitsForSiteTemplate(t *testing.T) {
+	g := NewGomegaWithT(t)
+	site := fakeSite("site-lc-1", true)
+	site.Spec.TemplateRef = &tmv1.SiteTemplateRef{Name: "launch-complex"}
+	c := newFakeClient(site, fakeTmSource("tm-1", "site-lc-1", "rock"))
+	r := newFakeTmSourceReconciler(c)
+
+	_, err := r.Reconcile(requestFor("tm-1"))
+	g.Expect(err).ToNot(HaveOccurred())
+	var latest tmv1.TmSource
+	ready := readyCondition(g, c, &latest, "tm-1")
+	g.Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+	g.Expect(ready.Reason).To(Equal("TemplateNotFound"))
+	var pods v1.PodList
+	g.Expect(c.List(context.Background(), &pods, client.InNamespace("default"))).To(Succeed())
+	g.Expect(pods.Items).To(BeEmpty())
+}
@@ -18,17 +18,28 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/audit"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
 )
 
 // SiteReconciler reconciles a Site object
@@ -36,6 +47,10 @@ type SiteReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+	// Audit optionally records the mode transitions of the sites.
+	Audit audit.Sink
+
+	backoff *backoff
 }
 
 type SiteConfig struct {
@@ -47,6 +62,12 @@ type SiteConfig struct {
 
 // +kubebuilder:rbac:groups=tm.rocketlab.global,resources=sites,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=tm.rocketlab.global,resources=sites/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=tm.rocketlab.global,resources=sites/finalizers,verbs=update
+// +kubebuilder:rbac:groups=tm.rocketlab.global,resources=sitetemplates,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;delete
 
 func (r *SiteReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -63,35 +84,193 @@ func (r *SiteReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		// Object not being deleted.
 		// Registering our finalizer.
 		if err := r.registerFinalizer(config); err != nil {
-			return ctrl.Result{}, err
+			result, _ := reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+			return result, nil
 		}
+		status := site.Status.DeepCopy()
+		spec := site.Spec.DeepCopy()
 
 		// Bootstrap site.
-		if err := r.bootstrapSite(config); err != nil {
-			return ctrl.Result{}, err
+		after, err := r.bootstrapSite(config)
+		result, term := reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+		result = requeueSooner(result, after)
+		if term != nil {
+			tmv1.SetCondition(&site.Status.Conditions, tmv1.Condition{
+				Type:    tmv1.ConditionReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  term.Reason,
+				Message: term.Err.Error(),
+			})
+		}
+		// The spec merged with the template is never written back
+		site.Spec = *spec
+		if err := r.updateStatus(config, status); err != nil {
+			result, _ = reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
 		}
+		return result, nil
 	} else if containsString(site.ObjectMeta.Finalizers, siteFinalizerName) {
 		// Object being deleted.
 		// Takedown site.
 		if err := r.takedownSite(config); err != nil {
-			return ctrl.Result{}, err
+			result, _ := reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+			return result, nil
 		}
 
 		// unregister our finalizer from the list.
 		if err := r.unregisterFinalizer(config); err != nil {
-			return ctrl.Result{}, err
+			result, _ := reconcileResult(r.Log, r.backoff, req.NamespacedName, err)
+			return result, nil
 		}
+		r.backoff.reset(req.NamespacedName)
 	}
 
 	return ctrl.Result{}, nil
 }
 
 func (r *SiteReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.backoff = newBackoff(transientBackoffBase, transientBackoffMax)
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&tmv1.Site{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&v1.ServiceAccount{}).
+		Watches(&source.Kind{Type: &tmv1.TmSource{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.tmSourceToSites),
+		}).
+		Watches(&source.Kind{Type: &v1.Pod{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.podToSite),
+		}).
+		Watches(&source.Kind{Type: &tmv1.Site{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.siteToRelatedSites),
+		}).
+		Watches(&source.Kind{Type: &v1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.configMapToSites),
+		}).
+		Watches(&source.Kind{Type: &tmv1.SiteTemplate{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.templateToSites),
+		}).
 		Complete(r)
 }
 
+// tmSourceToSites maps tmsource events to their site, so generated sources are
+// restored and overrides are picked up. A tmsource of a missing site maps to
+// every site of its namespace, which report it in their drift.
+func (r *SiteReconciler) tmSourceToSites(obj handler.MapObject) []reconcile.Request {
+	tm, ok := obj.Object.(*tmv1.TmSource)
+	if !ok {
+		return nil
+	}
+	key := types.NamespacedName{Name: tm.Spec.Site, Namespace: tm.Namespace}
+	if tm.Spec.Site != "" {
+		var site tmv1.Site
+		err := r.Get(context.Background(), key, &site)
+		if err == nil {
+			return []reconcile.Request{{NamespacedName: key}}
+		}
+		if !errors.IsNotFound(err) {
+			r.Log.Error(err, "unable to get site of tmsource "+tm.Name)
+			return []reconcile.Request{{NamespacedName: key}}
+		}
+	}
+
+	var sites tmv1.SiteList
+	if err := r.List(context.Background(), &sites, client.InNamespace(tm.Namespace)); err != nil {
+		r.Log.Error(err, "unable to list sites for tmsource "+tm.Name)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, site := range sites.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: site.Name, Namespace: site.Namespace}})
+	}
+	return requests
+}
+
+// podToSite maps events of source pods to the site of their tmsource, which
+// reports them in its drift. Pods created before the site label existed are
+// matched through their tmsource.
+func (r *SiteReconciler) podToSite(obj handler.MapObject) []reconcile.Request {
+	pod, ok := obj.Object.(*v1.Pod)
+	if !ok || pod.Labels[tmLabelAppKey] != tmLabelAppValue {
+		return nil
+	}
+	site, ok := desired.SiteOf(pod)
+	if !ok {
+		var tm tmv1.TmSource
+		if err := r.Get(context.Background(), types.NamespacedName{Name: desired.SourceOf(pod), Namespace: pod.Namespace}, &tm); err != nil {
+			return nil
+		}
+		site = tm.Spec.Site
+	}
+	if site == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: site, Namespace: pod.Namespace}}}
+}
+
+// siteToRelatedSites maps site events to the sites it depends on and to the
+// sites depending on it, which follow its Ready condition.
+func (r *SiteReconciler) siteToRelatedSites(obj handler.MapObject) []reconcile.Request {
+	site, ok := obj.Object.(*tmv1.Site)
+	if !ok {
+		return nil
+	}
+	var sites tmv1.SiteList
+	if err := r.List(context.Background(), &sites, client.InNamespace(site.Namespace)); err != nil {
+		r.Log.Error(err, "unable to list sites related to site "+site.Name)
+		return nil
+	}
+
+	names := map[string]bool{}
+	for _, dep := range site.Spec.DependsOn {
+		names[string(dep)] = true
+	}
+	for _, s := range sites.Items {
+		for _, dep := range s.Spec.DependsOn {
+			if string(dep) == site.Name {
+				names[s.Name] = true
+			}
+		}
+	}
+	delete(names, site.Name)
+
+	var requests []reconcile.Request
+	for name := range names {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: site.Namespace}})
+	}
+	return requests
+}
+
+// configMapToSites maps ConfigMap events to the sites reading their catalog from it.
+func (r *SiteReconciler) configMapToSites(obj handler.MapObject) []reconcile.Request {
+	var sites tmv1.SiteList
+	if err := r.List(context.Background(), &sites, client.InNamespace(obj.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "unable to list sites for configmap "+obj.Meta.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, site := range sites.Items {
+		// The catalog may come from the template of the site
+		if err := resolveSiteTemplate(context.Background(), r.Client, &site); err != nil {
+			continue
+		}
+		if ref := catalogConfigMapRef(&site); ref != nil && ref.Name == obj.Meta.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: site.Name, Namespace: site.Namespace}})
+		}
+	}
+	return requests
+}
+
+// templateToSites maps SiteTemplate events to the sites referencing it, which
+// converge to its new defaults.
+func (r *SiteReconciler) templateToSites(obj handler.MapObject) []reconcile.Request {
+	requests, err := templateSiteRequests(context.Background(), r.Client, obj.Meta.GetNamespace(), obj.Meta.GetName())
+	if err != nil {
+		r.Log.Error(err, "unable to list sites for sitetemplate "+obj.Meta.GetName())
+	}
+	return requests
+}
+
 func (r *SiteReconciler) registerFinalizer(config SiteConfig) error {
 	controllerutil.AddFinalizer(config.site, siteFinalizerName)
 	if err := r.Update(config.ctx, config.site); err != nil {
@@ -110,32 +289,408 @@ func (r *SiteReconciler) unregisterFinalizer(config SiteConfig) error {
 	return nil
 }
 
-func (r *SiteReconciler) bootstrapSite(config SiteConfig) error {
+// bootstrapSite converges the tmsources and pods of a site and returns when
+// its image rollout has to be evaluated again, zero when none is in progress.
+func (r *SiteReconciler) bootstrapSite(config SiteConfig) (time.Duration, error) {
+	// The template defaults apply to everything below
+	if err := resolveSiteTemplate(config.ctx, r.Client, config.site); err != nil {
+		r.Log.Info("unable to resolve site template")
+		return 0, err
+	}
+
 	// Get list of tmsource with site name equal to this site
 	tmSources, err := r.getTmSourcesWithSite(config)
 	if err != nil {
 		r.Log.Info("unable to fetch TmSources")
-		return err
+		return 0, err
 	}
 
-	if config.site.Spec.Enabled {
-		r.Log.Info("Site is enabled, activating tmsources...")
-		// Activate all pods
-		for _, tm := range tmSources {
-			r.activateTmSourcePod(getPodObject(tm))
+	// Generate and prune the tmsources of the metric catalog, the ones which
+	// failed are retried after the others converged
+	tmSources, catalogAfter, err := r.syncCatalog(config, tmSources)
+	if err != nil {
+		r.Log.Info("unable to sync metric catalog")
+		return 0, err
+	}
+	config.site.Status.Sources = int32(len(tmSources))
+
+	// Hold the tmsources until the dependencies are Ready, and keep them
+	// running on disable until the dependents stopped
+	if err := r.syncDependencies(config); err != nil {
+		r.Log.Info("unable to evaluate site dependencies")
+		return 0, err
+	}
+
+	// Usage of the site against its limits
+	quota := desired.Admit(config.site, tmSources)
+	config.site.Status.Usage = &quota.Usage
+
+	// Get the pods currently running for those sources
+	pods, err := listSourcePods(config.ctx, r.Client, config.site.Namespace, tmSources)
+	if err != nil {
+		r.Log.Info("unable to fetch pods")
+		return 0, err
+	}
+
+	// Canaries of the image rollout get the new image first
+	rollout, after := desired.Rollout(config.site, tmSources, pods, time.Now())
+	if catalogAfter > 0 && (after == 0 || catalogAfter < after) {
+		after = catalogAfter
+	}
+	if rollout != nil && (config.site.Status.Rollout == nil || rollout.Phase != config.site.Status.Rollout.Phase || rollout.Image != config.site.Status.Rollout.Image) {
+		r.Log.Info("Rollout of image " + rollout.Image + " is " + string(rollout.Phase) + ": " + rollout.Message)
+	}
+	config.site.Status.Rollout = rollout
+
+	// Tmsources shed by the mode of the site
+	mode := desired.EffectiveMode(config.site)
+	var shed int32
+	for _, tm := range tmSources {
+		if !desired.SourceRuns(config.site, tm) && tm.DeletionTimestamp.IsZero() {
+			shed++
 		}
+	}
+	// A draining site only transitions once its dependents stopped
+	if !desired.Draining(config.site) {
+		r.recordTransition(config)
+		config.site.Status.Mode = mode
+	}
+	config.site.Status.Shed = 0
+	if mode == tmv1.SiteModeDegraded {
+		config.site.Status.Shed = shed
+	}
 
-	} else {
+	switch {
+	case desired.Blocked(config.site):
+		r.Log.Info("Site waits for its dependencies, deactivating tmsources...")
+	case desired.Draining(config.site):
+		r.Log.Info("Site is disabled, keeping tmsources until its dependents stopped...")
+	case mode == tmv1.SiteModeEnabled:
+		r.Log.Info("Site is enabled, activating tmsources...")
+	case mode == tmv1.SiteModeDegraded:
+		r.Log.Info("Site is degraded, shedding non-essential tmsources...")
+	default:
 		r.Log.Info("Site is disabled, deactivating tmsources...")
-		// Deactivate all pods
-		for _, tm := range tmSources {
-			r.deactivateTmSourcePod(getPodObject(tm))
-		}
 	}
 
+	// Report how far the cluster is from the desired state before converging
+	if err := r.syncDrift(config); err != nil {
+		r.Log.Info("unable to compute site drift")
+		return 0, err
+	}
+
+	// Restrict the pods before they start
+	if err := r.syncNetworkPolicy(config); err != nil {
+		r.Log.Info("unable to sync network policy")
+		return 0, err
+	}
+	if err := r.syncServiceAccount(config); err != nil {
+		r.Log.Info("unable to sync service account")
+		return 0, err
+	}
+
+	// Converge the pods towards the desired state of the site
+	actions := desired.Plan(desired.Pods([]tmv1.Site{*config.site}, tmSources), pods)
+	if err := applyPodActions(r.Client, r.Log, actions); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case desired.Blocked(config.site):
+		dependencies := tmv1.FindCondition(config.site.Status.Conditions, tmv1.ConditionDependenciesReady)
+		r.setReady(config, metav1.ConditionFalse, dependencies.Reason, dependencies.Message)
+	case desired.Draining(config.site):
+		draining := tmv1.FindCondition(config.site.Status.Conditions, tmv1.ConditionDraining)
+		r.setReady(config, metav1.ConditionFalse, "SiteDraining", "Site is disabled. "+draining.Message)
+	case mode == tmv1.SiteModeDisabled:
+		r.setReady(config, metav1.ConditionFalse, "SiteDisabled", "Site is disabled.")
+	case mode == tmv1.SiteModeDegraded:
+		r.setReady(config, metav1.ConditionTrue, "SiteDegraded", fmt.Sprintf("Site is degraded, %d tmsources are active, %d are shed and %d are held by the site limits.", quota.Usage.Sources, shed, quota.Usage.Pending))
+	case quota.Usage.Pending > 0:
+		r.setReady(config, metav1.ConditionTrue, "SourcesLimited", fmt.Sprintf("%d tmsources are active, %d are held by the site limits.", quota.Usage.Sources, quota.Usage.Pending))
+	default:
+		r.setReady(config, metav1.ConditionTrue, "SourcesActive", "All tmsources of the site are active.")
+	}
+
+	return after, nil
+}
+
+// syncDependencies sets the DependenciesReady condition of a site with
+// dependencies, and the Draining condition of a site being disabled while
+// Ready sites still depend on it.
+func (r *SiteReconciler) syncDependencies(config SiteConfig) error {
+	site := config.site
+	var sites tmv1.SiteList
+	if err := r.List(config.ctx, &sites, client.InNamespace(site.Namespace)); err != nil {
+		return err
+	}
+
+	conditions := &site.Status.Conditions
+	if len(site.Spec.DependsOn) == 0 {
+		tmv1.RemoveCondition(conditions, tmv1.ConditionDependenciesReady)
+	} else if cycle := desired.DependencyCycle(site, sites.Items); cycle != nil {
+		r.Log.Info("Site " + site.Name + " is in a dependency cycle.")
+		r.setDependenciesReady(config, metav1.ConditionFalse, "DependencyCycle", "Sites depend on each other: "+strings.Join(cycle, " -> ")+".")
+	} else if blocking := desired.BlockingDependencies(site, sites.Items); len(blocking) > 0 {
+		r.setDependenciesReady(config, metav1.ConditionFalse, "DependenciesNotReady", "Waiting for sites "+strings.Join(blocking, ", ")+" to be Ready.")
+	} else {
+		r.setDependenciesReady(config, metav1.ConditionTrue, "DependenciesReady", "All dependencies are Ready.")
+	}
+
+	// Only a site going from running to disabled drains its dependents
+	var dependents []string
+	if desired.Mode(site) == tmv1.SiteModeDisabled && !desired.Blocked(site) &&
+		site.Status.Mode != "" && site.Status.Mode != tmv1.SiteModeDisabled {
+		dependents = desired.ReadyDependents(site, sites.Items)
+	}
+	if len(dependents) == 0 {
+		tmv1.RemoveCondition(conditions, tmv1.ConditionDraining)
+		return nil
+	}
+	tmv1.SetCondition(conditions, tmv1.Condition{
+		Type:    tmv1.ConditionDraining,
+		Status:  metav1.ConditionTrue,
+		Reason:  "WaitingForDependents",
+		Message: "Waiting for sites " + strings.Join(dependents, ", ") + " to stop.",
+	})
 	return nil
 }
 
+// syncDrift sets the drift and the InSync condition of a site from the
+// tmsources and source pods of its namespace.
+func (r *SiteReconciler) syncDrift(config SiteConfig) error {
+	namespace := client.InNamespace(config.site.Namespace)
+	var sites tmv1.SiteList
+	if err := r.List(config.ctx, &sites, namespace); err != nil {
+		return err
+	}
+	var sources tmv1.TmSourceList
+	if err := r.List(config.ctx, &sources, namespace); err != nil {
+		return err
+	}
+	var pods v1.PodList
+	if err := r.List(config.ctx, &pods, namespace, client.MatchingLabels{tmLabelAppKey: tmLabelAppValue}); err != nil {
+		return err
+	}
+
+	drift, message := desired.Drift(config.site, sites.Items, sources.Items, pods.Items)
+	config.site.Status.Drift = drift
+	if drift == nil {
+		r.setInSync(config, metav1.ConditionTrue, "InSync", "Tmsources and pods match the site.")
+		return nil
+	}
+	r.Log.Info("Site " + config.site.Name + " drifted: " + message)
+	r.setInSync(config, metav1.ConditionFalse, "Drifted", message)
+	return nil
+}
+
+// syncNetworkPolicy creates, updates or deletes the network policy of the
+// source pods of a site. A policy of the same name the site does not control
+// is left alone and fails the site.
+func (r *SiteReconciler) syncNetworkPolicy(config SiteConfig) error {
+	policy := desired.NetworkPolicy(config.site)
+	key := types.NamespacedName{Name: desired.NetworkPolicyName(config.site), Namespace: config.site.Namespace}
+
+	var existing networkingv1.NetworkPolicy
+	if err := r.Get(config.ctx, key, &existing); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		if policy == nil {
+			return nil
+		}
+		r.Log.Info("Creating NetworkPolicy " + policy.Name)
+		return r.Create(config.ctx, policy)
+	}
+
+	if !metav1.IsControlledBy(&existing, config.site) {
+		if policy == nil {
+			return nil
+		}
+		return terminal("NetworkPolicyConflict", fmt.Errorf("NetworkPolicy %s already exists and is not controlled by the site", key.Name))
+	}
+	if policy == nil {
+		r.Log.Info("Deleting NetworkPolicy " + existing.Name)
+		if err := r.Delete(config.ctx, &existing); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	if equality.Semantic.DeepEqual(existing.Spec, policy.Spec) && equality.Semantic.DeepEqual(existing.Labels, policy.Labels) {
+		return nil
+	}
+	r.Log.Info("Updating NetworkPolicy " + existing.Name)
+	existing.Labels = policy.Labels
+	existing.Spec = policy.Spec
+	return r.Update(config.ctx, &existing)
+}
+
+// syncServiceAccount creates, updates or deletes the service account the
+// source pods of a site run with. An account of the same name the site does
+// not control is left alone and fails the site.
+func (r *SiteReconciler) syncServiceAccount(config SiteConfig) error {
+	account := desired.ServiceAccount(config.site)
+	key := types.NamespacedName{Name: desired.ServiceAccountName(config.site), Namespace: config.site.Namespace}
+
+	var existing v1.ServiceAccount
+	if err := r.Get(config.ctx, key, &existing); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		if account == nil {
+			return nil
+		}
+		r.Log.Info("Creating ServiceAccount " + account.Name)
+		return r.Create(config.ctx, account)
+	}
+
+	if !metav1.IsControlledBy(&existing, config.site) {
+		if account == nil {
+			return nil
+		}
+		return terminal("ServiceAccountConflict", fmt.Errorf("ServiceAccount %s already exists and is not controlled by the site", key.Name))
+	}
+	if account == nil {
+		r.Log.Info("Deleting ServiceAccount " + existing.Name)
+		if err := r.Delete(config.ctx, &existing); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	// Secrets are filled in by the token controller, they are not ours
+	if equality.Semantic.DeepEqual(existing.AutomountServiceAccountToken, account.AutomountServiceAccountToken) && equality.Semantic.DeepEqual(existing.Labels, account.Labels) {
+		return nil
+	}
+	r.Log.Info("Updating ServiceAccount " + existing.Name)
+	existing.Labels = account.Labels
+	existing.AutomountServiceAccountToken = account.AutomountServiceAccountToken
+	return r.Update(config.ctx, &existing)
+}
+
+// recordTransition adds a change of mode since the last reconcile to the
+// history of the site and to the audit sink. The sink is best effort, a
+// failure is only logged.
+func (r *SiteReconciler) recordTransition(config SiteConfig) {
+	transition := audit.Observe(config.site, metav1.Now())
+	if transition == nil {
+		return
+	}
+	r.Log.Info("Site mode changed from " + string(transition.From) + " to " + string(transition.To) + " by " + transition.Manager + ".")
+	config.site.Status.History = audit.Append(config.site.Status.History, *transition)
+
+	if r.Audit == nil {
+		return
+	}
+	if err := r.Audit.Record(config.ctx, config.site, *transition); err != nil {
+		r.Log.Error(err, "unable to record site transition")
+	}
+}
+
+// syncCatalog generates and prunes the tmsources of the catalog of a site and
+// returns the tmsources left to the site. A tmsource which cannot be generated
+// or pruned is reported on CatalogSynced without holding the others, the
+// returned duration tells when to retry it.
+func (r *SiteReconciler) syncCatalog(config SiteConfig, tmSources []tmv1.TmSource) ([]tmv1.TmSource, time.Duration, error) {
+	site := config.site
+
+	// Without catalog nothing is generated, but earlier generated tmsources are still pruned
+	metrics, invalid, err := r.getCatalogMetrics(config)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			r.Log.Info("Catalog ConfigMap of site " + site.Name + " not found, keeping tmsources.")
+			r.setCatalogSynced(config, metav1.ConditionFalse, "ConfigMapNotFound", "ConfigMap "+catalogConfigMapRef(site).Name+" not found.")
+			return tmSources, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	// Generated names may collide with any tmsource of the namespace
+	var all tmv1.TmSourceList
+	if err := r.List(config.ctx, &all, client.InNamespace(site.Namespace)); err != nil {
+		return nil, 0, err
+	}
+	actions := desired.PlanCatalog(site, metrics, all.Items)
+
+	var failed []string
+	var firstErr error
+	deleted := map[string]bool{}
+	for _, tm := range actions.Delete {
+		r.Log.Info("Pruning TmSource " + tm.Name)
+		if err := r.Delete(config.ctx, tm); err != nil && !errors.IsNotFound(err) {
+			r.Log.Error(err, "unable to prune TmSource "+tm.Name)
+			failed = append(failed, tm.Name)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		deleted[tm.Name] = true
+	}
+	var synced []tmv1.TmSource
+	for _, tm := range tmSources {
+		if !deleted[tm.Name] {
+			synced = append(synced, tm)
+		}
+	}
+	for _, tm := range actions.Create {
+		r.Log.Info("Generating TmSource " + tm.Name)
+		if err := r.Create(config.ctx, tm); err != nil {
+			r.Log.Error(err, "unable to generate TmSource "+tm.Name)
+			failed = append(failed, tm.Name)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		synced = append(synced, *tm)
+	}
+
+	switch {
+	case len(failed) > 0:
+		r.setCatalogSynced(config, metav1.ConditionFalse, "SyncFailed", "Unable to sync tmsources "+strings.Join(failed, ", ")+": "+firstErr.Error())
+		return synced, defaultRequeueDelay, nil
+	case site.Spec.Catalog == nil:
+	case len(invalid) > 0:
+		r.setCatalogSynced(config, metav1.ConditionFalse, "InvalidMetric", "Invalid metric names: "+strings.Join(invalid, ", ")+".")
+	case len(actions.Conflicts) > 0:
+		r.setCatalogSynced(config, metav1.ConditionFalse, "NameConflict", "TmSource names already taken for metrics: "+strings.Join(actions.Conflicts, ", ")+".")
+	default:
+		r.setCatalogSynced(config, metav1.ConditionTrue, "Synced", fmt.Sprintf("%d metrics in catalog.", len(metrics)))
+	}
+
+	return synced, 0, nil
+}
+
+func (r *SiteReconciler) getCatalogMetrics(config SiteConfig) ([]string, []string, error) {
+	catalog := config.site.Spec.Catalog
+	if catalog == nil {
+		return nil, nil, nil
+	}
+
+	var fromConfigMap []string
+	if ref := catalogConfigMapRef(config.site); ref != nil {
+		var cm v1.ConfigMap
+		if err := r.Get(config.ctx, types.NamespacedName{Name: ref.Name, Namespace: config.site.Namespace}, &cm); err != nil {
+			return nil, nil, err
+		}
+		key := ref.Key
+		if key == "" {
+			key = desired.CatalogConfigMapKey
+		}
+		fromConfigMap = desired.ParseCatalog(cm.Data[key])
+	}
+
+	metrics, invalid := desired.CatalogMetrics(catalog.Metrics, fromConfigMap)
+	return metrics, invalid, nil
+}
+
+func catalogConfigMapRef(site *tmv1.Site) *tmv1.CatalogConfigMapRef {
+	if site.Spec.Catalog == nil {
+		return nil
+	}
+	return site.Spec.Catalog.ConfigMapRef
+}
+
 func (r *SiteReconciler) takedownSite(config SiteConfig) error {
 	// Delete the tmsources linked to the site
 	// Get list of tmsource with site name equal to this site
@@ -160,46 +715,57 @@ func (r *SiteReconciler) takedownSite(config SiteConfig) error {
 
 func (r *SiteReconciler) getTmSourcesWithSite(config SiteConfig) ([]tmv1.TmSource, error) {
 	// Get list of tmsource with site name equal to this site
-	var tmSources tmv1.TmSourceList
 	r.Log.Info("Fetching list of tmsources for site")
-	err := r.List(config.ctx, &tmSources, &client.ListOptions{})
+	sources, err := listSiteSources(config.ctx, r.Client, config.site.Namespace, config.site.Name)
 	if err != nil {
 		r.Log.Info("unable to fetch TmSources")
 		return nil, err
 	}
 
-	var sources []tmv1.TmSource
-	for _, tm := range tmSources.Items {
-		if tm.Spec.Site == config.site.Name {
-			sources = append(sources, tm)
-		}
-	}
-
 	return sources, nil
 }
 
-func (r *SiteReconciler) activateTmSourcePod(pod *v1.Pod) error {
-	if !doesPodExist(r.Client, types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}) {
-		r.Log.Info("Creating pod " + pod.Name + "...")
-		if err := createPod(r.Client, pod); err != nil {
-			r.Log.Info("Could not create pod " + pod.Name + ".")
-			return err
-		}
-	} else {
-		r.Log.Info("Pod " + pod.Name + " already up.")
-	}
-	return nil
+func (r *SiteReconciler) setReady(config SiteConfig, status metav1.ConditionStatus, reason, message string) {
+	tmv1.SetCondition(&config.site.Status.Conditions, tmv1.Condition{
+		Type:    tmv1.ConditionReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
 }
 
-func (r *SiteReconciler) deactivateTmSourcePod(pod *v1.Pod) error {
-	if doesPodExist(r.Client, types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}) {
-		r.Log.Info("Deleting pod " + pod.Name + "...")
-		if err := deletePod(r.Client, pod); err != nil {
-			r.Log.Info("Could not delete pod " + pod.Name + ".")
-			return err
-		}
-	} else {
-		r.Log.Info("Pod " + pod.Name + " already down.")
+func (r *SiteReconciler) setDependenciesReady(config SiteConfig, status metav1.ConditionStatus, reason, message string) {
+	tmv1.SetCondition(&config.site.Status.Conditions, tmv1.Condition{
+		Type:    tmv1.ConditionDependenciesReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+func (r *SiteReconciler) setInSync(config SiteConfig, status metav1.ConditionStatus, reason, message string) {
+	tmv1.SetCondition(&config.site.Status.Conditions, tmv1.Condition{
+		Type:    tmv1.ConditionInSync,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+func (r *SiteReconciler) setCatalogSynced(config SiteConfig, status metav1.ConditionStatus, reason, message string) {
+	tmv1.SetCondition(&config.site.Status.Conditions, tmv1.Condition{
+		Type:    tmv1.ConditionCatalogSynced,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+func (r *SiteReconciler) updateStatus(config SiteConfig, original *tmv1.SiteStatus) error {
+	// Only push the status when something changed during this pass
+	if equality.Semantic.DeepEqual(original, &config.site.Status) {
+		return nil
 	}
-	return nil
+
+	return r.Status().Update(config.ctx, config.site)
 }
@@ -0,0 +1,180 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+var _ = Describe("Site controller", func() {
+	var (
+		ctx       context.Context
+		namespace string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newNamespace()
+	})
+
+	It("fans enable and disable out to the pods of its tmsources", func() {
+		site := newSite(namespace, "site-fanout", true)
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+
+		rock := newTmSource(namespace, "fanout-rock", site.Name, "rock")
+		paper := newTmSource(namespace, "fanout-paper", site.Name, "paper")
+		Expect(k8sClient.Create(ctx, rock)).To(Succeed())
+		Expect(k8sClient.Create(ctx, paper)).To(Succeed())
+
+		By("creating the pods while the site is enabled")
+		Eventually(podExists(rock), timeout, interval).Should(BeTrue())
+		Eventually(podExists(paper), timeout, interval).Should(BeTrue())
+
+		By("deleting the pods when the site is disabled")
+		Expect(setSiteEnabled(ctx, site, false)).To(Succeed())
+		Eventually(podExists(rock), timeout, interval).Should(BeFalse())
+		Eventually(podExists(paper), timeout, interval).Should(BeFalse())
+
+		By("keeping the tmsources around while disabled")
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: rock.Name, Namespace: namespace}, &tmv1.TmSource{})).To(Succeed())
+
+		By("recreating the pods when the site is enabled again")
+		Expect(setSiteEnabled(ctx, site, true)).To(Succeed())
+		Eventually(podExists(rock), timeout, interval).Should(BeTrue())
+		Eventually(podExists(paper), timeout, interval).Should(BeTrue())
+	})
+
+	It("does not start pods of a disabled site", func() {
+		site := newSite(namespace, "site-disabled", false)
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		siteKey := types.NamespacedName{Name: site.Name, Namespace: namespace}
+		Eventually(func() []string {
+			var s tmv1.Site
+			_ = k8sClient.Get(ctx, siteKey, &s)
+			return s.Finalizers
+		}, timeout, interval).Should(ContainElement(siteFinalizerName))
+
+		tm := newTmSource(namespace, "disabled-smoke", site.Name, "smoke")
+		Expect(k8sClient.Create(ctx, tm)).To(Succeed())
+		Consistently(podExists(tm), "2s", interval).Should(BeFalse())
+	})
+
+	It("deletes its tmsources and their pods when the site is deleted", func() {
+		site := newSite(namespace, "site-cascade", true)
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+
+		tm := newTmSource(namespace, "cascade-scissors", site.Name, "scissors")
+		Expect(k8sClient.Create(ctx, tm)).To(Succeed())
+		Eventually(podExists(tm), timeout, interval).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, site)).To(Succeed())
+
+		siteKey := types.NamespacedName{Name: site.Name, Namespace: namespace}
+		tmKey := types.NamespacedName{Name: tm.Name, Namespace: namespace}
+		Eventually(objectExists(siteKey, &tmv1.Site{}), timeout, interval).Should(BeFalse())
+		Eventually(objectExists(tmKey, &tmv1.TmSource{}), timeout, interval).Should(BeFalse())
+		Eventually(podExists(tm), timeout, interval).Should(BeFalse())
+	})
+
+	It("runs its source pods with its own service account", func() {
+		site := newSite(namespace, "site-account", true)
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		tm := newTmSource(namespace, "account-rock", site.Name, "rock")
+		Expect(k8sClient.Create(ctx, tm)).To(Succeed())
+
+		key := types.NamespacedName{Name: "rocket-source-" + site.Name, Namespace: namespace}
+		Eventually(objectExists(key, &v1.ServiceAccount{}), timeout, interval).Should(BeTrue())
+		Eventually(podExists(tm), timeout, interval).Should(BeTrue())
+		pod := sourcePods(tm)[0]
+		Expect(pod.Spec.ServiceAccountName).To(Equal(key.Name))
+		Expect(*pod.Spec.Containers[0].SecurityContext.ReadOnlyRootFilesystem).To(BeTrue())
+	})
+
+	It("rolls its source pods when its template changes", func() {
+		template := &tmv1.SiteTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: "launch-complex", Namespace: namespace},
+			Spec:       tmv1.SiteTemplateSpec{Image: "maxthom/rocket-source:v2"},
+		}
+		Expect(k8sClient.Create(ctx, template)).To(Succeed())
+		site := newSite(namespace, "site-templated", true)
+		site.Spec.TemplateRef = &tmv1.SiteTemplateRef{Name: template.Name}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		tm := newTmSource(namespace, "templated-rock", site.Name, "rock")
+		Expect(k8sClient.Create(ctx, tm)).To(Succeed())
+
+		images := func() []string {
+			var images []string
+			for _, pod := range sourcePods(tm) {
+				images = append(images, pod.Spec.Containers[0].Image)
+			}
+			return images
+		}
+		Eventually(images, timeout, interval).Should(Equal([]string{"maxthom/rocket-source:v2"}))
+
+		By("starting a pod with the new template image")
+		Expect(retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			var latest tmv1.SiteTemplate
+			if err := k8sClient.Get(ctx, types.NamespacedName{Name: template.Name, Namespace: namespace}, &latest); err != nil {
+				return err
+			}
+			latest.Spec.Image = "maxthom/rocket-source:v3"
+			return k8sClient.Update(ctx, &latest)
+		})).To(Succeed())
+		Eventually(images, timeout, interval).Should(ContainElement("maxthom/rocket-source:v3"))
+	})
+
+	It("keeps the network policy of its source pods stable", func() {
+		site := newSite(namespace, "site-restricted", true)
+		site.Spec.NetworkPolicy = &tmv1.SiteNetworkPolicy{}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+
+		key := types.NamespacedName{Name: "rocket-source-" + site.Name, Namespace: namespace}
+		Eventually(objectExists(key, &networkingv1.NetworkPolicy{}), timeout, interval).Should(BeTrue())
+
+		By("not updating the policy defaulted by the api server again")
+		resourceVersion := func() string {
+			var policy networkingv1.NetworkPolicy
+			_ = k8sClient.Get(ctx, key, &policy)
+			return policy.ResourceVersion
+		}
+		Consistently(resourceVersion, "2s", interval).Should(Equal(resourceVersion()))
+	})
+})
+
+// setSiteEnabled flips spec.enabled, retrying on conflicts with the controller
+// which keeps updating the site finalizers and status.
+func setSiteEnabled(ctx context.Context, site *tmv1.Site, enabled bool) error {
+	key := types.NamespacedName{Name: site.Name, Namespace: site.Namespace}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var latest tmv1.Site
+		if err := k8sClient.Get(ctx, key, &latest); err != nil {
+			return err
+		}
+		latest.Spec.Enabled = enabled
+		return k8sClient.Update(ctx, &latest)
+	})
+}
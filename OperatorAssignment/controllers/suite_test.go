@@ -17,13 +17,22 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
@@ -31,17 +40,33 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
 	// +kubebuilder:scaffold:imports
 )
 
 // These tests use Ginkgo (BDD-style Go testing framework). Refer to
 // http://onsi.github.io/ginkgo/ to learn more about Ginkgo.
 
+const (
+	timeout  = 10 * time.Second
+	interval = 250 * time.Millisecond
+
+	defaultAssetsDir = "/usr/local/kubebuilder/bin"
+)
+
 var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
+var stopMgr chan struct{}
+var namespaceCount int
 
 func TestAPIs(t *testing.T) {
+	// The suite needs the etcd and kube-apiserver binaries, either in
+	// KUBEBUILDER_ASSETS or in the kubebuilder default location.
+	if !envtestAssetsAvailable() {
+		t.Skip("envtest binaries not found, set KUBEBUILDER_ASSETS to run the controller suite")
+	}
+
 	RegisterFailHandler(Fail)
 
 	RunSpecsWithDefaultAndCustomReporters(t,
@@ -49,12 +74,29 @@ func TestAPIs(t *testing.T) {
 		[]Reporter{printer.NewlineReporter{}})
 }
 
+func envtestAssetsAvailable() bool {
+	dir := os.Getenv("KUBEBUILDER_ASSETS")
+	if dir == "" {
+		dir = defaultAssetsDir
+	}
+	for _, bin := range []string{"etcd", "kube-apiserver"} {
+		if _, err := os.Stat(filepath.Join(dir, bin)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// crdDirectory holds the CRDs of the helm chart, which have the kustomize
+// patches of config/crd applied.
+var crdDirectory = filepath.Join("..", "charts", "rocketlab-operator", "crds")
+
 var _ = BeforeSuite(func(done Done) {
 	logf.SetLogger(zap.LoggerTo(GinkgoWriter, true))
 
 	By("bootstrapping test environment")
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths: []string{filepath.Join("..", "config", "crd", "bases")},
+		CRDDirectoryPaths: []string{crdDirectory},
 	}
 
 	var err error
@@ -65,11 +107,36 @@ var _ = BeforeSuite(func(done Done) {
 	err = tmv1.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
 
-	err = tmv1.AddToScheme(scheme.Scheme)
-	Expect(err).NotTo(HaveOccurred())
-
 	// +kubebuilder:scaffold:scheme
 
+	By("starting the controller manager")
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:             scheme.Scheme,
+		MetricsBindAddress: "0",
+	})
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&SiteReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("Site"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&TmSourceReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("TmSource"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+
+	stopMgr = make(chan struct{})
+	go func() {
+		defer GinkgoRecover()
+		Expect(mgr.Start(stopMgr)).To(Succeed())
+	}()
+
+	// Talk to the api server directly so assertions never read a stale cache
 	k8sClient, err = client.New(cfg, client.Options{Scheme: scheme.Scheme})
 	Expect(err).ToNot(HaveOccurred())
 	Expect(k8sClient).ToNot(BeNil())
@@ -79,6 +146,52 @@ var _ = BeforeSuite(func(done Done) {
 
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
+	if stopMgr != nil {
+		close(stopMgr)
+	}
 	err := testEnv.Stop()
 	Expect(err).ToNot(HaveOccurred())
 })
+
+// newNamespace creates a fresh namespace so specs do not see each other's objects.
+func newNamespace() string {
+	namespaceCount++
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("test-%d-%d", time.Now().Unix(), namespaceCount)}}
+	Expect(k8sClient.Create(context.Background(), ns)).To(Succeed())
+	return ns.Name
+}
+
+func newSite(namespace, name string, enabled bool) *tmv1.Site {
+	return &tmv1.Site{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       tmv1.SiteSpec{Enabled: enabled},
+	}
+}
+
+func newTmSource(namespace, name, site, metric string) *tmv1.TmSource {
+	return &tmv1.TmSource{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       tmv1.TmSourceSpec{Site: site, MetricName: metric},
+	}
+}
+
+// sourcePods lists the pods of the tmsource, whatever their template.
+func sourcePods(tm *tmv1.TmSource) []v1.Pod {
+	var pods v1.PodList
+	_ = k8sClient.List(context.Background(), &pods, client.InNamespace(tm.Namespace), client.MatchingLabels{tmLabelSourceKey: desired.LabelValue(tm.Name)})
+	return pods.Items
+}
+
+// podExists polls whether a pod of the tmsource is present.
+func podExists(tm *tmv1.TmSource) func() bool {
+	return func() bool {
+		return len(sourcePods(tm)) > 0
+	}
+}
+
+// objectExists polls whether obj is still present on the api server.
+func objectExists(key types.NamespacedName, obj runtime.Object) func() bool {
+	return func() bool {
+		return k8sClient.Get(context.Background(), key, obj) == nil
+	}
+}
@@ -18,11 +18,11 @@ package controllers
 
 import (
 	"context"
-	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -30,10 +30,15 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+	"github.com/maxthom/rocketlab-controller/pkg/flow"
 )
 
 // TmSourceReconciler reconciles a TmSource object
@@ -41,6 +46,13 @@ type TmSourceReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+	// Flow, when set, checks the metrics of the running tmsources reach NATS.
+	Flow *flow.Probe
+	// MissingSite is what tmsources do while their site does not exist, Run
+	// when empty.
+	MissingSite desired.MissingSitePolicy
+
+	backoff *backoff
 }
 
 type TmSourceConfig struct {
@@ -53,6 +65,9 @@ type TmSourceConfig struct {
 
 // +kubebuilder:rbac:groups=tm.rocketlab.global,resources=tmsources,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=tm.rocketlab.global,resources=tmsources/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=tm.rocketlab.global,resources=sites,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
 
 func (r *TmSourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -64,48 +79,109 @@ func (r *TmSourceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ResolveIfNotFound(err)
 	}
 	config := TmSourceConfig{ctx: ctx, tmsource: tmsource, pod: getPodObject(*tmsource), log: r.Log, req: req}
+	key := types.NamespacedName{Name: tmsource.Name, Namespace: tmsource.Namespace}
 
 	if tmsource.ObjectMeta.DeletionTimestamp.IsZero() {
 		// Object not being deleted.
 		// Registering our finalizer.
 		if err := r.registerFinalizer(config); err != nil {
-			return ctrl.Result{}, err
+			result, _ := reconcileResult(r.Log, r.backoff, key, err)
+			return result, nil
 		}
+		status := tmsource.Status.DeepCopy()
 
 		// Bootstrap tmsource pod.
-		if err := r.bootstrapTmSourcePod(config); err != nil {
-			if err.Error() == "requeue" {
-				return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
-			}
-			return ctrl.Result{}, err
+		after, err := r.bootstrapTmSourcePod(config)
+		result, term := reconcileResult(r.Log, r.backoff, key, err)
+		if term != nil {
+			tmsource.Status.Phase = tmv1.TmSourceFailed
+			tmv1.SetCondition(&tmsource.Status.Conditions, tmv1.Condition{
+				Type:    tmv1.ConditionReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  term.Reason,
+				Message: term.Err.Error(),
+			})
+		}
+		result = requeueSooner(result, after)
+		result = requeueSooner(result, r.syncFlow(config))
+		if err := r.updateStatus(config, status); err != nil {
+			result, _ = reconcileResult(r.Log, r.backoff, key, err)
 		}
+		return result, nil
 	} else if containsString(tmsource.ObjectMeta.Finalizers, tmSourceFinalizerName) {
 		// Object being deleted.
-		// Takedown tmsource pod.
-		if err := r.takedownTmSourcePod(config.pod); err != nil {
-			return ctrl.Result{}, err
+		if r.Flow != nil {
+			r.Flow.Forget(key)
+		}
+		// Takedown tmsource pods.
+		if err := r.takedownTmSourcePods(config); err != nil {
+			result, _ := reconcileResult(r.Log, r.backoff, key, err)
+			return result, nil
 		}
 
 		// unregister our finalizer from the list.
 		if err := r.unregisterFinalizer(config); err != nil {
-			return ctrl.Result{}, err
+			result, _ := reconcileResult(r.Log, r.backoff, key, err)
+			return result, nil
 		}
+		r.backoff.reset(key)
 	}
 
 	return ctrl.Result{}, nil
 }
 
 func (r *TmSourceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	r.backoff = newBackoff(transientBackoffBase, transientBackoffMax)
+
+	c, err := ctrl.NewControllerManagedBy(mgr).
 		For(&tmv1.TmSource{}).
-		Watches(&source.Kind{
-			Type: &v1.Pod{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{tmLabelAppKey: tmLabelAppValue},
-				},
-			},
-		}, &handler.EnqueueRequestForObject{}).
-		Complete(r)
+		Watches(&source.Kind{Type: &v1.Pod{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(podToTmSource),
+		}).
+		Build(r)
+	if err != nil {
+		return err
+	}
+
+	// Tmsources created before their site are resolved once it is created,
+	// the site reconciler takes care of their pods afterwards
+	return c.Watch(&source.Kind{Type: &tmv1.Site{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(r.siteToTmSources),
+	}, predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return true },
+		UpdateFunc:  func(event.UpdateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	})
+}
+
+// siteToTmSources maps the creation of a site to the tmsources linked to its
+// name.
+func (r *TmSourceReconciler) siteToTmSources(obj handler.MapObject) []reconcile.Request {
+	sources, err := listSiteSources(context.Background(), r.Client, obj.Meta.GetNamespace(), obj.Meta.GetName())
+	if err != nil {
+		r.Log.Error(err, "unable to list tmsources of site "+obj.Meta.GetName())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, tm := range sources {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: tm.Name, Namespace: tm.Namespace}})
+	}
+	return requests
+}
+
+// podToTmSource maps events of source pods to their tmsource.
+func podToTmSource(obj handler.MapObject) []reconcile.Request {
+	pod, ok := obj.Object.(*v1.Pod)
+	if !ok || pod.Labels[tmLabelAppKey] != tmLabelAppValue {
+		return nil
+	}
+	name := desired.SourceOf(pod)
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name, Namespace: pod.Namespace}}}
 }
 
 func (r *TmSourceReconciler) registerFinalizer(config TmSourceConfig) error {
@@ -119,25 +195,36 @@ func (r *TmSourceReconciler) registerFinalizer(config TmSourceConfig) error {
 
 func (r *TmSourceReconciler) unregisterFinalizer(config TmSourceConfig) error {
 	controllerutil.RemoveFinalizer(config.tmsource, tmSourceFinalizerName)
-	if err := r.Update(context.Background(), config.tmsource); err != nil && !strings.Contains(err.Error(), "invalid") {
-		return err
+	// A tmsource already gone has nothing left to unregister
+	if err := r.Update(context.Background(), config.tmsource); err != nil && !errors.IsNotFound(err) && !errors.IsInvalid(err) {
+		return classifyAPIError(err)
 	}
 
 	return nil
 }
 
-func (r *TmSourceReconciler) bootstrapTmSourcePod(config TmSourceConfig) error {
+// bootstrapTmSourcePod converges the pods of a tmsource and returns when its
+// remediation policy has to be evaluated again, zero when it does not.
+func (r *TmSourceReconciler) bootstrapTmSourcePod(config TmSourceConfig) (time.Duration, error) {
 	// Get site associated with this source
 	site, err := r.getSourceSite(config)
 	if err != nil {
 		r.Log.Error(err, "unable to get site")
-		return err
+		return 0, err
 	}
+	// The extensions of the site are part of the pod template
+	config.pod = desired.SitePod(site, *config.tmsource)
 
-	// Get pod associated with this source
-	podInstance, err := r.getTmSourcePod(config)
+	// Get pods associated with this source, an older template may still run
+	pods, err := listSourcePods(config.ctx, r.Client, config.tmsource.Namespace, []tmv1.TmSource{*config.tmsource})
 	if err != nil {
-		return err
+		return 0, err
+	}
+	var podInstance *v1.Pod
+	for i := range pods {
+		if pods[i].Name == config.pod.Name {
+			podInstance = &pods[i]
+		}
 	}
 	if podInstance == nil {
 		r.Log.Info("Pod of TmSource is non-existent.")
@@ -145,49 +232,175 @@ func (r *TmSourceReconciler) bootstrapTmSourcePod(config TmSourceConfig) error {
 		r.Log.Info("Pod of TmSource is " + podInstance.Name + ".")
 	}
 
+	// Without site, the missing site policy may hold the tmsource until the
+	// site is created
+	if site == nil && r.MissingSite != "" && r.MissingSite != desired.MissingSiteRun {
+		if err := applyPodActions(r.Client, r.Log, desired.Plan(nil, pods)); err != nil {
+			return 0, err
+		}
+		if r.MissingSite == desired.MissingSiteFail {
+			r.setPhase(config, tmv1.TmSourceFailed, "")
+			r.setReady(config, metav1.ConditionFalse, "SiteNotFound", "Site "+config.tmsource.Spec.Site+" does not exist.")
+		} else {
+			r.setPhase(config, tmv1.TmSourcePending, "")
+			r.setReady(config, metav1.ConditionFalse, "SiteNotFound", "Waiting for site "+config.tmsource.Spec.Site+" to be created.")
+		}
+		return 0, nil
+	}
+
+	// A pod restarting too often is deleted, the policy may withhold the
+	// next one for a while
+	remediation := desired.Remediate(*config.tmsource, podInstance, time.Now())
+	if remediation.Act {
+		r.Log.Info("Remediating pod " + podInstance.Name + ": " + remediation.Status.Message)
+		// The attempt is recorded before the pod goes, a failed update keeps
+		// the pod for the next pass
+		if err := r.saveRemediation(config, remediation.Status); err != nil {
+			r.Log.Info("unable to record remediation")
+			return 0, err
+		}
+	}
+	config.tmsource.Status.Remediation = remediation.Status
+
 	// Take action according to site status
 	// We still create the source even if there is no site linked
-	if site == nil || site.Spec.Enabled {
-		r.Log.Info("Site is enabled.")
-		return r.checkTmSourcePod(podInstance, config)
-	} else if !site.Spec.Enabled {
+	var sites []tmv1.Site
+	siteSources := []tmv1.TmSource{*config.tmsource}
+	var quota desired.Quota
+	if site != nil {
+		sites = append(sites, *site)
+		// The limits of the site apply to all its sources
+		if siteSources, err = r.getSiteSources(config, site); err != nil {
+			return 0, err
+		}
+		quota = desired.Admit(site, siteSources)
+	}
+	want := podsOfSource(desired.Pods(sites, siteSources), config.tmsource.Name)
+	if remediation.Act {
+		want = nil
+	}
+	actions := desired.Plan(want, pods)
+	if len(actions.Create) > 0 {
+		if err := r.waitServiceAccount(config, site); err != nil {
+			return 0, err
+		}
+	}
+	if err := applyPodActions(r.Client, r.Log, actions); err != nil {
+		return 0, err
+	}
+
+	if reason, held := quota.Held[config.tmsource.Name]; held {
+		r.Log.Info("TmSource is over the limits of its site.")
+		r.setPhase(config, tmv1.TmSourcePending, "")
+		r.setReady(config, metav1.ConditionFalse, "QuotaExceeded", reason)
+		return 0, nil
+	}
+
+	if remediation.Reason != "" && desired.SourceRuns(site, *config.tmsource) {
+		phase := tmv1.TmSourcePending
+		if remediation.Reason == desired.RemediationReasonFailed {
+			phase = tmv1.TmSourceFailed
+		}
+		r.setPhase(config, phase, "")
+		r.setReady(config, metav1.ConditionFalse, remediation.Reason, remediation.Message)
+		return remediation.Requeue, nil
+	}
+
+	// In case the pod drifted, the previous one keeps running until the new
+	// one is ready, the pod watch brings us back when it is
+	if len(actions.Replace) > 0 {
+		r.setPhase(config, tmv1.TmSourceRecreating, config.pod.Name)
+		r.setReady(config, metav1.ConditionFalse, "PodRecreating", "Waiting for pod "+config.pod.Name+" to be ready before removing the previous one.")
+		return remediation.Requeue, nil
+	}
+
+	// The mode of the site is evaluated for this source, a degraded site keeps
+	// only the sources selected by its policy
+	switch {
+	case desired.SourceRuns(site, *config.tmsource):
+		r.Log.Info("TmSource runs on its site.")
+		if podInstance != nil && desired.PodReady(podInstance) {
+			r.setPhase(config, tmv1.TmSourceRunning, config.pod.Name)
+		} else {
+			r.setPhase(config, tmv1.TmSourcePending, config.pod.Name)
+		}
+		r.setReady(config, metav1.ConditionTrue, "PodActive", "Pod "+config.pod.Name+" is active.")
+	case desired.Blocked(site):
+		r.Log.Info("Site waits for its dependencies.")
+		r.setPhase(config, tmv1.TmSourceStopped, "")
+		r.setReady(config, metav1.ConditionFalse, "SiteBlocked", "Site "+site.Name+" waits for its dependencies to be Ready.")
+	case desired.EffectiveMode(site) == tmv1.SiteModeDegraded:
+		r.Log.Info("Site is degraded, the TmSource is shed.")
+		r.setPhase(config, tmv1.TmSourceStopped, "")
+		r.setReady(config, metav1.ConditionFalse, "SiteDegraded", "Site "+site.Name+" is degraded and does not keep this tmsource.")
+	default:
 		r.Log.Info("Site is disabled.")
-		return r.takedownTmSourcePod(podInstance)
+		r.setPhase(config, tmv1.TmSourceStopped, "")
+		r.setReady(config, metav1.ConditionFalse, "SiteDisabled", "Site "+site.Name+" is disabled.")
 	}
 
-	return nil
+	return remediation.Requeue, nil
 }
 
-func (r *TmSourceReconciler) takedownTmSourcePod(podInstance *v1.Pod) error {
-	// Check if exist, if so delete
-	if podInstance != nil {
-		r.Log.Info("Deleting old pod...")
-		if err := deletePod(r.Client, podInstance); err != nil {
-			r.Log.Info("Could not delete pod " + podInstance.Name + ".")
-			return err
-		}
-		r.Log.Info("TmSource pod is deleted !")
+// syncFlow sets the Flowing condition of a tmsource whose pod publishes its
+// metric, and returns when to check it again. Other tmsources are not watched,
+// nor those publishing to another NATS than the probe.
+func (r *TmSourceReconciler) syncFlow(config TmSourceConfig) time.Duration {
+	if r.Flow == nil {
+		return 0
+	}
+	key := types.NamespacedName{Name: config.tmsource.Name, Namespace: config.tmsource.Namespace}
+
+	// While recreating, the previous pod keeps publishing
+	phase := config.tmsource.Status.Phase
+	if phase != tmv1.TmSourceRunning && phase != tmv1.TmSourceRecreating {
+		r.Flow.Forget(key)
+		tmv1.RemoveCondition(&config.tmsource.Status.Conditions, tmv1.ConditionFlowing)
+		return 0
+	}
+	site, err := r.getSourceSite(config)
+	if err != nil {
+		r.Log.Error(err, "unable to get site")
+		return 0
+	}
+	// The probe only sees the messages of its own NATS server
+	if address := desired.NatsAddress(site); !r.Flow.Covers(address, config.tmsource.Namespace) {
+		r.Flow.Forget(key)
+		tmv1.SetCondition(&config.tmsource.Status.Conditions, tmv1.Condition{
+			Type:    tmv1.ConditionFlowing,
+			Status:  metav1.ConditionUnknown,
+			Reason:  flow.ReasonNotProbed,
+			Message: "The source publishes to NATS at " + address + ", the probe only connects to " + r.Flow.URL + ".",
+		})
+		return 0
 	}
 
-	return nil
+	r.Flow.Watch(key, config.tmsource.Spec.MetricName)
+	status, reason, message := r.Flow.Status(key)
+	tmv1.SetCondition(&config.tmsource.Status.Conditions, tmv1.Condition{
+		Type:    tmv1.ConditionFlowing,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+	return r.Flow.CheckInterval()
 }
 
-func (r *TmSourceReconciler) checkTmSourcePod(podInstance *v1.Pod, config TmSourceConfig) error {
-	// In case envvars are different, delete and recreate
-	if podInstance != nil && isPodEnvDifferent(podInstance, config.pod) {
-		if err := r.takedownTmSourcePod(podInstance); err != nil {
+func (r *TmSourceReconciler) takedownTmSourcePods(config TmSourceConfig) error {
+	// Delete every pod of the source, whatever its template
+	pods, err := listSourcePods(config.ctx, r.Client, config.tmsource.Namespace, []tmv1.TmSource{*config.tmsource})
+	if err != nil {
+		return err
+	}
+
+	for i := range pods {
+		r.Log.Info("Deleting pod " + pods[i].Name + "...")
+		if err := deletePod(r.Client, &pods[i]); err != nil {
+			r.Log.Info("Could not delete pod " + pods[i].Name + ".")
 			return err
 		}
-		return &RequeueError{}
-	} else if podInstance == nil {
-		// Create pod
-		r.Log.Info("Creating new pod...")
-		if err := createPod(r.Client, config.pod); err != nil && !errors.IsAlreadyExists(err) {
-			r.Log.Error(err, "Could not create pod.")
-		}
-
-		r.Log.Info("TmSource pod is operationnal !")
 	}
+	r.Log.Info("TmSource pods are deleted !")
 
 	return nil
 }
@@ -203,33 +416,31 @@ func (r *TmSourceReconciler) getSourceSite(config TmSourceConfig) (*tmv1.Site, e
 	}
 
 	r.Log.Info("Site of TmSource is " + site.Name + ".")
+	// The pods follow the template defaults of the site
+	if err := resolveSiteTemplate(config.ctx, r.Client, &site); err != nil {
+		return nil, err
+	}
 	return &site, nil
 }
 
-func (r *TmSourceReconciler) getTmSourcePod(config TmSourceConfig) (*v1.Pod, error) {
-	var pod v1.Pod
-	loc := types.NamespacedName{
-		Name:      config.pod.Name,
-		Namespace: config.tmsource.Namespace,
+// getSiteSources returns the sources of a site, the reconciled one included
+// even when the cache does not hold it yet.
+func (r *TmSourceReconciler) getSiteSources(config TmSourceConfig, site *tmv1.Site) ([]tmv1.TmSource, error) {
+	sources, err := listSiteSources(config.ctx, r.Client, site.Namespace, site.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := r.Get(config.ctx, loc, &pod); err != nil {
-		if errors.IsNotFound(err) {
-			return nil, nil
+	for i := range sources {
+		if sources[i].Name == config.tmsource.Name {
+			sources[i] = *config.tmsource
+			return sources, nil
 		}
-		return nil, err
 	}
-
-	return &pod, nil
+	return append(sources, *config.tmsource), nil
 }
 
 func (r *TmSourceReconciler) getTmSource(ctx context.Context, req ctrl.Request) (*tmv1.TmSource, error) {
-	if strings.HasPrefix(req.Name, tmNamePrefix) {
-		// Mean its a pod event
-		req.NamespacedName.Name = strings.TrimPrefix(req.Name, tmNamePrefix)
-		r.Log.Info("Pod Event, tmsource is " + req.NamespacedName.Name + ".")
-	}
-
 	var tmsource tmv1.TmSource
 	if err := r.Get(ctx, req.NamespacedName, &tmsource); err != nil {
 		return nil, err
@@ -237,3 +448,58 @@ func (r *TmSourceReconciler) getTmSource(ctx context.Context, req ctrl.Request)
 
 	return &tmsource, nil
 }
+
+func (r *TmSourceReconciler) setReady(config TmSourceConfig, status metav1.ConditionStatus, reason, message string) {
+	tmv1.SetCondition(&config.tmsource.Status.Conditions, tmv1.Condition{
+		Type:    tmv1.ConditionReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+func (r *TmSourceReconciler) setPhase(config TmSourceConfig, phase tmv1.TmSourcePhase, pod string) {
+	config.tmsource.Status.Phase = phase
+	config.tmsource.Status.Pod = pod
+}
+
+// waitServiceAccount requeues the tmsource until the service account the site
+// reconciler creates for its pods exists, the admission of the pods rejects
+// them before.
+func (r *TmSourceReconciler) waitServiceAccount(config TmSourceConfig, site *tmv1.Site) error {
+	if site == nil || config.pod.Spec.ServiceAccountName != desired.ServiceAccountName(site) {
+		return nil
+	}
+	key := types.NamespacedName{Name: config.pod.Spec.ServiceAccountName, Namespace: site.Namespace}
+	if err := r.Get(config.ctx, key, &v1.ServiceAccount{}); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		r.Log.Info("ServiceAccount " + key.Name + " does not exist yet.")
+		r.setPhase(config, tmv1.TmSourcePending, "")
+		r.setReady(config, metav1.ConditionFalse, "ServiceAccountPending", "Waiting for ServiceAccount "+key.Name+" of site "+site.Name+".")
+		return requeueAfter(defaultRequeueDelay)
+	}
+	return nil
+}
+
+// saveRemediation pushes a remediation attempt to the status of the tmsource
+// ahead of the rest of the pass.
+func (r *TmSourceReconciler) saveRemediation(config TmSourceConfig, status *tmv1.RemediationStatus) error {
+	tmsource := config.tmsource.DeepCopy()
+	tmsource.Status.Remediation = status
+	if err := r.Status().Update(config.ctx, tmsource); err != nil {
+		return err
+	}
+	config.tmsource.ResourceVersion = tmsource.ResourceVersion
+	return nil
+}
+
+func (r *TmSourceReconciler) updateStatus(config TmSourceConfig, original *tmv1.TmSourceStatus) error {
+	// Only push the status when something changed during this pass
+	if equality.Semantic.DeepEqual(original, &config.tmsource.Status) {
+		return nil
+	}
+
+	return r.Status().Update(config.ctx, config.tmsource)
+}
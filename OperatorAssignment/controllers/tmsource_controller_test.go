@@ -0,0 +1,138 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+)
+
+var _ = Describe("TmSource controller", func() {
+	var (
+		ctx       context.Context
+		namespace string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = newNamespace()
+	})
+
+	It("recreates the pod when the metric changes", func() {
+		site := newSite(namespace, "site-env", true)
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+
+		tm := newTmSource(namespace, "env-rock", site.Name, "rock")
+		Expect(k8sClient.Create(ctx, tm)).To(Succeed())
+		Eventually(podMetrics(tm), timeout, interval).Should(Equal([]string{"rock"}))
+		Eventually(func() string {
+			var latest tmv1.TmSource
+			_ = k8sClient.Get(ctx, types.NamespacedName{Name: tm.Name, Namespace: namespace}, &latest)
+			return latest.Status.Pod
+		}, timeout, interval).Should(Equal(desired.SitePod(site, *tm).Name))
+
+		tmKey := types.NamespacedName{Name: tm.Name, Namespace: namespace}
+		Expect(retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			var latest tmv1.TmSource
+			if err := k8sClient.Get(ctx, tmKey, &latest); err != nil {
+				return err
+			}
+			latest.Spec.MetricName = "paper"
+			return k8sClient.Update(ctx, &latest)
+		})).To(Succeed())
+
+		By("keeping the previous pod until the new one is ready")
+		Eventually(podMetrics(tm), timeout, interval).Should(Equal([]string{"paper", "rock"}))
+		Consistently(podMetrics(tm), "1s", interval).Should(Equal([]string{"paper", "rock"}))
+
+		updated := tm.DeepCopy()
+		updated.Spec.MetricName = "paper"
+		for _, pod := range sourcePods(tm) {
+			if pod.Name != desired.SitePod(site, *updated).Name {
+				continue
+			}
+			// No kubelet in envtest, report the new pod ready ourselves
+			pod.Status.Phase = v1.PodRunning
+			pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+			Expect(k8sClient.Status().Update(ctx, &pod)).To(Succeed())
+		}
+		Eventually(podMetrics(tm), timeout, interval).Should(Equal([]string{"paper"}))
+	})
+
+	It("runs the pod of a tmsource without a site", func() {
+		tm := newTmSource(namespace, "orphan-smoke", "site-missing", "smoke")
+		Expect(k8sClient.Create(ctx, tm)).To(Succeed())
+		Eventually(podExists(tm), timeout, interval).Should(BeTrue())
+	})
+
+	It("rejects a tmsource with an invalid metric or site", func() {
+		badMetric := newTmSource(namespace, "bad-metric", "site-lc-1", "rock paper")
+		Expect(apierrors.IsInvalid(k8sClient.Create(ctx, badMetric))).To(BeTrue())
+
+		badSite := newTmSource(namespace, "bad-site", "Site_LC_1", "rock")
+		Expect(apierrors.IsInvalid(k8sClient.Create(ctx, badSite))).To(BeTrue())
+	})
+
+	It("removes the pod and its finalizer when the tmsource is deleted", func() {
+		site := newSite(namespace, "site-finalizer", true)
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+
+		tm := newTmSource(namespace, "finalizer-rock", site.Name, "rock")
+		Expect(k8sClient.Create(ctx, tm)).To(Succeed())
+
+		tmKey := types.NamespacedName{Name: tm.Name, Namespace: namespace}
+		Eventually(func() []string {
+			var latest tmv1.TmSource
+			_ = k8sClient.Get(ctx, tmKey, &latest)
+			return latest.Finalizers
+		}, timeout, interval).Should(ContainElement(tmSourceFinalizerName))
+		Eventually(podExists(tm), timeout, interval).Should(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, tm)).To(Succeed())
+		Eventually(objectExists(tmKey, &tmv1.TmSource{}), timeout, interval).Should(BeFalse())
+		Eventually(podExists(tm), timeout, interval).Should(BeFalse())
+
+		By("leaving the site untouched")
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: site.Name, Namespace: namespace}, &tmv1.Site{})).To(Succeed())
+	})
+})
+
+// podMetrics polls the sorted metric names the pods of the tmsource publish.
+func podMetrics(tm *tmv1.TmSource) func() []string {
+	return func() []string {
+		var metrics []string
+		for _, pod := range sourcePods(tm) {
+			for _, env := range pod.Spec.Containers[0].Env {
+				if env.Name == tmContainerEnvMetricKey {
+					metrics = append(metrics, env.Value)
+				}
+			}
+		}
+		sort.Strings(metrics)
+		return metrics
+	}
+}
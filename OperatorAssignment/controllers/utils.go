@@ -2,25 +2,19 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 
-	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/go-logr/logr"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-)
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
-type RequeueError struct{}
-
-func (m *RequeueError) Error() string {
-	return "requeue"
-}
-
-func doesPodExist(c client.Client, loc types.NamespacedName) bool {
-	return c.Get(context.Background(), loc, &v1.Pod{}) == nil
-}
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+)
 
 func createPod(c client.Client, pod *v1.Pod) error {
 	return c.Create(context.Background(), pod)
@@ -38,46 +32,123 @@ func deletePod(c client.Client, pod *v1.Pod) error {
 }
 
 func getPodObject(tmsource tmv1.TmSource) *v1.Pod {
-	return &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      tmNamePrefix + tmsource.Name,
-			Namespace: tmsource.Namespace,
-			Labels: map[string]string{
-				tmLabelAppKey: tmLabelAppValue,
-				//tmLabelSiteKey: tmsource.Spec.Site,
-			},
-		},
-		Spec: v1.PodSpec{
-			Containers: []v1.Container{
-				{
-					Name:            tmContainerName,
-					Image:           tmContainerPath,
-					ImagePullPolicy: v1.PullAlways,
-					Env: []v1.EnvVar{
-						{
-							Name:  tmContainerEnvNatKey,
-							Value: tmContainerEnvNatValue,
-						},
-						{
-							Name:  tmContainerEnvMetricKey,
-							Value: tmsource.Spec.MetricName,
-						},
-					},
-				},
-			},
-		},
-		Status: v1.PodStatus{},
+	return desired.Pod(tmsource)
+}
+
+// resolveSiteTemplate merges the SiteTemplate referenced by a site under its
+// spec, in memory only. A missing template is a terminal error until it is
+// created.
+func resolveSiteTemplate(ctx context.Context, c client.Reader, site *tmv1.Site) error {
+	ref := site.Spec.TemplateRef
+	if ref == nil {
+		return nil
 	}
+	var template tmv1.SiteTemplate
+	if err := c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: site.Namespace}, &template); err != nil {
+		if errors.IsNotFound(err) {
+			return terminal("TemplateNotFound", fmt.Errorf("SiteTemplate %s does not exist", ref.Name))
+		}
+		return err
+	}
+	desired.ApplyTemplate(site, &template)
+	return nil
 }
 
-func isPodEnvDifferent(a *v1.Pod, b *v1.Pod) bool {
-	for i, env := range a.Spec.Containers[0].Env {
-		if env.Value != b.Spec.Containers[0].Env[i].Value {
-			return true
+// templateSiteRequests returns a request for each site referencing a
+// SiteTemplate.
+func templateSiteRequests(ctx context.Context, c client.Reader, namespace, template string) ([]reconcile.Request, error) {
+	var sites tmv1.SiteList
+	if err := c.List(ctx, &sites, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	var requests []reconcile.Request
+	for _, site := range sites.Items {
+		if ref := site.Spec.TemplateRef; ref != nil && ref.Name == template {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: site.Name, Namespace: site.Namespace}})
+		}
+	}
+	return requests, nil
+}
+
+// listSiteSources returns the tmsources linked to a site.
+func listSiteSources(ctx context.Context, c client.Client, namespace, site string) ([]tmv1.TmSource, error) {
+	var tmSources tmv1.TmSourceList
+	if err := c.List(ctx, &tmSources, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	var sources []tmv1.TmSource
+	for _, tm := range tmSources.Items {
+		if tm.Spec.Site == site {
+			sources = append(sources, tm)
 		}
 	}
 
-	return false
+	return sources, nil
+}
+
+// podsOfSource keeps the pods generated for the named tmsource.
+func podsOfSource(pods []*v1.Pod, name string) []*v1.Pod {
+	var out []*v1.Pod
+	for _, pod := range pods {
+		if desired.SourceOf(pod) == name {
+			out = append(out, pod)
+		}
+	}
+	return out
+}
+
+// listSourcePods returns the existing pods generated for the given sources.
+func listSourcePods(ctx context.Context, c client.Client, namespace string, sources []tmv1.TmSource) ([]v1.Pod, error) {
+	var pods v1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(namespace), client.MatchingLabels{tmLabelAppKey: tmLabelAppValue}); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, tm := range sources {
+		names[tm.Name] = true
+	}
+
+	var owned []v1.Pod
+	for i := range pods.Items {
+		if names[desired.SourceOf(&pods.Items[i])] {
+			owned = append(owned, pods.Items[i])
+		}
+	}
+
+	return owned, nil
+}
+
+// applyPodActions creates and deletes pods to converge on the desired state.
+// Pods are created first so a replaced pod overlaps with its successor. Every
+// action is attempted, the first failure is returned.
+func applyPodActions(c client.Client, log logr.Logger, actions desired.Actions) error {
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = classifyAPIError(err)
+		}
+	}
+
+	for _, pod := range actions.Create {
+		log.Info("Creating pod " + pod.Name + "...")
+		if err := createPod(c, pod); err != nil {
+			log.Info("Could not create pod " + pod.Name + ".")
+			record(err)
+		}
+	}
+
+	for _, pod := range actions.Delete {
+		log.Info("Deleting pod " + pod.Name + "...")
+		if err := deletePod(c, pod); err != nil {
+			log.Info("Could not delete pod " + pod.Name + ".")
+			record(err)
+		}
+	}
+
+	return firstErr
 }
 
 func containsString(slice []string, s string) bool {
@@ -0,0 +1,429 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Placeholders are set on the objects before marshalling and swapped for
+// template expressions afterwards, so the yaml encoder never sees braces.
+const (
+	fullnamePlaceholder   = "__FULLNAME__"
+	namespacePlaceholder  = "__NAMESPACE__"
+	imagePlaceholder      = "__IMAGE__"
+	pullPolicyPlaceholder = "__PULL_POLICY__"
+	replicasPlaceholder   = "__REPLICAS__"
+	resourcesPlaceholder  = "__RESOURCES__"
+	membersPlaceholder    = "__MEMBERS_NAMESPACE__"
+	hubArgsPlaceholder    = "__HUB_ARGS__"
+)
+
+var chartReplacer = strings.NewReplacer(
+	fullnamePlaceholder, `{{ include "rocketlab-operator.fullname" . }}`,
+	namespacePlaceholder, `{{ .Release.Namespace }}`,
+	membersPlaceholder, `{{ .Values.hub.membersNamespace }}`,
+	imagePlaceholder, `"{{ .Values.image.repository }}:{{ .Values.image.tag }}"`,
+	pullPolicyPlaceholder, `{{ .Values.image.pullPolicy }}`,
+	replicasPlaceholder, `{{ .Values.replicaCount }}`,
+)
+
+const helpersTemplate = `{{/*
+Expand the name of the chart.
+*/}}
+{{- define "rocketlab-operator.name" -}}
+{{- default .Chart.Name .Values.nameOverride | trunc 63 | trimSuffix "-" }}
+{{- end }}
+
+{{/*
+Fully qualified app name, used as prefix of every object of the release.
+*/}}
+{{- define "rocketlab-operator.fullname" -}}
+{{- if .Values.fullnameOverride }}
+{{- .Values.fullnameOverride | trunc 40 | trimSuffix "-" }}
+{{- else }}
+{{- printf "%s-%s" .Release.Name (include "rocketlab-operator.name" .) | trunc 40 | trimSuffix "-" }}
+{{- end }}
+{{- end }}
+`
+
+const valuesTemplate = `# Default values for %[1]s.
+# Generated by hack/packaging from config/, edit the kustomize manifests instead.
+
+nameOverride: ""
+fullnameOverride: ""
+
+replicaCount: %[2]v
+
+image:
+  repository: %[3]s
+  tag: %[4]s
+  pullPolicy: IfNotPresent
+
+resources:
+%[5]s
+metrics:
+  # Create a prometheus-operator ServiceMonitor scraping the manager metrics.
+  serviceMonitor:
+    enabled: false
+
+webhook:
+  # Expose the admission webhook server of the manager.
+  enabled: false
+  certManager:
+    # Issue the webhook serving certificate with cert-manager.
+    enabled: true
+
+priorityClasses:
+  # Create the cluster wide PriorityClasses of prioritized source pods. Only one
+  # release per cluster should create them.
+  create: true
+
+hub:
+  # Run the manager as the hub of member clusters. It may only read the Secrets
+  # of membersNamespace, which must exist, where the member kubeconfigs are.
+  enabled: false
+  membersNamespace: rocketlab-members
+`
+
+func writeChart(m *manifests, dir, version string) error {
+	repository, tag := splitImage(m.image)
+	chart := fmt.Sprintf(`apiVersion: v2
+name: %s
+description: Operator managing rocketlab telemetry Sites and TmSources
+type: application
+version: %s
+appVersion: %q
+`, operatorName, version, tag)
+
+	deployment := chartDeployment(m)
+	replicas := nested(m.deployment, "spec")["replicas"]
+	if replicas == nil {
+		replicas = 1
+	}
+	resources := object{}
+	for _, c := range containers(m.deployment) {
+		container := c.(map[string]interface{})
+		if container["name"] == "manager" {
+			if r, ok := container["resources"].(map[string]interface{}); ok {
+				resources = r
+			}
+		}
+	}
+	resourcesYAML, err := yaml.Marshal(resources)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"Chart.yaml":                        chart,
+		"values.yaml":                       fmt.Sprintf(valuesTemplate, operatorName, replicas, repository, tag, indent(string(resourcesYAML), 2)),
+		"templates/_helpers.tpl":            helpersTemplate,
+		"templates/serviceaccount.yaml":     renderTemplate("", chartServiceAccount()),
+		"templates/rbac.yaml":               renderTemplate("", chartRBAC(m)...),
+		"templates/hub-rbac.yaml":           renderTemplate(".Values.hub.enabled", chartHubRBAC(m)...),
+		"templates/deployment.yaml":         renderTemplate("", deployment),
+		"templates/manager-config.yaml":     renderTemplate("", managerConfigMap(m, chartMeta(managerConfigName, true))),
+		"templates/metrics-service.yaml":    renderTemplate("", chartService(m.metricsService, "controller-manager-metrics-service")),
+		"templates/servicemonitor.yaml":     renderTemplate(".Values.metrics.serviceMonitor.enabled", chartMonitor(m)),
+		"templates/webhook-service.yaml":    renderTemplate(".Values.webhook.enabled", chartService(m.webhookService, "webhook-service")),
+		"templates/certificate.yaml":        renderTemplate(".Values.webhook.enabled .Values.webhook.certManager.enabled", chartCertificates(m)...),
+		"templates/validating-webhook.yaml": renderTemplate(".Values.webhook.enabled", chartWebhooks(m)),
+		"templates/priorityclasses.yaml":    renderTemplate(".Values.priorityClasses.create", m.priorityClasses...),
+	}
+	for name, data := range m.crdFiles {
+		files[filepath.Join("crds", name)] = string(data)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeFile(filepath.Join(dir, name), []byte(files[name])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitImage(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, "latest"
+	}
+	return image[:i], image[i+1:]
+}
+
+func indent(s string, n int) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = pad + l
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// renderTemplate marshals the objects, swaps the placeholders and optionally
+// wraps the document in an "if" on the given helm condition(s).
+func renderTemplate(condition string, objs ...object) string {
+	var docs []string
+	for _, obj := range objs {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			panic(err)
+		}
+		doc := expandBlock(string(data), "resources", resourcesPlaceholder, ".Values.resources")
+		docs = append(docs, expandItem(doc, hubArgsPlaceholder, ".Values.hub.enabled",
+			"--hub", "--hub-members-namespace="+membersPlaceholder))
+	}
+
+	out := chartReplacer.Replace(strings.Join(docs, "---\n"))
+	if condition == "" {
+		return out
+	}
+	if strings.Contains(condition, " ") {
+		condition = "and " + condition
+	}
+	return "{{- if " + condition + " }}\n" + out + "{{- end }}\n"
+}
+
+// expandBlock turns "key: placeholder" into a toYaml block of value at the
+// indentation of the key.
+func expandBlock(doc, key, placeholder, value string) string {
+	lines := strings.Split(doc, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) != key+": "+placeholder {
+			continue
+		}
+		n := len(l) - len(strings.TrimLeft(l, " "))
+		lines[i] = fmt.Sprintf("%s%s:\n%s{{- toYaml %s | nindent %d }}", strings.Repeat(" ", n), key, strings.Repeat(" ", n+2), value, n+2)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// expandItem turns the list item "- placeholder" into the given items, only
+// rendered when condition holds.
+func expandItem(doc, placeholder, condition string, items ...string) string {
+	lines := strings.Split(doc, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) != "- "+placeholder {
+			continue
+		}
+		pad := strings.Repeat(" ", len(l)-len(strings.TrimLeft(l, " ")))
+		block := []string{pad + "{{- if " + condition + " }}"}
+		for _, item := range items {
+			block = append(block, pad+"- "+item)
+		}
+		lines[i] = strings.Join(append(block, pad+"{{- end }}"), "\n")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func chartMeta(name string, namespaced bool) object {
+	meta := object{"name": fullnamePlaceholder + "-" + name}
+	if namespaced {
+		meta["namespace"] = namespacePlaceholder
+	}
+	return meta
+}
+
+func chartServiceAccount() object {
+	return object{
+		"apiVersion": "v1",
+		"kind":       "ServiceAccount",
+		"metadata":   chartMeta("controller-manager", true),
+	}
+}
+
+func chartSubjects() []interface{} {
+	return []interface{}{object{
+		"kind":      "ServiceAccount",
+		"name":      fullnamePlaceholder + "-controller-manager",
+		"namespace": namespacePlaceholder,
+	}}
+}
+
+func chartRBAC(m *manifests) []object {
+	binding := func(kind, name, role string) object {
+		roleKind := "ClusterRole"
+		if kind == "RoleBinding" {
+			roleKind = "Role"
+		}
+		return object{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       kind,
+			"metadata":   chartMeta(name, kind == "RoleBinding"),
+			"roleRef": object{
+				"apiGroup": "rbac.authorization.k8s.io",
+				"kind":     roleKind,
+				"name":     fullnamePlaceholder + "-" + role,
+			},
+			"subjects": chartSubjects(),
+		}
+	}
+	role := func(kind, name string, rules []interface{}) object {
+		return object{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       kind,
+			"metadata":   chartMeta(name, kind == "Role"),
+			"rules":      rules,
+		}
+	}
+
+	return []object{
+		role("ClusterRole", "manager-role", m.clusterRules),
+		binding("ClusterRoleBinding", "manager-rolebinding", "manager-role"),
+		role("Role", "leader-election-role", m.namespaceRules),
+		binding("RoleBinding", "leader-election-rolebinding", "leader-election-role"),
+		role("ClusterRole", "proxy-role", m.proxyRules),
+		binding("ClusterRoleBinding", "proxy-rolebinding", "proxy-role"),
+	}
+}
+
+// chartHubRBAC lets the manager read the member kubeconfigs of the members
+// namespace in hub mode.
+func chartHubRBAC(m *manifests) []object {
+	meta := func(name string) object {
+		return object{"name": fullnamePlaceholder + "-" + name, "namespace": membersPlaceholder}
+	}
+	return []object{
+		{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "Role",
+			"metadata":   meta("hub-members-role"),
+			"rules":      m.hubRules,
+		},
+		{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "RoleBinding",
+			"metadata":   meta("hub-members-rolebinding"),
+			"roleRef": object{
+				"apiGroup": "rbac.authorization.k8s.io",
+				"kind":     "Role",
+				"name":     fullnamePlaceholder + "-hub-members-role",
+			},
+			"subjects": chartSubjects(),
+		},
+	}
+}
+
+func chartDeployment(m *manifests) object {
+	deployment := deepCopy(m.deployment)
+	mergeContainers(deployment, deepCopy(m.webhookPatch))
+
+	deployment["metadata"] = chartMeta("controller-manager", true)
+	nested(deployment, "metadata")["labels"] = object{"control-plane": "controller-manager"}
+	nested(deployment, "spec")["replicas"] = replicasPlaceholder
+
+	podSpec := nested(deployment, "spec", "template", "spec")
+	podSpec["serviceAccountName"] = fullnamePlaceholder + "-controller-manager"
+	setManagerField(deployment, "image", imagePlaceholder)
+	setManagerField(deployment, "imagePullPolicy", pullPolicyPlaceholder)
+	setManagerField(deployment, "resources", resourcesPlaceholder)
+	for _, c := range containers(deployment) {
+		container := c.(map[string]interface{})
+		if args, ok := container["args"].([]interface{}); ok && container["name"] == "manager" {
+			container["args"] = append(args, hubArgsPlaceholder)
+		}
+	}
+
+	renameVolumes(podSpec, map[string]string{
+		"webhook-server-cert": fullnamePlaceholder + "-webhook-server-cert",
+		managerConfigName:     fullnamePlaceholder + "-" + managerConfigName,
+	})
+	// The serving certificate only exists when the webhook is enabled
+	volumes, _ := podSpec["volumes"].([]interface{})
+	for _, v := range volumes {
+		if secret, ok := v.(map[string]interface{})["secret"].(map[string]interface{}); ok {
+			secret["optional"] = true
+		}
+	}
+
+	return deployment
+}
+
+func chartService(svc object, name string) object {
+	svc = deepCopy(svc)
+	labels := nested(svc, "metadata")["labels"]
+	svc["metadata"] = chartMeta(name, true)
+	if labels != nil {
+		nested(svc, "metadata")["labels"] = labels
+	}
+	return svc
+}
+
+func chartMonitor(m *manifests) object {
+	monitor := deepCopy(m.monitor)
+	labels := nested(monitor, "metadata")["labels"]
+	monitor["metadata"] = chartMeta("controller-manager-metrics-monitor", true)
+	nested(monitor, "metadata")["labels"] = labels
+	return monitor
+}
+
+func chartCertificates(m *manifests) []object {
+	var out []object
+	for _, c := range m.certificates {
+		cert := deepCopy(c)
+		name, _ := nested(cert, "metadata")["name"].(string)
+		cert["metadata"] = chartMeta(name, true)
+
+		spec := nested(cert, "spec")
+		if issuer, ok := spec["issuerRef"].(map[string]interface{}); ok {
+			issuer["name"] = fullnamePlaceholder + "-" + issuer["name"].(string)
+		}
+		if _, ok := spec["secretName"]; ok {
+			spec["secretName"] = fullnamePlaceholder + "-webhook-server-cert"
+		}
+		if dnsNames, ok := spec["dnsNames"].([]interface{}); ok {
+			for i, d := range dnsNames {
+				s := strings.Replace(d.(string), "$(SERVICE_NAME)", fullnamePlaceholder+"-webhook-service", -1)
+				dnsNames[i] = strings.Replace(s, "$(SERVICE_NAMESPACE)", namespacePlaceholder, -1)
+			}
+		}
+		out = append(out, cert)
+	}
+	return out
+}
+
+// chartWebhooks points the webhook configuration at the webhook service of the
+// release. With cert-manager the CA bundle is injected from the certificate,
+// otherwise it is left to the user.
+func chartWebhooks(m *manifests) object {
+	config := deepCopy(m.webhooks)
+	name, _ := nested(config, "metadata")["name"].(string)
+	config["metadata"] = chartMeta(name, false)
+	nested(config, "metadata")["annotations"] = object{
+		"cert-manager.io/inject-ca-from": namespacePlaceholder + "/" + fullnamePlaceholder + "-serving-cert",
+	}
+
+	webhooks, _ := config["webhooks"].([]interface{})
+	for _, w := range webhooks {
+		clientConfig := nested(w.(map[string]interface{}), "clientConfig")
+		delete(clientConfig, "caBundle")
+		service := nested(clientConfig, "service")
+		service["name"] = fullnamePlaceholder + "-webhook-service"
+		service["namespace"] = namespacePlaceholder
+	}
+	return config
+}
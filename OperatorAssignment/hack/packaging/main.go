@@ -0,0 +1,481 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command packaging renders the Helm chart and the OLM bundle of the operator
+// from the kustomize manifests under config/, so both stay in sync with the
+// CRDs, RBAC and manager Deployment generated by controller-gen.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	operatorName = "rocketlab-operator"
+
+	// managerConfigName is the ConfigMap generated from the manager config file
+	// by config/manager/kustomization.yaml.
+	managerConfigName = "manager-config"
+	managerConfigFile = "controller_manager_config.yaml"
+)
+
+type object = map[string]interface{}
+
+// manifests holds the objects read from config/ which are shared by the chart
+// and the bundle.
+type manifests struct {
+	crds           []object
+	crdFiles       map[string][]byte
+	clusterRules   []interface{}
+	namespaceRules []interface{}
+	proxyRules     []interface{}
+	// hubRules are granted in the members namespace in hub mode only.
+	hubRules       []interface{}
+	deployment     object
+	managerConfig  string
+	webhookPatch   object
+	metricsService object
+	webhookService object
+	webhooks       object
+	// priorityClasses are cluster wide, their names are used as is by the
+	// operator and never prefixed.
+	priorityClasses []object
+	monitor         object
+	certificates    []object
+	samples         []object
+	image           string
+}
+
+func main() {
+	var configDir, chartDir, bundleDir, version, channel string
+	flag.StringVar(&configDir, "config", "config", "Directory holding the kustomize manifests.")
+	flag.StringVar(&chartDir, "chart", filepath.Join("charts", operatorName), "Output directory of the Helm chart.")
+	flag.StringVar(&bundleDir, "bundle", "bundle", "Output directory of the OLM bundle.")
+	flag.StringVar(&version, "version", "0.1.0", "Version of the chart and the bundle.")
+	flag.StringVar(&channel, "channel", "alpha", "OLM channel of the bundle.")
+	flag.Parse()
+
+	m, err := readManifests(configDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to read manifests:", err)
+		os.Exit(1)
+	}
+
+	if err := writeChart(m, chartDir, version); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to write helm chart:", err)
+		os.Exit(1)
+	}
+	if err := writeBundle(m, bundleDir, version, channel); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to write olm bundle:", err)
+		os.Exit(1)
+	}
+}
+
+func readManifests(dir string) (*manifests, error) {
+	m := &manifests{crdFiles: map[string][]byte{}}
+
+	patches, err := readJSONPatches(filepath.Join(dir, "crd"))
+	if err != nil {
+		return nil, err
+	}
+	crdFiles, err := filepath.Glob(filepath.Join(dir, "crd", "bases", "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(crdFiles)
+	for _, f := range crdFiles {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		objs, err := splitObjects(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if objs, data, err = patchObjects(objs, patches); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		m.crdFiles[filepath.Base(f)] = data
+		m.crds = append(m.crds, objs...)
+	}
+
+	if m.clusterRules, err = readRules(filepath.Join(dir, "rbac", "role.yaml")); err != nil {
+		return nil, err
+	}
+	if m.namespaceRules, err = readRules(filepath.Join(dir, "rbac", "leader_election_role.yaml")); err != nil {
+		return nil, err
+	}
+	if m.proxyRules, err = readRules(filepath.Join(dir, "rbac", "auth_proxy_role.yaml")); err != nil {
+		return nil, err
+	}
+	if m.hubRules, err = readRules(filepath.Join(dir, "hub", "members_role.yaml")); err != nil {
+		return nil, err
+	}
+
+	if m.deployment, err = readKind(filepath.Join(dir, "manager", "manager.yaml"), "Deployment"); err != nil {
+		return nil, err
+	}
+	proxyPatch, err := readKind(filepath.Join(dir, "default", "manager_auth_proxy_patch.yaml"), "Deployment")
+	if err != nil {
+		return nil, err
+	}
+	mergeContainers(m.deployment, proxyPatch)
+	if m.webhookPatch, err = readKind(filepath.Join(dir, "default", "manager_webhook_patch.yaml"), "Deployment"); err != nil {
+		return nil, err
+	}
+
+	config, err := ioutil.ReadFile(filepath.Join(dir, "manager", managerConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	m.managerConfig = string(config)
+
+	if m.image, err = readImage(filepath.Join(dir, "manager", "kustomization.yaml")); err != nil {
+		return nil, err
+	}
+	setManagerField(m.deployment, "image", m.image)
+
+	if m.metricsService, err = readKind(filepath.Join(dir, "rbac", "auth_proxy_service.yaml"), "Service"); err != nil {
+		return nil, err
+	}
+	if m.webhookService, err = readKind(filepath.Join(dir, "webhook", "service.yaml"), "Service"); err != nil {
+		return nil, err
+	}
+	if m.webhooks, err = readKind(filepath.Join(dir, "webhook", "manifests.yaml"), "ValidatingWebhookConfiguration"); err != nil {
+		return nil, err
+	}
+	if m.monitor, err = readKind(filepath.Join(dir, "prometheus", "monitor.yaml"), "ServiceMonitor"); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "certmanager", "certificate.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if m.certificates, err = splitObjects(data); err != nil {
+		return nil, err
+	}
+
+	if data, err = ioutil.ReadFile(filepath.Join(dir, "priority", "priorityclasses.yaml")); err != nil {
+		return nil, err
+	}
+	if m.priorityClasses, err = splitObjects(data); err != nil {
+		return nil, err
+	}
+
+	sampleFiles, err := filepath.Glob(filepath.Join(dir, "samples", "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(sampleFiles)
+	for _, f := range sampleFiles {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		objs, err := splitObjects(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		m.samples = append(m.samples, objs...)
+	}
+
+	return m, nil
+}
+
+// splitObjects decodes a multi document yaml file, skipping empty documents.
+func splitObjects(data []byte) ([]object, error) {
+	var objs []object
+	for _, doc := range bytes.Split(data, []byte("\n---")) {
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		var obj object
+		if err := yaml.Unmarshal(doc, &obj); err != nil {
+			return nil, err
+		}
+		if obj != nil {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+// readJSONPatches reads the JSON6902 patches of a kustomization by the name of
+// the object they target.
+func readJSONPatches(dir string) (map[string][]jsonpatch.Patch, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var k struct {
+		PatchesJSON6902 []struct {
+			Target struct {
+				Name string `json:"name"`
+			} `json:"target"`
+			Path string `json:"path"`
+		} `json:"patchesJson6902"`
+	}
+	if err := yaml.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+	patches := map[string][]jsonpatch.Patch{}
+	for _, p := range k.PatchesJSON6902 {
+		data, err := ioutil.ReadFile(filepath.Join(dir, p.Path))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Path, err)
+		}
+		patch, err := jsonpatch.DecodePatch(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Path, err)
+		}
+		patches[p.Target.Name] = append(patches[p.Target.Name], patch)
+	}
+	return patches, nil
+}
+
+// patchObjects applies the patches targeting the given objects and renders
+// them back as a multi document yaml file.
+func patchObjects(objs []object, patches map[string][]jsonpatch.Patch) ([]object, []byte, error) {
+	var out []byte
+	for i, obj := range objs {
+		name, _ := nested(obj, "metadata")["name"].(string)
+		for _, patch := range patches[name] {
+			data, err := json.Marshal(obj)
+			if err != nil {
+				return nil, nil, err
+			}
+			if data, err = patch.Apply(data); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", name, err)
+			}
+			obj = object{}
+			if err := json.Unmarshal(data, &obj); err != nil {
+				return nil, nil, err
+			}
+		}
+		objs[i] = obj
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = append(append(out, "\n---\n"...), data...)
+	}
+	return objs, out, nil
+}
+
+func readKind(path, kind string) (object, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := splitObjects(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, obj := range objs {
+		if obj["kind"] == kind {
+			return obj, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no %s found", path, kind)
+}
+
+func readRules(path string) ([]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := splitObjects(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var rules []interface{}
+	for _, obj := range objs {
+		if r, ok := obj["rules"].([]interface{}); ok {
+			rules = append(rules, r...)
+		}
+	}
+	return rules, nil
+}
+
+// readImage resolves the manager image from the kustomize images override.
+func readImage(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var k struct {
+		Images []struct {
+			Name    string `json:"name"`
+			NewName string `json:"newName"`
+			NewTag  string `json:"newTag"`
+		} `json:"images"`
+	}
+	if err := yaml.Unmarshal(data, &k); err != nil {
+		return "", err
+	}
+	for _, img := range k.Images {
+		if img.Name == "controller" {
+			return img.NewName + ":" + img.NewTag, nil
+		}
+	}
+	return "controller:latest", nil
+}
+
+// nested returns the map found under the given keys, creating missing levels.
+func nested(obj object, keys ...string) object {
+	current := obj
+	for _, k := range keys {
+		next, ok := current[k].(map[string]interface{})
+		if !ok {
+			next = object{}
+			current[k] = next
+		}
+		current = next
+	}
+	return current
+}
+
+func containers(deployment object) []interface{} {
+	c, _ := nested(deployment, "spec", "template", "spec")["containers"].([]interface{})
+	return c
+}
+
+// mergeKeys are the strategic merge keys of the pod spec lists patched by
+// config/default, other lists are replaced.
+var mergeKeys = map[string]string{
+	"containers":   "name",
+	"env":          "name",
+	"ports":        "containerPort",
+	"volumeMounts": "mountPath",
+	"volumes":      "name",
+}
+
+// mergeContainers applies the pod spec of a strategic merge patch: fields of
+// known containers are overridden, new containers and list items are appended.
+func mergeContainers(deployment, patch object) {
+	podSpec := nested(deployment, "spec", "template", "spec")
+	for k, v := range nested(patch, "spec", "template", "spec") {
+		podSpec[k] = mergeValue(k, podSpec[k], v)
+	}
+}
+
+func mergeValue(key string, current, patch interface{}) interface{} {
+	mergeKey, ok := mergeKeys[key]
+	currentList, isList := current.([]interface{})
+	patchList, _ := patch.([]interface{})
+	if !ok || !isList {
+		return patch
+	}
+	for _, p := range patchList {
+		patchItem := p.(map[string]interface{})
+		merged := false
+		for _, c := range currentList {
+			item := c.(map[string]interface{})
+			if item[mergeKey] == patchItem[mergeKey] {
+				for k, v := range patchItem {
+					item[k] = mergeValue(k, item[k], v)
+				}
+				merged = true
+			}
+		}
+		if !merged {
+			currentList = append(currentList, patchItem)
+		}
+	}
+	return currentList
+}
+
+func setManagerField(deployment object, field string, value interface{}) {
+	for _, c := range containers(deployment) {
+		container := c.(map[string]interface{})
+		if container["name"] == "manager" {
+			container[field] = value
+		}
+	}
+}
+
+// managerConfigMap is the ConfigMap holding the manager config file.
+func managerConfigMap(m *manifests, meta object) object {
+	return object{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   meta,
+		"data":       object{managerConfigFile: m.managerConfig},
+	}
+}
+
+// renameVolumes points the secret and ConfigMap volumes of a pod spec to the
+// given names, keyed by the names found in config/.
+func renameVolumes(podSpec object, names map[string]string) {
+	volumes, _ := podSpec["volumes"].([]interface{})
+	for _, v := range volumes {
+		volume := v.(map[string]interface{})
+		if secret, ok := volume["secret"].(map[string]interface{}); ok {
+			if name, ok := names[secret["secretName"].(string)]; ok {
+				secret["secretName"] = name
+			}
+		}
+		if configMap, ok := volume["configMap"].(map[string]interface{}); ok {
+			if name, ok := names[configMap["name"].(string)]; ok {
+				configMap["name"] = name
+			}
+		}
+	}
+}
+
+// deepCopy returns a copy of obj which can be mutated freely.
+func deepCopy(obj object) object {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	var out object
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// title turns a json field path into a display name, e.g. metricname -> Metricname.
+func title(path string) string {
+	parts := strings.Split(path, ".")
+	last := parts[len(parts)-1]
+	if last == "" {
+		return ""
+	}
+	return strings.ToUpper(last[:1]) + last[1:]
+}
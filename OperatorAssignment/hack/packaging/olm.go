@@ -0,0 +1,241 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	bundleMediaType    = "registry+v1"
+	bundleManifestsDir = "manifests"
+	bundleMetadataDir  = "metadata"
+
+	serviceAccountName      = operatorName + "-controller-manager"
+	bundleManagerConfigName = operatorName + "-" + managerConfigName
+
+	descriptorPrefix     = "urn:alm:descriptor:"
+	descriptorBoolean    = descriptorPrefix + "com.tectonic.ui:booleanSwitch"
+	descriptorText       = descriptorPrefix + "com.tectonic.ui:text"
+	descriptorNumber     = descriptorPrefix + "com.tectonic.ui:number"
+	descriptorConditions = descriptorPrefix + "io.kubernetes.conditions"
+)
+
+func writeBundle(m *manifests, dir, version, channel string) error {
+	csv, err := clusterServiceVersion(m, version)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(csv)
+	if err != nil {
+		return err
+	}
+	manifestsDir := filepath.Join(dir, bundleManifestsDir)
+	if err := writeFile(filepath.Join(manifestsDir, operatorName+".clusterserviceversion.yaml"), data); err != nil {
+		return err
+	}
+	for name, crd := range m.crdFiles {
+		if err := writeFile(filepath.Join(manifestsDir, name), crd); err != nil {
+			return err
+		}
+	}
+	if data, err = yaml.Marshal(managerConfigMap(m, object{"name": bundleManagerConfigName})); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(manifestsDir, bundleManagerConfigName+".configmap.yaml"), data); err != nil {
+		return err
+	}
+	for _, pc := range m.priorityClasses {
+		if data, err = yaml.Marshal(pc); err != nil {
+			return err
+		}
+		name := nested(pc, "metadata")["name"].(string)
+		if err := writeFile(filepath.Join(manifestsDir, name+".priorityclass.yaml"), data); err != nil {
+			return err
+		}
+	}
+
+	labels := [][2]string{
+		{"operators.operatorframework.io.bundle.mediatype.v1", bundleMediaType},
+		{"operators.operatorframework.io.bundle.manifests.v1", bundleManifestsDir + "/"},
+		{"operators.operatorframework.io.bundle.metadata.v1", bundleMetadataDir + "/"},
+		{"operators.operatorframework.io.bundle.package.v1", operatorName},
+		{"operators.operatorframework.io.bundle.channels.v1", channel},
+		{"operators.operatorframework.io.bundle.channel.default.v1", channel},
+	}
+
+	annotations := "annotations:\n"
+	dockerfile := "FROM scratch\n\n"
+	for _, l := range labels {
+		annotations += fmt.Sprintf("  %s: %s\n", l[0], l[1])
+		dockerfile += fmt.Sprintf("LABEL %s=%s\n", l[0], l[1])
+	}
+	dockerfile += fmt.Sprintf("\nCOPY %s/ /%s/\nCOPY %s/ /%s/\n", bundleManifestsDir, bundleManifestsDir, bundleMetadataDir, bundleMetadataDir)
+
+	if err := writeFile(filepath.Join(dir, bundleMetadataDir, "annotations.yaml"), []byte(annotations)); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, "bundle.Dockerfile"), []byte(dockerfile))
+}
+
+func clusterServiceVersion(m *manifests, version string) (object, error) {
+	var owned []interface{}
+	kinds := map[interface{}]bool{}
+	for _, crd := range m.crds {
+		owned = append(owned, ownedCRD(crd))
+		kinds[nested(crd, "spec", "names")["kind"]] = true
+	}
+
+	// Only the custom resources are examples, samples also ship their ConfigMaps
+	var samples []object
+	for _, sample := range m.samples {
+		if kinds[sample["kind"]] {
+			samples = append(samples, sample)
+		}
+	}
+	examples, err := json.MarshalIndent(samples, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	deployment := deepCopy(m.deployment)
+	podSpec := nested(deployment, "spec", "template", "spec")
+	podSpec["serviceAccountName"] = serviceAccountName
+	renameVolumes(podSpec, map[string]string{managerConfigName: bundleManagerConfigName})
+
+	// OLM creates the webhook configuration and mounts its serving certificate
+	// in the default directory of the webhook server
+	var webhooks []interface{}
+	for _, w := range m.webhooks["webhooks"].([]interface{}) {
+		webhook := w.(map[string]interface{})
+		webhooks = append(webhooks, object{
+			"type":                    "ValidatingAdmissionWebhook",
+			"generateName":            webhook["name"],
+			"deploymentName":          serviceAccountName,
+			"containerPort":           443,
+			"targetPort":              9443,
+			"webhookPath":             nested(webhook, "clientConfig", "service")["path"],
+			"failurePolicy":           webhook["failurePolicy"],
+			"sideEffects":             "None",
+			"admissionReviewVersions": []interface{}{"v1beta1"},
+			"rules":                   webhook["rules"],
+		})
+	}
+
+	return object{
+		"apiVersion": "operators.coreos.com/v1alpha1",
+		"kind":       "ClusterServiceVersion",
+		"metadata": object{
+			"name":      operatorName + ".v" + version,
+			"namespace": "placeholder",
+			"annotations": object{
+				"alm-examples":   string(examples),
+				"capabilities":   "Basic Install",
+				"categories":     "Monitoring",
+				"containerImage": m.image,
+			},
+		},
+		"spec": object{
+			"displayName": "Rocketlab Operator",
+			"description": "Runs a rocket-source pod publishing its metric to NATS for every TmSource of an enabled Site.",
+			"version":     version,
+			"maturity":    "alpha",
+			"provider":    object{"name": "rocketlab"},
+			"keywords":    []interface{}{"rocketlab", "telemetry", "nats"},
+			"installModes": []interface{}{
+				object{"type": "OwnNamespace", "supported": true},
+				object{"type": "SingleNamespace", "supported": true},
+				object{"type": "MultiNamespace", "supported": false},
+				object{"type": "AllNamespaces", "supported": true},
+			},
+			"customresourcedefinitions": object{"owned": owned},
+			"webhookdefinitions":        webhooks,
+			"install": object{
+				"strategy": "deployment",
+				"spec": object{
+					"clusterPermissions": []interface{}{object{
+						"serviceAccountName": serviceAccountName,
+						"rules":              append(append([]interface{}{}, m.clusterRules...), m.proxyRules...),
+					}},
+					"permissions": []interface{}{object{
+						"serviceAccountName": serviceAccountName,
+						"rules":              m.namespaceRules,
+					}},
+					"deployments": []interface{}{object{
+						"name": serviceAccountName,
+						"spec": deployment["spec"],
+					}},
+				},
+			},
+		},
+	}, nil
+}
+
+// ownedCRD describes a CRD for the OLM console, with a descriptor for every
+// top level spec and status field of its schema.
+func ownedCRD(crd object) object {
+	spec := nested(crd, "spec")
+	names := nested(spec, "names")
+	schema := nested(spec, "validation", "openAPIV3Schema")
+	properties := nested(schema, "properties")
+
+	return object{
+		"name":              nested(crd, "metadata")["name"],
+		"version":           spec["version"],
+		"kind":              names["kind"],
+		"displayName":       names["kind"],
+		"description":       schema["description"],
+		"resources":         []interface{}{object{"kind": "Pod", "version": "v1"}},
+		"specDescriptors":   descriptors(nested(properties, "spec")),
+		"statusDescriptors": descriptors(nested(properties, "status")),
+	}
+}
+
+func descriptors(schema object) []interface{} {
+	properties := nested(schema, "properties")
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out []interface{}
+	for _, k := range keys {
+		prop := properties[k].(map[string]interface{})
+		d := object{"path": k, "displayName": title(k)}
+		if desc, ok := prop["description"]; ok {
+			d["description"] = desc
+		}
+		switch {
+		case k == "conditions":
+			d["x-descriptors"] = []interface{}{descriptorConditions}
+		case prop["type"] == "boolean":
+			d["x-descriptors"] = []interface{}{descriptorBoolean}
+		case prop["type"] == "integer" || prop["type"] == "number":
+			d["x-descriptors"] = []interface{}{descriptorNumber}
+		case prop["type"] == "string":
+			d["x-descriptors"] = []interface{}{descriptorText}
+		}
+		out = append(out, d)
+	}
+	return out
+}
@@ -17,17 +17,30 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
 	"github.com/maxthom/rocketlab-controller/controllers"
+	"github.com/maxthom/rocketlab-controller/pkg/admission"
+	"github.com/maxthom/rocketlab-controller/pkg/audit"
+	"github.com/maxthom/rocketlab-controller/pkg/config"
+	"github.com/maxthom/rocketlab-controller/pkg/federation"
+	"github.com/maxthom/rocketlab-controller/pkg/flow"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -44,49 +57,162 @@ func init() {
 }
 
 func main() {
-	var metricsAddr string
-	var enableLeaderElection bool
-	flag.StringVar(&metricsAddr, "metrics-addr", ":32997", "The address the metric endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
-		"Enable leader election for controller manager. "+
-			"Enabling this will ensure there is only one active controller manager.")
+	var configFile string
+	managerConfig := config.Default()
+	flag.StringVar(&configFile, "config", "",
+		"The ControllerManagerConfig file of the manager options. "+
+			"Flags given on the command line take precedence over the file.")
+	managerConfig.BindFlags(flag.CommandLine)
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		Port:               9443,
-		LeaderElection:     enableLeaderElection,
-		LeaderElectionID:   "8ec726d7.rocketlab.global",
-	})
+	if configFile != "" {
+		if err := managerConfig.LoadFile(configFile, flag.CommandLine); err != nil {
+			setupLog.Error(err, "unable to load the manager config", "file", configFile)
+			os.Exit(1)
+		}
+	}
+	if err := managerConfig.Validate(); err != nil {
+		setupLog.Error(err, "invalid manager config")
+		os.Exit(1)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), managerConfig.Options(scheme))
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	if err = (&controllers.SiteReconciler{
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		setupLog.Error(err, "unable to set up health check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("informers", cacheSynced(mgr.GetCache())); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
+
+	var auditSinks audit.MultiSink
+	if managerConfig.Audit.ConfigMap != "" {
+		namespace, name := managerConfig.Audit.ConfigMapName()
+		auditSinks = append(auditSinks, &audit.ConfigMapSink{Client: mgr.GetClient(), Namespace: namespace, Name: name})
+	}
+	if managerConfig.Audit.File != "" {
+		auditSinks = append(auditSinks, &audit.FileSink{Path: managerConfig.Audit.File})
+	}
+
+	if managerConfig.Hub.Enabled {
+		// The hub propagates the sites to its members, which run their pods
+		members, err := federation.NewMembers(mgr, managerConfig.Hub.MembersNamespace)
+		if err != nil {
+			setupLog.Error(err, "unable to read the member secrets")
+			os.Exit(1)
+		}
+		if err = (&controllers.FederationReconciler{
+			Client:       mgr.GetClient(),
+			Log:          ctrl.Log.WithName("controllers").WithName("Federation"),
+			Scheme:       mgr.GetScheme(),
+			Members:      members,
+			SyncInterval: managerConfig.Hub.SyncInterval.Duration,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Federation")
+			os.Exit(1)
+		}
+	} else {
+		setupSourceControllers(mgr, managerConfig, auditSinks)
+	}
+	// The webhook server only starts with a serving certificate, which is
+	// mounted when the webhook is deployed
+	if _, err := os.Stat(filepath.Join(webhookCertDir(managerConfig), "tls.crt")); err == nil {
+		if err = (&admission.TmSourceValidator{
+			Client: mgr.GetClient(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "TmSource")
+			os.Exit(1)
+		}
+	} else {
+		setupLog.Info("no webhook serving certificate, admission webhooks are disabled")
+	}
+	// +kubebuilder:scaffold:builder
+
+	setupLog.Info("starting manager")
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		setupLog.Error(err, "problem running manager")
+		os.Exit(1)
+	}
+}
+
+// setupSourceControllers adds the site and tmsource reconcilers, the flow
+// probe and the pod garbage collector, which run the source pods of the
+// cluster.
+func setupSourceControllers(mgr ctrl.Manager, managerConfig *config.ControllerManagerConfig, auditSinks audit.MultiSink) {
+	var flowProbe *flow.Probe
+	if managerConfig.Flow.NatsURL != "" {
+		flowProbe = &flow.Probe{
+			URL:        managerConfig.Flow.NatsURL,
+			StaleAfter: managerConfig.Flow.StaleAfter.Duration,
+			Log:        ctrl.Log.WithName("flow"),
+		}
+		if err := mgr.Add(flowProbe); err != nil {
+			setupLog.Error(err, "unable to add the flow probe")
+			os.Exit(1)
+		}
+		metrics.Registry.MustRegister(flowProbe)
+	}
+
+	if err := (&controllers.SiteReconciler{
 		Client: mgr.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("Site"),
 		Scheme: mgr.GetScheme(),
+		Audit:  auditSinks,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Site")
 		os.Exit(1)
 	}
-	if err = (&controllers.TmSourceReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("TmSource"),
-		Scheme: mgr.GetScheme(),
+	if err := (&controllers.TmSourceReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("TmSource"),
+		Scheme:      mgr.GetScheme(),
+		Flow:        flowProbe,
+		MissingSite: managerConfig.MissingSite,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "TmSource")
 		os.Exit(1)
 	}
-	// +kubebuilder:scaffold:builder
+	if managerConfig.PodGC.Interval.Duration > 0 {
+		if err := (&controllers.PodGarbageCollector{
+			Client:      mgr.GetClient(),
+			Log:         ctrl.Log.WithName("controllers").WithName("PodGC"),
+			Interval:    managerConfig.PodGC.Interval.Duration,
+			MinAge:      managerConfig.PodGC.MinAge.Duration,
+			DryRun:      managerConfig.PodGC.DryRun,
+			MissingSite: managerConfig.MissingSite,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create pod garbage collector")
+			os.Exit(1)
+		}
+	}
+}
 
-	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
+// cacheSynced reports ready once the informers of the manager are synced.
+// Standby replicas sync their cache too, so they are ready to take the lead.
+func cacheSynced(c cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx.Done()) {
+			return errors.New("informers not synced")
+		}
+		return nil
+	}
+}
+
+// webhookCertDir returns the directory the webhook server reads its
+// certificate from.
+func webhookCertDir(c *config.ControllerManagerConfig) string {
+	if c.Webhook.CertDir != "" {
+		return c.Webhook.CertDir
 	}
+	return filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
 }
@@ -0,0 +1,114 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package admission holds the admission webhooks of the operator.
+package admission
+
+import (
+	"context"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+)
+
+// TmSourceValidatorPath is where the webhook server serves TmSourceValidator.
+const TmSourceValidatorPath = "/validate-tm-rocketlab-global-v1-tmsource"
+
+// +kubebuilder:webhook:path=/validate-tm-rocketlab-global-v1-tmsource,mutating=false,failurePolicy=ignore,groups=tm.rocketlab.global,resources=tmsources,verbs=create;update,versions=v1,name=vtmsource.rocketlab.global
+
+// TmSourceValidator rejects the tmsources which do not fit in the limits of
+// their site. The reconciler holds over quota tmsources anyway, the webhook
+// only reports it at apply time.
+type TmSourceValidator struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+func (v *TmSourceValidator) SetupWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(TmSourceValidatorPath, &webhook.Admission{Handler: v})
+	return nil
+}
+
+// InjectDecoder is called by the webhook server.
+func (v *TmSourceValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+func (v *TmSourceValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var tm tmv1.TmSource
+	if err := v.decoder.Decode(req, &tm); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// Tmsources of a site catalog are limited by the reconciler only, the
+	// site controller must always be able to write them
+	if metav1.GetControllerOf(&tm) != nil {
+		return admission.Allowed("")
+	}
+	// Updates not changing what the tmsource costs are always allowed
+	if len(req.OldObject.Raw) > 0 {
+		var old tmv1.TmSource
+		if err := v.decoder.DecodeRaw(req.OldObject, &old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if old.Spec.Site == tm.Spec.Site && equality.Semantic.DeepEqual(old.Spec.Resources, tm.Spec.Resources) {
+			return admission.Allowed("")
+		}
+	}
+
+	var site tmv1.Site
+	if err := v.Client.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: tm.Spec.Site}, &site); err != nil {
+		if apierrors.IsNotFound(err) {
+			return admission.Allowed("")
+		}
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if site.Spec.Limits == nil {
+		return admission.Allowed("")
+	}
+	// The resources of the tmsources may default to the template of the site
+	if ref := site.Spec.TemplateRef; ref != nil {
+		var template tmv1.SiteTemplate
+		if err := v.Client.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: ref.Name}, &template); err != nil {
+			if apierrors.IsNotFound(err) {
+				return admission.Allowed("")
+			}
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		desired.ApplyTemplate(&site, &template)
+	}
+
+	var sources tmv1.TmSourceList
+	if err := v.Client.List(ctx, &sources, client.InNamespace(req.Namespace)); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	// The namespace may be defaulted from the request on create
+	tm.Namespace = req.Namespace
+	if reason := desired.Exceeds(&site, sources.Items, tm); reason != "" {
+		return admission.Denied(reason)
+	}
+	return admission.Allowed("")
+}
@@ -0,0 +1,118 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func source(name, site string) *tmv1.TmSource {
+	return &tmv1.TmSource{
+		TypeMeta:   metav1.TypeMeta{APIVersion: tmv1.GroupVersion.String(), Kind: "TmSource"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       tmv1.TmSourceSpec{Site: site, MetricName: "rock"},
+	}
+}
+
+func request(t *testing.T, tm, old *tmv1.TmSource) admission.Request {
+	raw := func(obj *tmv1.TmSource) runtime.RawExtension {
+		if obj == nil {
+			return runtime.RawExtension{}
+		}
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runtime.RawExtension{Raw: data}
+	}
+	operation := admissionv1beta1.Create
+	if old != nil {
+		operation = admissionv1beta1.Update
+	}
+	return admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+		Operation: operation,
+		Namespace: "default",
+		Name:      tm.Name,
+		Object:    raw(tm),
+		OldObject: raw(old),
+	}}
+}
+
+func TestTmSourceValidator(t *testing.T) {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+	_ = tmv1.AddToScheme(s)
+
+	one := int32(1)
+	cpu := resource.MustParse("30m")
+	site := &tmv1.Site{
+		ObjectMeta: metav1.ObjectMeta{Name: "site-lc-1", Namespace: "default"},
+		Spec:       tmv1.SiteSpec{Enabled: true, Limits: &tmv1.SiteLimits{MaxSources: &one, CPU: &cpu}},
+	}
+	free := &tmv1.Site{
+		ObjectMeta: metav1.ObjectMeta{Name: "site-lc-2", Namespace: "default"},
+		Spec:       tmv1.SiteSpec{Enabled: true},
+	}
+	existing := source("tm-1", "site-lc-1")
+
+	decoder, err := admission.NewDecoder(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &TmSourceValidator{Client: fake.NewFakeClientWithScheme(s, site, free, existing)}
+	if err := v.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	bigger := source("tm-1", "site-lc-1")
+	bigger.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("50m")}
+	renamed := source("tm-1", "site-lc-1")
+	renamed.Spec.MetricName = "paper"
+
+	tests := []struct {
+		name    string
+		req     admission.Request
+		allowed bool
+	}{
+		{"over max sources", request(t, source("tm-2", "site-lc-1"), nil), false},
+		{"site without limits", request(t, source("tm-2", "site-lc-2"), nil), true},
+		{"missing site", request(t, source("tm-2", "site-missing"), nil), true},
+		{"update over cpu", request(t, bigger, existing), false},
+		{"update keeping the resources", request(t, renamed, existing), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := v.Handle(context.Background(), tt.req)
+			if resp.Allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v (%v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit records the mode transitions of sites, in their status and
+// optionally in a sink for offline review.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+)
+
+// HistoryLimit is the number of transitions kept in the status of a site.
+const HistoryLimit = 10
+
+// Sink stores the transitions of sites outside of the cluster state.
+type Sink interface {
+	Record(ctx context.Context, site *tmv1.Site, transition tmv1.SiteTransition) error
+}
+
+// MultiSink records the transitions to each of its sinks.
+type MultiSink []Sink
+
+func (m MultiSink) Record(ctx context.Context, site *tmv1.Site, transition tmv1.SiteTransition) error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.Record(ctx, site, transition); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Entry is a transition as written by the sinks, one JSON object per line.
+type Entry struct {
+	Namespace string `json:"namespace"`
+	Site      string `json:"site"`
+	tmv1.SiteTransition
+}
+
+// Line returns the JSON line of a transition, newline included.
+func Line(site *tmv1.Site, transition tmv1.SiteTransition) ([]byte, error) {
+	data, err := json.Marshal(Entry{Namespace: site.Namespace, Site: site.Name, SiteTransition: transition})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Observe returns the transition from the mode last observed in the status of
+// a site to its current mode, nil when the mode did not change.
+func Observe(site *tmv1.Site, now metav1.Time) *tmv1.SiteTransition {
+	mode := desired.Mode(site)
+	if site.Status.Mode == mode {
+		return nil
+	}
+	return &tmv1.SiteTransition{
+		Time:    now,
+		From:    site.Status.Mode,
+		To:      mode,
+		Reason:  site.Annotations[tmv1.AnnotationReason],
+		Manager: FieldManager(site),
+	}
+}
+
+// Append adds a transition to a history, dropping the oldest ones over
+// HistoryLimit.
+func Append(history []tmv1.SiteTransition, transition tmv1.SiteTransition) []tmv1.SiteTransition {
+	history = append(history, transition)
+	if len(history) > HistoryLimit {
+		history = append([]tmv1.SiteTransition(nil), history[len(history)-HistoryLimit:]...)
+	}
+	return history
+}
+
+// FieldManager returns the manager which last wrote spec.mode or spec.enabled
+// of a site, from its managed fields. It is empty when the API server does not
+// track them.
+func FieldManager(site *tmv1.Site) string {
+	manager := ""
+	var latest *metav1.Time
+	for _, entry := range site.ManagedFields {
+		if entry.FieldsV1 == nil || !ownsMode(entry.FieldsV1.Raw) {
+			continue
+		}
+		// Entries without time are older than any timed one
+		if latest == nil || (entry.Time != nil && !entry.Time.Before(latest)) {
+			manager, latest = entry.Manager, entry.Time
+		}
+	}
+	return manager
+}
+
+// ownsMode reports whether a FieldsV1 set holds spec.mode or spec.enabled.
+func ownsMode(raw []byte) bool {
+	var fields struct {
+		Spec map[string]json.RawMessage `json:"f:spec"`
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return false
+	}
+	_, mode := fields.Spec["f:mode"]
+	_, enabled := fields.Spec["f:enabled"]
+	return mode || enabled
+}
@@ -0,0 +1,71 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func managedFields(manager string, minutes int, fields string) metav1.ManagedFieldsEntry {
+	t := metav1.NewTime(time.Date(2020, 1, 1, 0, minutes, 0, 0, time.UTC))
+	return metav1.ManagedFieldsEntry{
+		Manager:    manager,
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		Time:       &t,
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(fields)},
+	}
+}
+
+func TestObserve(t *testing.T) {
+	site := &tmv1.Site{ObjectMeta: metav1.ObjectMeta{Name: "site-lc-1", Namespace: "default"}}
+	site.Status.Mode = tmv1.SiteModeDisabled
+	if got := Observe(site, metav1.Now()); got != nil {
+		t.Errorf("Observe() = %+v without a change", got)
+	}
+
+	site.Spec.Mode = tmv1.SiteModeDegraded
+	site.Annotations = map[string]string{tmv1.AnnotationReason: "network incident"}
+	site.ManagedFields = []metav1.ManagedFieldsEntry{
+		managedFields("kubectl", 1, `{"f:spec":{".":{},"f:enabled":{}}}`),
+		managedFields("rocketlab-controller", 3, `{"f:status":{"f:mode":{}}}`),
+		managedFields("ops-console", 2, `{"f:spec":{"f:mode":{}}}`),
+	}
+	got := Observe(site, metav1.Now())
+	if got == nil {
+		t.Fatal("Observe() = nil, want a transition")
+	}
+	if got.From != tmv1.SiteModeDisabled || got.To != tmv1.SiteModeDegraded || got.Reason != "network incident" || got.Manager != "ops-console" {
+		t.Errorf("Observe() = %+v", got)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	var history []tmv1.SiteTransition
+	for i := 0; i < HistoryLimit+3; i++ {
+		history = Append(history, tmv1.SiteTransition{Reason: fmt.Sprint(i)})
+	}
+	if len(history) != HistoryLimit || history[0].Reason != "3" || history[HistoryLimit-1].Reason != fmt.Sprint(HistoryLimit+2) {
+		t.Errorf("Append() kept %d transitions from %s", len(history), history[0].Reason)
+	}
+}
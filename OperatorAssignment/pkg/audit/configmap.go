@@ -0,0 +1,100 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+const (
+	// ConfigMapKey holds the transitions in the ConfigMap of a ConfigMapSink.
+	ConfigMapKey = "transitions.jsonl"
+	// DefaultConfigMapLines bounds the ConfigMap below its 1MiB size limit.
+	DefaultConfigMapLines = 1000
+)
+
+// ConfigMapSink appends the transitions to a ConfigMap, created when missing.
+// Only the last MaxLines transitions are kept.
+type ConfigMapSink struct {
+	Client client.Client
+	// Namespace of the ConfigMap, the namespace of each site when empty.
+	Namespace string
+	Name      string
+	MaxLines  int
+}
+
+func (s *ConfigMapSink) Record(ctx context.Context, site *tmv1.Site, transition tmv1.SiteTransition) error {
+	line, err := Line(site, transition)
+	if err != nil {
+		return err
+	}
+	key := client.ObjectKey{Namespace: s.Namespace, Name: s.Name}
+	if key.Namespace == "" {
+		key.Namespace = site.Namespace
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cm v1.ConfigMap
+		err := s.Client.Get(ctx, key, &cm)
+		if apierrors.IsNotFound(err) {
+			cm = v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+				Data:       map[string]string{ConfigMapKey: string(line)},
+			}
+			err = s.Client.Create(ctx, &cm)
+			if apierrors.IsAlreadyExists(err) {
+				// Created meanwhile, retry as a conflict
+				return apierrors.NewConflict(v1.Resource("configmaps"), key.Name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[ConfigMapKey] = s.trim(cm.Data[ConfigMapKey] + string(line))
+		return s.Client.Update(ctx, &cm)
+	})
+}
+
+// trim keeps the last MaxLines lines.
+func (s *ConfigMapSink) trim(data string) string {
+	max := s.MaxLines
+	if max <= 0 {
+		max = DefaultConfigMapLines
+	}
+	lines := strings.SplitAfter(data, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= max {
+		return data
+	}
+	return strings.Join(lines[len(lines)-max:], "")
+}
@@ -0,0 +1,100 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+var testSite = &tmv1.Site{ObjectMeta: metav1.ObjectMeta{Name: "site-lc-1", Namespace: "default"}}
+
+func transitionTo(mode tmv1.SiteMode) tmv1.SiteTransition {
+	return tmv1.SiteTransition{Time: metav1.Now(), To: mode, Manager: "kubectl"}
+}
+
+func decodeLines(t *testing.T, data string) []Entry {
+	var entries []Entry
+	for _, l := range strings.Split(strings.TrimSpace(data), "\n") {
+		var e Entry
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("line %q: %v", l, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &FileSink{Path: filepath.Join(dir, "transitions.jsonl")}
+	for _, mode := range []tmv1.SiteMode{tmv1.SiteModeEnabled, tmv1.SiteModeDisabled} {
+		if err := sink.Record(context.Background(), testSite, transitionTo(mode)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(sink.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := decodeLines(t, string(data))
+	if len(entries) != 2 || entries[1].To != tmv1.SiteModeDisabled || entries[1].Site != "site-lc-1" || entries[1].Manager != "kubectl" {
+		t.Errorf("file holds %+v", entries)
+	}
+}
+
+func TestConfigMapSink(t *testing.T) {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+	c := fake.NewFakeClientWithScheme(s)
+	sink := &ConfigMapSink{Client: c, Name: "site-history", MaxLines: 2}
+
+	for _, mode := range []tmv1.SiteMode{tmv1.SiteModeEnabled, tmv1.SiteModeDegraded, tmv1.SiteModeDisabled} {
+		if err := sink.Record(context.Background(), testSite, transitionTo(mode)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var cm v1.ConfigMap
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "site-history"}, &cm); err != nil {
+		t.Fatal(err)
+	}
+	entries := decodeLines(t, cm.Data[ConfigMapKey])
+	if len(entries) != 2 || entries[0].To != tmv1.SiteModeDegraded || entries[1].To != tmv1.SiteModeDisabled {
+		t.Errorf("ConfigMap holds %+v", entries)
+	}
+}
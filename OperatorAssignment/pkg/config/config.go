@@ -0,0 +1,372 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config holds the options of the controller manager. They are read
+// from a ControllerManagerConfig file, in the format of the controller-runtime
+// component config, and from command line flags.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/yaml"
+
+	"github.com/maxthom/rocketlab-controller/pkg/desired"
+)
+
+const (
+	// APIVersion and Kind of a manager config file.
+	APIVersion = "controller-runtime.sigs.k8s.io/v1alpha1"
+	Kind       = "ControllerManagerConfig"
+
+	// DefaultLeaderElectionID is the name of the leader election lock.
+	DefaultLeaderElectionID = "8ec726d7.rocketlab.global"
+
+	// leaderElectionJitter is the client-go jitter factor applied to the retry
+	// period, the renew deadline has to be greater than the jittered period.
+	leaderElectionJitter = 1.2
+)
+
+// ControllerManagerConfig are the options of the controller manager.
+type ControllerManagerConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// SyncPeriod is the minimum frequency at which watched objects are
+	// reconciled. Zero keeps the controller-runtime default of 10 hours.
+	SyncPeriod metav1.Duration `json:"syncPeriod,omitempty"`
+	// Namespace restricts the manager cache to a single namespace. Empty
+	// watches all namespaces.
+	Namespace string `json:"namespace,omitempty"`
+
+	LeaderElection LeaderElectionConfig `json:"leaderElection,omitempty"`
+	Metrics        MetricsConfig        `json:"metrics,omitempty"`
+	Health         HealthConfig         `json:"health,omitempty"`
+	Webhook        WebhookConfig        `json:"webhook,omitempty"`
+
+	// PodGC configures the sweeper of orphan source pods.
+	PodGC PodGCConfig `json:"podGC,omitempty"`
+
+	// Audit configures where the mode transitions of sites are recorded,
+	// besides their status.
+	Audit AuditConfig `json:"audit,omitempty"`
+
+	// Flow configures the probe checking the metrics reach NATS.
+	Flow FlowConfig `json:"flow,omitempty"`
+
+	// Hub runs the operator as the hub of member clusters.
+	Hub HubConfig `json:"hub,omitempty"`
+
+	// MissingSite is what tmsources do while their site does not exist: Run,
+	// Wait or Fail.
+	MissingSite desired.MissingSitePolicy `json:"missingSite,omitempty"`
+}
+
+// LeaderElectionConfig configures the election of the active manager replica.
+type LeaderElectionConfig struct {
+	// LeaderElect enables leader election, required to run several replicas.
+	LeaderElect bool `json:"leaderElect,omitempty"`
+	// ResourceName is the name of the lock.
+	ResourceName string `json:"resourceName,omitempty"`
+	// ResourceNamespace is the namespace of the lock. Defaults to the
+	// namespace of the manager when running in cluster.
+	ResourceNamespace string `json:"resourceNamespace,omitempty"`
+	// LeaseDuration is how long standby replicas wait before taking over a
+	// lock which was not renewed.
+	LeaseDuration metav1.Duration `json:"leaseDuration,omitempty"`
+	// RenewDeadline is how long the leader retries renewing the lock before
+	// giving it up.
+	RenewDeadline metav1.Duration `json:"renewDeadline,omitempty"`
+	// RetryPeriod is the wait between two tries to acquire or renew the lock.
+	RetryPeriod metav1.Duration `json:"retryPeriod,omitempty"`
+}
+
+// MetricsConfig configures the prometheus endpoint.
+type MetricsConfig struct {
+	// BindAddress of the metrics endpoint, "0" disables it.
+	BindAddress string `json:"bindAddress,omitempty"`
+}
+
+// HealthConfig configures the liveness and readiness probes endpoint.
+type HealthConfig struct {
+	// HealthProbeBindAddress of the /healthz and /readyz endpoints, "0"
+	// disables them.
+	HealthProbeBindAddress string `json:"healthProbeBindAddress,omitempty"`
+}
+
+// WebhookConfig configures the admission webhook server.
+type WebhookConfig struct {
+	// Port the webhook server listens on.
+	Port int `json:"port,omitempty"`
+	// Host the webhook server binds to, empty binds all interfaces.
+	Host string `json:"host,omitempty"`
+	// CertDir holds the tls.crt and tls.key of the server.
+	CertDir string `json:"certDir,omitempty"`
+}
+
+// PodGCConfig configures the periodic deletion of source pods no tmsource
+// wants anymore.
+type PodGCConfig struct {
+	// Interval between two sweeps, zero disables the sweeper.
+	Interval metav1.Duration `json:"interval,omitempty"`
+	// MinAge protects recently created pods from the sweeper.
+	MinAge metav1.Duration `json:"minAge,omitempty"`
+	// DryRun logs the orphan pods instead of deleting them.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// AuditConfig selects the sinks of the site transitions, both may be set.
+type AuditConfig struct {
+	// ConfigMap is the [namespace/]name of a ConfigMap the transitions are
+	// appended to. Without namespace, each site uses a ConfigMap of its own
+	// namespace.
+	ConfigMap string `json:"configMap,omitempty"`
+	// File is a local file the transitions are appended to.
+	File string `json:"file,omitempty"`
+}
+
+// FlowConfig configures the NATS subscriber following the metric subjects of
+// the running tmsources.
+type FlowConfig struct {
+	// NatsURL of the server the tmsources publish to, empty disables the
+	// probe.
+	NatsURL string `json:"natsURL,omitempty"`
+	// StaleAfter is how long a subject may stay silent before its tmsource
+	// is no longer Flowing.
+	StaleAfter metav1.Duration `json:"staleAfter,omitempty"`
+}
+
+// HubConfig configures the hub mode, in which the sites and tmsources of the
+// cluster are propagated to member clusters instead of running pods.
+type HubConfig struct {
+	// Enabled runs the federation controller instead of the site and tmsource
+	// reconcilers.
+	Enabled bool `json:"enabled,omitempty"`
+	// MembersNamespace holds a Secret per member cluster, named after it,
+	// with its kubeconfig under the kubeconfig key.
+	MembersNamespace string `json:"membersNamespace,omitempty"`
+	// SyncInterval between two reads of the member status.
+	SyncInterval metav1.Duration `json:"syncInterval,omitempty"`
+}
+
+// ConfigMapName splits ConfigMap into its namespace, possibly empty, and name.
+func (a AuditConfig) ConfigMapName() (string, string) {
+	if i := strings.Index(a.ConfigMap, "/"); i >= 0 {
+		return a.ConfigMap[:i], a.ConfigMap[i+1:]
+	}
+	return "", a.ConfigMap
+}
+
+// Default returns the options the manager runs with when no file or flag
+// overrides them.
+func Default() *ControllerManagerConfig {
+	return &ControllerManagerConfig{
+		TypeMeta: metav1.TypeMeta{APIVersion: APIVersion, Kind: Kind},
+		LeaderElection: LeaderElectionConfig{
+			ResourceName:  DefaultLeaderElectionID,
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		Metrics: MetricsConfig{BindAddress: ":32997"},
+		Health:  HealthConfig{HealthProbeBindAddress: ":8081"},
+		Webhook: WebhookConfig{Port: 9443},
+		PodGC: PodGCConfig{
+			Interval: metav1.Duration{Duration: 5 * time.Minute},
+			MinAge:   metav1.Duration{Duration: time.Minute},
+		},
+		Flow: FlowConfig{
+			StaleAfter: metav1.Duration{Duration: 30 * time.Second},
+		},
+		Hub: HubConfig{
+			SyncInterval: metav1.Duration{Duration: 30 * time.Second},
+		},
+		MissingSite: desired.MissingSiteRun,
+	}
+}
+
+// BindFlags registers a flag for every option on fs, defaulting to the
+// current values of c.
+func (c *ControllerManagerConfig) BindFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.SyncPeriod.Duration, "sync-period", c.SyncPeriod.Duration,
+		"Minimum frequency at which watched objects are reconciled.")
+	fs.StringVar(&c.Namespace, "namespace", c.Namespace,
+		"Namespace the manager watches, all namespaces when empty.")
+
+	fs.BoolVar(&c.LeaderElection.LeaderElect, "enable-leader-election", c.LeaderElection.LeaderElect,
+		"Enable leader election for controller manager. "+
+			"Enabling this will ensure there is only one active controller manager.")
+	fs.StringVar(&c.LeaderElection.ResourceName, "leader-election-id", c.LeaderElection.ResourceName,
+		"Name of the leader election lock.")
+	fs.StringVar(&c.LeaderElection.ResourceNamespace, "leader-election-namespace", c.LeaderElection.ResourceNamespace,
+		"Namespace of the leader election lock, the manager namespace when empty.")
+	fs.DurationVar(&c.LeaderElection.LeaseDuration.Duration, "leader-election-lease-duration", c.LeaderElection.LeaseDuration.Duration,
+		"Duration standby replicas wait before taking over a lock which was not renewed.")
+	fs.DurationVar(&c.LeaderElection.RenewDeadline.Duration, "leader-election-renew-deadline", c.LeaderElection.RenewDeadline.Duration,
+		"Duration the leader retries renewing the lock before giving it up.")
+	fs.DurationVar(&c.LeaderElection.RetryPeriod.Duration, "leader-election-retry-period", c.LeaderElection.RetryPeriod.Duration,
+		"Duration between two tries to acquire or renew the lock.")
+
+	fs.StringVar(&c.Metrics.BindAddress, "metrics-addr", c.Metrics.BindAddress,
+		"The address the metric endpoint binds to.")
+	fs.StringVar(&c.Health.HealthProbeBindAddress, "health-probe-addr", c.Health.HealthProbeBindAddress,
+		"The address the /healthz and /readyz endpoints bind to.")
+
+	fs.IntVar(&c.Webhook.Port, "webhook-port", c.Webhook.Port,
+		"The port the webhook server listens on.")
+	fs.StringVar(&c.Webhook.Host, "webhook-host", c.Webhook.Host,
+		"The host the webhook server binds to.")
+	fs.StringVar(&c.Webhook.CertDir, "webhook-cert-dir", c.Webhook.CertDir,
+		"The directory holding the tls.crt and tls.key of the webhook server.")
+
+	fs.DurationVar(&c.PodGC.Interval.Duration, "pod-gc-interval", c.PodGC.Interval.Duration,
+		"Interval between two sweeps of orphan source pods, 0 disables the sweeper.")
+	fs.DurationVar(&c.PodGC.MinAge.Duration, "pod-gc-min-age", c.PodGC.MinAge.Duration,
+		"Age under which source pods are never swept.")
+	fs.BoolVar(&c.PodGC.DryRun, "pod-gc-dry-run", c.PodGC.DryRun,
+		"Log the orphan source pods instead of deleting them.")
+
+	fs.StringVar(&c.Audit.ConfigMap, "audit-configmap", c.Audit.ConfigMap,
+		"The [namespace/]name of a ConfigMap the site transitions are appended to.")
+	fs.StringVar(&c.Audit.File, "audit-file", c.Audit.File,
+		"A file the site transitions are appended to.")
+
+	fs.StringVar(&c.Flow.NatsURL, "flow-nats-url", c.Flow.NatsURL,
+		"The NATS server the metrics of the tmsources are checked on, empty disables the probe.")
+	fs.DurationVar(&c.Flow.StaleAfter.Duration, "flow-stale-after", c.Flow.StaleAfter.Duration,
+		"Duration a metric subject may stay silent before its tmsource is no longer Flowing.")
+
+	fs.BoolVar(&c.Hub.Enabled, "hub", c.Hub.Enabled,
+		"Propagate the sites and tmsources to member clusters instead of running their pods.")
+	fs.StringVar(&c.Hub.MembersNamespace, "hub-members-namespace", c.Hub.MembersNamespace,
+		"The namespace of the kubeconfig Secrets of the member clusters.")
+	fs.DurationVar(&c.Hub.SyncInterval.Duration, "hub-sync-interval", c.Hub.SyncInterval.Duration,
+		"Duration between two reads of the status of the member clusters.")
+
+	fs.StringVar((*string)(&c.MissingSite), "missing-site", string(c.MissingSite),
+		"What tmsources do while their site does not exist: Run, Wait or Fail.")
+}
+
+// LoadFile reads a ControllerManagerConfig file into c. Flags of fs given on
+// the command line take precedence over the file.
+func (c *ControllerManagerConfig) LoadFile(path string, fs *flag.FlagSet) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	explicit := map[string]string{}
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = f.Value.String()
+		})
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if c.APIVersion != APIVersion || c.Kind != Kind {
+		return fmt.Errorf("%s: expected %s %s, got %s %s", path, APIVersion, Kind, c.APIVersion, c.Kind)
+	}
+
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks the options can start a manager.
+func (c *ControllerManagerConfig) Validate() error {
+	if c.SyncPeriod.Duration < 0 {
+		return fmt.Errorf("syncPeriod must not be negative")
+	}
+	if c.PodGC.Interval.Duration < 0 || c.PodGC.MinAge.Duration < 0 {
+		return fmt.Errorf("podGC.interval and podGC.minAge must not be negative")
+	}
+	if parts := strings.Split(c.Audit.ConfigMap, "/"); len(parts) > 2 || (c.Audit.ConfigMap != "" && parts[len(parts)-1] == "") {
+		return fmt.Errorf("audit.configMap %q is not a [namespace/]name", c.Audit.ConfigMap)
+	}
+	if c.Flow.NatsURL != "" && c.Flow.StaleAfter.Duration <= 0 {
+		return fmt.Errorf("flow.staleAfter must be positive")
+	}
+	if c.Hub.Enabled && c.Hub.MembersNamespace == "" {
+		return fmt.Errorf("hub.membersNamespace is required in hub mode")
+	}
+	if c.Hub.Enabled && c.Hub.SyncInterval.Duration <= 0 {
+		return fmt.Errorf("hub.syncInterval must be positive")
+	}
+	if !c.MissingSite.Valid() {
+		return fmt.Errorf("missingSite %q must be Run, Wait or Fail", c.MissingSite)
+	}
+	if c.Webhook.Port < 0 || c.Webhook.Port > 65535 {
+		return fmt.Errorf("webhook.port %d is not a valid port", c.Webhook.Port)
+	}
+
+	le := c.LeaderElection
+	if !le.LeaderElect {
+		return nil
+	}
+	if le.ResourceName == "" {
+		return fmt.Errorf("leaderElection.resourceName is required")
+	}
+	if le.RetryPeriod.Duration <= 0 {
+		return fmt.Errorf("leaderElection.retryPeriod must be positive")
+	}
+	if le.LeaseDuration.Duration <= le.RenewDeadline.Duration {
+		return fmt.Errorf("leaderElection.leaseDuration %s must be greater than renewDeadline %s",
+			le.LeaseDuration.Duration, le.RenewDeadline.Duration)
+	}
+	if float64(le.RenewDeadline.Duration) <= leaderElectionJitter*float64(le.RetryPeriod.Duration) {
+		return fmt.Errorf("leaderElection.renewDeadline %s must be greater than %v times retryPeriod %s",
+			le.RenewDeadline.Duration, leaderElectionJitter, le.RetryPeriod.Duration)
+	}
+	return nil
+}
+
+// Options returns the controller-runtime manager options.
+func (c *ControllerManagerConfig) Options(scheme *runtime.Scheme) ctrl.Options {
+	le := c.LeaderElection
+	leaseDuration, renewDeadline, retryPeriod := le.LeaseDuration.Duration, le.RenewDeadline.Duration, le.RetryPeriod.Duration
+
+	options := ctrl.Options{
+		Scheme:                  scheme,
+		Namespace:               c.Namespace,
+		MetricsBindAddress:      c.Metrics.BindAddress,
+		HealthProbeBindAddress:  c.Health.HealthProbeBindAddress,
+		Port:                    c.Webhook.Port,
+		Host:                    c.Webhook.Host,
+		CertDir:                 c.Webhook.CertDir,
+		LeaderElection:          le.LeaderElect,
+		LeaderElectionID:        le.ResourceName,
+		LeaderElectionNamespace: le.ResourceNamespace,
+		LeaseDuration:           &leaseDuration,
+		RenewDeadline:           &renewDeadline,
+		RetryPeriod:             &retryPeriod,
+	}
+	if c.SyncPeriod.Duration > 0 {
+		syncPeriod := c.SyncPeriod.Duration
+		options.SyncPeriod = &syncPeriod
+	}
+	return options
+}
@@ -0,0 +1,156 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const managerConfigFile = `apiVersion: controller-runtime.sigs.k8s.io/v1alpha1
+kind: ControllerManagerConfig
+health:
+  healthProbeBindAddress: :6789
+metrics:
+  bindAddress: 127.0.0.1:8080
+webhook:
+  port: 9444
+leaderElection:
+  leaderElect: true
+  resourceNamespace: rocketlab
+  leaseDuration: 30s
+  renewDeadline: 20s
+podGC:
+  interval: 10m
+  dryRun: true
+`
+
+func writeConfig(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "controller_manager_config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "manager-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func parse(t *testing.T, args ...string) (*ControllerManagerConfig, *flag.FlagSet) {
+	c := Default()
+	fs := flag.NewFlagSet("manager", flag.ContinueOnError)
+	c.BindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return c, fs
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := writeConfig(t, dir, managerConfigFile)
+	c, fs := parse(t, "--metrics-addr=:9090", "--leader-election-retry-period=5s")
+	if err := c.LoadFile(path, fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Health.HealthProbeBindAddress != ":6789" || c.Webhook.Port != 9444 {
+		t.Errorf("file values not loaded: %+v", c)
+	}
+	if c.Metrics.BindAddress != ":9090" {
+		t.Errorf("metrics address = %s, the flag should take precedence over the file", c.Metrics.BindAddress)
+	}
+	le := c.LeaderElection
+	if !le.LeaderElect || le.ResourceNamespace != "rocketlab" || le.ResourceName != DefaultLeaderElectionID {
+		t.Errorf("leader election = %+v", le)
+	}
+	if le.LeaseDuration.Duration != 30*time.Second || le.RenewDeadline.Duration != 20*time.Second || le.RetryPeriod.Duration != 5*time.Second {
+		t.Errorf("lease durations = %s %s %s", le.LeaseDuration.Duration, le.RenewDeadline.Duration, le.RetryPeriod.Duration)
+	}
+
+	if c.PodGC.Interval.Duration != 10*time.Minute || c.PodGC.MinAge.Duration != time.Minute || !c.PodGC.DryRun {
+		t.Errorf("pod gc = %+v", c.PodGC)
+	}
+
+	options := c.Options(nil)
+	if options.Port != 9444 || options.HealthProbeBindAddress != ":6789" || *options.LeaseDuration != 30*time.Second {
+		t.Errorf("options = %+v", options)
+	}
+	if options.SyncPeriod != nil {
+		t.Errorf("sync period = %s, want the controller-runtime default", *options.SyncPeriod)
+	}
+}
+
+func TestLoadFileRejectsUnknownFields(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field": managerConfigFile + "leaderElect: true\n",
+		"wrong kind":    "apiVersion: controller-runtime.sigs.k8s.io/v1alpha1\nkind: Manager\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			c, fs := parse(t)
+			if err := c.LoadFile(writeConfig(t, dir, content), fs); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "defaults", args: nil},
+		{name: "leader election defaults", args: []string{"--enable-leader-election"}},
+		{name: "lease shorter than renew deadline", args: []string{"--enable-leader-election", "--leader-election-lease-duration=5s"}, wantErr: true},
+		{name: "renew deadline within retry jitter", args: []string{"--enable-leader-election", "--leader-election-retry-period=9s"}, wantErr: true},
+		{name: "empty lock name", args: []string{"--enable-leader-election", "--leader-election-id="}, wantErr: true},
+		{name: "lease ignored without leader election", args: []string{"--leader-election-lease-duration=5s"}},
+		{name: "negative pod gc interval", args: []string{"--pod-gc-interval=-1m"}, wantErr: true},
+		{name: "invalid webhook port", args: []string{"--webhook-port=70000"}, wantErr: true},
+		{name: "audit configmap with namespace", args: []string{"--audit-configmap=rocketlab/site-history"}},
+		{name: "audit configmap without name", args: []string{"--audit-configmap=rocketlab/"}, wantErr: true},
+		{name: "hub", args: []string{"--hub", "--hub-members-namespace=rocketlab-members"}},
+		{name: "hub without members namespace", args: []string{"--hub"}, wantErr: true},
+		{name: "hub without sync interval", args: []string{"--hub", "--hub-members-namespace=rocketlab-members", "--hub-sync-interval=0s"}, wantErr: true},
+		{name: "tmsources wait for their site", args: []string{"--missing-site=Wait"}},
+		{name: "unknown missing site policy", args: []string{"--missing-site=Ignore"}, wantErr: true},
+		{name: "flow probe without staleness", args: []string{"--flow-nats-url=nats://nats:4222", "--flow-stale-after=0s"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := parse(t, tt.args...)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
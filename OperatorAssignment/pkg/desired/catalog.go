@@ -0,0 +1,189 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+const (
+	// LabelCatalogKey marks the tmsources generated from the catalog of a site.
+	LabelCatalogKey = "catalog"
+	// CatalogConfigMapKey is the ConfigMap key read when the reference sets none.
+	CatalogConfigMapKey = "metrics"
+)
+
+var (
+	metricNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+// CatalogActions are the tmsource operations needed to match the catalog of a
+// site.
+type CatalogActions struct {
+	// Create lists generated tmsources that do not exist yet.
+	Create []*tmv1.TmSource
+	// Delete lists generated tmsources whose metric left the catalog or is
+	// overridden by a hand-authored tmsource.
+	Delete []*tmv1.TmSource
+	// Conflicts lists metrics whose generated name is taken by a tmsource the
+	// site does not own.
+	Conflicts []string
+}
+
+// ParseCatalog reads metric names from ConfigMap data: one per line or comma
+// separated, blank lines and lines starting with # are ignored.
+func ParseCatalog(data string) []string {
+	var metrics []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, metric := range strings.Split(line, ",") {
+			if metric = strings.TrimSpace(metric); metric != "" {
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+	return metrics
+}
+
+// CatalogMetrics merges metric lists, dropping duplicates. Names which are not
+// valid metric names are returned apart.
+func CatalogMetrics(lists ...[]string) (metrics []string, invalid []string) {
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, metric := range list {
+			if seen[metric] {
+				continue
+			}
+			seen[metric] = true
+			if metricNameRegexp.MatchString(metric) {
+				metrics = append(metrics, metric)
+			} else {
+				invalid = append(invalid, metric)
+			}
+		}
+	}
+	sort.Strings(metrics)
+	sort.Strings(invalid)
+	return metrics, invalid
+}
+
+// CatalogSourceName returns the name of the tmsource generated for a metric of
+// a site. Metrics which are not valid object names get a hash suffix so two of
+// them never map to the same name, names too long for an object are truncated
+// and suffixed with the hash of the whole name.
+func CatalogSourceName(site *tmv1.Site, metric string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(metric), "-"), "-")
+	if name != metric {
+		h := fnv.New32a()
+		h.Write([]byte(metric))
+		name = fmt.Sprintf("%s-%08x", name, h.Sum32())
+	}
+	return shorten(site.Name+"-"+name, validation.DNS1123SubdomainMaxLength)
+}
+
+// CatalogSource builds the tmsource generated for a metric of a site, owned by
+// the site.
+func CatalogSource(site *tmv1.Site, metric string) *tmv1.TmSource {
+	controller := true
+	return &tmv1.TmSource{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CatalogSourceName(site, metric),
+			Namespace: site.Namespace,
+			Labels:    map[string]string{LabelCatalogKey: LabelValue(site.Name)},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion:         tmv1.GroupVersion.String(),
+				Kind:               "Site",
+				Name:               site.Name,
+				UID:                site.UID,
+				Controller:         &controller,
+				BlockOwnerDeletion: &controller,
+			}},
+		},
+		Spec: tmv1.TmSourceSpec{
+			Site:       site.Name,
+			MetricName: metric,
+		},
+	}
+}
+
+// PlanCatalog compares the catalog of a site with the tmsources linked to it.
+// Only tmsources controlled by the site are ever deleted.
+func PlanCatalog(site *tmv1.Site, metrics []string, sources []tmv1.TmSource) CatalogActions {
+	owned := map[string]*tmv1.TmSource{}
+	overridden := map[string]bool{}
+	taken := map[string]bool{}
+	for i := range sources {
+		tm := &sources[i]
+		if tm.Namespace != site.Namespace || !tm.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if metav1.IsControlledBy(tm, site) {
+			owned[tm.Name] = tm
+			continue
+		}
+		taken[tm.Name] = true
+		if tm.Spec.Site == site.Name {
+			overridden[tm.Spec.MetricName] = true
+		}
+	}
+
+	var actions CatalogActions
+	wanted := map[string]bool{}
+	for _, metric := range metrics {
+		if overridden[metric] {
+			continue
+		}
+		name := CatalogSourceName(site, metric)
+		if taken[name] {
+			actions.Conflicts = append(actions.Conflicts, metric)
+			continue
+		}
+		wanted[name] = true
+		if _, ok := owned[name]; !ok {
+			actions.Create = append(actions.Create, CatalogSource(site, metric))
+		}
+	}
+
+	for name, tm := range owned {
+		if !wanted[name] {
+			actions.Delete = append(actions.Delete, tm.DeepCopy())
+		}
+	}
+
+	sortSources(actions.Create)
+	sortSources(actions.Delete)
+	return actions
+}
+
+func sortSources(sources []*tmv1.TmSource) {
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+}
@@ -0,0 +1,151 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func sourceNames(sources []*tmv1.TmSource) []string {
+	var out []string
+	for _, tm := range sources {
+		out = append(out, tm.Name)
+	}
+	return out
+}
+
+func TestParseCatalog(t *testing.T) {
+	got := ParseCatalog("# telemetry\nrock\n\n paper , scissors\nsmoke\n")
+	want := []string{"rock", "paper", "scissors", "smoke"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCatalog() = %v, want %v", got, want)
+	}
+}
+
+func TestCatalogMetrics(t *testing.T) {
+	metrics, invalid := CatalogMetrics([]string{"rock", "paper"}, []string{"paper", "smoke", "bad metric"})
+	if want := []string{"paper", "rock", "smoke"}; !reflect.DeepEqual(metrics, want) {
+		t.Errorf("metrics = %v, want %v", metrics, want)
+	}
+	if want := []string{"bad metric"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("invalid = %v, want %v", invalid, want)
+	}
+}
+
+func TestCatalogSourceName(t *testing.T) {
+	s := site("site-lc-1", true)
+	if got := CatalogSourceName(&s, "rock"); got != "site-lc-1-rock" {
+		t.Errorf("CatalogSourceName(rock) = %s", got)
+	}
+	upper, lower := CatalogSourceName(&s, "Rock"), CatalogSourceName(&s, "rock")
+	if upper == lower {
+		t.Errorf("Rock and rock map to the same name %s", upper)
+	}
+	if a, b := CatalogSourceName(&s, "cpu.load"), CatalogSourceName(&s, "cpu_load"); a == b {
+		t.Errorf("cpu.load and cpu_load map to the same name %s", a)
+	}
+
+	long := site(strings.Repeat("s", 200), true)
+	metric := strings.Repeat("m", 100)
+	name := CatalogSourceName(&long, metric)
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		t.Errorf("CatalogSourceName() = %s is invalid: %v", name, errs)
+	}
+	if other := CatalogSourceName(&long, metric+"x"); other == name {
+		t.Errorf("metrics sharing a prefix map to the same name %s", name)
+	}
+	if label := CatalogSource(&long, metric).Labels[LabelCatalogKey]; len(validation.IsValidLabelValue(label)) > 0 {
+		t.Errorf("catalog label %q is invalid", label)
+	}
+}
+
+func TestPlanCatalog(t *testing.T) {
+	s := site("site-lc-1", true)
+	s.UID = "uid-site-lc-1"
+	generated := func(metric string) tmv1.TmSource { return *CatalogSource(&s, metric) }
+
+	otherSite := site("site-lc-2", true)
+	otherSite.UID = "uid-site-lc-2"
+	foreign := *CatalogSource(&otherSite, "rock")
+	foreign.Name = "site-lc-1-paper"
+
+	tests := []struct {
+		name          string
+		metrics       []string
+		sources       []tmv1.TmSource
+		wantCreate    []string
+		wantDelete    []string
+		wantConflicts []string
+	}{
+		{
+			name:       "generate missing tmsources",
+			metrics:    []string{"rock", "paper"},
+			sources:    []tmv1.TmSource{generated("rock")},
+			wantCreate: []string{"site-lc-1-paper"},
+		},
+		{
+			name:       "prune metrics removed from the catalog",
+			metrics:    []string{"rock"},
+			sources:    []tmv1.TmSource{generated("rock"), generated("smoke")},
+			wantDelete: []string{"site-lc-1-smoke"},
+		},
+		{
+			name:       "hand-authored tmsource overrides a catalog entry",
+			metrics:    []string{"rock", "paper"},
+			sources:    []tmv1.TmSource{generated("rock"), source("tm-1", "site-lc-1", "rock")},
+			wantCreate: []string{"site-lc-1-paper"},
+			wantDelete: []string{"site-lc-1-rock"},
+		},
+		{
+			name:    "hand-authored tmsources are never pruned",
+			metrics: nil,
+			sources: []tmv1.TmSource{source("tm-1", "site-lc-1", "rock"), source("site-lc-1-smoke", "site-lc-1", "smoke")},
+		},
+		{
+			name:          "names taken by other tmsources are conflicts",
+			metrics:       []string{"paper"},
+			sources:       []tmv1.TmSource{foreign},
+			wantConflicts: []string{"paper"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PlanCatalog(&s, tt.metrics, tt.sources)
+			if !reflect.DeepEqual(sourceNames(got.Create), tt.wantCreate) {
+				t.Errorf("Create = %v, want %v", sourceNames(got.Create), tt.wantCreate)
+			}
+			if !reflect.DeepEqual(sourceNames(got.Delete), tt.wantDelete) {
+				t.Errorf("Delete = %v, want %v", sourceNames(got.Delete), tt.wantDelete)
+			}
+			if !reflect.DeepEqual(got.Conflicts, tt.wantConflicts) {
+				t.Errorf("Conflicts = %v, want %v", got.Conflicts, tt.wantConflicts)
+			}
+			for _, tm := range got.Create {
+				if tm.Spec.Site != s.Name || tm.Labels[LabelCatalogKey] != s.Name {
+					t.Errorf("generated %s is not linked to the site", tm.Name)
+				}
+			}
+		})
+	}
+}
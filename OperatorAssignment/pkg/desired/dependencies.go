@@ -0,0 +1,115 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// DependencyCycle returns a cycle of dependsOn going through a site, starting
+// and ending with it, or nil. Sites are matched by name in the namespace of
+// the site.
+func DependencyCycle(site *tmv1.Site, sites []tmv1.Site) []string {
+	byName := map[string]*tmv1.Site{}
+	for i := range sites {
+		if sites[i].Namespace == site.Namespace {
+			byName[sites[i].Name] = &sites[i]
+		}
+	}
+	byName[site.Name] = site
+
+	visited := map[string]bool{}
+	var path []string
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		path = append(path, name)
+		s, ok := byName[name]
+		if ok && !visited[name] {
+			visited[name] = true
+			for _, dep := range s.Spec.DependsOn {
+				if string(dep) == site.Name || visit(string(dep)) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+
+	if !visit(site.Name) {
+		return nil
+	}
+	return append(path, site.Name)
+}
+
+// BlockingDependencies returns the dependencies of a site which are missing or
+// not Ready, sorted.
+func BlockingDependencies(site *tmv1.Site, sites []tmv1.Site) []string {
+	ready := map[string]bool{}
+	for i := range sites {
+		if sites[i].Namespace == site.Namespace && sites[i].DeletionTimestamp.IsZero() {
+			ready[sites[i].Name] = tmv1.IsConditionStatus(sites[i].Status.Conditions, tmv1.ConditionReady, metav1.ConditionTrue)
+		}
+	}
+
+	var blocking []string
+	for _, dep := range site.Spec.DependsOn {
+		if !ready[string(dep)] {
+			blocking = append(blocking, string(dep))
+		}
+	}
+	sort.Strings(blocking)
+	return blocking
+}
+
+// ReadyDependents returns the Ready sites which depend on a site, sorted.
+func ReadyDependents(site *tmv1.Site, sites []tmv1.Site) []string {
+	var dependents []string
+	for i := range sites {
+		s := &sites[i]
+		if s.Namespace != site.Namespace || s.Name == site.Name {
+			continue
+		}
+		if !tmv1.IsConditionStatus(s.Status.Conditions, tmv1.ConditionReady, metav1.ConditionTrue) {
+			continue
+		}
+		for _, dep := range s.Spec.DependsOn {
+			if string(dep) == site.Name {
+				dependents = append(dependents, s.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// Blocked reports whether the dependencies of a site hold its sources, as
+// observed in its status.
+func Blocked(site *tmv1.Site) bool {
+	return site != nil && tmv1.IsConditionStatus(site.Status.Conditions, tmv1.ConditionDependenciesReady, metav1.ConditionFalse)
+}
+
+// Draining reports whether a disabled site still waits for its dependents, as
+// observed in its status.
+func Draining(site *tmv1.Site) bool {
+	return site != nil && tmv1.IsConditionStatus(site.Status.Conditions, tmv1.ConditionDraining, metav1.ConditionTrue)
+}
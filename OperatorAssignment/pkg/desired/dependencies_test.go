@@ -0,0 +1,95 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func dependent(name string, ready bool, deps ...tmv1.SiteName) tmv1.Site {
+	s := site(name, true)
+	s.Spec.DependsOn = deps
+	if ready {
+		s.Status.Conditions = []tmv1.Condition{{Type: tmv1.ConditionReady, Status: metav1.ConditionTrue}}
+	}
+	return s
+}
+
+func TestDependencyCycle(t *testing.T) {
+	sites := []tmv1.Site{
+		dependent("a", true, "b"),
+		dependent("b", true, "c"),
+		dependent("c", true, "a"),
+		dependent("self", true, "self"),
+		dependent("d", true, "e", "f"),
+		dependent("e", true, "f"),
+		dependent("f", true),
+		dependent("g", true, "a"),
+	}
+
+	tests := map[string][]string{
+		"a":    {"a", "b", "c", "a"},
+		"self": {"self", "self"},
+		"d":    nil,
+		"g":    nil,
+	}
+	for name, want := range tests {
+		var s *tmv1.Site
+		for i := range sites {
+			if sites[i].Name == name {
+				s = &sites[i]
+			}
+		}
+		if got := DependencyCycle(s, sites); !reflect.DeepEqual(got, want) {
+			t.Errorf("DependencyCycle(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestBlockingDependenciesAndReadyDependents(t *testing.T) {
+	ground := dependent("ground", true)
+	relay := dependent("relay", false)
+	pad := dependent("pad", true, "relay", "ground", "missing")
+	sites := []tmv1.Site{ground, relay, pad, dependent("pad-2", false, "ground")}
+
+	if got, want := BlockingDependencies(&pad, sites), []string{"missing", "relay"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BlockingDependencies() = %v, want %v", got, want)
+	}
+	if got, want := ReadyDependents(&ground, sites), []string{"pad"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadyDependents() = %v, want %v", got, want)
+	}
+}
+
+func TestSourceRunsFollowsDependencyConditions(t *testing.T) {
+	blocked := site("site-lc-1", true)
+	blocked.Status.Conditions = []tmv1.Condition{{Type: tmv1.ConditionDependenciesReady, Status: metav1.ConditionFalse}}
+	if SourceRuns(&blocked, source("tm-1", "site-lc-1", "rock")) {
+		t.Errorf("a source of a blocked site runs")
+	}
+
+	draining := site("site-lc-1", false)
+	draining.Status.Mode = tmv1.SiteModeEnabled
+	draining.Status.Conditions = []tmv1.Condition{{Type: tmv1.ConditionDraining, Status: metav1.ConditionTrue}}
+	if !SourceRuns(&draining, source("tm-1", "site-lc-1", "rock")) {
+		t.Errorf("a source of a draining site stopped before its dependents")
+	}
+}
@@ -0,0 +1,363 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package desired computes which rocket-source pods should exist for a set of
+// Sites and TmSources. It holds no client and performs no API calls so the
+// decisions of the reconcilers can be tested on plain objects.
+package desired
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+const (
+	LabelSiteKey         = "site"
+	LabelAppKey          = "app"
+	LabelAppValue        = "rocket-source-pod"
+	LabelSourceKey       = "tmsource"
+	LabelTemplateHashKey = "pod-template-hash"
+	PodNamePrefix        = "rocket-source-pod-"
+
+	// AnnotationSourceKey holds the full name of the tmsource of a pod, whose
+	// label may be shortened, see LabelValue.
+	AnnotationSourceKey = "tm.rocketlab.global/tmsource"
+	// AnnotationSiteKey holds the full name of the site of a pod, whose label
+	// may be shortened as well.
+	AnnotationSiteKey = "tm.rocketlab.global/site"
+
+	// podBaseNameMaxLength leaves room in the 253 characters of a pod name
+	// for the template hash appended to its base name.
+	podBaseNameMaxLength = validation.DNS1123SubdomainMaxLength - 9
+
+	ContainerName         = "rocket-source"
+	ContainerImage        = "maxthom/rocket-source:latest"
+	ContainerEnvMetricKey = "METRIC_NAME"
+	ContainerEnvNatKey    = "NATS_SERVICE_PORT"
+	ContainerEnvNatValue  = "nats-server-service.default.svc.cluster.local:4222"
+
+	// PodTerminationWaitTimeSec is the grace period of source pods when the
+	// tmsource does not set one.
+	PodTerminationWaitTimeSec int64 = 20
+)
+
+// Actions are the pod operations needed to go from the existing pods to the
+// desired ones.
+type Actions struct {
+	// Create lists desired pods that do not exist yet.
+	Create []*v1.Pod
+	// Delete lists existing pods that are not desired anymore, including
+	// pods of an older template once their replacement is ready.
+	Delete []*v1.Pod
+	// Replace lists desired pods superseding a pod of an older template which
+	// is still running. It is informational, the pods to create or delete for
+	// the rollout are already part of Create and Delete.
+	Replace []*v1.Pod
+}
+
+// IsEmpty reports whether the existing pods already match the desired ones.
+func (a Actions) IsEmpty() bool {
+	return len(a.Create) == 0 && len(a.Delete) == 0 && len(a.Replace) == 0
+}
+
+// PodName returns the base name of the pods generated for a tmsource. The
+// hash of the pod template is appended to it, see Pod. Names too long for a
+// pod are truncated and suffixed with the hash of the tmsource name.
+func PodName(tmsource tmv1.TmSource) string {
+	return shorten(PodNamePrefix+tmsource.Name, podBaseNameMaxLength)
+}
+
+// LabelValue returns a label value standing for a name. Names longer than the
+// 63 characters allowed in a label are truncated and suffixed with their hash
+// so distinct names keep distinct labels.
+func LabelValue(name string) string {
+	return shorten(name, validation.LabelValueMaxLength)
+}
+
+// shorten truncates a name to max characters, replacing its end with the hash
+// of the whole name. The result still ends with an alphanumeric character.
+func shorten(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return strings.TrimRight(name[:max-9], "-.") + fmt.Sprintf("-%08x", h.Sum32())
+}
+
+// Pod builds the pod publishing the metric of a tmsource without site, see
+// SitePod.
+func Pod(tmsource tmv1.TmSource) *v1.Pod {
+	return SitePod(nil, tmsource)
+}
+
+// SitePod builds the pod publishing the metric of a tmsource of a site, with
+// the extensions of both. The pod is named after the hash of its spec so a new
+// template, extensions included, gets a new pod which can run next to the old
+// one until it is ready.
+func SitePod(site *tmv1.Site, tmsource tmv1.TmSource) *v1.Pod {
+	grace := TerminationGracePeriod(tmsource)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: tmsource.Namespace,
+			Labels: map[string]string{
+				LabelAppKey:    LabelAppValue,
+				LabelSourceKey: LabelValue(tmsource.Name),
+				LabelSiteKey:   LabelValue(tmsource.Spec.Site),
+			},
+		},
+		Spec: v1.PodSpec{
+			TerminationGracePeriodSeconds: &grace,
+			PriorityClassName:             PriorityClassName(tmsource),
+			Containers: []v1.Container{
+				{
+					Name:            ContainerName,
+					Image:           Image(site, tmsource),
+					ImagePullPolicy: v1.PullAlways,
+					Env: []v1.EnvVar{
+						{
+							Name:  ContainerEnvNatKey,
+							Value: NatsAddress(site),
+						},
+						{
+							Name:  ContainerEnvMetricKey,
+							Value: tmsource.Spec.MetricName,
+						},
+					},
+					Resources: SourceResources(site, tmsource),
+					Lifecycle: drainHook(DrainCommand(site, tmsource)),
+				},
+			},
+		},
+		Status: v1.PodStatus{},
+	}
+	applyExtensions(pod, Extensions(site, tmsource))
+	applySecurity(pod, site, Security(site, tmsource))
+
+	hash := templateHash(pod)
+	pod.Name = PodName(tmsource) + "-" + hash
+	pod.Labels[LabelTemplateHashKey] = hash
+	// Set after hashing, the name of the tmsource is not part of its template
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[AnnotationSourceKey] = tmsource.Name
+	pod.Annotations[AnnotationSiteKey] = tmsource.Spec.Site
+	return pod
+}
+
+// TerminationGracePeriod returns the grace period of the pods of a tmsource.
+func TerminationGracePeriod(tmsource tmv1.TmSource) int64 {
+	if tmsource.Spec.TerminationGracePeriodSeconds != nil {
+		return *tmsource.Spec.TerminationGracePeriodSeconds
+	}
+	return PodTerminationWaitTimeSec
+}
+
+// DrainCommand returns the command run before the rocket-source container of
+// a tmsource is stopped, the one of the site unless it sets its own.
+func DrainCommand(site *tmv1.Site, tmsource tmv1.TmSource) []string {
+	if len(tmsource.Spec.DrainCommand) > 0 {
+		return tmsource.Spec.DrainCommand
+	}
+	if site != nil {
+		return site.Spec.DrainCommand
+	}
+	return nil
+}
+
+// drainHook runs the drain command as preStop hook. Without one, the pod
+// only gets its grace period: nothing is known of the rocket-source image
+// beyond its handling of SIGTERM.
+func drainHook(command []string) *v1.Lifecycle {
+	if len(command) == 0 {
+		return nil
+	}
+	return &v1.Lifecycle{
+		PreStop: &v1.Handler{
+			Exec: &v1.ExecAction{Command: append([]string(nil), command...)},
+		},
+	}
+}
+
+// templateHash hashes the annotations and the spec of a source pod, which
+// carry its seccomp profile and everything else it runs with.
+func templateHash(pod *v1.Pod) string {
+	data, err := json.Marshal(struct {
+		Annotations map[string]string `json:"annotations,omitempty"`
+		Spec        v1.PodSpec        `json:"spec"`
+	}{pod.Annotations, pod.Spec})
+	if err != nil {
+		panic(err)
+	}
+	h := fnv.New32a()
+	h.Write(data)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// SourceOf returns the name of the tmsource owning a pod. Pods created before
+// the source annotation existed are matched by label, or by name when older
+// than the label.
+func SourceOf(pod *v1.Pod) string {
+	if source, ok := pod.Annotations[AnnotationSourceKey]; ok {
+		return source
+	}
+	if source, ok := pod.Labels[LabelSourceKey]; ok {
+		return source
+	}
+	if strings.HasPrefix(pod.Name, PodNamePrefix) {
+		return strings.TrimPrefix(pod.Name, PodNamePrefix)
+	}
+	return ""
+}
+
+// SiteOf returns the name of the site of a pod. Pods created before the site
+// annotation existed are matched by label, the last result tells whether the
+// pod carries either.
+func SiteOf(pod *v1.Pod) (string, bool) {
+	if site, ok := pod.Annotations[AnnotationSiteKey]; ok {
+		return site, true
+	}
+	site, ok := pod.Labels[LabelSiteKey]
+	return site, ok
+}
+
+// PodReady reports whether a pod passed its readiness checks.
+func PodReady(pod *v1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Pods returns the pods that should exist for the given sites and sources,
+// sorted by namespace and name. A source is matched to the site of the same
+// name in its own namespace. Sources held back by the limits of their site or
+// suspended by their remediation policy get no pod, the limits are applied to
+// the given sources only.
+func Pods(sites []tmv1.Site, sources []tmv1.TmSource) []*v1.Pod {
+	siteByKey := map[types.NamespacedName]*tmv1.Site{}
+	quotas := map[types.NamespacedName]Quota{}
+	for i := range sites {
+		key := types.NamespacedName{Name: sites[i].Name, Namespace: sites[i].Namespace}
+		siteByKey[key] = &sites[i]
+		quotas[key] = Admit(&sites[i], sources)
+	}
+
+	var pods []*v1.Pod
+	for _, tm := range sources {
+		if !tm.DeletionTimestamp.IsZero() {
+			continue
+		}
+		key := types.NamespacedName{Name: tm.Spec.Site, Namespace: tm.Namespace}
+		if site := siteByKey[key]; SourceRuns(site, tm) && !quotas[key].IsHeld(tm) && !Suspended(tm) {
+			pods = append(pods, SitePod(site, tm))
+		}
+	}
+
+	sortPods(pods)
+	return pods
+}
+
+// PodDrifted reports whether an existing pod was built from another template
+// than the desired one and has to be replaced.
+func PodDrifted(existing *v1.Pod, template *v1.Pod) bool {
+	return existing.Labels[LabelTemplateHashKey] != template.Labels[LabelTemplateHashKey]
+}
+
+// Plan compares the desired pods with the existing ones and returns the
+// operations to converge. Existing pods are expected to be scoped by the
+// caller, any of them which is not desired is deleted. A pod of an older
+// template is only deleted once the pod replacing it is ready, so the metric
+// keeps being published during the change.
+func Plan(desired []*v1.Pod, existing []v1.Pod) Actions {
+	existingBySource := map[types.NamespacedName][]*v1.Pod{}
+	for i := range existing {
+		key := types.NamespacedName{Name: SourceOf(&existing[i]), Namespace: existing[i].Namespace}
+		existingBySource[key] = append(existingBySource[key], &existing[i])
+	}
+
+	var actions Actions
+	desiredSources := map[types.NamespacedName]bool{}
+	for _, pod := range desired {
+		key := types.NamespacedName{Name: SourceOf(pod), Namespace: pod.Namespace}
+		desiredSources[key] = true
+
+		var current *v1.Pod
+		var old []*v1.Pod
+		for _, p := range existingBySource[key] {
+			switch {
+			case p.Name == pod.Name:
+				current = p
+			case p.DeletionTimestamp.IsZero():
+				old = append(old, p)
+			}
+		}
+
+		if current == nil {
+			actions.Create = append(actions.Create, pod)
+		}
+		// A terminating current pod is left alone until it is gone
+
+		if len(old) > 0 {
+			actions.Replace = append(actions.Replace, pod)
+			if current != nil && current.DeletionTimestamp.IsZero() && PodReady(current) {
+				for _, p := range old {
+					actions.Delete = append(actions.Delete, p.DeepCopy())
+				}
+			}
+		}
+	}
+
+	for key, pods := range existingBySource {
+		if desiredSources[key] {
+			continue
+		}
+		for _, p := range pods {
+			if p.DeletionTimestamp.IsZero() {
+				actions.Delete = append(actions.Delete, p.DeepCopy())
+			}
+		}
+	}
+
+	// Higher priority pods are created first
+	sortPodsByPriority(actions.Create)
+	// Lower priority pods are shed first
+	sortPodsForShedding(actions.Delete)
+	sortPods(actions.Replace)
+	return actions
+}
+
+func sortPods(pods []*v1.Pod) {
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+}
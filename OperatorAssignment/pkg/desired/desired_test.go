@@ -0,0 +1,334 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func site(name string, enabled bool) tmv1.Site {
+	return tmv1.Site{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       tmv1.SiteSpec{Enabled: enabled},
+	}
+}
+
+func source(name, site, metric string) tmv1.TmSource {
+	return tmv1.TmSource{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       tmv1.TmSourceSpec{Site: site, MetricName: metric},
+	}
+}
+
+// names returns the tmsources of the pods, pod names carry a template hash.
+func names(pods []*v1.Pod) []string {
+	var out []string
+	for _, pod := range pods {
+		out = append(out, SourceOf(pod))
+	}
+	return out
+}
+
+func ready(pod *v1.Pod) v1.Pod {
+	out := *pod.DeepCopy()
+	out.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	return out
+}
+
+func TestPods(t *testing.T) {
+	deleting := source("tm-deleting", "site-lc-1", "smoke")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+
+	otherNamespace := site("site-lc-1", false)
+	otherNamespace.Namespace = "other"
+
+	tests := []struct {
+		name    string
+		sites   []tmv1.Site
+		sources []tmv1.TmSource
+		want    []string
+	}{
+		{
+			name:    "enabled site runs all its sources",
+			sites:   []tmv1.Site{site("site-lc-1", true)},
+			sources: []tmv1.TmSource{source("tm-2", "site-lc-1", "paper"), source("tm-1", "site-lc-1", "rock")},
+			want:    []string{"tm-1", "tm-2"},
+		},
+		{
+			name:    "disabled site runs nothing",
+			sites:   []tmv1.Site{site("site-lc-1", false)},
+			sources: []tmv1.TmSource{source("tm-1", "site-lc-1", "rock")},
+			want:    nil,
+		},
+		{
+			name:    "source without a site still runs",
+			sites:   nil,
+			sources: []tmv1.TmSource{source("tm-3", "site-missing", "scissors")},
+			want:    []string{"tm-3"},
+		},
+		{
+			name:    "sites are matched per site",
+			sites:   []tmv1.Site{site("site-lc-1", true), site("site-lc-2", false)},
+			sources: []tmv1.TmSource{source("tm-1", "site-lc-1", "rock"), source("tm-3", "site-lc-2", "scissors")},
+			want:    []string{"tm-1"},
+		},
+		{
+			name:    "sites are matched in the source namespace",
+			sites:   []tmv1.Site{otherNamespace},
+			sources: []tmv1.TmSource{source("tm-1", "site-lc-1", "rock")},
+			want:    []string{"tm-1"},
+		},
+		{
+			name:    "deleted sources do not run",
+			sites:   []tmv1.Site{site("site-lc-1", true)},
+			sources: []tmv1.TmSource{deleting},
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := names(Pods(tt.sites, tt.sources))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Pods() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPod(t *testing.T) {
+	pod := Pod(source("tm-1", "site-lc-1", "rock"))
+	if !strings.HasPrefix(pod.Name, "rocket-source-pod-tm-1-") {
+		t.Errorf("Name = %s, want the template hash appended to rocket-source-pod-tm-1", pod.Name)
+	}
+	if pod.Name != Pod(source("tm-1", "site-lc-1", "rock")).Name {
+		t.Errorf("Name is not stable for the same tmsource")
+	}
+	if SourceOf(pod) != "tm-1" {
+		t.Errorf("SourceOf() = %s, want tm-1", SourceOf(pod))
+	}
+	if got := *pod.Spec.TerminationGracePeriodSeconds; got != PodTerminationWaitTimeSec {
+		t.Errorf("TerminationGracePeriodSeconds = %d, want %d", got, PodTerminationWaitTimeSec)
+	}
+	if pod.Spec.Containers[0].Lifecycle != nil {
+		t.Errorf("Lifecycle = %+v, want no preStop hook without drain command", pod.Spec.Containers[0].Lifecycle)
+	}
+
+	noGrace := source("tm-1", "site-lc-1", "rock")
+	zero := int64(0)
+	noGrace.Spec.TerminationGracePeriodSeconds = &zero
+	pod = Pod(noGrace)
+	if *pod.Spec.TerminationGracePeriodSeconds != 0 {
+		t.Errorf("TerminationGracePeriodSeconds = %d, want 0", *pod.Spec.TerminationGracePeriodSeconds)
+	}
+}
+
+func TestPodDrainCommand(t *testing.T) {
+	s := site("site-lc-1", true)
+	s.Spec.DrainCommand = []string{"/rocket-source", "flush"}
+	tm := source("tm-1", "site-lc-1", "rock")
+
+	hook := SitePod(&s, tm).Spec.Containers[0].Lifecycle
+	if hook == nil || hook.PreStop == nil || hook.PreStop.Exec == nil {
+		t.Fatalf("missing preStop drain hook")
+	}
+	if got := hook.PreStop.Exec.Command; !reflect.DeepEqual(got, s.Spec.DrainCommand) {
+		t.Errorf("preStop = %q, want the drain command of the site", got)
+	}
+
+	tm.Spec.DrainCommand = []string{"/rocket-source", "flush", "--timeout=5s"}
+	withOwn := SitePod(&s, tm)
+	if got := withOwn.Spec.Containers[0].Lifecycle.PreStop.Exec.Command; !reflect.DeepEqual(got, tm.Spec.DrainCommand) {
+		t.Errorf("preStop = %q, want the drain command of the tmsource", got)
+	}
+	if withOwn.Name == SitePod(&s, source("tm-1", "site-lc-1", "rock")).Name {
+		t.Errorf("a new drain command should give a new pod")
+	}
+}
+
+func TestPodLongName(t *testing.T) {
+	long := strings.Repeat("a", 99) + "1"
+	pod := Pod(source(long, "site-lc-1", "rock"))
+	if errs := validation.IsValidLabelValue(pod.Labels[LabelSourceKey]); len(errs) > 0 {
+		t.Errorf("tmsource label %q is invalid: %v", pod.Labels[LabelSourceKey], errs)
+	}
+	if errs := validation.IsDNS1123Subdomain(pod.Name); len(errs) > 0 {
+		t.Errorf("Name %q is invalid: %v", pod.Name, errs)
+	}
+	if SourceOf(pod) != long {
+		t.Errorf("SourceOf() = %s, want the full tmsource name", SourceOf(pod))
+	}
+	other := Pod(source(strings.Repeat("a", 99)+"2", "site-lc-1", "rock"))
+	if other.Labels[LabelSourceKey] == pod.Labels[LabelSourceKey] {
+		t.Errorf("tmsources sharing a prefix share the label %s", pod.Labels[LabelSourceKey])
+	}
+
+	longest := strings.Repeat("b", validation.DNS1123SubdomainMaxLength)
+	pod = Pod(source(longest, "site-lc-1", "rock"))
+	if errs := validation.IsDNS1123Subdomain(pod.Name); len(errs) > 0 {
+		t.Errorf("Name of %d characters is invalid: %v", len(pod.Name), errs)
+	}
+	if SourceOf(pod) != longest {
+		t.Errorf("SourceOf() does not return the full tmsource name")
+	}
+}
+
+func TestPodDrifted(t *testing.T) {
+	template := Pod(source("tm-1", "site-lc-1", "rock"))
+
+	longerGrace := source("tm-1", "site-lc-1", "rock")
+	grace := int64(60)
+	longerGrace.Spec.TerminationGracePeriodSeconds = &grace
+
+	tests := []struct {
+		name     string
+		existing *v1.Pod
+		want     bool
+	}{
+		{name: "identical", existing: Pod(source("tm-1", "site-lc-1", "rock")), want: false},
+		{name: "metric changed", existing: Pod(source("tm-1", "site-lc-1", "paper")), want: true},
+		{name: "grace period changed", existing: Pod(longerGrace), want: true},
+		{name: "legacy pod without hash", existing: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "rocket-source-pod-tm-1"}}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PodDrifted(tt.existing, template); got != tt.want {
+				t.Errorf("PodDrifted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	rock := Pod(source("tm-1", "site-lc-1", "rock"))
+	paper := Pod(source("tm-2", "site-lc-1", "paper"))
+
+	oldRock := *Pod(source("tm-1", "site-lc-1", "paper"))
+	legacy := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "rocket-source-pod-tm-1", Namespace: "default"}}
+
+	now := metav1.Now()
+	terminating := *rock.DeepCopy()
+	terminating.DeletionTimestamp = &now
+	terminatingOld := *oldRock.DeepCopy()
+	terminatingOld.DeletionTimestamp = &now
+
+	tests := []struct {
+		name        string
+		desired     []*v1.Pod
+		existing    []v1.Pod
+		wantCreate  []string
+		wantDelete  []string
+		wantReplace []string
+	}{
+		{
+			name:       "create missing pods",
+			desired:    []*v1.Pod{paper, rock},
+			existing:   nil,
+			wantCreate: []string{"tm-1", "tm-2"},
+		},
+		{
+			name:     "nothing to do when up to date",
+			desired:  []*v1.Pod{rock},
+			existing: []v1.Pod{*Pod(source("tm-1", "site-lc-1", "rock"))},
+		},
+		{
+			name:       "delete pods not desired anymore",
+			desired:    nil,
+			existing:   []v1.Pod{*rock, *paper},
+			wantDelete: []string{"tm-1", "tm-2"},
+		},
+		{
+			name:        "create the replacement of a drifted pod first",
+			desired:     []*v1.Pod{rock},
+			existing:    []v1.Pod{oldRock},
+			wantCreate:  []string{"tm-1"},
+			wantReplace: []string{"tm-1"},
+		},
+		{
+			name:        "keep the drifted pod while the replacement is not ready",
+			desired:     []*v1.Pod{rock},
+			existing:    []v1.Pod{oldRock, *rock},
+			wantReplace: []string{"tm-1"},
+		},
+		{
+			name:        "delete the drifted pod once the replacement is ready",
+			desired:     []*v1.Pod{rock},
+			existing:    []v1.Pod{oldRock, ready(rock)},
+			wantDelete:  []string{"tm-1"},
+			wantReplace: []string{"tm-1"},
+		},
+		{
+			name:        "legacy pods are matched by name",
+			desired:     []*v1.Pod{rock},
+			existing:    []v1.Pod{legacy, ready(rock)},
+			wantDelete:  []string{"tm-1"},
+			wantReplace: []string{"tm-1"},
+		},
+		{
+			name:     "wait for a terminating pod of the same template",
+			desired:  []*v1.Pod{rock},
+			existing: []v1.Pod{terminating},
+		},
+		{
+			name:       "terminating pods of an older template do not block",
+			desired:    []*v1.Pod{rock},
+			existing:   []v1.Pod{terminatingOld},
+			wantCreate: []string{"tm-1"},
+		},
+		{
+			name:     "terminating pods are not deleted twice",
+			desired:  nil,
+			existing: []v1.Pod{terminating},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Plan(tt.desired, tt.existing)
+			if !reflect.DeepEqual(names(got.Create), tt.wantCreate) {
+				t.Errorf("Create = %v, want %v", names(got.Create), tt.wantCreate)
+			}
+			if !reflect.DeepEqual(names(got.Delete), tt.wantDelete) {
+				t.Errorf("Delete = %v, want %v", names(got.Delete), tt.wantDelete)
+			}
+			if !reflect.DeepEqual(names(got.Replace), tt.wantReplace) {
+				t.Errorf("Replace = %v, want %v", names(got.Replace), tt.wantReplace)
+			}
+			for _, deleted := range got.Delete {
+				for _, pod := range tt.desired {
+					if deleted.Name == pod.Name {
+						t.Errorf("desired pod %s is deleted", pod.Name)
+					}
+				}
+			}
+			wantEmpty := len(tt.wantCreate) == 0 && len(tt.wantDelete) == 0 && len(tt.wantReplace) == 0
+			if got.IsEmpty() != wantEmpty {
+				t.Errorf("IsEmpty() = %v, want %v", got.IsEmpty(), wantEmpty)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// MaxDriftNames bounds each list of the drift of a site.
+const MaxDriftNames = 20
+
+// Drift compares the tmsources and source pods of the namespace of a site to
+// its desired state. It returns nil and an empty message when they match,
+// otherwise the bounded drift and a message counting every difference.
+func Drift(site *tmv1.Site, sites []tmv1.Site, sources []tmv1.TmSource, pods []v1.Pod) (*tmv1.SiteDrift, string) {
+	siteNames := map[string]bool{site.Name: true}
+	for _, s := range sites {
+		if s.Namespace == site.Namespace {
+			siteNames[s.Name] = true
+		}
+	}
+
+	var siteSources []tmv1.TmSource
+	sourceNames := map[string]bool{}
+	var unlinked []string
+	for _, tm := range sources {
+		if tm.Namespace != site.Namespace {
+			continue
+		}
+		sourceNames[tm.Name] = true
+		switch {
+		case !tm.DeletionTimestamp.IsZero():
+		case tm.Spec.Site == site.Name:
+			siteSources = append(siteSources, tm)
+		case !siteNames[tm.Spec.Site]:
+			unlinked = append(unlinked, tm.Name)
+		}
+	}
+
+	podsBySource := map[string][]*v1.Pod{}
+	var withoutSource []string
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Namespace != site.Namespace || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		name := SourceOf(pod)
+		podsBySource[name] = append(podsBySource[name], pod)
+		if podSite, _ := SiteOf(pod); !sourceNames[name] && podSite == site.Name {
+			withoutSource = append(withoutSource, pod.Name)
+		}
+	}
+
+	var withoutPods, outdated []string
+	for _, pod := range Pods([]tmv1.Site{*site}, siteSources) {
+		if len(podsBySource[SourceOf(pod)]) == 0 {
+			withoutPods = append(withoutPods, SourceOf(pod))
+		}
+	}
+	for _, tm := range siteSources {
+		template := SitePod(site, tm)
+		for _, pod := range podsBySource[tm.Name] {
+			if PodDrifted(pod, template) {
+				outdated = append(outdated, pod.Name)
+			}
+		}
+	}
+
+	var counts []string
+	count := func(names []string, what string) []string {
+		if len(names) == 0 {
+			return nil
+		}
+		counts = append(counts, fmt.Sprintf("%d %s", len(names), what))
+		sort.Strings(names)
+		if len(names) > MaxDriftNames {
+			names = names[:MaxDriftNames]
+		}
+		return names
+	}
+	drift := &tmv1.SiteDrift{
+		SourcesWithoutPods: count(withoutPods, "tmsources without pods"),
+		PodsWithoutSources: count(withoutSource, "pods without tmsources"),
+		OutdatedPods:       count(outdated, "outdated pods"),
+		UnlinkedSources:    count(unlinked, "tmsources of missing sites"),
+	}
+	if len(counts) == 0 {
+		return nil, ""
+	}
+	return drift, strings.Join(counts, ", ") + "."
+}
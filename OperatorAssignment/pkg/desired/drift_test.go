@@ -0,0 +1,99 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func TestDriftInSync(t *testing.T) {
+	s := site("site-lc-1", true)
+	sources := []tmv1.TmSource{source("tm-1", "site-lc-1", "rock")}
+	pods := []v1.Pod{*SitePod(&s, sources[0])}
+
+	if drift, message := Drift(&s, []tmv1.Site{s}, sources, pods); drift != nil || message != "" {
+		t.Errorf("expected no drift, got %+v %q", drift, message)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	s := site("site-lc-1", true)
+	other := site("site-lc-2", false)
+	running := source("tm-1", "site-lc-1", "rock")
+	missing := source("tm-2", "site-lc-1", "paper")
+	unlinked := source("tm-3", "site-lc-9", "smoke")
+	deleting := source("tm-4", "site-lc-9", "smoke")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	ofOther := source("tm-5", "site-lc-2", "scissors")
+
+	outdated := *SitePod(&s, running)
+	outdated.Name = PodName(running) + "-00000000"
+	outdated.Labels[LabelTemplateHashKey] = "00000000"
+	orphan := *SitePod(&s, source("tm-gone", "site-lc-1", "rock"))
+	// Pods of another site are left to it
+	otherOrphan := *SitePod(&other, source("tm-gone-2", "site-lc-2", "rock"))
+
+	drift, message := Drift(&s, []tmv1.Site{s, other},
+		[]tmv1.TmSource{running, missing, unlinked, deleting, ofOther},
+		[]v1.Pod{*SitePod(&s, running), outdated, orphan, otherOrphan})
+
+	want := &tmv1.SiteDrift{
+		SourcesWithoutPods: []string{"tm-2"},
+		PodsWithoutSources: []string{orphan.Name},
+		OutdatedPods:       []string{outdated.Name},
+		UnlinkedSources:    []string{"tm-3"},
+	}
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("expected %+v, got %+v", want, drift)
+	}
+	if expected := "1 tmsources without pods, 1 pods without tmsources, 1 outdated pods, 1 tmsources of missing sites."; message != expected {
+		t.Errorf("expected %q, got %q", expected, message)
+	}
+}
+
+func TestDriftSkipsStoppedSources(t *testing.T) {
+	s := site("site-lc-1", false)
+	sources := []tmv1.TmSource{source("tm-1", "site-lc-1", "rock")}
+
+	if drift, _ := Drift(&s, nil, sources, nil); drift != nil {
+		t.Errorf("expected a disabled site without pods to be in sync, got %+v", drift)
+	}
+}
+
+func TestDriftIsBounded(t *testing.T) {
+	s := site("site-lc-1", true)
+	var sources []tmv1.TmSource
+	for i := 0; i < MaxDriftNames+5; i++ {
+		sources = append(sources, source(fmt.Sprintf("tm-%02d", i), "site-lc-1", "rock"))
+	}
+
+	drift, message := Drift(&s, nil, sources, nil)
+	if drift == nil || len(drift.SourcesWithoutPods) != MaxDriftNames || drift.SourcesWithoutPods[0] != "tm-00" {
+		t.Errorf("expected the first %d tmsources, got %+v", MaxDriftNames, drift)
+	}
+	if expected := fmt.Sprintf("%d tmsources without pods.", MaxDriftNames+5); message != expected {
+		t.Errorf("expected %q, got %q", expected, message)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	v1 "k8s.io/api/core/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// Extensions merges the pod extensions of a site and of one of its tmsources.
+// Entries keep their declaration order, site first, and a tmsource entry
+// replaces the site entry with the same name, or mount path for mounts.
+func Extensions(site *tmv1.Site, tmsource tmv1.TmSource) tmv1.PodExtensions {
+	var base tmv1.PodExtensions
+	if site != nil {
+		base = site.Spec.PodExtensions
+	}
+	own := tmsource.Spec.PodExtensions
+
+	return tmv1.PodExtensions{
+		Sidecars:       mergeContainers(base.Sidecars, own.Sidecars),
+		InitContainers: mergeContainers(base.InitContainers, own.InitContainers),
+		Volumes:        mergeVolumes(base.Volumes, own.Volumes),
+		VolumeMounts:   mergeVolumeMounts(base.VolumeMounts, own.VolumeMounts),
+	}
+}
+
+// applyExtensions adds the merged extensions to a source pod.
+func applyExtensions(pod *v1.Pod, ext tmv1.PodExtensions) {
+	spec := &pod.Spec
+	for _, c := range ext.Sidecars {
+		spec.Containers = append(spec.Containers, *c.DeepCopy())
+	}
+	for _, c := range ext.InitContainers {
+		spec.InitContainers = append(spec.InitContainers, *c.DeepCopy())
+	}
+	for _, vol := range ext.Volumes {
+		spec.Volumes = append(spec.Volumes, *vol.DeepCopy())
+	}
+	for _, m := range ext.VolumeMounts {
+		spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, *m.DeepCopy())
+	}
+}
+
+func mergeContainers(base, own []v1.Container) []v1.Container {
+	out := append([]v1.Container(nil), base...)
+	for _, c := range own {
+		i := indexOf(len(out), func(i int) bool { return out[i].Name == c.Name })
+		if i < 0 {
+			out = append(out, c)
+		} else {
+			out[i] = c
+		}
+	}
+	return out
+}
+
+func mergeVolumes(base, own []v1.Volume) []v1.Volume {
+	out := append([]v1.Volume(nil), base...)
+	for _, vol := range own {
+		i := indexOf(len(out), func(i int) bool { return out[i].Name == vol.Name })
+		if i < 0 {
+			out = append(out, vol)
+		} else {
+			out[i] = vol
+		}
+	}
+	return out
+}
+
+func mergeVolumeMounts(base, own []v1.VolumeMount) []v1.VolumeMount {
+	out := append([]v1.VolumeMount(nil), base...)
+	for _, m := range own {
+		i := indexOf(len(out), func(i int) bool { return out[i].MountPath == m.MountPath })
+		if i < 0 {
+			out = append(out, m)
+		} else {
+			out[i] = m
+		}
+	}
+	return out
+}
+
+func indexOf(n int, match func(int) bool) int {
+	for i := 0; i < n; i++ {
+		if match(i) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,104 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func containerNames(containers []v1.Container) []string {
+	var out []string
+	for _, c := range containers {
+		out = append(out, c.Name)
+	}
+	return out
+}
+
+func TestExtensions(t *testing.T) {
+	s := site("site-lc-1", true)
+	s.Spec.Sidecars = []v1.Container{{Name: "log-shipper", Image: "fluent-bit:1.6"}, {Name: "proxy", Image: "envoy:1.16"}}
+	s.Spec.Volumes = []v1.Volume{{Name: "certs"}}
+	s.Spec.VolumeMounts = []v1.VolumeMount{{Name: "certs", MountPath: "/etc/certs"}}
+
+	tm := source("tm-1", "site-lc-1", "rock")
+	tm.Spec.Sidecars = []v1.Container{{Name: "proxy", Image: "envoy:1.17"}, {Name: "debug", Image: "busybox"}}
+	tm.Spec.VolumeMounts = []v1.VolumeMount{{Name: "certs", MountPath: "/etc/certs", ReadOnly: true}}
+
+	ext := Extensions(&s, tm)
+	if got, want := containerNames(ext.Sidecars), []string{"log-shipper", "proxy", "debug"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Sidecars = %v, want %v", got, want)
+	}
+	if ext.Sidecars[1].Image != "envoy:1.17" {
+		t.Errorf("the tmsource sidecar should replace the site one, got %s", ext.Sidecars[1].Image)
+	}
+	if len(ext.VolumeMounts) != 1 || !ext.VolumeMounts[0].ReadOnly {
+		t.Errorf("VolumeMounts = %v, want the tmsource mount of /etc/certs", ext.VolumeMounts)
+	}
+	if len(s.Spec.Sidecars) != 2 || s.Spec.Sidecars[1].Image != "envoy:1.16" {
+		t.Errorf("Extensions() modified the site")
+	}
+
+	if got := Extensions(nil, tm); !reflect.DeepEqual(got.Sidecars, tm.Spec.Sidecars) {
+		t.Errorf("without a site, Sidecars = %v, want the tmsource ones", got.Sidecars)
+	}
+}
+
+func TestSitePod(t *testing.T) {
+	s := site("site-lc-1", true)
+	tm := source("tm-1", "site-lc-1", "rock")
+	// A site without extensions only adds its service account
+	withoutSite := Pod(tm)
+	withoutSite.Spec.ServiceAccountName = ServiceAccountName(&s)
+	if !reflect.DeepEqual(SitePod(&s, tm).Spec, withoutSite.Spec) {
+		t.Errorf("a site without extensions changed the pod template")
+	}
+
+	s.Spec.InitContainers = []v1.Container{{Name: "wait-for-nats", Image: "busybox"}}
+	s.Spec.Sidecars = []v1.Container{{Name: "log-shipper", Image: "fluent-bit:1.6"}}
+	s.Spec.Volumes = []v1.Volume{{Name: "logs", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+	s.Spec.VolumeMounts = []v1.VolumeMount{{Name: "logs", MountPath: "/var/log/rocket"}}
+
+	pod := SitePod(&s, tm)
+	if got, want := containerNames(pod.Spec.Containers), []string{ContainerName, "log-shipper"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Containers = %v, want %v", got, want)
+	}
+	if got := containerNames(pod.Spec.InitContainers); !reflect.DeepEqual(got, []string{"wait-for-nats"}) {
+		t.Errorf("InitContainers = %v", got)
+	}
+	if len(pod.Spec.Volumes) != 1 || len(pod.Spec.Containers[0].VolumeMounts) != 1 {
+		t.Errorf("the volume should be mounted in the source container")
+	}
+	if len(pod.Spec.Containers[1].VolumeMounts) != 0 {
+		t.Errorf("mounts should not be added to the sidecars")
+	}
+	if !PodDrifted(Pod(tm), pod) {
+		t.Errorf("adding site extensions should roll the pod")
+	}
+	if pod.Name != SitePod(&s, tm).Name {
+		t.Errorf("Name is not stable for the same extensions")
+	}
+
+	var noExt tmv1.PodExtensions
+	if !reflect.DeepEqual(Extensions(nil, tm), noExt) {
+		t.Errorf("Extensions() = %v, want none", Extensions(nil, tm))
+	}
+}
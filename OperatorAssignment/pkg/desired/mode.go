@@ -0,0 +1,107 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// MissingSitePolicy is what a tmsource does while its site does not exist.
+type MissingSitePolicy string
+
+const (
+	// MissingSiteRun runs the tmsource as if its site was Enabled.
+	MissingSiteRun MissingSitePolicy = "Run"
+	// MissingSiteWait keeps the tmsource Pending without pod until its site
+	// is created.
+	MissingSiteWait MissingSitePolicy = "Wait"
+	// MissingSiteFail marks the tmsource Failed without pod until its site
+	// is created.
+	MissingSiteFail MissingSitePolicy = "Fail"
+)
+
+// Valid reports whether the policy is one of Run, Wait or Fail.
+func (p MissingSitePolicy) Valid() bool {
+	return p == MissingSiteRun || p == MissingSiteWait || p == MissingSiteFail
+}
+
+// Mode returns the mode a site runs in. Without mode the enabled field picks
+// Enabled or Disabled, and a source without a site runs as if Enabled.
+func Mode(site *tmv1.Site) tmv1.SiteMode {
+	switch {
+	case site == nil:
+		return tmv1.SiteModeEnabled
+	case site.Spec.Mode != "":
+		return site.Spec.Mode
+	case site.Spec.Enabled:
+		return tmv1.SiteModeEnabled
+	default:
+		return tmv1.SiteModeDisabled
+	}
+}
+
+// EffectiveMode returns the mode the sources of a site run in. A draining
+// site keeps the mode it last ran in until its dependents stopped.
+func EffectiveMode(site *tmv1.Site) tmv1.SiteMode {
+	if Draining(site) && site.Status.Mode != "" {
+		return site.Status.Mode
+	}
+	return Mode(site)
+}
+
+// SourceRuns reports whether a tmsource of a site should be running, before
+// the limits of the site are applied. Sources of a site blocked by its
+// dependencies do not run.
+func SourceRuns(site *tmv1.Site, tmsource tmv1.TmSource) bool {
+	if Blocked(site) {
+		return false
+	}
+	switch EffectiveMode(site) {
+	case tmv1.SiteModeEnabled:
+		return true
+	case tmv1.SiteModeDegraded:
+		return KeptDegraded(site, tmsource)
+	default:
+		return false
+	}
+}
+
+// KeptDegraded reports whether the degraded policy of a site keeps a tmsource
+// running. An invalid selector matches nothing.
+func KeptDegraded(site *tmv1.Site, tmsource tmv1.TmSource) bool {
+	var policy tmv1.DegradedPolicy
+	if site.Spec.Degraded != nil {
+		policy = *site.Spec.Degraded
+	}
+	if policy.Selector == nil && policy.MinPriority == "" {
+		policy.MinPriority = tmv1.TmSourcePriorityCritical
+	}
+
+	if policy.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(policy.Selector)
+		if err == nil && selector.Matches(labels.Set(tmsource.Labels)) {
+			return true
+		}
+	}
+	if policy.MinPriority != "" {
+		return priorityRanks[Priority(tmsource)] >= priorityRanks[policy.MinPriority]
+	}
+	return false
+}
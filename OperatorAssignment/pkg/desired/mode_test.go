@@ -0,0 +1,79 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func TestMode(t *testing.T) {
+	enabled, disabled := site("site-lc-1", true), site("site-lc-1", false)
+	degraded := site("site-lc-1", true)
+	degraded.Spec.Mode = tmv1.SiteModeDegraded
+
+	for _, tt := range []struct {
+		site *tmv1.Site
+		want tmv1.SiteMode
+	}{
+		{nil, tmv1.SiteModeEnabled},
+		{&enabled, tmv1.SiteModeEnabled},
+		{&disabled, tmv1.SiteModeDisabled},
+		{&degraded, tmv1.SiteModeDegraded},
+	} {
+		if got := Mode(tt.site); got != tt.want {
+			t.Errorf("Mode() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestSourceRuns(t *testing.T) {
+	degraded := func(policy *tmv1.DegradedPolicy) *tmv1.Site {
+		s := site("site-lc-1", false)
+		s.Spec.Mode = tmv1.SiteModeDegraded
+		s.Spec.Degraded = policy
+		return &s
+	}
+	labeled := source("tm-1", "site-lc-1", "rock")
+	labeled.Labels = map[string]string{"essential": "true"}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"essential": "true"}}
+
+	tests := []struct {
+		name   string
+		site   *tmv1.Site
+		source tmv1.TmSource
+		want   bool
+	}{
+		{"default policy keeps critical", degraded(nil), withPriority(source("tm-1", "site-lc-1", "rock"), tmv1.TmSourcePriorityCritical), true},
+		{"default policy sheds high", degraded(nil), withPriority(source("tm-1", "site-lc-1", "rock"), tmv1.TmSourcePriorityHigh), false},
+		{"min priority keeps higher", degraded(&tmv1.DegradedPolicy{MinPriority: tmv1.TmSourcePriorityNormal}), source("tm-1", "site-lc-1", "rock"), true},
+		{"min priority sheds lower", degraded(&tmv1.DegradedPolicy{MinPriority: tmv1.TmSourcePriorityNormal}), withPriority(source("tm-1", "site-lc-1", "rock"), tmv1.TmSourcePriorityLow), false},
+		{"selector keeps matching", degraded(&tmv1.DegradedPolicy{Selector: selector}), labeled, true},
+		{"selector sheds others", degraded(&tmv1.DegradedPolicy{Selector: selector}), source("tm-2", "site-lc-1", "rock"), false},
+		{"selector or priority", degraded(&tmv1.DegradedPolicy{Selector: selector, MinPriority: tmv1.TmSourcePriorityHigh}), withPriority(source("tm-2", "site-lc-1", "rock"), tmv1.TmSourcePriorityHigh), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SourceRuns(tt.site, tt.source); got != tt.want {
+				t.Errorf("SourceRuns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"net"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+const (
+	// SiteObjectPrefix prefixes the names of the network policy and the
+	// service account generated for a site.
+	SiteObjectPrefix = "rocket-source-"
+	// NatsDefaultPort is used when the NATS address of a site has no port.
+	NatsDefaultPort = 4222
+	// LabelDNSKey and LabelDNSValue select the cluster DNS pods.
+	LabelDNSKey   = "k8s-app"
+	LabelDNSValue = "kube-dns"
+)
+
+// NatsAddress returns the NATS address given to the source pods of a site.
+func NatsAddress(site *tmv1.Site) string {
+	if site == nil || site.Spec.NATS == nil || site.Spec.NATS.Address == "" {
+		return ContainerEnvNatValue
+	}
+	return site.Spec.NATS.Address
+}
+
+// NatsPort returns the port of the NATS address of a site.
+func NatsPort(site *tmv1.Site) int {
+	_, port, err := net.SplitHostPort(NatsAddress(site))
+	if err != nil {
+		return NatsDefaultPort
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return NatsDefaultPort
+	}
+	return n
+}
+
+// NetworkPolicyName returns the name of the network policy of a site.
+func NetworkPolicyName(site *tmv1.Site) string {
+	return siteObjectName(site)
+}
+
+// NetworkPolicy builds the network policy of the source pods of a site, owned
+// by the site, or nil when the site does not ask for one. The pods may only
+// reach NATS and the cluster DNS, and only the monitoring peers may reach them.
+func NetworkPolicy(site *tmv1.Site) *networkingv1.NetworkPolicy {
+	if site.Spec.NetworkPolicy == nil {
+		return nil
+	}
+
+	tcp, udp := v1.ProtocolTCP, v1.ProtocolUDP
+	natsPort, dnsPort := intstr.FromInt(NatsPort(site)), intstr.FromInt(53)
+	nats := networkingv1.NetworkPolicyEgressRule{
+		Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &natsPort}},
+	}
+	if endpoint := site.Spec.NATS; endpoint != nil && (endpoint.PodSelector != nil || endpoint.NamespaceSelector != nil) {
+		nats.To = []networkingv1.NetworkPolicyPeer{{
+			PodSelector:       endpoint.PodSelector.DeepCopy(),
+			NamespaceSelector: endpoint.NamespaceSelector.DeepCopy(),
+		}}
+	}
+	dns := networkingv1.NetworkPolicyEgressRule{
+		Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dnsPort}, {Protocol: &tcp, Port: &dnsPort}},
+		To: []networkingv1.NetworkPolicyPeer{{
+			NamespaceSelector: &metav1.LabelSelector{},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{LabelDNSKey: LabelDNSValue}},
+		}},
+	}
+
+	var ingress []networkingv1.NetworkPolicyIngressRule
+	if monitoring := site.Spec.NetworkPolicy.Monitoring; len(monitoring) > 0 {
+		rule := networkingv1.NetworkPolicyIngressRule{}
+		for _, peer := range monitoring {
+			rule.From = append(rule.From, *peer.DeepCopy())
+		}
+		ingress = append(ingress, rule)
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: siteObjectMeta(site, NetworkPolicyName(site)),
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{
+				LabelAppKey:  LabelAppValue,
+				LabelSiteKey: LabelValue(site.Name),
+			}},
+			Ingress:     ingress,
+			Egress:      []networkingv1.NetworkPolicyEgressRule{nats, dns},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+}
@@ -0,0 +1,134 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"strings"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func TestNatsPort(t *testing.T) {
+	tests := []struct {
+		address string
+		want    int
+	}{
+		{address: "", want: 4222},
+		{address: "nats.telemetry.svc:4333", want: 4333},
+		{address: "nats.telemetry.svc", want: NatsDefaultPort},
+		{address: "nats.telemetry.svc:http", want: NatsDefaultPort},
+	}
+
+	for _, tt := range tests {
+		s := site("site-lc-1", true)
+		s.Spec.NATS = &tmv1.NatsEndpoint{Address: tt.address}
+		if got := NatsPort(&s); got != tt.want {
+			t.Errorf("%q: expected port %d, got %d", tt.address, tt.want, got)
+		}
+	}
+}
+
+func TestSitePodNatsAddress(t *testing.T) {
+	s := site("site-lc-1", true)
+	tm := source("tm-1", "site-lc-1", "rock")
+	before := SitePod(&s, tm)
+	if env := before.Spec.Containers[0].Env[0]; env.Value != ContainerEnvNatValue {
+		t.Errorf("expected the default NATS address, got %s", env.Value)
+	}
+
+	s.Spec.NATS = &tmv1.NatsEndpoint{Address: "nats.telemetry.svc:4333"}
+	after := SitePod(&s, tm)
+	if env := after.Spec.Containers[0].Env[0]; env.Value != "nats.telemetry.svc:4333" {
+		t.Errorf("expected the site NATS address, got %s", env.Value)
+	}
+	if before.Name == after.Name {
+		t.Errorf("expected a new pod template for a new NATS address")
+	}
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	s := site("site-lc-1", true)
+	if policy := NetworkPolicy(&s); policy != nil {
+		t.Errorf("expected no network policy, got %s", policy.Name)
+	}
+
+	s.Spec.NetworkPolicy = &tmv1.SiteNetworkPolicy{}
+	policy := NetworkPolicy(&s)
+	if policy.Name != "rocket-source-site-lc-1" || !metav1.IsControlledBy(policy, &s) {
+		t.Errorf("expected rocket-source-site-lc-1 controlled by the site, got %s %v", policy.Name, policy.OwnerReferences)
+	}
+	if sel := policy.Spec.PodSelector.MatchLabels; sel[LabelAppKey] != LabelAppValue || sel[LabelSiteKey] != "site-lc-1" {
+		t.Errorf("expected the source pods of the site to be selected, got %v", sel)
+	}
+	if len(policy.Spec.PolicyTypes) != 2 || len(policy.Spec.Ingress) != 0 {
+		t.Errorf("expected every ingress to be denied, got %v %v", policy.Spec.PolicyTypes, policy.Spec.Ingress)
+	}
+	nats := policy.Spec.Egress[0]
+	if len(nats.To) != 0 || nats.Ports[0].Port.IntValue() != 4222 {
+		t.Errorf("expected egress to port 4222 of any destination, got %+v", nats)
+	}
+	dns := policy.Spec.Egress[1]
+	if len(dns.Ports) != 2 || dns.Ports[0].Port.IntValue() != 53 || dns.To[0].PodSelector.MatchLabels[LabelDNSKey] != LabelDNSValue {
+		t.Errorf("expected egress to the cluster DNS, got %+v", dns)
+	}
+
+	natsPods := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nats"}}
+	monitoring := networkingv1.NetworkPolicyPeer{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"name": "monitoring"}}}
+	s.Spec.NATS = &tmv1.NatsEndpoint{Address: "nats.telemetry.svc:4333", PodSelector: natsPods}
+	s.Spec.NetworkPolicy.Monitoring = []networkingv1.NetworkPolicyPeer{monitoring}
+	policy = NetworkPolicy(&s)
+	nats = policy.Spec.Egress[0]
+	if len(nats.To) != 1 || nats.To[0].PodSelector.MatchLabels["app"] != "nats" || nats.To[0].NamespaceSelector != nil || nats.Ports[0].Port.IntValue() != 4333 {
+		t.Errorf("expected egress to port 4333 of the NATS pods, got %+v", nats)
+	}
+	if len(policy.Spec.Ingress) != 1 || policy.Spec.Ingress[0].From[0].NamespaceSelector.MatchLabels["name"] != "monitoring" {
+		t.Errorf("expected ingress from monitoring, got %+v", policy.Spec.Ingress)
+	}
+}
+
+func TestNetworkPolicyLongSiteName(t *testing.T) {
+	s := site(strings.Repeat("s", validation.DNS1123SubdomainMaxLength), true)
+	s.Spec.NetworkPolicy = &tmv1.SiteNetworkPolicy{}
+	pod := SitePod(&s, source("tm-1", s.Name, "rock"))
+	if errs := validation.IsValidLabelValue(pod.Labels[LabelSiteKey]); len(errs) > 0 {
+		t.Errorf("site label %q is invalid: %v", pod.Labels[LabelSiteKey], errs)
+	}
+	if got, _ := SiteOf(pod); got != s.Name {
+		t.Errorf("SiteOf() does not return the full site name")
+	}
+
+	policy := NetworkPolicy(&s)
+	selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	if err != nil || !selector.Matches(labels.Set(pod.Labels)) {
+		t.Errorf("expected the policy to select the pods of the site, got %v %v", policy.Spec.PodSelector, err)
+	}
+	account := ServiceAccount(&s)
+	for _, name := range []string{policy.Name, account.Name} {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			t.Errorf("name %q is invalid: %v", name, errs)
+		}
+	}
+	if account.Labels[LabelSiteKey] != pod.Labels[LabelSiteKey] || policy.Labels[LabelSiteKey] != pod.Labels[LabelSiteKey] {
+		t.Errorf("expected the objects of the site to share the site label of its pods")
+	}
+}
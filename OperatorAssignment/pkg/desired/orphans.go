@@ -0,0 +1,95 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// Reasons for a source pod to be an orphan.
+const (
+	OrphanSourceNotFound = "TmSourceNotFound"
+	OrphanSourceDeleting = "TmSourceDeleting"
+	OrphanSiteDisabled   = "SiteDisabled"
+	OrphanSiteDegraded   = "SiteDegraded"
+	OrphanSiteBlocked    = "SiteBlocked"
+	OrphanSiteNotFound   = "SiteNotFound"
+)
+
+// Orphan is a source pod no tmsource wants anymore.
+type Orphan struct {
+	Pod    *v1.Pod
+	Reason string
+}
+
+// Orphans returns the source pods whose tmsource does not exist, is being
+// deleted, belongs to a disabled site or to a site blocked by its
+// dependencies, or is shed by a degraded site. The pods of a tmsource whose
+// site does not exist are orphans unless missingSite runs them. Pods created
+// after createdBefore are skipped, the informers may not have seen their
+// tmsource yet. Pods of an older template of a running tmsource are left to
+// its reconciler.
+func Orphans(sites []tmv1.Site, sources []tmv1.TmSource, pods []v1.Pod, missingSite MissingSitePolicy, createdBefore time.Time) []Orphan {
+	siteByKey := map[types.NamespacedName]*tmv1.Site{}
+	for i := range sites {
+		siteByKey[types.NamespacedName{Name: sites[i].Name, Namespace: sites[i].Namespace}] = &sites[i]
+	}
+	sourceByKey := map[types.NamespacedName]*tmv1.TmSource{}
+	for i := range sources {
+		sourceByKey[types.NamespacedName{Name: sources[i].Name, Namespace: sources[i].Namespace}] = &sources[i]
+	}
+
+	var orphans []Orphan
+	for i := range pods {
+		pod := &pods[i]
+		name := SourceOf(pod)
+		if name == "" || !pod.DeletionTimestamp.IsZero() || !pod.CreationTimestamp.Time.Before(createdBefore) {
+			continue
+		}
+
+		reason := ""
+		tm, ok := sourceByKey[types.NamespacedName{Name: name, Namespace: pod.Namespace}]
+		var site *tmv1.Site
+		if ok {
+			site = siteByKey[types.NamespacedName{Name: tm.Spec.Site, Namespace: tm.Namespace}]
+		}
+		switch {
+		case !ok:
+			reason = OrphanSourceNotFound
+		case !tm.DeletionTimestamp.IsZero():
+			reason = OrphanSourceDeleting
+		case site == nil && missingSite != "" && missingSite != MissingSiteRun:
+			reason = OrphanSiteNotFound
+		case Blocked(site):
+			reason = OrphanSiteBlocked
+		case EffectiveMode(site) == tmv1.SiteModeDegraded && !SourceRuns(site, *tm):
+			reason = OrphanSiteDegraded
+		case !SourceRuns(site, *tm):
+			reason = OrphanSiteDisabled
+		default:
+			continue
+		}
+		orphans = append(orphans, Orphan{Pod: pod.DeepCopy(), Reason: reason})
+	}
+
+	return orphans
+}
@@ -0,0 +1,95 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func TestOrphans(t *testing.T) {
+	now := time.Now()
+	created := func(tm tmv1.TmSource, age time.Duration) v1.Pod {
+		pod := *Pod(tm)
+		pod.CreationTimestamp = metav1.NewTime(now.Add(-age))
+		return pod
+	}
+
+	deleting := source("tm-deleting", "site-lc-1", "smoke")
+	deletionTime := metav1.NewTime(now)
+	deleting.DeletionTimestamp = &deletionTime
+
+	terminating := created(source("tm-gone-terminating", "site-lc-1", "rock"), time.Hour)
+	terminating.DeletionTimestamp = &deletionTime
+
+	drifted := source("tm-1", "site-lc-1", "rock")
+	drifted.Spec.MetricName = "stone"
+
+	degraded := site("site-lc-3", true)
+	degraded.Spec.Mode = tmv1.SiteModeDegraded
+
+	sites := []tmv1.Site{site("site-lc-1", true), site("site-lc-2", false), degraded}
+	sources := []tmv1.TmSource{
+		source("tm-1", "site-lc-1", "rock"),
+		source("tm-2", "site-lc-2", "paper"),
+		source("tm-3", "site-missing", "scissors"),
+		source("tm-shed", "site-lc-3", "rock"),
+		deleting,
+	}
+	pods := []v1.Pod{
+		created(source("tm-1", "site-lc-1", "rock"), time.Hour),
+		created(drifted, time.Hour),
+		created(source("tm-2", "site-lc-2", "paper"), time.Hour),
+		created(source("tm-3", "site-missing", "scissors"), time.Hour),
+		created(source("tm-shed", "site-lc-3", "rock"), time.Hour),
+		created(deleting, time.Hour),
+		created(source("tm-renamed", "site-lc-1", "rock"), time.Hour),
+		created(source("tm-young", "site-lc-1", "rock"), time.Second),
+		terminating,
+	}
+
+	got := map[string]string{}
+	for _, o := range Orphans(sites, sources, pods, MissingSiteRun, now.Add(-time.Minute)) {
+		got[SourceOf(o.Pod)] = o.Reason
+	}
+	want := map[string]string{
+		"tm-2":        OrphanSiteDisabled,
+		"tm-shed":     OrphanSiteDegraded,
+		"tm-deleting": OrphanSourceDeleting,
+		"tm-renamed":  OrphanSourceNotFound,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Orphans() = %v, want %v", got, want)
+	}
+
+	// Without site, the tmsource only runs under the Run policy
+	for _, policy := range []MissingSitePolicy{MissingSiteWait, MissingSiteFail} {
+		got := map[string]string{}
+		for _, o := range Orphans(sites, sources, pods, policy, now.Add(-time.Minute)) {
+			got[SourceOf(o.Pod)] = o.Reason
+		}
+		if got["tm-3"] != OrphanSiteNotFound || len(got) != len(want)+1 {
+			t.Errorf("Orphans(%s) = %v, want tm-3 %s besides %v", policy, got, OrphanSiteNotFound, want)
+		}
+	}
+}
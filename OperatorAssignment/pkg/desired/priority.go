@@ -0,0 +1,110 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// PriorityClassPrefix prefixes the PriorityClasses shipped with the operator,
+// see config/priority.
+const PriorityClassPrefix = "rocketlab-source-"
+
+// priorityRanks orders the priorities, higher first. Normal pods keep the
+// default priority of the cluster and get no PriorityClass.
+var priorityRanks = map[tmv1.TmSourcePriority]int{
+	tmv1.TmSourcePriorityCritical: 3,
+	tmv1.TmSourcePriorityHigh:     2,
+	tmv1.TmSourcePriorityNormal:   1,
+	tmv1.TmSourcePriorityLow:      0,
+}
+
+// Priority returns the priority of a tmsource, Normal when unset.
+func Priority(tmsource tmv1.TmSource) tmv1.TmSourcePriority {
+	if _, ok := priorityRanks[tmsource.Spec.Priority]; ok {
+		return tmsource.Spec.Priority
+	}
+	return tmv1.TmSourcePriorityNormal
+}
+
+// PriorityClassName returns the PriorityClass of the pods of a tmsource.
+func PriorityClassName(tmsource tmv1.TmSource) string {
+	switch p := Priority(tmsource); p {
+	case tmv1.TmSourcePriorityNormal:
+		return ""
+	default:
+		return PriorityClassPrefix + strings.ToLower(string(p))
+	}
+}
+
+// podRank returns the rank of the priority a pod was built with.
+func podRank(pod *v1.Pod) int {
+	for p, rank := range priorityRanks {
+		if p != tmv1.TmSourcePriorityNormal && pod.Spec.PriorityClassName == PriorityClassPrefix+strings.ToLower(string(p)) {
+			return rank
+		}
+	}
+	return priorityRanks[tmv1.TmSourcePriorityNormal]
+}
+
+// StartOrder sorts tmsources in the order they get a pod: higher priority
+// first, then oldest first.
+func StartOrder(sources []tmv1.TmSource) {
+	sort.SliceStable(sources, func(i, j int) bool {
+		ri, rj := priorityRanks[Priority(sources[i])], priorityRanks[Priority(sources[j])]
+		if ri != rj {
+			return ri > rj
+		}
+		ti, tj := sources[i].CreationTimestamp, sources[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return sources[i].Name < sources[j].Name
+	})
+}
+
+// ShedOrder sorts tmsources in the order they are stopped when their site
+// runs short: the reverse of StartOrder.
+func ShedOrder(sources []tmv1.TmSource) {
+	StartOrder(sources)
+	for i, j := 0, len(sources)-1; i < j; i, j = i+1, j-1 {
+		sources[i], sources[j] = sources[j], sources[i]
+	}
+}
+
+// sortPodsByPriority sorts pods higher priority first, then by namespace and
+// name.
+func sortPodsByPriority(pods []*v1.Pod) {
+	sortPods(pods)
+	sort.SliceStable(pods, func(i, j int) bool {
+		return podRank(pods[i]) > podRank(pods[j])
+	})
+}
+
+// sortPodsForShedding sorts pods lower priority first, then by namespace and
+// name.
+func sortPodsForShedding(pods []*v1.Pod) {
+	sortPods(pods)
+	sort.SliceStable(pods, func(i, j int) bool {
+		return podRank(pods[i]) < podRank(pods[j])
+	})
+}
@@ -0,0 +1,97 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func withPriority(tm tmv1.TmSource, p tmv1.TmSourcePriority) tmv1.TmSource {
+	tm.Spec.Priority = p
+	return tm
+}
+
+func orderNames(sources []tmv1.TmSource) []string {
+	var out []string
+	for _, tm := range sources {
+		out = append(out, tm.Name)
+	}
+	return out
+}
+
+func TestPriorityClassName(t *testing.T) {
+	normal := source("tm-1", "site-lc-1", "rock")
+	if got := PriorityClassName(normal); got != "" {
+		t.Errorf("PriorityClassName(Normal) = %q, want none", got)
+	}
+	if got := Pod(normal).Name; got != Pod(withPriority(normal, tmv1.TmSourcePriorityNormal)).Name {
+		t.Errorf("an explicit Normal priority changed the pod template")
+	}
+	if got := Pod(withPriority(normal, tmv1.TmSourcePriorityCritical)).Spec.PriorityClassName; got != "rocketlab-source-critical" {
+		t.Errorf("PriorityClassName = %q", got)
+	}
+}
+
+func TestStartAndShedOrder(t *testing.T) {
+	sources := []tmv1.TmSource{
+		createdAt(withPriority(source("tm-low", "site-lc-1", "rock"), tmv1.TmSourcePriorityLow), 1),
+		createdAt(source("tm-normal-new", "site-lc-1", "paper"), 3),
+		createdAt(source("tm-normal-old", "site-lc-1", "smoke"), 2),
+		createdAt(withPriority(source("tm-critical", "site-lc-1", "scissors"), tmv1.TmSourcePriorityCritical), 4),
+	}
+
+	StartOrder(sources)
+	if got, want := orderNames(sources), []string{"tm-critical", "tm-normal-old", "tm-normal-new", "tm-low"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StartOrder() = %v, want %v", got, want)
+	}
+	ShedOrder(sources)
+	if got, want := orderNames(sources), []string{"tm-low", "tm-normal-new", "tm-normal-old", "tm-critical"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ShedOrder() = %v, want %v", got, want)
+	}
+}
+
+func TestAdmitHoldsLowerPriorityFirst(t *testing.T) {
+	cpu := resource.MustParse("20m")
+	s := site("site-lc-1", true)
+	s.Spec.Limits = &tmv1.SiteLimits{CPU: &cpu}
+
+	q := Admit(&s, []tmv1.TmSource{
+		createdAt(source("tm-old", "site-lc-1", "rock"), 1),
+		createdAt(withPriority(source("tm-high", "site-lc-1", "paper"), tmv1.TmSourcePriorityHigh), 2),
+		createdAt(withPriority(source("tm-low", "site-lc-1", "smoke"), tmv1.TmSourcePriorityLow), 0),
+	})
+	if got, want := held(q), []string{"tm-low"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("held = %v, want %v", got, want)
+	}
+}
+
+func TestPlanCreatesHigherPriorityFirst(t *testing.T) {
+	pods := []*v1.Pod{
+		Pod(source("tm-a", "site-lc-1", "rock")),
+		Pod(withPriority(source("tm-b", "site-lc-1", "paper"), tmv1.TmSourcePriorityLow)),
+		Pod(withPriority(source("tm-c", "site-lc-1", "smoke"), tmv1.TmSourcePriorityHigh)),
+	}
+	if got, want := names(Plan(pods, nil).Create), []string{"tm-c", "tm-a", "tm-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan().Create = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// Requests given to the rocket-source container when the tmsource sets
+// neither a request nor a limit.
+var (
+	DefaultSourceCPU    = resource.MustParse("10m")
+	DefaultSourceMemory = resource.MustParse("16Mi")
+)
+
+// Quota is the outcome of the limits of a site on its tmsources.
+type Quota struct {
+	// Usage of the admitted tmsources.
+	Usage tmv1.SiteUsage
+	// Held maps the tmsources over a limit to the reason they are held.
+	Held map[string]string
+}
+
+// IsHeld reports whether a tmsource is held back by the limits.
+func (q Quota) IsHeld(tmsource tmv1.TmSource) bool {
+	_, held := q.Held[tmsource.Name]
+	return held
+}
+
+// SourceResources returns the resources of the rocket-source container of a
+// tmsource, those of its site when it sets none. Like for any container a
+// missing request defaults to the limit, then to DefaultSourceCPU and
+// DefaultSourceMemory.
+func SourceResources(site *tmv1.Site, tmsource tmv1.TmSource) v1.ResourceRequirements {
+	resources := tmsource.Spec.Resources.DeepCopy()
+	if len(resources.Requests) == 0 && len(resources.Limits) == 0 && site != nil && site.Spec.Resources != nil {
+		resources = site.Spec.Resources.DeepCopy()
+	}
+	if resources.Requests == nil {
+		resources.Requests = v1.ResourceList{}
+	}
+	defaults := v1.ResourceList{v1.ResourceCPU: DefaultSourceCPU, v1.ResourceMemory: DefaultSourceMemory}
+	for name, value := range defaults {
+		if _, ok := resources.Requests[name]; ok {
+			continue
+		}
+		if limit, ok := resources.Limits[name]; ok {
+			value = limit
+		}
+		resources.Requests[name] = value.DeepCopy()
+	}
+	return *resources
+}
+
+// Admit applies the limits of a site to its tmsources, higher priority then
+// older tmsources first.
+// A tmsource is admitted when it fits in what the tmsources admitted before it
+// left, so a small tmsource can still run after a bigger one was held.
+func Admit(site *tmv1.Site, sources []tmv1.TmSource) Quota {
+	quota := Quota{Held: map[string]string{}}
+	quota.Usage.CPU = *resource.NewMilliQuantity(0, resource.DecimalSI)
+	quota.Usage.Memory = *resource.NewQuantity(0, resource.BinarySI)
+
+	var limits tmv1.SiteLimits
+	if site.Spec.Limits != nil {
+		limits = *site.Spec.Limits
+	}
+
+	for _, tm := range admissionOrder(site, sources) {
+		// Tmsources stopped by the mode of the site use nothing
+		if !SourceRuns(site, tm) {
+			continue
+		}
+		requests := SourceResources(site, tm).Requests
+		cpu, memory := quota.Usage.CPU.DeepCopy(), quota.Usage.Memory.DeepCopy()
+		cpu.Add(requests[v1.ResourceCPU])
+		memory.Add(requests[v1.ResourceMemory])
+
+		switch {
+		case limits.MaxSources != nil && quota.Usage.Sources+1 > *limits.MaxSources:
+			quota.Held[tm.Name] = fmt.Sprintf("Site %s runs at most %d tmsources.", site.Name, *limits.MaxSources)
+		case limits.CPU != nil && cpu.Cmp(*limits.CPU) > 0:
+			quota.Held[tm.Name] = fmt.Sprintf("Site %s limits cpu to %s, %s is used and the tmsource requests %s.",
+				site.Name, limits.CPU.String(), quota.Usage.CPU.String(), requests.Cpu().String())
+		case limits.Memory != nil && memory.Cmp(*limits.Memory) > 0:
+			quota.Held[tm.Name] = fmt.Sprintf("Site %s limits memory to %s, %s is used and the tmsource requests %s.",
+				site.Name, limits.Memory.String(), quota.Usage.Memory.String(), requests.Memory().String())
+		default:
+			quota.Usage.Sources++
+			quota.Usage.CPU, quota.Usage.Memory = cpu, memory
+		}
+	}
+	quota.Usage.Pending = int32(len(quota.Held))
+
+	return quota
+}
+
+// admissionOrder returns the running tmsources of a site in StartOrder.
+func admissionOrder(site *tmv1.Site, sources []tmv1.TmSource) []tmv1.TmSource {
+	var out []tmv1.TmSource
+	for _, tm := range sources {
+		if tm.Namespace == site.Namespace && tm.Spec.Site == site.Name && tm.DeletionTimestamp.IsZero() {
+			out = append(out, tm)
+		}
+	}
+	StartOrder(out)
+	return out
+}
+
+// Exceeds returns why adding or updating tmsource goes over the limits of its
+// site, counting every other tmsource of the site whether held or not, or an
+// empty string when it fits.
+func Exceeds(site *tmv1.Site, sources []tmv1.TmSource, tmsource tmv1.TmSource) string {
+	if site.Spec.Limits == nil {
+		return ""
+	}
+	limits := *site.Spec.Limits
+
+	all := []tmv1.TmSource{tmsource}
+	for _, tm := range sources {
+		if tm.Name != tmsource.Name {
+			all = append(all, tm)
+		}
+	}
+	var count int32
+	cpu := *resource.NewMilliQuantity(0, resource.DecimalSI)
+	memory := *resource.NewQuantity(0, resource.BinarySI)
+	for _, tm := range admissionOrder(site, all) {
+		requests := SourceResources(site, tm).Requests
+		count++
+		cpu.Add(requests[v1.ResourceCPU])
+		memory.Add(requests[v1.ResourceMemory])
+	}
+
+	switch {
+	case limits.MaxSources != nil && count > *limits.MaxSources:
+		return fmt.Sprintf("Site %s runs at most %d tmsources.", site.Name, *limits.MaxSources)
+	case limits.CPU != nil && cpu.Cmp(*limits.CPU) > 0:
+		return fmt.Sprintf("Site %s limits cpu to %s, its tmsources would request %s.", site.Name, limits.CPU.String(), cpu.String())
+	case limits.Memory != nil && memory.Cmp(*limits.Memory) > 0:
+		return fmt.Sprintf("Site %s limits memory to %s, its tmsources would request %s.", site.Name, limits.Memory.String(), memory.String())
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func withCPU(tm tmv1.TmSource, request string) tmv1.TmSource {
+	tm.Spec.Resources.Requests = v1.ResourceList{v1.ResourceCPU: resource.MustParse(request)}
+	return tm
+}
+
+func createdAt(tm tmv1.TmSource, minutes int) tmv1.TmSource {
+	tm.CreationTimestamp = metav1.NewTime(time.Date(2020, 1, 1, 0, minutes, 0, 0, time.UTC))
+	return tm
+}
+
+func held(q Quota) []string {
+	var out []string
+	for name := range q.Held {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestSourceResources(t *testing.T) {
+	defaulted := SourceResources(nil, source("tm-1", "site-lc-1", "rock"))
+	if cpu := defaulted.Requests[v1.ResourceCPU]; cpu.Cmp(DefaultSourceCPU) != 0 {
+		t.Errorf("default cpu request = %s", cpu.String())
+	}
+
+	limited := source("tm-2", "site-lc-1", "rock")
+	limited.Spec.Resources.Limits = v1.ResourceList{v1.ResourceMemory: resource.MustParse("8Mi")}
+	if memory := SourceResources(nil, limited).Requests[v1.ResourceMemory]; memory.String() != "8Mi" {
+		t.Errorf("memory request = %s, want the limit", memory.String())
+	}
+	if limited.Spec.Resources.Requests != nil {
+		t.Errorf("the tmsource was modified")
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	limited := func(maxSources int32, cpu string) tmv1.Site {
+		s := site("site-lc-1", true)
+		s.Spec.Limits = &tmv1.SiteLimits{}
+		if maxSources >= 0 {
+			s.Spec.Limits.MaxSources = &maxSources
+		}
+		if cpu != "" {
+			q := resource.MustParse(cpu)
+			s.Spec.Limits.CPU = &q
+		}
+		return s
+	}
+
+	tests := []struct {
+		name      string
+		site      tmv1.Site
+		sources   []tmv1.TmSource
+		wantHeld  []string
+		wantCPU   string
+		wantCount int32
+	}{
+		{
+			name:      "no limits admits everything",
+			site:      site("site-lc-1", true),
+			sources:   []tmv1.TmSource{source("tm-1", "site-lc-1", "rock"), source("tm-2", "site-lc-1", "paper")},
+			wantCPU:   "20m",
+			wantCount: 2,
+		},
+		{
+			name: "max sources keeps the oldest",
+			site: limited(1, ""),
+			sources: []tmv1.TmSource{
+				createdAt(source("tm-1", "site-lc-1", "rock"), 2),
+				createdAt(source("tm-2", "site-lc-1", "paper"), 1),
+			},
+			wantHeld:  []string{"tm-1"},
+			wantCPU:   "10m",
+			wantCount: 1,
+		},
+		{
+			name: "a smaller source fits after a held one",
+			site: limited(-1, "100m"),
+			sources: []tmv1.TmSource{
+				createdAt(withCPU(source("tm-1", "site-lc-1", "rock"), "60m"), 1),
+				createdAt(withCPU(source("tm-2", "site-lc-1", "paper"), "50m"), 2),
+				createdAt(withCPU(source("tm-3", "site-lc-1", "smoke"), "40m"), 3),
+			},
+			wantHeld:  []string{"tm-2"},
+			wantCPU:   "100m",
+			wantCount: 2,
+		},
+		{
+			name:      "sources of other sites are ignored",
+			site:      limited(0, ""),
+			sources:   []tmv1.TmSource{source("tm-1", "site-lc-2", "rock")},
+			wantCPU:   "0",
+			wantCount: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := Admit(&tt.site, tt.sources)
+			if got := held(q); !reflect.DeepEqual(got, tt.wantHeld) {
+				t.Errorf("held = %v, want %v", got, tt.wantHeld)
+			}
+			if q.Usage.CPU.String() != tt.wantCPU || q.Usage.Sources != tt.wantCount || q.Usage.Pending != int32(len(tt.wantHeld)) {
+				t.Errorf("usage = %d sources %s cpu %d pending", q.Usage.Sources, q.Usage.CPU.String(), q.Usage.Pending)
+			}
+		})
+	}
+}
+
+func TestPodsSkipsHeldSources(t *testing.T) {
+	one := int32(1)
+	s := site("site-lc-1", true)
+	s.Spec.Limits = &tmv1.SiteLimits{MaxSources: &one}
+
+	got := names(Pods([]tmv1.Site{s}, []tmv1.TmSource{source("tm-1", "site-lc-1", "rock"), source("tm-2", "site-lc-1", "paper")}))
+	if want := []string{"tm-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pods() = %v, want %v", got, want)
+	}
+}
+
+func TestExceeds(t *testing.T) {
+	two := int32(2)
+	cpu := resource.MustParse("50m")
+	s := site("site-lc-1", true)
+	s.Spec.Limits = &tmv1.SiteLimits{MaxSources: &two, CPU: &cpu}
+	existing := []tmv1.TmSource{withCPU(source("tm-1", "site-lc-1", "rock"), "30m"), source("tm-other", "site-lc-2", "rock")}
+
+	if got := Exceeds(&s, existing, source("tm-2", "site-lc-1", "paper")); got != "" {
+		t.Errorf("Exceeds() = %q, want it to fit", got)
+	}
+	if got := Exceeds(&s, existing, withCPU(source("tm-2", "site-lc-1", "paper"), "30m")); got == "" {
+		t.Errorf("Exceeds() fits over the cpu limit")
+	}
+	if got := Exceeds(&s, existing, withCPU(source("tm-1", "site-lc-1", "rock"), "50m")); got != "" {
+		t.Errorf("Exceeds() = %q, an update replaces the old tmsource", got)
+	}
+	full := append(existing, source("tm-2", "site-lc-1", "paper"))
+	if got := Exceeds(&s, full, source("tm-3", "site-lc-1", "smoke")); got == "" {
+		t.Errorf("Exceeds() fits over the max sources")
+	}
+}
@@ -0,0 +1,182 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// Defaults of the remediation policy of a tmsource.
+const (
+	DefaultRemediationMaxRestarts = 5
+	DefaultRemediationWindow      = 10 * time.Minute
+	RemediationBackoffBase        = 10 * time.Second
+	RemediationBackoffMax         = 10 * time.Minute
+)
+
+// Reasons of the Ready condition of a remediated tmsource.
+const (
+	RemediationReasonRecreated = "PodRemediated"
+	RemediationReasonBackOff   = "RemediationBackOff"
+	RemediationReasonFailed    = "RemediationFailed"
+)
+
+// Remediation is what the remediation policy of a tmsource asks for.
+type Remediation struct {
+	// Status to record on the tmsource, nil without policy.
+	Status *tmv1.RemediationStatus
+	// Act is true when the pod has to be deleted now.
+	Act bool
+	// Reason and Message of the Ready condition when the pod was remediated
+	// or the tmsource is suspended, empty otherwise.
+	Reason  string
+	Message string
+	// Requeue is when to evaluate the policy again, zero without deadline.
+	Requeue time.Duration
+}
+
+// Remediate evaluates the remediation policy of a tmsource against its current
+// pod, nil when it has none. Restarts are counted over a window starting when
+// the pod is created, or first observed for an older pod. A spec change starts
+// the attempts over.
+func Remediate(tm tmv1.TmSource, pod *v1.Pod, now time.Time) Remediation {
+	policy := tm.Spec.Remediation
+	if policy == nil {
+		return Remediation{}
+	}
+	status := tm.Status.Remediation.DeepCopy()
+	if status == nil || status.ObservedGeneration != tm.Generation {
+		status = &tmv1.RemediationStatus{ObservedGeneration: tm.Generation}
+	}
+	r := Remediation{Status: status}
+
+	if status.Suspended {
+		if policy.Action == tmv1.RemediationFail {
+			r.Reason, r.Message = RemediationReasonFailed, status.Message+" Change the tmsource to retry."
+			return r
+		}
+		if status.RetryAfter != nil && now.Before(status.RetryAfter.Time) {
+			r.Reason, r.Message = RemediationReasonBackOff, status.Message+" Backing off until "+status.RetryAfter.UTC().Format(time.RFC3339)+"."
+			r.Requeue = status.RetryAfter.Sub(now)
+			return r
+		}
+		// The backoff is over, the tmsource gets a pod again
+		status.Suspended = false
+	}
+	if pod == nil || !pod.DeletionTimestamp.IsZero() {
+		return r
+	}
+
+	restarts := Restarts(pod)
+	window := DefaultRemediationWindow
+	if policy.Window != nil {
+		window = policy.Window.Duration
+	}
+	if status.WindowStart == nil || now.Sub(status.WindowStart.Time) > window || restarts < status.WindowRestarts {
+		// All the restarts of a pod created within the window count
+		created := pod.CreationTimestamp.Time
+		if !created.IsZero() && now.Sub(created) <= window {
+			status.WindowStart = &metav1.Time{Time: created}
+			status.WindowRestarts = 0
+		} else {
+			status.WindowStart = &metav1.Time{Time: now}
+			status.WindowRestarts = restarts
+		}
+	}
+
+	maxRestarts := policy.MaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = DefaultRemediationMaxRestarts
+	}
+	var cause string
+	switch {
+	case restarts-status.WindowRestarts >= maxRestarts:
+		cause = fmt.Sprintf("Pod %s restarted %d times within %s.", pod.Name, restarts-status.WindowRestarts, window)
+	case policy.StalledAfter != nil && !PodReady(pod):
+		ready := pod.CreationTimestamp.Add(policy.StalledAfter.Duration)
+		if now.Before(ready) {
+			r.Requeue = ready.Sub(now)
+			return r
+		}
+		cause = fmt.Sprintf("Pod %s is not ready %s after its creation.", pod.Name, policy.StalledAfter.Duration)
+	default:
+		return r
+	}
+	// The previous attempt is still backing off
+	if status.RetryAfter != nil && now.Before(status.RetryAfter.Time) {
+		r.Requeue = status.RetryAfter.Sub(now)
+		return r
+	}
+
+	status.Attempts++
+	delay := remediationBackoff(status.Attempts)
+	status.LastAttemptTime = &metav1.Time{Time: now}
+	status.RetryAfter = &metav1.Time{Time: now.Add(delay)}
+	status.Message = cause
+	status.WindowStart, status.WindowRestarts = nil, 0
+	r.Act = true
+
+	switch policy.Action {
+	case tmv1.RemediationBackOff:
+		status.Suspended = true
+		r.Reason, r.Message = RemediationReasonBackOff, cause+" Backing off until "+status.RetryAfter.UTC().Format(time.RFC3339)+"."
+		r.Requeue = delay
+	case tmv1.RemediationFail:
+		status.Suspended = true
+		r.Reason, r.Message = RemediationReasonFailed, cause+" Change the tmsource to retry."
+	default:
+		r.Reason, r.Message = RemediationReasonRecreated, cause+fmt.Sprintf(" Recreating it, attempt %d.", status.Attempts)
+	}
+	return r
+}
+
+// Suspended reports whether the remediation policy of a tmsource withholds
+// its pod.
+func Suspended(tm tmv1.TmSource) bool {
+	return tm.Spec.Remediation != nil && tm.Status.Remediation != nil && tm.Status.Remediation.Suspended &&
+		tm.Status.Remediation.ObservedGeneration == tm.Generation
+}
+
+// Restarts sums the restarts of the containers of a pod.
+func Restarts(pod *v1.Pod) int32 {
+	var restarts int32
+	for _, c := range pod.Status.InitContainerStatuses {
+		restarts += c.RestartCount
+	}
+	for _, c := range pod.Status.ContainerStatuses {
+		restarts += c.RestartCount
+	}
+	return restarts
+}
+
+// remediationBackoff doubles the wait after each attempt.
+func remediationBackoff(attempts int32) time.Duration {
+	delay := RemediationBackoffBase
+	for i := int32(1); i < attempts && delay < RemediationBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > RemediationBackoffMax {
+		delay = RemediationBackoffMax
+	}
+	return delay
+}
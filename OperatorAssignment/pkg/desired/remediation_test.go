@@ -0,0 +1,186 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func withRemediation(tm tmv1.TmSource, action tmv1.RemediationAction) tmv1.TmSource {
+	tm.Spec.Remediation = &tmv1.RemediationPolicy{MaxRestarts: 3, Action: action}
+	return tm
+}
+
+func restarted(pod *v1.Pod, restarts int32) *v1.Pod {
+	pod = pod.DeepCopy()
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: ContainerName, RestartCount: restarts}}
+	return pod
+}
+
+// remediate evaluates the policy and records its status, like the reconciler.
+func remediate(tm *tmv1.TmSource, pod *v1.Pod, now time.Time) Remediation {
+	r := Remediate(*tm, pod, now)
+	tm.Status.Remediation = r.Status
+	return r
+}
+
+func TestRemediateRecreatePod(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	tm := withRemediation(source("tm-1", "site-lc-1", "rock"), tmv1.RemediationRecreatePod)
+	pod := Pod(tm)
+
+	if r := Remediate(source("tm-1", "site-lc-1", "rock"), restarted(pod, 10), now); r.Status != nil || r.Act {
+		t.Errorf("without policy, Remediate() = %+v, want nothing", r)
+	}
+
+	// Restarts before the policy saw the pod are not counted
+	if r := remediate(&tm, restarted(pod, 10), now); r.Act {
+		t.Errorf("the restarts of the first observation should be the baseline")
+	}
+	if r := remediate(&tm, restarted(pod, 12), now.Add(time.Minute)); r.Act {
+		t.Errorf("2 restarts should not remediate")
+	}
+	r := remediate(&tm, restarted(pod, 13), now.Add(2*time.Minute))
+	if !r.Act || r.Reason != RemediationReasonRecreated || tm.Status.Remediation.Attempts != 1 {
+		t.Fatalf("3 restarts within the window, Remediate() = %+v", r)
+	}
+	if got := tm.Status.Remediation.RetryAfter.Sub(now.Add(2 * time.Minute)); got != RemediationBackoffBase {
+		t.Errorf("first backoff = %s, want %s", got, RemediationBackoffBase)
+	}
+	if Suspended(tm) {
+		t.Errorf("RecreatePod should not withhold the pod")
+	}
+
+	// The new pod crashes during the backoff, it is left alone until its end
+	attempt := now.Add(2 * time.Minute)
+	remediate(&tm, restarted(pod, 0), attempt.Add(time.Second))
+	if r := remediate(&tm, restarted(pod, 3), attempt.Add(5*time.Second)); r.Act || r.Requeue != 5*time.Second {
+		t.Errorf("during the backoff, Remediate() = %+v, want a requeue at its end", r)
+	}
+	if r := remediate(&tm, restarted(pod, 3), attempt.Add(10*time.Second)); !r.Act || tm.Status.Remediation.Attempts != 2 {
+		t.Errorf("after the backoff, Remediate() = %+v, want a second attempt", r)
+	}
+	if got := tm.Status.Remediation.RetryAfter.Sub(attempt.Add(10 * time.Second)); got != 2*RemediationBackoffBase {
+		t.Errorf("second backoff = %s, want it doubled", got)
+	}
+
+	// A spec change starts over
+	tm.Generation++
+	if r := remediate(&tm, restarted(pod, 0), attempt.Add(time.Minute)); r.Act || tm.Status.Remediation.Attempts != 0 {
+		t.Errorf("after a spec change, Attempts = %d, want 0", tm.Status.Remediation.Attempts)
+	}
+}
+
+func TestRemediateWindow(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	tm := withRemediation(source("tm-1", "site-lc-1", "rock"), tmv1.RemediationRecreatePod)
+	tm.Spec.Remediation.Window = &metav1.Duration{Duration: 5 * time.Minute}
+	pod := Pod(tm)
+
+	remediate(&tm, restarted(pod, 0), now)
+	remediate(&tm, restarted(pod, 2), now.Add(4*time.Minute))
+	// The window ended, its restarts are forgotten
+	if r := remediate(&tm, restarted(pod, 3), now.Add(6*time.Minute)); r.Act {
+		t.Errorf("restarts of a previous window should not count")
+	}
+	if r := remediate(&tm, restarted(pod, 6), now.Add(8*time.Minute)); !r.Act {
+		t.Errorf("3 restarts within the new window should remediate")
+	}
+
+	// All the restarts of a young pod are within the window
+	fresh := withRemediation(source("tm-2", "site-lc-1", "paper"), tmv1.RemediationRecreatePod)
+	young := restarted(Pod(fresh), 3)
+	young.CreationTimestamp = metav1.Time{Time: now.Add(-time.Minute)}
+	if r := remediate(&fresh, young, now); !r.Act {
+		t.Errorf("a pod restarting 3 times since its creation a minute ago should be remediated")
+	}
+}
+
+func TestRemediateBackOff(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	tm := withRemediation(source("tm-1", "site-lc-1", "rock"), tmv1.RemediationBackOff)
+	pod := Pod(tm)
+
+	remediate(&tm, restarted(pod, 0), now)
+	r := remediate(&tm, restarted(pod, 3), now)
+	if !r.Act || r.Reason != RemediationReasonBackOff || r.Requeue != RemediationBackoffBase {
+		t.Fatalf("Remediate() = %+v, want a backoff", r)
+	}
+	if !Suspended(tm) {
+		t.Fatalf("BackOff should withhold the pod")
+	}
+	s := site("site-lc-1", true)
+	if got := names(Pods([]tmv1.Site{s}, []tmv1.TmSource{tm})); len(got) != 0 {
+		t.Errorf("Pods() = %v, want none while backing off", got)
+	}
+
+	if r := remediate(&tm, nil, now.Add(5*time.Second)); r.Reason != RemediationReasonBackOff || r.Requeue != 5*time.Second {
+		t.Errorf("during the backoff, Remediate() = %+v", r)
+	}
+	if r := remediate(&tm, nil, now.Add(RemediationBackoffBase)); r.Reason != "" || Suspended(tm) {
+		t.Errorf("after the backoff, Remediate() = %+v, want the pod back", r)
+	}
+}
+
+func TestRemediateFail(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	tm := withRemediation(source("tm-1", "site-lc-1", "rock"), tmv1.RemediationFail)
+	pod := Pod(tm)
+
+	remediate(&tm, restarted(pod, 0), now)
+	if r := remediate(&tm, restarted(pod, 3), now); !r.Act || r.Reason != RemediationReasonFailed {
+		t.Fatalf("Remediate() = %+v, want a failure", r)
+	}
+	if r := remediate(&tm, nil, now.Add(time.Hour)); r.Reason != RemediationReasonFailed || !Suspended(tm) {
+		t.Errorf("a failed tmsource should stay suspended, got %+v", r)
+	}
+
+	tm.Generation++
+	if Suspended(tm) {
+		t.Errorf("a spec change should resume the tmsource")
+	}
+	if r := remediate(&tm, nil, now.Add(time.Hour)); r.Reason != "" {
+		t.Errorf("after a spec change, Remediate() = %+v", r)
+	}
+}
+
+func TestRemediateStalled(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	tm := withRemediation(source("tm-1", "site-lc-1", "rock"), tmv1.RemediationRecreatePod)
+	tm.Spec.Remediation.StalledAfter = &metav1.Duration{Duration: 2 * time.Minute}
+	pod := Pod(tm)
+	pod.CreationTimestamp = metav1.Time{Time: now}
+
+	if r := remediate(&tm, pod, now.Add(time.Minute)); r.Act || r.Requeue != time.Minute {
+		t.Errorf("a young pod, Remediate() = %+v, want a requeue when it stalls", r)
+	}
+	if r := remediate(&tm, pod, now.Add(2*time.Minute)); !r.Act {
+		t.Errorf("a pod not ready after 2m should be remediated")
+	}
+
+	readyPod := pod.DeepCopy()
+	readyPod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	if r := remediate(&tm, readyPod, now.Add(time.Hour)); r.Act {
+		t.Errorf("a ready pod should not be remediated")
+	}
+}
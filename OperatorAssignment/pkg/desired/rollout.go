@@ -0,0 +1,231 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// Defaults of the image rollout of a site.
+const (
+	DefaultCanaryPercent    = 10
+	DefaultBakeTime         = 5 * time.Minute
+	DefaultProgressDeadline = 10 * time.Minute
+
+	// RolloutCheckInterval is how often a rollout in progress is evaluated,
+	// the site does not watch the canary pods.
+	RolloutCheckInterval = 15 * time.Second
+)
+
+// failingWaitReasons are the waiting reasons of a container failing a canary.
+var failingWaitReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+}
+
+// Image returns the rocket-source image of the pods of a tmsource: the
+// rollout image for a canary, the stable image of the site otherwise. Without
+// spec.rollout the image of the site applies whatever a past rollout did.
+func Image(site *tmv1.Site, tmsource tmv1.TmSource) string {
+	if site == nil || site.Spec.Rollout == nil || site.Status.Rollout == nil {
+		return SiteImage(site)
+	}
+	rollout := site.Status.Rollout
+	if rollout.Phase == tmv1.RolloutCanary {
+		for _, name := range rollout.Canaries {
+			if name == tmsource.Name {
+				return rollout.Image
+			}
+		}
+	}
+	if rollout.StableImage != "" {
+		return rollout.StableImage
+	}
+	return SiteImage(site)
+}
+
+// Rollout advances the image rollout of a site given its tmsources and their
+// pods. It returns the new rollout status and when to evaluate it again, zero
+// once it is over. A new image starts with the lowest priority tmsources as
+// canaries, every tmsource gets it once the canaries baked, and the canaries
+// go back to the stable image when they fail. Once spec.rollout is removed the
+// status is cleared, after reporting the rollback of a rollout in progress.
+func Rollout(site *tmv1.Site, sources []tmv1.TmSource, pods []v1.Pod, now time.Time) (*tmv1.RolloutStatus, time.Duration) {
+	spec := site.Spec.Rollout
+	status := site.Status.Rollout.DeepCopy()
+	if spec == nil {
+		if status == nil || status.Phase != tmv1.RolloutCanary {
+			return nil, 0
+		}
+		rollback(status, "The rollout was removed from the site.")
+		return status, 0
+	}
+
+	if status == nil || status.Image != spec.Image {
+		return startRollout(site, status, sources, now)
+	}
+	if status.Phase != tmv1.RolloutCanary {
+		return status, 0
+	}
+
+	sourceByName := map[string]tmv1.TmSource{}
+	for _, tm := range sources {
+		sourceByName[tm.Name] = tm
+	}
+	podByName := map[string]*v1.Pod{}
+	for i := range pods {
+		podByName[pods[i].Name] = &pods[i]
+	}
+
+	ready := 0
+	for _, name := range status.Canaries {
+		tm, ok := sourceByName[name]
+		if !ok || !tm.DeletionTimestamp.IsZero() || !SourceRuns(site, tm) {
+			continue
+		}
+		pod := podByName[SitePod(site, tm).Name]
+		if failure := canaryFailure(tm, pod); failure != "" {
+			rollback(status, failure)
+			return status, 0
+		}
+		if pod != nil && PodReady(pod) {
+			ready++
+		}
+	}
+
+	if ready < len(status.Canaries) {
+		status.BakeStartTime = nil
+		deadline := status.StartTime.Add(durationOr(spec.ProgressDeadline, DefaultProgressDeadline))
+		if !now.Before(deadline) {
+			rollback(status, fmt.Sprintf("%d of %d canary tmsources are ready after %s.", ready, len(status.Canaries), durationOr(spec.ProgressDeadline, DefaultProgressDeadline)))
+			return status, 0
+		}
+		status.Message = fmt.Sprintf("%d of %d canary tmsources run image %s and are ready.", ready, len(status.Canaries), status.Image)
+		return status, minDuration(RolloutCheckInterval, deadline.Sub(now))
+	}
+
+	if status.BakeStartTime == nil {
+		status.BakeStartTime = &metav1.Time{Time: now}
+	}
+	end := status.BakeStartTime.Add(durationOr(spec.BakeTime, DefaultBakeTime))
+	if now.Before(end) {
+		status.Message = "The canary tmsources are ready, baking until " + end.UTC().Format(time.RFC3339) + "."
+		return status, minDuration(RolloutCheckInterval, end.Sub(now))
+	}
+
+	status.Phase = tmv1.RolloutComplete
+	status.StableImage = status.Image
+	status.Canaries = nil
+	status.Message = "Image " + status.Image + " is rolled out to every tmsource."
+	return status, 0
+}
+
+// startRollout picks the canaries of a new rollout image.
+func startRollout(site *tmv1.Site, previous *tmv1.RolloutStatus, sources []tmv1.TmSource, now time.Time) (*tmv1.RolloutStatus, time.Duration) {
+	spec := site.Spec.Rollout
+	stable := SiteImage(site)
+	if previous != nil && previous.StableImage != "" {
+		stable = previous.StableImage
+	}
+	status := &tmv1.RolloutStatus{Image: spec.Image, StableImage: stable, StartTime: &metav1.Time{Time: now}}
+
+	var running []tmv1.TmSource
+	for _, tm := range sources {
+		if tm.DeletionTimestamp.IsZero() && SourceRuns(site, tm) {
+			running = append(running, tm)
+		}
+	}
+	if spec.Image == stable || len(running) == 0 {
+		status.Phase = tmv1.RolloutComplete
+		status.StableImage = spec.Image
+		status.Message = "Image " + spec.Image + " is used by every tmsource, no canary was needed."
+		return status, 0
+	}
+
+	percent := spec.CanaryPercent
+	if percent <= 0 {
+		percent = DefaultCanaryPercent
+	}
+	count := (len(running)*int(percent) + 99) / 100
+	if count < 1 {
+		count = 1
+	}
+	// The least critical tmsources try the image first
+	ShedOrder(running)
+	for _, tm := range running[:count] {
+		status.Canaries = append(status.Canaries, tm.Name)
+	}
+	status.Phase = tmv1.RolloutCanary
+	status.Message = fmt.Sprintf("Upgrading %d canary tmsources of %d to image %s.", count, len(running), spec.Image)
+	return status, RolloutCheckInterval
+}
+
+// canaryFailure explains why a canary failed, empty while it did not.
+func canaryFailure(tm tmv1.TmSource, pod *v1.Pod) string {
+	if Suspended(tm) {
+		return "Canary tmsource " + tm.Name + " was suspended by its remediation policy."
+	}
+	if pod == nil {
+		return ""
+	}
+	if Restarts(pod) > 0 {
+		return "Canary pod " + pod.Name + " restarted."
+	}
+	statuses := append(append([]v1.ContainerStatus(nil), pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, c := range statuses {
+		if c.State.Waiting != nil && failingWaitReasons[c.State.Waiting.Reason] {
+			return "Canary pod " + pod.Name + " is in " + c.State.Waiting.Reason + "."
+		}
+	}
+	// Only a flow observed since the canary pod started counts
+	flowing := tmv1.FindCondition(tm.Status.Conditions, tmv1.ConditionFlowing)
+	if flowing != nil && flowing.Status == metav1.ConditionFalse && PodReady(pod) && flowing.LastTransitionTime.After(pod.CreationTimestamp.Time) {
+		return "The metric of canary tmsource " + tm.Name + " is not flowing: " + flowing.Message
+	}
+	return ""
+}
+
+// rollback sends the canaries back to the stable image.
+func rollback(status *tmv1.RolloutStatus, reason string) {
+	status.Phase = tmv1.RolloutRolledBack
+	status.Canaries = nil
+	status.BakeStartTime = nil
+	status.Message = reason + " Rolled back to image " + status.StableImage + "."
+}
+
+func durationOr(d *metav1.Duration, def time.Duration) time.Duration {
+	if d != nil && d.Duration > 0 {
+		return d.Duration
+	}
+	return def
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,225 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func rolloutSite(image string, percent int32) tmv1.Site {
+	s := site("site-lc-1", true)
+	s.Spec.Rollout = &tmv1.ImageRollout{Image: image, CanaryPercent: percent}
+	return s
+}
+
+// readyPods returns the ready pods of the sources for the rollout state of s.
+func readyPods(s *tmv1.Site, sources []tmv1.TmSource) []v1.Pod {
+	var pods []v1.Pod
+	for _, pod := range Pods([]tmv1.Site{*s}, sources) {
+		pods = append(pods, ready(pod))
+	}
+	return pods
+}
+
+func TestImage(t *testing.T) {
+	tm := source("tm-1", "site-lc-1", "rock")
+	if got := SitePod(nil, tm).Spec.Containers[0].Image; got != ContainerImage {
+		t.Errorf("Image = %s, want %s without rollout", got, ContainerImage)
+	}
+
+	s := rolloutSite("rocket-source:v2", 10)
+	s.Status.Rollout = &tmv1.RolloutStatus{Image: "rocket-source:v2", StableImage: "rocket-source:v1", Phase: tmv1.RolloutCanary, Canaries: []string{"tm-1"}}
+	if got := Image(&s, tm); got != "rocket-source:v2" {
+		t.Errorf("canary Image = %s", got)
+	}
+	if got := Image(&s, source("tm-2", "site-lc-1", "paper")); got != "rocket-source:v1" {
+		t.Errorf("stable Image = %s", got)
+	}
+	s.Status.Rollout.Phase = tmv1.RolloutRolledBack
+	if got := Image(&s, tm); got != "rocket-source:v1" {
+		t.Errorf("rolled back Image = %s", got)
+	}
+}
+
+func TestRolloutPromotesAfterBake(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	s := rolloutSite("rocket-source:v2", 20)
+	var sources []tmv1.TmSource
+	for i := 0; i < 10; i++ {
+		sources = append(sources, source(fmt.Sprintf("tm-%d", i), "site-lc-1", "rock"))
+	}
+	sources[3] = withPriority(sources[3], tmv1.TmSourcePriorityLow)
+
+	var after time.Duration
+	s.Status.Rollout, after = Rollout(&s, sources, nil, now)
+	rollout := s.Status.Rollout
+	if rollout.Phase != tmv1.RolloutCanary || after != RolloutCheckInterval {
+		t.Fatalf("Rollout() = %+v, %s, want a canary phase", rollout, after)
+	}
+	if got, want := rollout.Canaries, []string{"tm-3", "tm-9"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Canaries = %v, want the lowest priority first %v", got, want)
+	}
+	if rollout.StableImage != ContainerImage {
+		t.Errorf("StableImage = %s, want %s", rollout.StableImage, ContainerImage)
+	}
+
+	// Canaries not ready yet
+	s.Status.Rollout, _ = Rollout(&s, sources, nil, now.Add(time.Minute))
+	if s.Status.Rollout.Phase != tmv1.RolloutCanary || s.Status.Rollout.BakeStartTime != nil {
+		t.Errorf("Rollout() = %+v, want to wait for the canaries", s.Status.Rollout)
+	}
+
+	pods := readyPods(&s, sources)
+	s.Status.Rollout, after = Rollout(&s, sources, pods, now.Add(2*time.Minute))
+	if s.Status.Rollout.BakeStartTime == nil || after != RolloutCheckInterval {
+		t.Fatalf("Rollout() = %+v, want the canaries to bake", s.Status.Rollout)
+	}
+	s.Status.Rollout, after = Rollout(&s, sources, pods, now.Add(7*time.Minute-5*time.Second))
+	if s.Status.Rollout.Phase != tmv1.RolloutCanary || after != 5*time.Second {
+		t.Errorf("Rollout() = %+v, %s, want the end of the bake", s.Status.Rollout, after)
+	}
+
+	s.Status.Rollout, after = Rollout(&s, sources, pods, now.Add(7*time.Minute))
+	if s.Status.Rollout.Phase != tmv1.RolloutComplete || after != 0 {
+		t.Fatalf("Rollout() = %+v, want the rollout complete", s.Status.Rollout)
+	}
+	for _, tm := range sources {
+		if got := Image(&s, tm); got != "rocket-source:v2" {
+			t.Errorf("Image(%s) = %s after the rollout", tm.Name, got)
+		}
+	}
+}
+
+func TestRolloutRollsBack(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	sources := []tmv1.TmSource{source("tm-1", "site-lc-1", "rock"), source("tm-2", "site-lc-1", "paper")}
+
+	tests := []struct {
+		name   string
+		broken func(pod *v1.Pod)
+		at     time.Duration
+	}{
+		{name: "restarted", at: time.Minute, broken: func(pod *v1.Pod) {
+			pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: ContainerName, RestartCount: 1}}
+		}},
+		{name: "image pull", at: time.Minute, broken: func(pod *v1.Pod) {
+			pod.Status.Conditions = nil
+			pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: ContainerName, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}}}
+		}},
+		{name: "progress deadline", at: 10 * time.Minute, broken: func(pod *v1.Pod) {
+			pod.Status.Conditions = nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := rolloutSite("rocket-source:broken", 50)
+			s.Status.Rollout, _ = Rollout(&s, sources, nil, now)
+			pods := readyPods(&s, sources)
+			for i := range pods {
+				if SourceOf(&pods[i]) == s.Status.Rollout.Canaries[0] {
+					tt.broken(&pods[i])
+				}
+			}
+
+			s.Status.Rollout, _ = Rollout(&s, sources, pods, now.Add(tt.at))
+			if s.Status.Rollout.Phase != tmv1.RolloutRolledBack || len(s.Status.Rollout.Canaries) != 0 {
+				t.Fatalf("Rollout() = %+v, want a rollback", s.Status.Rollout)
+			}
+			for _, tm := range sources {
+				if got := Image(&s, tm); got != ContainerImage {
+					t.Errorf("Image(%s) = %s after the rollback", tm.Name, got)
+				}
+			}
+
+			// It stays rolled back until the image changes
+			if rollout, _ := Rollout(&s, sources, pods, now.Add(time.Hour)); rollout.Phase != tmv1.RolloutRolledBack {
+				t.Errorf("Rollout() = %+v, want to stay rolled back", rollout)
+			}
+			s.Spec.Rollout.Image = "rocket-source:fixed"
+			if rollout, _ := Rollout(&s, sources, pods, now.Add(time.Hour)); rollout.Phase != tmv1.RolloutCanary || rollout.StableImage != ContainerImage {
+				t.Errorf("Rollout() = %+v, want a new canary phase from the stable image", rollout)
+			}
+		})
+	}
+}
+
+func TestRolloutWithoutCanary(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	sources := []tmv1.TmSource{source("tm-1", "site-lc-1", "rock")}
+
+	s := rolloutSite(ContainerImage, 10)
+	if rollout, _ := Rollout(&s, sources, nil, now); rollout.Phase != tmv1.RolloutComplete {
+		t.Errorf("rolling out the stable image, Rollout() = %+v, want it complete", rollout)
+	}
+
+	s = rolloutSite("rocket-source:v2", 10)
+	s.Spec.Enabled = false
+	if rollout, _ := Rollout(&s, sources, nil, now); rollout.Phase != tmv1.RolloutComplete || rollout.StableImage != "rocket-source:v2" {
+		t.Errorf("without running tmsource, Rollout() = %+v, want it complete", rollout)
+	}
+
+	s = rolloutSite("rocket-source:v2", 10)
+	s.Status.Rollout, _ = Rollout(&s, sources, nil, now)
+	s.Spec.Rollout = nil
+	if rollout, _ := Rollout(&s, sources, nil, now); rollout.Phase != tmv1.RolloutRolledBack {
+		t.Errorf("once the rollout is removed, Rollout() = %+v, want a rollback", rollout)
+	}
+}
+
+func TestRolloutRemovedFollowsSiteImage(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	tm := source("tm-1", "site-lc-1", "rock")
+
+	s := rolloutSite("rocket-source:v2", 10)
+	s.Spec.Enabled = false
+	s.Status.Rollout, _ = Rollout(&s, []tmv1.TmSource{tm}, nil, now)
+	if s.Status.Rollout.Phase != tmv1.RolloutComplete {
+		t.Fatalf("Rollout() = %+v, want it complete", s.Status.Rollout)
+	}
+
+	s.Spec.Rollout = nil
+	s.Spec.Image = "rocket-source:v3"
+	if got := Image(&s, tm); got != "rocket-source:v3" {
+		t.Errorf("once the rollout is removed, Image = %s, want the site image", got)
+	}
+	if rollout, after := Rollout(&s, []tmv1.TmSource{tm}, nil, now); rollout != nil || after != 0 {
+		t.Errorf("once the rollout is removed, Rollout() = %+v, %s, want it cleared", rollout, after)
+	}
+}
+
+func TestCanaryFailureIgnoresOlderFlow(t *testing.T) {
+	tm := source("tm-1", "site-lc-1", "rock")
+	pod := ready(Pod(tm))
+	pod.CreationTimestamp = metav1.Time{Time: time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)}
+	tm.Status.Conditions = []tmv1.Condition{{Type: tmv1.ConditionFlowing, Status: metav1.ConditionFalse, LastTransitionTime: metav1.Time{Time: pod.CreationTimestamp.Add(-time.Minute)}}}
+	if got := canaryFailure(tm, &pod); got != "" {
+		t.Errorf("canaryFailure() = %q, the flow was lost before the canary pod", got)
+	}
+	tm.Status.Conditions[0].LastTransitionTime = metav1.Time{Time: pod.CreationTimestamp.Add(time.Minute)}
+	if got := canaryFailure(tm, &pod); got == "" {
+		t.Errorf("a canary whose metric stopped flowing should fail")
+	}
+}
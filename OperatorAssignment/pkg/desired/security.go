@@ -0,0 +1,233 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+const (
+	// SourceUserID is the default user and group of the source pods.
+	SourceUserID int64 = 1000
+	// SeccompProfileDefault is the default seccomp profile of the source pods.
+	SeccompProfileDefault = v1.SeccompProfileRuntimeDefault
+)
+
+// Security merges the pod security of a site and of one of its tmsources, a
+// field set by the tmsource wins.
+func Security(site *tmv1.Site, tmsource tmv1.TmSource) tmv1.PodSecurity {
+	var base tmv1.PodSecurity
+	if site != nil {
+		base = *site.Spec.PodSecurity.DeepCopy()
+	}
+	own := tmsource.Spec.PodSecurity.DeepCopy()
+
+	if own.ServiceAccountName != "" {
+		base.ServiceAccountName = own.ServiceAccountName
+	}
+	if own.AutomountServiceAccountToken != nil {
+		base.AutomountServiceAccountToken = own.AutomountServiceAccountToken
+	}
+	if own.SeccompProfile != "" {
+		base.SeccompProfile = own.SeccompProfile
+	}
+	base.PodSecurityContext = mergePodSecurityContext(base.PodSecurityContext, own.PodSecurityContext)
+	base.SecurityContext = mergeSecurityContext(base.SecurityContext, own.SecurityContext)
+	return base
+}
+
+// ServiceAccountName returns the name of the service account the operator
+// manages for a site.
+func ServiceAccountName(site *tmv1.Site) string {
+	return siteObjectName(site)
+}
+
+// ServiceAccount builds the service account of the source pods of a site,
+// owned by the site, or nil when the site runs them with its own.
+func ServiceAccount(site *tmv1.Site) *v1.ServiceAccount {
+	if site.Spec.ServiceAccountName != "" {
+		return nil
+	}
+	automount := false
+	return &v1.ServiceAccount{
+		ObjectMeta: siteObjectMeta(site, ServiceAccountName(site)),
+		// The token is only mounted in pods which ask for it
+		AutomountServiceAccountToken: &automount,
+	}
+}
+
+// applySecurity sets the service account, security contexts and seccomp
+// profile of a source pod: the secure defaults, overridden by the site and
+// the tmsource.
+func applySecurity(pod *v1.Pod, site *tmv1.Site, security tmv1.PodSecurity) {
+	spec := &pod.Spec
+	switch {
+	case security.ServiceAccountName != "":
+		spec.ServiceAccountName = security.ServiceAccountName
+	case site != nil:
+		spec.ServiceAccountName = ServiceAccountName(site)
+	}
+	automount := false
+	if security.AutomountServiceAccountToken != nil {
+		automount = *security.AutomountServiceAccountToken
+	}
+	spec.AutomountServiceAccountToken = &automount
+
+	nonRoot, user := true, SourceUserID
+	spec.SecurityContext = mergePodSecurityContext(&v1.PodSecurityContext{
+		RunAsNonRoot: &nonRoot,
+		RunAsUser:    &user,
+		RunAsGroup:   &user,
+	}, security.PodSecurityContext)
+
+	readOnly, escalation := true, false
+	container := mergeSecurityContext(&v1.SecurityContext{
+		ReadOnlyRootFilesystem:   &readOnly,
+		AllowPrivilegeEscalation: &escalation,
+		Capabilities:             &v1.Capabilities{Drop: []v1.Capability{"ALL"}},
+	}, security.SecurityContext)
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == ContainerName {
+			spec.Containers[i].SecurityContext = container.DeepCopy()
+		} else {
+			spec.Containers[i].SecurityContext = mergeSecurityContext(container, spec.Containers[i].SecurityContext)
+		}
+	}
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].SecurityContext = mergeSecurityContext(container, spec.InitContainers[i].SecurityContext)
+	}
+
+	profile := SeccompProfileDefault
+	if security.SeccompProfile != "" {
+		profile = security.SeccompProfile
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[v1.SeccompPodAnnotationKey] = profile
+}
+
+// mergePodSecurityContext returns a copy of base with the fields set in
+// override.
+func mergePodSecurityContext(base, override *v1.PodSecurityContext) *v1.PodSecurityContext {
+	if override == nil {
+		return base.DeepCopy()
+	}
+	if base == nil {
+		return override.DeepCopy()
+	}
+	merged := base.DeepCopy()
+	o := override.DeepCopy()
+	if o.SELinuxOptions != nil {
+		merged.SELinuxOptions = o.SELinuxOptions
+	}
+	if o.WindowsOptions != nil {
+		merged.WindowsOptions = o.WindowsOptions
+	}
+	if o.RunAsUser != nil {
+		merged.RunAsUser = o.RunAsUser
+	}
+	if o.RunAsGroup != nil {
+		merged.RunAsGroup = o.RunAsGroup
+	}
+	if o.RunAsNonRoot != nil {
+		merged.RunAsNonRoot = o.RunAsNonRoot
+	}
+	if o.SupplementalGroups != nil {
+		merged.SupplementalGroups = o.SupplementalGroups
+	}
+	if o.FSGroup != nil {
+		merged.FSGroup = o.FSGroup
+	}
+	if o.Sysctls != nil {
+		merged.Sysctls = o.Sysctls
+	}
+	return merged
+}
+
+// mergeSecurityContext returns a copy of base with the fields set in
+// override.
+func mergeSecurityContext(base, override *v1.SecurityContext) *v1.SecurityContext {
+	if override == nil {
+		return base.DeepCopy()
+	}
+	if base == nil {
+		return override.DeepCopy()
+	}
+	merged := base.DeepCopy()
+	o := override.DeepCopy()
+	if o.Capabilities != nil {
+		merged.Capabilities = o.Capabilities
+	}
+	if o.Privileged != nil {
+		merged.Privileged = o.Privileged
+	}
+	if o.SELinuxOptions != nil {
+		merged.SELinuxOptions = o.SELinuxOptions
+	}
+	if o.WindowsOptions != nil {
+		merged.WindowsOptions = o.WindowsOptions
+	}
+	if o.RunAsUser != nil {
+		merged.RunAsUser = o.RunAsUser
+	}
+	if o.RunAsGroup != nil {
+		merged.RunAsGroup = o.RunAsGroup
+	}
+	if o.RunAsNonRoot != nil {
+		merged.RunAsNonRoot = o.RunAsNonRoot
+	}
+	if o.ReadOnlyRootFilesystem != nil {
+		merged.ReadOnlyRootFilesystem = o.ReadOnlyRootFilesystem
+	}
+	if o.AllowPrivilegeEscalation != nil {
+		merged.AllowPrivilegeEscalation = o.AllowPrivilegeEscalation
+	}
+	if o.ProcMount != nil {
+		merged.ProcMount = o.ProcMount
+	}
+	return merged
+}
+
+// siteObjectName returns the name of an object generated for a site, bounded
+// like the name of any object.
+func siteObjectName(site *tmv1.Site) string {
+	return shorten(SiteObjectPrefix+site.Name, validation.DNS1123SubdomainMaxLength)
+}
+
+// siteObjectMeta returns the metadata of an object generated for a site and
+// controlled by it.
+func siteObjectMeta(site *tmv1.Site, name string) metav1.ObjectMeta {
+	controller := true
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: site.Namespace,
+		Labels:    map[string]string{LabelAppKey: LabelAppValue, LabelSiteKey: LabelValue(site.Name)},
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion:         tmv1.GroupVersion.String(),
+			Kind:               "Site",
+			Name:               site.Name,
+			UID:                site.UID,
+			Controller:         &controller,
+			BlockOwnerDeletion: &controller,
+		}},
+	}
+}
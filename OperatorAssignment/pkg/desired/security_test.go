@@ -0,0 +1,235 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// restrictedViolations checks a pod against the restricted Pod Security
+// Standard, baseline checks included, and returns the violations.
+// https://kubernetes.io/docs/concepts/security/pod-security-standards/
+func restrictedViolations(pod *v1.Pod) []string {
+	var violations []string
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+	spec := pod.Spec
+	podContext := spec.SecurityContext
+	if podContext == nil {
+		podContext = &v1.PodSecurityContext{}
+	}
+
+	if spec.HostNetwork || spec.HostPID || spec.HostIPC {
+		fail("host namespaces")
+	}
+	allowedVolumes := func(vol v1.Volume) bool {
+		s := vol.VolumeSource
+		return s.ConfigMap != nil || s.CSI != nil || s.DownwardAPI != nil || s.EmptyDir != nil ||
+			s.PersistentVolumeClaim != nil || s.Projected != nil || s.Secret != nil
+	}
+	for _, vol := range spec.Volumes {
+		if !allowedVolumes(vol) {
+			fail("volume %s has a restricted type", vol.Name)
+		}
+	}
+	for _, sysctl := range podContext.Sysctls {
+		switch sysctl.Name {
+		case "kernel.shm_rmid_forced", "net.ipv4.ip_local_port_range", "net.ipv4.tcp_syncookies", "net.ipv4.ping_group_range":
+		default:
+			fail("sysctl %s is unsafe", sysctl.Name)
+		}
+	}
+	checkSELinux := func(where string, options *v1.SELinuxOptions) {
+		if options == nil {
+			return
+		}
+		switch options.Type {
+		case "", "container_t", "container_init_t", "container_kvm_t":
+		default:
+			fail("%s sets SELinux type %s", where, options.Type)
+		}
+		if options.User != "" || options.Role != "" {
+			fail("%s sets SELinux user or role", where)
+		}
+	}
+	checkSELinux("pod", podContext.SELinuxOptions)
+	checkSeccomp := func(where, profile string) bool {
+		if profile == "" {
+			return false
+		}
+		if profile != v1.SeccompProfileRuntimeDefault && profile != v1.DeprecatedSeccompProfileDockerDefault && !strings.HasPrefix(profile, "localhost/") {
+			fail("%s seccomp profile %s is not allowed", where, profile)
+		}
+		return true
+	}
+	podSeccomp := checkSeccomp("pod", pod.Annotations[v1.SeccompPodAnnotationKey])
+	for key, value := range pod.Annotations {
+		if strings.HasPrefix(key, "container.apparmor.security.beta.kubernetes.io/") &&
+			value != "runtime/default" && !strings.HasPrefix(value, "localhost/") {
+			fail("apparmor profile %s is not allowed", value)
+		}
+	}
+
+	containers := append(append([]v1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		ctx := c.SecurityContext
+		if ctx == nil {
+			ctx = &v1.SecurityContext{}
+		}
+		for _, port := range c.Ports {
+			if port.HostPort != 0 {
+				fail("container %s uses host port %d", c.Name, port.HostPort)
+			}
+		}
+		if ctx.Privileged != nil && *ctx.Privileged {
+			fail("container %s is privileged", c.Name)
+		}
+		if ctx.ProcMount != nil && *ctx.ProcMount != v1.DefaultProcMount {
+			fail("container %s sets procMount %s", c.Name, *ctx.ProcMount)
+		}
+		checkSELinux("container "+c.Name, ctx.SELinuxOptions)
+		if ctx.AllowPrivilegeEscalation == nil || *ctx.AllowPrivilegeEscalation {
+			fail("container %s allows privilege escalation", c.Name)
+		}
+		nonRoot := podContext.RunAsNonRoot
+		if ctx.RunAsNonRoot != nil {
+			nonRoot = ctx.RunAsNonRoot
+		}
+		if nonRoot == nil || !*nonRoot {
+			fail("container %s may run as root", c.Name)
+		}
+		user := podContext.RunAsUser
+		if ctx.RunAsUser != nil {
+			user = ctx.RunAsUser
+		}
+		if user != nil && *user == 0 {
+			fail("container %s runs as user 0", c.Name)
+		}
+		if !checkSeccomp("container "+c.Name, pod.Annotations[v1.SeccompContainerAnnotationKeyPrefix+c.Name]) && !podSeccomp {
+			fail("container %s has no seccomp profile", c.Name)
+		}
+		dropsAll := false
+		if ctx.Capabilities != nil {
+			for _, capability := range ctx.Capabilities.Drop {
+				dropsAll = dropsAll || capability == "ALL"
+			}
+			for _, capability := range ctx.Capabilities.Add {
+				if capability != "NET_BIND_SERVICE" {
+					fail("container %s adds capability %s", c.Name, capability)
+				}
+			}
+		}
+		if !dropsAll {
+			fail("container %s does not drop ALL capabilities", c.Name)
+		}
+	}
+	return violations
+}
+
+func TestSitePodIsRestricted(t *testing.T) {
+	withExtensions := site("site-lc-1", true)
+	withExtensions.Spec.InitContainers = []v1.Container{{Name: "wait-for-nats", Image: "busybox"}}
+	withExtensions.Spec.Sidecars = []v1.Container{{Name: "log-shipper", Image: "fluent-bit:1.6"}}
+	withExtensions.Spec.Volumes = []v1.Volume{{Name: "logs", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+	user := int64(2000)
+	withOverrides := site("site-lc-1", true)
+	withOverrides.Spec.PodSecurityContext = &v1.PodSecurityContext{RunAsUser: &user}
+	withOverrides.Spec.SeccompProfile = "localhost/rocket-source.json"
+
+	tests := []struct {
+		name string
+		pod  *v1.Pod
+	}{
+		{name: "without site", pod: Pod(source("tm-1", "site-lc-1", "rock"))},
+		{name: "site extensions", pod: SitePod(&withExtensions, source("tm-1", "site-lc-1", "rock"))},
+		{name: "site overrides", pod: SitePod(&withOverrides, source("tm-1", "site-lc-1", "rock"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if violations := restrictedViolations(tt.pod); len(violations) > 0 {
+				t.Errorf("expected a restricted pod, got %v", violations)
+			}
+		})
+	}
+}
+
+func TestSitePodReportsLooseOverrides(t *testing.T) {
+	s := site("site-lc-1", true)
+	escalation, root := true, int64(0)
+	s.Spec.SecurityContext = &v1.SecurityContext{AllowPrivilegeEscalation: &escalation}
+	tm := source("tm-1", "site-lc-1", "rock")
+	tm.Spec.PodSecurityContext = &v1.PodSecurityContext{RunAsUser: &root}
+	tm.Spec.SeccompProfile = "unconfined"
+
+	violations := restrictedViolations(SitePod(&s, tm))
+	want := []string{
+		"pod seccomp profile unconfined is not allowed",
+		"container rocket-source allows privilege escalation",
+		"container rocket-source runs as user 0",
+	}
+	if strings.Join(violations, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected violations %v, got %v", want, violations)
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	s := site("site-lc-1", true)
+	siteUser, ownUser, group := int64(1500), int64(2000), int64(3000)
+	writable := false
+	s.Spec.ServiceAccountName = "site-lc-1-sources"
+	s.Spec.PodSecurityContext = &v1.PodSecurityContext{RunAsUser: &siteUser, RunAsGroup: &group}
+	s.Spec.SecurityContext = &v1.SecurityContext{ReadOnlyRootFilesystem: &writable}
+	tm := source("tm-1", "site-lc-1", "rock")
+	tm.Spec.PodSecurityContext = &v1.PodSecurityContext{RunAsUser: &ownUser}
+
+	pod := SitePod(&s, tm)
+	if pod.Spec.ServiceAccountName != "site-lc-1-sources" || *pod.Spec.AutomountServiceAccountToken {
+		t.Errorf("expected the site service account without token, got %s", pod.Spec.ServiceAccountName)
+	}
+	podContext := pod.Spec.SecurityContext
+	if *podContext.RunAsUser != 2000 || *podContext.RunAsGroup != 3000 || !*podContext.RunAsNonRoot {
+		t.Errorf("expected the tmsource user over the site group and the defaults, got %+v", podContext)
+	}
+	container := pod.Spec.Containers[0].SecurityContext
+	if *container.ReadOnlyRootFilesystem || *container.AllowPrivilegeEscalation || container.Capabilities.Drop[0] != "ALL" {
+		t.Errorf("expected a writable root filesystem over the defaults, got %+v", container)
+	}
+	if pod.Annotations[v1.SeccompPodAnnotationKey] != v1.SeccompProfileRuntimeDefault {
+		t.Errorf("expected the runtime/default seccomp profile, got %v", pod.Annotations)
+	}
+	if s.Spec.PodSecurityContext.RunAsNonRoot != nil {
+		t.Errorf("Security() modified the site")
+	}
+
+	if account := ServiceAccount(&s); account != nil {
+		t.Errorf("expected no managed service account, got %s", account.Name)
+	}
+	s.Spec.ServiceAccountName = ""
+	account := ServiceAccount(&s)
+	if account.Name != "rocket-source-site-lc-1" || *account.AutomountServiceAccountToken {
+		t.Errorf("expected rocket-source-site-lc-1 without token, got %+v", account)
+	}
+	if pod := SitePod(&s, tm); pod.Spec.ServiceAccountName != account.Name {
+		t.Errorf("expected the managed service account, got %s", pod.Spec.ServiceAccountName)
+	}
+}
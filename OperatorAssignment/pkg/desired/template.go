@@ -0,0 +1,74 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// ApplyTemplate merges the defaults of a template under the spec of a site
+// referencing it. Fields set by the site win, field by field for nats and
+// catalog. The merged spec is only used to reconcile, it is never written
+// back to the site.
+func ApplyTemplate(site *tmv1.Site, template *tmv1.SiteTemplate) {
+	spec := &site.Spec
+	defaults := template.Spec.DeepCopy()
+
+	if spec.Image == "" {
+		spec.Image = defaults.Image
+	}
+	if spec.Resources == nil {
+		spec.Resources = defaults.Resources
+	}
+
+	switch {
+	case defaults.NATS == nil:
+	case spec.NATS == nil:
+		spec.NATS = defaults.NATS
+	default:
+		if spec.NATS.Address == "" {
+			spec.NATS.Address = defaults.NATS.Address
+		}
+		if spec.NATS.PodSelector == nil {
+			spec.NATS.PodSelector = defaults.NATS.PodSelector
+		}
+		if spec.NATS.NamespaceSelector == nil {
+			spec.NATS.NamespaceSelector = defaults.NATS.NamespaceSelector
+		}
+	}
+
+	switch {
+	case defaults.Catalog == nil:
+	case spec.Catalog == nil:
+		spec.Catalog = defaults.Catalog
+	default:
+		if len(spec.Catalog.Metrics) == 0 {
+			spec.Catalog.Metrics = defaults.Catalog.Metrics
+		}
+		if spec.Catalog.ConfigMapRef == nil {
+			spec.Catalog.ConfigMapRef = defaults.Catalog.ConfigMapRef
+		}
+	}
+}
+
+// SiteImage returns the rocket-source image of a site without rollout.
+func SiteImage(site *tmv1.Site) string {
+	if site == nil || site.Spec.Image == "" {
+		return ContainerImage
+	}
+	return site.Spec.Image
+}
@@ -0,0 +1,107 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package desired
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func launchComplex() *tmv1.SiteTemplate {
+	return &tmv1.SiteTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "launch-complex", Namespace: "default"},
+		Spec: tmv1.SiteTemplateSpec{
+			Image:     "maxthom/rocket-source:v2",
+			Resources: &v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("50m")}},
+			NATS: &tmv1.NatsEndpoint{
+				Address:     "nats.telemetry.svc:4333",
+				PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nats"}},
+			},
+			Catalog: &tmv1.MetricCatalog{
+				Metrics:      []string{"smoke"},
+				ConfigMapRef: &tmv1.CatalogConfigMapRef{Name: "launch-complex-catalog"},
+			},
+		},
+	}
+}
+
+func TestApplyTemplate(t *testing.T) {
+	template := launchComplex()
+
+	s := site("site-lc-1", true)
+	ApplyTemplate(&s, template)
+	if !reflect.DeepEqual(s.Spec.NATS, template.Spec.NATS) || !reflect.DeepEqual(s.Spec.Catalog, template.Spec.Catalog) ||
+		s.Spec.Image != template.Spec.Image || !reflect.DeepEqual(s.Spec.Resources, template.Spec.Resources) {
+		t.Errorf("expected the template defaults, got %+v", s.Spec)
+	}
+	s.Spec.Catalog.Metrics[0] = "rock"
+	if template.Spec.Catalog.Metrics[0] != "smoke" {
+		t.Errorf("ApplyTemplate() shares the template with the site")
+	}
+
+	overrides := site("site-lc-2", true)
+	overrides.Spec.Image = "maxthom/rocket-source:v3"
+	overrides.Spec.NATS = &tmv1.NatsEndpoint{Address: "nats.lc-2.svc:4222"}
+	overrides.Spec.Catalog = &tmv1.MetricCatalog{Metrics: []string{"rock", "paper"}}
+	ApplyTemplate(&overrides, template)
+	if overrides.Spec.Image != "maxthom/rocket-source:v3" {
+		t.Errorf("expected the site image, got %s", overrides.Spec.Image)
+	}
+	if nats := overrides.Spec.NATS; nats.Address != "nats.lc-2.svc:4222" || nats.PodSelector.MatchLabels["app"] != "nats" {
+		t.Errorf("expected the site address with the template selector, got %+v", nats)
+	}
+	if catalog := overrides.Spec.Catalog; !reflect.DeepEqual(catalog.Metrics, []string{"rock", "paper"}) || catalog.ConfigMapRef.Name != "launch-complex-catalog" {
+		t.Errorf("expected the site metrics with the template ConfigMap, got %+v", catalog)
+	}
+}
+
+func TestSitePodFollowsTemplate(t *testing.T) {
+	s := site("site-lc-1", true)
+	ApplyTemplate(&s, launchComplex())
+	tm := source("tm-1", "site-lc-1", "rock")
+
+	container := SitePod(&s, tm).Spec.Containers[0]
+	if container.Image != "maxthom/rocket-source:v2" || container.Env[0].Value != "nats.telemetry.svc:4333" {
+		t.Errorf("expected the template image and NATS address, got %s %s", container.Image, container.Env[0].Value)
+	}
+	if cpu := container.Resources.Requests[v1.ResourceCPU]; cpu.String() != "50m" {
+		t.Errorf("expected the template cpu request, got %s", cpu.String())
+	}
+
+	tm.Spec.Resources = v1.ResourceRequirements{Limits: v1.ResourceList{v1.ResourceMemory: resource.MustParse("8Mi")}}
+	own := SitePod(&s, tm).Spec.Containers[0].Resources
+	if cpu := own.Requests[v1.ResourceCPU]; cpu.String() != DefaultSourceCPU.String() {
+		t.Errorf("expected the tmsource resources to replace the site ones, got cpu %s", cpu.String())
+	}
+
+	// A rollout keeps precedence over the image of the site while it is set
+	s.Spec.Rollout = &tmv1.ImageRollout{Image: "maxthom/rocket-source:v4"}
+	s.Status.Rollout = &tmv1.RolloutStatus{Image: "maxthom/rocket-source:v4", StableImage: "maxthom/rocket-source:v4", Phase: tmv1.RolloutComplete}
+	if image := Image(&s, tm); image != "maxthom/rocket-source:v4" {
+		t.Errorf("expected the rolled out image, got %s", image)
+	}
+	s.Spec.Rollout = nil
+	if image := Image(&s, tm); image != "maxthom/rocket-source:v2" {
+		t.Errorf("expected the template image once the rollout is removed, got %s", image)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package federation propagates sites and tmsources from a hub cluster to
+// member clusters and reads their status back. Members are reached through
+// kubeconfigs stored in Secrets of the hub.
+package federation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// SecretKey is the key of the kubeconfig in a member Secret.
+const SecretKey = "kubeconfig"
+
+// Members builds clients of the member clusters from the Secret named after
+// each cluster in Namespace. A client is kept until its Secret changes.
+type Members struct {
+	// Hub reads the member Secrets.
+	Hub client.Reader
+	// Secrets informs of the changes of the member Secrets.
+	Secrets cache.Informers
+	// Namespace of the member Secrets.
+	Namespace string
+	// Scheme of the member clients, it must know sites and tmsources.
+	Scheme *runtime.Scheme
+
+	mu      sync.Mutex
+	clients map[string]member
+}
+
+// NewMembers returns the members whose Secrets are read from a cache of
+// namespace only, so the hub needs no access to the Secrets of the other
+// namespaces. The cache is started by the manager on every replica, like its
+// own cache.
+func NewMembers(mgr manager.Manager, namespace string) (*Members, error) {
+	secrets, err := cache.New(mgr.GetConfig(), cache.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper(), Namespace: namespace})
+	if err != nil {
+		return nil, err
+	}
+	if err := mgr.Add(unelectedCache{secrets}); err != nil {
+		return nil, err
+	}
+	return &Members{Hub: secrets, Secrets: secrets, Namespace: namespace, Scheme: mgr.GetScheme()}, nil
+}
+
+// unelectedCache runs a cache whether the replica leads or not.
+type unelectedCache struct {
+	cache.Cache
+}
+
+func (unelectedCache) NeedLeaderElection() bool {
+	return false
+}
+
+type member struct {
+	resourceVersion string
+	client          client.Client
+}
+
+// Client returns a client of the named member cluster. The error is NotFound
+// when the cluster has no Secret.
+func (m *Members) Client(ctx context.Context, cluster string) (client.Client, error) {
+	var secret v1.Secret
+	if err := m.Hub.Get(ctx, types.NamespacedName{Name: cluster, Namespace: m.Namespace}, &secret); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cached, ok := m.clients[cluster]; ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached.client, nil
+	}
+
+	kubeconfig, ok := secret.Data[SecretKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no %s key", m.Namespace, cluster, SecretKey)
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig of cluster %s: %v", cluster, err)
+	}
+	c, err := client.New(config, client.Options{Scheme: m.Scheme})
+	if err != nil {
+		return nil, fmt.Errorf("client of cluster %s: %v", cluster, err)
+	}
+
+	if m.clients == nil {
+		m.clients = map[string]member{}
+	}
+	m.clients[cluster] = member{resourceVersion: secret.ResourceVersion, client: c}
+	return c, nil
+}
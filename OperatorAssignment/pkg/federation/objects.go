@@ -0,0 +1,151 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package federation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+const (
+	// LabelHubKey marks the sites and tmsources written to a member by the
+	// hub, the tmsources of a site carrying it are pruned with the hub ones.
+	LabelHubKey   = "tm.rocketlab.global/hub"
+	LabelHubValue = "true"
+
+	// lastAppliedAnnotation is kubectl's copy of the hub object.
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// Clusters returns the member clusters a site is placed on.
+func Clusters(site *tmv1.Site) []string {
+	if site.Spec.Placement == nil {
+		return nil
+	}
+	return site.Spec.Placement.Clusters
+}
+
+// Sources keeps the tmsources of a site which are propagated with it. The
+// ones generated from its catalog are not, each member generates its own.
+func Sources(site *tmv1.Site, sources []tmv1.TmSource) []tmv1.TmSource {
+	var out []tmv1.TmSource
+	for _, tm := range sources {
+		if tm.Spec.Site != site.Name || !tm.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if owner := metav1.GetControllerOf(&tm); owner != nil && owner.Kind == "Site" {
+			continue
+		}
+		out = append(out, tm)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// SetSite writes the hub site into its member copy. The placement and the
+// template reference stay on the hub, the hub site is expected to hold the
+// spec merged with its template.
+func SetSite(member, hub *tmv1.Site) {
+	setMeta(&member.ObjectMeta, &hub.ObjectMeta)
+	member.Spec = *hub.Spec.DeepCopy()
+	member.Spec.Placement = nil
+	member.Spec.TemplateRef = nil
+}
+
+// SetSource writes the hub tmsource into its member copy.
+func SetSource(member, hub *tmv1.TmSource) {
+	setMeta(&member.ObjectMeta, &hub.ObjectMeta)
+	member.Spec = *hub.Spec.DeepCopy()
+}
+
+func setMeta(member, hub *metav1.ObjectMeta) {
+	member.Labels = map[string]string{}
+	for k, v := range hub.Labels {
+		member.Labels[k] = v
+	}
+	member.Labels[LabelHubKey] = LabelHubValue
+
+	member.Annotations = nil
+	for k, v := range hub.Annotations {
+		if k == lastAppliedAnnotation {
+			continue
+		}
+		if member.Annotations == nil {
+			member.Annotations = map[string]string{}
+		}
+		member.Annotations[k] = v
+	}
+}
+
+// SiteStatus summarizes a member site, site is nil when the member does not
+// have it yet.
+func SiteStatus(cluster string, site *tmv1.Site, now metav1.Time) tmv1.MemberSiteStatus {
+	status := tmv1.MemberSiteStatus{Cluster: cluster, Ready: metav1.ConditionUnknown, LastSyncTime: &now}
+	if site == nil {
+		status.Message = "Site not created yet."
+		return status
+	}
+	status.Mode = site.Status.Mode
+	status.Sources = site.Status.Sources
+	if ready := tmv1.FindCondition(site.Status.Conditions, tmv1.ConditionReady); ready != nil {
+		status.Ready = ready.Status
+		status.Message = ready.Message
+	}
+	return status
+}
+
+// SourceStatus summarizes a member tmsource.
+func SourceStatus(cluster string, tm *tmv1.TmSource) tmv1.MemberSourceStatus {
+	status := tmv1.MemberSourceStatus{Cluster: cluster, Ready: metav1.ConditionUnknown}
+	if tm == nil {
+		return status
+	}
+	status.Phase = tm.Status.Phase
+	status.Pod = tm.Status.Pod
+	if ready := tmv1.FindCondition(tm.Status.Conditions, tmv1.ConditionReady); ready != nil {
+		status.Ready = ready.Status
+	}
+	return status
+}
+
+// Unreachable is the status of a member which could not be synced.
+func Unreachable(cluster string, err error) tmv1.MemberSiteStatus {
+	return tmv1.MemberSiteStatus{Cluster: cluster, Ready: metav1.ConditionUnknown, Message: err.Error()}
+}
+
+// Ready aggregates the member statuses of a site into its hub Ready condition:
+// True once it is Ready on every member.
+func Ready(members []tmv1.MemberSiteStatus) (metav1.ConditionStatus, string, string) {
+	if len(members) == 0 {
+		return metav1.ConditionFalse, "NoPlacement", "Site is not placed on any member cluster."
+	}
+	var notReady []string
+	for _, m := range members {
+		if m.Ready != metav1.ConditionTrue {
+			notReady = append(notReady, m.Cluster)
+		}
+	}
+	if len(notReady) > 0 {
+		return metav1.ConditionFalse, "MembersNotReady", fmt.Sprintf("Site is not Ready on %s.", strings.Join(notReady, ", "))
+	}
+	return metav1.ConditionTrue, "MembersReady", fmt.Sprintf("Site is Ready on %d member clusters.", len(members))
+}
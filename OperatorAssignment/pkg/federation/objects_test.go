@@ -0,0 +1,142 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package federation
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func source(name, site string) tmv1.TmSource {
+	return tmv1.TmSource{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       tmv1.TmSourceSpec{Site: site, MetricName: "rock"},
+	}
+}
+
+func TestSources(t *testing.T) {
+	site := &tmv1.Site{ObjectMeta: metav1.ObjectMeta{Name: "site-lc-1", Namespace: "default"}}
+	generated := source("site-lc-1-paper", "site-lc-1")
+	isController := true
+	generated.OwnerReferences = []metav1.OwnerReference{{Kind: "Site", Name: "site-lc-1", Controller: &isController}}
+	deleting := source("tm-3", "site-lc-1")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+
+	got := Sources(site, []tmv1.TmSource{source("tm-2", "site-lc-1"), source("tm-1", "site-lc-1"), source("tm-4", "site-lc-2"), generated, deleting})
+	var names []string
+	for _, tm := range got {
+		names = append(names, tm.Name)
+	}
+	if want := []string{"tm-1", "tm-2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected %v, got %v", want, names)
+	}
+}
+
+func TestSetSite(t *testing.T) {
+	hub := &tmv1.Site{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "site-lc-1",
+			Namespace:   "default",
+			Labels:      map[string]string{"team": "ops"},
+			Annotations: map[string]string{tmv1.AnnotationReason: "launch", lastAppliedAnnotation: "{}"},
+		},
+		Spec: tmv1.SiteSpec{
+			Enabled:     true,
+			Placement:   &tmv1.Placement{Clusters: []string{"edge-1"}},
+			TemplateRef: &tmv1.SiteTemplateRef{Name: "launch-complex"},
+		},
+	}
+	member := &tmv1.Site{ObjectMeta: metav1.ObjectMeta{
+		Name:       "site-lc-1",
+		Namespace:  "default",
+		Finalizers: []string{"site.finalizers.rocket.global"},
+	}}
+
+	SetSite(member, hub)
+	if !member.Spec.Enabled || member.Spec.Placement != nil || member.Spec.TemplateRef != nil {
+		t.Errorf("expected the spec without placement and template, got %+v", member.Spec)
+	}
+	if hub.Spec.Placement == nil {
+		t.Errorf("expected the hub site to keep its placement")
+	}
+	if want := map[string]string{"team": "ops", LabelHubKey: LabelHubValue}; !reflect.DeepEqual(member.Labels, want) {
+		t.Errorf("expected labels %v, got %v", want, member.Labels)
+	}
+	if want := map[string]string{tmv1.AnnotationReason: "launch"}; !reflect.DeepEqual(member.Annotations, want) {
+		t.Errorf("expected annotations %v, got %v", want, member.Annotations)
+	}
+	if len(member.Finalizers) != 1 {
+		t.Errorf("expected the member finalizers to be kept, got %v", member.Finalizers)
+	}
+	if hub.Labels[LabelHubKey] != "" {
+		t.Errorf("expected the hub labels to be unchanged, got %v", hub.Labels)
+	}
+}
+
+func TestSiteStatus(t *testing.T) {
+	now := metav1.Now()
+	if got := SiteStatus("edge-1", nil, now); got.Ready != metav1.ConditionUnknown || got.Cluster != "edge-1" {
+		t.Errorf("expected Unknown for a site not created yet, got %+v", got)
+	}
+
+	member := &tmv1.Site{Status: tmv1.SiteStatus{
+		Mode:       tmv1.SiteModeEnabled,
+		Sources:    2,
+		Conditions: []tmv1.Condition{{Type: tmv1.ConditionReady, Status: metav1.ConditionTrue, Message: "All tmsources of the site are active."}},
+	}}
+	got := SiteStatus("edge-1", member, now)
+	if got.Ready != metav1.ConditionTrue || got.Mode != tmv1.SiteModeEnabled || got.Sources != 2 || got.Message == "" {
+		t.Errorf("expected the member status, got %+v", got)
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []tmv1.MemberSiteStatus
+		status  metav1.ConditionStatus
+		reason  string
+	}{
+		{name: "no placement", status: metav1.ConditionFalse, reason: "NoPlacement"},
+		{
+			name:    "all ready",
+			members: []tmv1.MemberSiteStatus{{Cluster: "edge-1", Ready: metav1.ConditionTrue}, {Cluster: "edge-2", Ready: metav1.ConditionTrue}},
+			status:  metav1.ConditionTrue,
+			reason:  "MembersReady",
+		},
+		{
+			name:    "one unreachable",
+			members: []tmv1.MemberSiteStatus{{Cluster: "edge-1", Ready: metav1.ConditionTrue}, {Cluster: "edge-2", Ready: metav1.ConditionUnknown}},
+			status:  metav1.ConditionFalse,
+			reason:  "MembersNotReady",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reason, _ := Ready(tt.members)
+			if status != tt.status || reason != tt.reason {
+				t.Errorf("expected %s %s, got %s %s", tt.status, tt.reason, status, reason)
+			}
+		})
+	}
+}
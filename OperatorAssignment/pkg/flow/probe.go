@@ -0,0 +1,323 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package flow checks the metrics of the tmsources actually reach NATS.
+package flow
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Reasons of the Flowing condition of a tmsource.
+const (
+	ReasonFlowing      = "MessagesFlowing"
+	ReasonWaiting      = "WaitingForMessages"
+	ReasonNoMessages   = "NoMessages"
+	ReasonStale        = "MessagesStale"
+	ReasonDisconnected = "ProbeDisconnected"
+	ReasonNotProbed    = "NatsNotProbed"
+)
+
+// clusterDomain completes the service names of the NATS addresses.
+const clusterDomain = "cluster.local"
+
+const (
+	// DefaultStaleAfter is how long a subject may stay silent before it is
+	// stale.
+	DefaultStaleAfter = 30 * time.Second
+
+	// connectRetryPeriod is the wait between two connections to an
+	// unreachable NATS, once connected the client reconnects by itself.
+	connectRetryPeriod = 5 * time.Second
+)
+
+var stalenessDesc = prometheus.NewDesc(
+	"rocketlab_tmsource_flow_staleness_seconds",
+	"Seconds since the last message on the metric subject of a tmsource, or since it is watched when none was received.",
+	[]string{"namespace", "tmsource", "subject"}, nil,
+)
+
+// watch is a tmsource whose metric subject is followed.
+type watch struct {
+	subject string
+	since   time.Time
+}
+
+// Probe subscribes to the metric subjects of the running tmsources and keeps
+// the time of their last message. Subjects are subscribed once, whatever the
+// number of tmsources publishing them. It only runs on the leader.
+type Probe struct {
+	// URL of the NATS server.
+	URL string
+	// StaleAfter is how long a subject may stay silent, DefaultStaleAfter
+	// when zero.
+	StaleAfter time.Duration
+	Log        logr.Logger
+
+	mu      sync.Mutex
+	conn    *nats.Conn
+	watches map[types.NamespacedName]watch
+	subs    map[string]*nats.Subscription
+	last    map[string]time.Time
+	clock   func() time.Time
+}
+
+// Start connects to NATS and keeps the subscriptions until stop is closed.
+// NATS not being reachable does not fail the manager, the connection is
+// retried and the tmsources report the probe is disconnected meanwhile.
+func (p *Probe) Start(stop <-chan struct{}) error {
+	var conn *nats.Conn
+	err := wait.PollImmediateUntil(connectRetryPeriod, func() (bool, error) {
+		var err error
+		conn, err = nats.Connect(p.URL,
+			nats.Name("rocketlab-controller-flow-probe"),
+			nats.MaxReconnects(-1),
+			nats.DisconnectErrHandler(func(_ *nats.Conn, _ error) {
+				p.Log.Info("Disconnected from NATS.")
+			}),
+			nats.ReconnectHandler(func(_ *nats.Conn) {
+				p.Log.Info("Reconnected to NATS.")
+			}),
+		)
+		if err != nil {
+			p.Log.Info("Could not connect to NATS at " + p.URL + ", retrying.")
+			return false, nil
+		}
+		return true, nil
+	}, stop)
+	if err == wait.ErrWaitTimeout {
+		// Stopped before NATS was reachable
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.Log.Info("Watching the tmsource subjects on " + p.URL + ".")
+
+	p.mu.Lock()
+	p.init()
+	p.conn = conn
+	for _, w := range p.watches {
+		p.subscribe(w.subject)
+	}
+	p.mu.Unlock()
+
+	<-stop
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.Close()
+	p.conn = nil
+	p.subs = map[string]*nats.Subscription{}
+	return nil
+}
+
+// Watch follows the subject of a tmsource, replacing its previous subject.
+func (p *Probe) Watch(key types.NamespacedName, subject string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+
+	if w, ok := p.watches[key]; ok {
+		if w.subject == subject {
+			return
+		}
+		p.forget(key)
+	}
+	p.watches[key] = watch{subject: subject, since: p.clock()}
+	if p.conn != nil {
+		p.subscribe(subject)
+	}
+}
+
+// Forget stops following the subject of a tmsource.
+func (p *Probe) Forget(key types.NamespacedName) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	p.forget(key)
+}
+
+// Status returns the Flowing condition of a watched tmsource.
+func (p *Probe) Status(key types.NamespacedName) (metav1.ConditionStatus, string, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+
+	w, ok := p.watches[key]
+	if !ok {
+		return metav1.ConditionUnknown, ReasonWaiting, "The tmsource is not watched."
+	}
+	if p.conn == nil || !p.conn.IsConnected() {
+		return metav1.ConditionUnknown, ReasonDisconnected, "The probe is not connected to NATS at " + p.URL + "."
+	}
+
+	now := p.clock()
+	last, received := p.last[w.subject]
+	switch {
+	case received && now.Sub(last) <= p.staleAfter():
+		return metav1.ConditionTrue, ReasonFlowing, "Messages are received on subject " + w.subject + "."
+	case received:
+		return metav1.ConditionFalse, ReasonStale, "No message on subject " + w.subject + " for more than " + p.staleAfter().String() + "."
+	case now.Sub(w.since) <= p.staleAfter():
+		return metav1.ConditionUnknown, ReasonWaiting, "Waiting for a first message on subject " + w.subject + "."
+	default:
+		return metav1.ConditionFalse, ReasonNoMessages, "No message was received on subject " + w.subject + "."
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *Probe) Describe(ch chan<- *prometheus.Desc) {
+	ch <- stalenessDesc
+}
+
+// Collect implements prometheus.Collector, one staleness per watched tmsource.
+func (p *Probe) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+
+	now := p.clock()
+	for key, w := range p.watches {
+		since := w.since
+		if last, ok := p.last[w.subject]; ok {
+			since = last
+		}
+		ch <- prometheus.MustNewConstMetric(stalenessDesc, prometheus.GaugeValue,
+			now.Sub(since).Seconds(), key.Namespace, key.Name, w.subject)
+	}
+}
+
+// Covers reports whether the probe connects to the NATS server of a host:port
+// address, as given to the source pods of a namespace. Service names are
+// completed to their cluster-local name first, a port defaults to the NATS
+// one.
+func (p *Probe) Covers(address, namespace string) bool {
+	want := hostPort(address, namespace)
+	for _, server := range strings.Split(p.URL, ",") {
+		server = strings.TrimSpace(server)
+		if !strings.Contains(server, "://") {
+			server = "nats://" + server
+		}
+		u, err := url.Parse(server)
+		if err == nil && hostPort(u.Host, "") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPort completes the host of an address resolved from a namespace and
+// adds the default NATS port when it has none.
+func hostPort(address, namespace string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, strconv.Itoa(nats.DefaultPort)
+	}
+	return net.JoinHostPort(serviceHost(host, namespace), port)
+}
+
+// serviceHost returns the cluster-local name of a service host: name,
+// name.namespace and name.namespace.svc all resolve to
+// name.namespace.svc.cluster.local. Other hosts are kept, the name of a
+// service without namespace too when the namespace is not known.
+func serviceHost(host, namespace string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	switch labels := strings.Split(host, "."); {
+	case len(labels) == 1 && namespace != "":
+		return host + "." + namespace + ".svc." + clusterDomain
+	case len(labels) == 2:
+		return host + ".svc." + clusterDomain
+	case len(labels) == 3 && labels[2] == "svc":
+		return host + "." + clusterDomain
+	}
+	return host
+}
+
+// CheckInterval is how often the status of the watched tmsources should be
+// read for their condition to follow the flow.
+func (p *Probe) CheckInterval() time.Duration {
+	return p.staleAfter() / 2
+}
+
+func (p *Probe) init() {
+	if p.watches != nil {
+		return
+	}
+	p.watches = map[types.NamespacedName]watch{}
+	p.subs = map[string]*nats.Subscription{}
+	p.last = map[string]time.Time{}
+	if p.clock == nil {
+		p.clock = time.Now
+	}
+}
+
+func (p *Probe) staleAfter() time.Duration {
+	if p.StaleAfter > 0 {
+		return p.StaleAfter
+	}
+	return DefaultStaleAfter
+}
+
+// subscribe records the messages of a subject, once.
+func (p *Probe) subscribe(subject string) {
+	if _, ok := p.subs[subject]; ok {
+		return
+	}
+	sub, err := p.conn.Subscribe(subject, func(msg *nats.Msg) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.last[msg.Subject] = p.clock()
+	})
+	if err != nil {
+		p.Log.Error(err, "unable to subscribe to "+subject)
+		return
+	}
+	p.subs[subject] = sub
+}
+
+// forget drops a watch and the subscription no other watch needs.
+func (p *Probe) forget(key types.NamespacedName) {
+	w, ok := p.watches[key]
+	if !ok {
+		return
+	}
+	delete(p.watches, key)
+	for _, other := range p.watches {
+		if other.subject == w.subject {
+			return
+		}
+	}
+	if sub, ok := p.subs[w.subject]; ok {
+		_ = sub.Unsubscribe()
+		delete(p.subs, w.subject)
+	}
+	delete(p.last, w.subject)
+}
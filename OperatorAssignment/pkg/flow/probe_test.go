@@ -0,0 +1,238 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// fakeClock is read by the subscription goroutines of the probe.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Step(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// runServer starts an embedded nats-server on a random port.
+func runServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats-server did not start")
+	}
+	return s
+}
+
+// startProbe runs a probe against the server until the returned stop is called.
+func startProbe(t *testing.T, s *server.Server, clock *fakeClock) (*Probe, func()) {
+	p := &Probe{URL: s.ClientURL(), StaleAfter: 30 * time.Second, Log: ctrl.Log.WithName("test"), clock: clock.Now}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		if err := p.Start(stop); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.conn != nil && p.conn.IsConnected()
+	})
+	return p, func() {
+		close(stop)
+		<-done
+	}
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("condition not met within 5s")
+}
+
+func publish(t *testing.T, s *server.Server, subject string) {
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	if err := nc.Publish(subject, []byte("42")); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reason(p *Probe, key types.NamespacedName) string {
+	_, r, _ := p.Status(key)
+	return r
+}
+
+func TestProbeStatus(t *testing.T) {
+	s := runServer(t)
+	defer s.Shutdown()
+	clock := &fakeClock{now: time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)}
+	p, stop := startProbe(t, s, clock)
+	defer stop()
+
+	rock := types.NamespacedName{Namespace: "default", Name: "tm-rock"}
+	p.Watch(rock, "rock")
+	if status, r, _ := p.Status(rock); status != metav1.ConditionUnknown || r != ReasonWaiting {
+		t.Errorf("before any message, Status() = %s %s, want Unknown %s", status, r, ReasonWaiting)
+	}
+
+	publish(t, s, "rock")
+	eventually(t, func() bool { return reason(p, rock) == ReasonFlowing })
+	if status, _, _ := p.Status(rock); status != metav1.ConditionTrue {
+		t.Errorf("Status() = %s, want True", status)
+	}
+
+	clock.Step(31 * time.Second)
+	if status, r, _ := p.Status(rock); status != metav1.ConditionFalse || r != ReasonStale {
+		t.Errorf("after 31s of silence, Status() = %s %s, want False %s", status, r, ReasonStale)
+	}
+	publish(t, s, "rock")
+	eventually(t, func() bool { return reason(p, rock) == ReasonFlowing })
+
+	paper := types.NamespacedName{Namespace: "default", Name: "tm-paper"}
+	p.Watch(paper, "paper")
+	clock.Step(31 * time.Second)
+	if status, r, _ := p.Status(paper); status != metav1.ConditionFalse || r != ReasonNoMessages {
+		t.Errorf("Status() = %s %s, want False %s", status, r, ReasonNoMessages)
+	}
+}
+
+func TestProbeSharesSubscriptions(t *testing.T) {
+	s := runServer(t)
+	defer s.Shutdown()
+	p, stop := startProbe(t, s, &fakeClock{now: time.Now()})
+	defer stop()
+
+	first := types.NamespacedName{Namespace: "default", Name: "tm-1"}
+	second := types.NamespacedName{Namespace: "default", Name: "tm-2"}
+	p.Watch(first, "rock")
+	p.Watch(second, "rock")
+	if len(p.subs) != 1 {
+		t.Errorf("%d subscriptions, want one per subject", len(p.subs))
+	}
+
+	p.Forget(first)
+	if len(p.subs) != 1 {
+		t.Errorf("the subject of tm-2 was unsubscribed")
+	}
+	p.Watch(second, "paper")
+	if _, ok := p.subs["rock"]; ok || len(p.subs) != 1 {
+		t.Errorf("subscriptions = %v, want only paper", p.subs)
+	}
+	p.Forget(second)
+	if len(p.subs) != 0 {
+		t.Errorf("subscriptions left after forgetting every tmsource")
+	}
+}
+
+func TestProbeDisconnected(t *testing.T) {
+	p := &Probe{URL: "nats://127.0.0.1:4222"}
+	key := types.NamespacedName{Namespace: "default", Name: "tm-1"}
+	p.Watch(key, "rock")
+	if status, r, _ := p.Status(key); status != metav1.ConditionUnknown || r != ReasonDisconnected {
+		t.Errorf("without connection, Status() = %s %s, want Unknown %s", status, r, ReasonDisconnected)
+	}
+}
+
+func TestProbeCollect(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)}
+	p := &Probe{clock: clock.Now}
+	p.Watch(types.NamespacedName{Namespace: "default", Name: "tm-rock"}, "rock")
+	p.Watch(types.NamespacedName{Namespace: "default", Name: "tm-paper"}, "paper")
+	clock.Step(10 * time.Second)
+	// A message received by the subscription
+	p.last["paper"] = clock.Now()
+	clock.Step(2 * time.Second)
+
+	expected := `
+# HELP rocketlab_tmsource_flow_staleness_seconds Seconds since the last message on the metric subject of a tmsource, or since it is watched when none was received.
+# TYPE rocketlab_tmsource_flow_staleness_seconds gauge
+rocketlab_tmsource_flow_staleness_seconds{namespace="default",subject="paper",tmsource="tm-paper"} 2
+rocketlab_tmsource_flow_staleness_seconds{namespace="default",subject="rock",tmsource="tm-rock"} 12
+`
+	if err := testutil.CollectAndCompare(p, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProbeCovers(t *testing.T) {
+	p := &Probe{URL: "nats://nats-server-service.default.svc.cluster.local:4222, nats://nats-2.telemetry.svc, nats://nats.infra.svc.cluster.local:4222"}
+	tests := []struct {
+		address   string
+		namespace string
+		want      bool
+	}{
+		{"nats-server-service.default.svc.cluster.local:4222", "lab", true},
+		{"nats-2.telemetry.svc:4222", "lab", true},
+		{"nats-2.telemetry.svc", "lab", true},
+		{"nats-server-service.default.svc.cluster.local:4333", "lab", false},
+		{"nats.telemetry.svc:4222", "lab", false},
+		// Short service names resolve to the same server as the FQDN
+		{"nats.infra:4222", "lab", true},
+		{"nats.infra.svc:4222", "lab", true},
+		{"NATS.infra.svc.cluster.local.:4222", "lab", true},
+		{"nats:4222", "infra", true},
+		{"nats:4222", "lab", false},
+		{"nats-2:4222", "telemetry", true},
+	}
+	for _, tt := range tests {
+		if got := p.Covers(tt.address, tt.namespace); got != tt.want {
+			t.Errorf("Covers(%s, %s) = %v, want %v", tt.address, tt.namespace, got, tt.want)
+		}
+	}
+	if !(&Probe{URL: "127.0.0.1:4222"}).Covers("127.0.0.1:4222", "lab") {
+		t.Errorf("a URL without scheme should cover its address")
+	}
+	if !(&Probe{URL: "nats://localhost:4222"}).Covers("localhost:4222", "") {
+		t.Errorf("a host without namespace should be kept as is")
+	}
+}
@@ -0,0 +1,287 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package topology exports a site with its tmsources as a single bundle, and
+// imports it into another namespace or cluster.
+package topology
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+const (
+	// APIVersion and Kind identify a bundle document.
+	APIVersion = "tm.rocketlab.global/v1"
+	Kind       = "SiteBundle"
+
+	// lastAppliedAnnotation is set by kubectl apply, it would leak the
+	// original object into the imported one.
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// Bundle is a site and everything needed to recreate it: its hand-authored
+// tmsources, its SiteTemplate and the ConfigMaps of their catalogs. Tmsources
+// generated from the catalog are left out, the imported site generates them
+// again.
+type Bundle struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Site          tmv1.Site           `json:"site"`
+	SiteTemplates []tmv1.SiteTemplate `json:"siteTemplates,omitempty"`
+	TmSources     []tmv1.TmSource     `json:"tmsources,omitempty"`
+	ConfigMaps    []v1.ConfigMap      `json:"configMaps,omitempty"`
+}
+
+// Export reads a site, its tmsources, its template and their catalog
+// ConfigMaps into a bundle without the fields populated by the API server.
+func Export(ctx context.Context, c client.Reader, namespace, name string) (*Bundle, error) {
+	b := &Bundle{TypeMeta: metav1.TypeMeta{APIVersion: APIVersion, Kind: Kind}}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &b.Site); err != nil {
+		return nil, err
+	}
+	b.Site.Status = tmv1.SiteStatus{}
+	stripMeta(&b.Site.ObjectMeta)
+	b.Site.TypeMeta = metav1.TypeMeta{APIVersion: tmv1.GroupVersion.String(), Kind: "Site"}
+
+	var sources tmv1.TmSourceList
+	if err := c.List(ctx, &sources, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	for _, tm := range sources.Items {
+		if tm.Spec.Site != name || generated(&tm) {
+			continue
+		}
+		tm.Status = tmv1.TmSourceStatus{}
+		stripMeta(&tm.ObjectMeta)
+		tm.TypeMeta = metav1.TypeMeta{APIVersion: tmv1.GroupVersion.String(), Kind: "TmSource"}
+		b.TmSources = append(b.TmSources, tm)
+	}
+	sort.Slice(b.TmSources, func(i, j int) bool { return b.TmSources[i].Name < b.TmSources[j].Name })
+
+	if err := b.exportCatalog(ctx, c, namespace, b.Site.Spec.Catalog); err != nil {
+		return nil, err
+	}
+
+	if ref := b.Site.Spec.TemplateRef; ref != nil {
+		var tpl tmv1.SiteTemplate
+		err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &tpl)
+		switch {
+		case apierrors.IsNotFound(err):
+			// The site waits for a missing template, the bundle leaves it out
+		case err != nil:
+			return nil, err
+		default:
+			stripMeta(&tpl.ObjectMeta)
+			tpl.TypeMeta = metav1.TypeMeta{APIVersion: tmv1.GroupVersion.String(), Kind: "SiteTemplate"}
+			b.SiteTemplates = append(b.SiteTemplates, tpl)
+			if err := b.exportCatalog(ctx, c, namespace, tpl.Spec.Catalog); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return b, nil
+}
+
+// exportCatalog adds the ConfigMap of a catalog to the bundle, once.
+func (b *Bundle) exportCatalog(ctx context.Context, c client.Reader, namespace string, catalog *tmv1.MetricCatalog) error {
+	if catalog == nil || catalog.ConfigMapRef == nil {
+		return nil
+	}
+	for _, cm := range b.ConfigMaps {
+		if cm.Name == catalog.ConfigMapRef.Name {
+			return nil
+		}
+	}
+	var cm v1.ConfigMap
+	err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: catalog.ConfigMapRef.Name}, &cm)
+	switch {
+	case apierrors.IsNotFound(err):
+		// The site tolerates a missing catalog ConfigMap, so does the bundle
+		return nil
+	case err != nil:
+		return err
+	}
+	stripMeta(&cm.ObjectMeta)
+	cm.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"}
+	b.ConfigMaps = append(b.ConfigMaps, cm)
+	return nil
+}
+
+// Marshal encodes a bundle as YAML, or JSON when format is json.
+func Marshal(b *Bundle, format string) ([]byte, error) {
+	doc, err := document(b)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "", "yaml":
+		return yaml.Marshal(doc)
+	case "json":
+		return json.MarshalIndent(doc, "", "  ")
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected yaml or json", format)
+	}
+}
+
+// document converts an object to a map without the empty status and creation
+// timestamp the typed structs always encode.
+func document(obj interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	prune(doc)
+	return doc, nil
+}
+
+func prune(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if meta, ok := v["metadata"].(map[string]interface{}); ok {
+			delete(v, "status")
+			delete(meta, "creationTimestamp")
+		}
+		for _, child := range v {
+			prune(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			prune(child)
+		}
+	}
+}
+
+// Unmarshal decodes a YAML or JSON bundle.
+func Unmarshal(data []byte) (*Bundle, error) {
+	var b Bundle
+	if err := yaml.UnmarshalStrict(data, &b); err != nil {
+		return nil, err
+	}
+	if b.APIVersion != APIVersion || b.Kind != Kind {
+		return nil, fmt.Errorf("expected %s %s, got %s %s", APIVersion, Kind, b.APIVersion, b.Kind)
+	}
+	if b.Site.Name == "" {
+		return nil, fmt.Errorf("the bundle has no site")
+	}
+	return &b, nil
+}
+
+// Remap returns a copy of the bundle moved to namespace, unchanged when empty,
+// with its objects renamed after names, old name to new name. References
+// between the objects follow: the site of the tmsources, the sites the site
+// depends on, its template and the catalog ConfigMaps.
+func (b *Bundle) Remap(namespace string, names map[string]string) *Bundle {
+	rename := func(name string) string {
+		if to, ok := names[name]; ok {
+			return to
+		}
+		return name
+	}
+	move := func(meta *metav1.ObjectMeta) {
+		meta.Name = rename(meta.Name)
+		if namespace != "" {
+			meta.Namespace = namespace
+		}
+	}
+
+	out := &Bundle{TypeMeta: b.TypeMeta}
+	out.Site = *b.Site.DeepCopy()
+	move(&out.Site.ObjectMeta)
+	for i, dep := range out.Site.Spec.DependsOn {
+		out.Site.Spec.DependsOn[i] = tmv1.SiteName(rename(string(dep)))
+	}
+	if catalog := out.Site.Spec.Catalog; catalog != nil && catalog.ConfigMapRef != nil {
+		catalog.ConfigMapRef.Name = rename(catalog.ConfigMapRef.Name)
+	}
+	if ref := out.Site.Spec.TemplateRef; ref != nil {
+		ref.Name = rename(ref.Name)
+	}
+	for _, tpl := range b.SiteTemplates {
+		tpl := *tpl.DeepCopy()
+		move(&tpl.ObjectMeta)
+		if catalog := tpl.Spec.Catalog; catalog != nil && catalog.ConfigMapRef != nil {
+			catalog.ConfigMapRef.Name = rename(catalog.ConfigMapRef.Name)
+		}
+		out.SiteTemplates = append(out.SiteTemplates, tpl)
+	}
+	for _, tm := range b.TmSources {
+		tm := *tm.DeepCopy()
+		move(&tm.ObjectMeta)
+		tm.Spec.Site = rename(tm.Spec.Site)
+		out.TmSources = append(out.TmSources, tm)
+	}
+	for _, cm := range b.ConfigMaps {
+		cm := *cm.DeepCopy()
+		move(&cm.ObjectMeta)
+		out.ConfigMaps = append(out.ConfigMaps, cm)
+	}
+	return out
+}
+
+// objects returns the objects of the bundle in the order they are imported,
+// ConfigMaps and templates before the site which reads them, and the site
+// before its tmsources so they do not start without it.
+func (b *Bundle) objects() []object {
+	var objs []object
+	for i := range b.ConfigMaps {
+		objs = append(objs, object{kind: "ConfigMap", obj: &b.ConfigMaps[i], meta: &b.ConfigMaps[i].ObjectMeta, empty: &v1.ConfigMap{}})
+	}
+	for i := range b.SiteTemplates {
+		objs = append(objs, object{kind: "SiteTemplate", obj: &b.SiteTemplates[i], meta: &b.SiteTemplates[i].ObjectMeta, empty: &tmv1.SiteTemplate{}})
+	}
+	objs = append(objs, object{kind: "Site", obj: &b.Site, meta: &b.Site.ObjectMeta, empty: &tmv1.Site{}})
+	for i := range b.TmSources {
+		objs = append(objs, object{kind: "TmSource", obj: &b.TmSources[i], meta: &b.TmSources[i].ObjectMeta, empty: &tmv1.TmSource{}})
+	}
+	return objs
+}
+
+// generated reports whether a tmsource was generated from a site catalog.
+func generated(tm *tmv1.TmSource) bool {
+	owner := metav1.GetControllerOf(tm)
+	return owner != nil && owner.Kind == "Site"
+}
+
+// stripMeta keeps the metadata an imported object is created with.
+func stripMeta(meta *metav1.ObjectMeta) {
+	*meta = metav1.ObjectMeta{
+		Name:        meta.Name,
+		Namespace:   meta.Namespace,
+		Labels:      meta.Labels,
+		Annotations: meta.Annotations,
+	}
+	delete(meta.Annotations, lastAppliedAnnotation)
+	if len(meta.Annotations) == 0 {
+		meta.Annotations = nil
+	}
+}
@@ -0,0 +1,269 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topology
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func newClient(objs ...runtime.Object) client.Client {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+	_ = tmv1.AddToScheme(s)
+	return fake.NewFakeClientWithScheme(s, objs...)
+}
+
+func meta(namespace, name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       namespace,
+		UID:             types.UID(name + "-uid"),
+		ResourceVersion: "42",
+		Generation:      3,
+		Finalizers:      []string{"tm.rocketlab.global/finalizer"},
+		Labels:          map[string]string{"team": "ops"},
+		Annotations:     map[string]string{lastAppliedAnnotation: "{}"},
+	}
+}
+
+// objects returns a site with a catalog, a tmsource of its own, one generated
+// from its catalog and one of another site.
+func objects() []runtime.Object {
+	site := &tmv1.Site{
+		ObjectMeta: meta("default", "site-lc-1"),
+		Spec: tmv1.SiteSpec{
+			Enabled:   true,
+			DependsOn: []tmv1.SiteName{"site-lc-0"},
+			Catalog: &tmv1.MetricCatalog{
+				Metrics:      []string{"paper"},
+				ConfigMapRef: &tmv1.CatalogConfigMapRef{Name: "site-lc-1-catalog"},
+			},
+		},
+		Status: tmv1.SiteStatus{Mode: tmv1.SiteModeEnabled},
+	}
+	rock := &tmv1.TmSource{
+		ObjectMeta: meta("default", "tm-1"),
+		Spec:       tmv1.TmSourceSpec{Site: "site-lc-1", MetricName: "rock"},
+		Status:     tmv1.TmSourceStatus{Phase: tmv1.TmSourceRunning},
+	}
+	paper := &tmv1.TmSource{
+		ObjectMeta: meta("default", "site-lc-1-paper"),
+		Spec:       tmv1.TmSourceSpec{Site: "site-lc-1", MetricName: "paper"},
+	}
+	isController := true
+	paper.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: tmv1.GroupVersion.String(), Kind: "Site", Name: "site-lc-1", UID: "site-lc-1-uid", Controller: &isController,
+	}}
+	other := &tmv1.TmSource{
+		ObjectMeta: meta("default", "tm-2"),
+		Spec:       tmv1.TmSourceSpec{Site: "site-lc-2", MetricName: "rock"},
+	}
+	catalog := &v1.ConfigMap{
+		ObjectMeta: meta("default", "site-lc-1-catalog"),
+		Data:       map[string]string{"metrics": "scissors\n"},
+	}
+	return []runtime.Object{site, rock, paper, other, catalog}
+}
+
+func TestExport(t *testing.T) {
+	b, err := Export(context.Background(), newClient(objects()...), "default", "site-lc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.APIVersion != APIVersion || b.Kind != Kind {
+		t.Errorf("expected %s %s, got %s %s", APIVersion, Kind, b.APIVersion, b.Kind)
+	}
+	if b.Site.Name != "site-lc-1" || b.Site.Kind != "Site" {
+		t.Errorf("expected Site site-lc-1, got %s %s", b.Site.Kind, b.Site.Name)
+	}
+	if b.Site.Status.Mode != "" {
+		t.Errorf("expected no status, got %+v", b.Site.Status)
+	}
+	if len(b.TmSources) != 1 || b.TmSources[0].Name != "tm-1" {
+		t.Fatalf("expected only tm-1 to be exported, got %+v", b.TmSources)
+	}
+	if b.TmSources[0].Status.Phase != "" {
+		t.Errorf("expected no status, got %+v", b.TmSources[0].Status)
+	}
+	if len(b.ConfigMaps) != 1 || b.ConfigMaps[0].Data["metrics"] != "scissors\n" {
+		t.Errorf("expected the catalog ConfigMap, got %+v", b.ConfigMaps)
+	}
+
+	metas := []metav1.ObjectMeta{b.Site.ObjectMeta, b.TmSources[0].ObjectMeta, b.ConfigMaps[0].ObjectMeta}
+	for _, m := range metas {
+		if m.UID != "" || m.ResourceVersion != "" || m.Generation != 0 || len(m.Finalizers) != 0 {
+			t.Errorf("expected server fields of %s to be stripped, got %+v", m.Name, m)
+		}
+		if m.Labels["team"] != "ops" {
+			t.Errorf("expected labels of %s to be kept, got %v", m.Name, m.Labels)
+		}
+		if m.Annotations != nil {
+			t.Errorf("expected the last applied annotation of %s to be stripped, got %v", m.Name, m.Annotations)
+		}
+	}
+}
+
+func TestExportMissingSite(t *testing.T) {
+	if _, err := Export(context.Background(), newClient(), "default", "site-lc-1"); err == nil {
+		t.Errorf("expected an error for a missing site")
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	b, err := Export(context.Background(), newClient(objects()...), "default", "site-lc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"yaml", "json"} {
+		data, err := Marshal(b, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if strings.Contains(string(data), "status") || strings.Contains(string(data), "resourceVersion") {
+			t.Errorf("%s: expected no server fields, got\n%s", format, data)
+		}
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if got.Site.Name != "site-lc-1" || len(got.TmSources) != 1 || len(got.ConfigMaps) != 1 {
+			t.Errorf("%s: expected the exported bundle back, got %+v", format, got)
+		}
+	}
+
+	if _, err := Marshal(b, "xml"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+	if _, err := Unmarshal([]byte("apiVersion: v1\nkind: List\n")); err == nil {
+		t.Errorf("expected an error for another kind")
+	}
+}
+
+func TestRemap(t *testing.T) {
+	b, err := Export(context.Background(), newClient(objects()...), "default", "site-lc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.Remap("staging", map[string]string{
+		"site-lc-1":         "site-lc-9",
+		"site-lc-0":         "site-lc-8",
+		"site-lc-1-catalog": "site-lc-9-catalog",
+	})
+
+	if got.Site.Name != "site-lc-9" || got.Site.Namespace != "staging" {
+		t.Errorf("expected staging/site-lc-9, got %s/%s", got.Site.Namespace, got.Site.Name)
+	}
+	if got.Site.Spec.DependsOn[0] != "site-lc-8" {
+		t.Errorf("expected a dependency on site-lc-8, got %v", got.Site.Spec.DependsOn)
+	}
+	if got.Site.Spec.Catalog.ConfigMapRef.Name != "site-lc-9-catalog" {
+		t.Errorf("expected catalog site-lc-9-catalog, got %s", got.Site.Spec.Catalog.ConfigMapRef.Name)
+	}
+	if tm := got.TmSources[0]; tm.Name != "tm-1" || tm.Namespace != "staging" || tm.Spec.Site != "site-lc-9" {
+		t.Errorf("expected staging/tm-1 of site-lc-9, got %s/%s of %s", tm.Namespace, tm.Name, tm.Spec.Site)
+	}
+	if cm := got.ConfigMaps[0]; cm.Name != "site-lc-9-catalog" || cm.Namespace != "staging" {
+		t.Errorf("expected staging/site-lc-9-catalog, got %s/%s", cm.Namespace, cm.Name)
+	}
+	if b.Site.Name != "site-lc-1" || b.TmSources[0].Spec.Site != "site-lc-1" {
+		t.Errorf("expected the original bundle to be unchanged")
+	}
+}
+
+func TestExportSiteTemplate(t *testing.T) {
+	ctx := context.Background()
+	site := &tmv1.Site{
+		ObjectMeta: meta("default", "site-lc-1"),
+		Spec:       tmv1.SiteSpec{Enabled: true, TemplateRef: &tmv1.SiteTemplateRef{Name: "launch-complex"}},
+	}
+	tpl := &tmv1.SiteTemplate{
+		ObjectMeta: meta("default", "launch-complex"),
+		Spec: tmv1.SiteTemplateSpec{
+			Image:   "maxthom/rocket-source:v2",
+			Catalog: &tmv1.MetricCatalog{ConfigMapRef: &tmv1.CatalogConfigMapRef{Name: "launch-complex-catalog"}},
+		},
+	}
+	catalog := &v1.ConfigMap{
+		ObjectMeta: meta("default", "launch-complex-catalog"),
+		Data:       map[string]string{"metrics": "rock\n"},
+	}
+	b, err := Export(ctx, newClient(site, tpl, catalog), "default", "site-lc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.SiteTemplates) != 1 || b.SiteTemplates[0].Spec.Image != "maxthom/rocket-source:v2" || b.SiteTemplates[0].Kind != "SiteTemplate" {
+		t.Fatalf("expected the template of the site, got %+v", b.SiteTemplates)
+	}
+	if m := b.SiteTemplates[0].ObjectMeta; m.UID != "" || m.ResourceVersion != "" || m.Annotations != nil {
+		t.Errorf("expected server fields of the template to be stripped, got %+v", m)
+	}
+	if len(b.ConfigMaps) != 1 || b.ConfigMaps[0].Name != "launch-complex-catalog" {
+		t.Errorf("expected the catalog ConfigMap of the template, got %+v", b.ConfigMaps)
+	}
+
+	data, err := Marshal(b, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	got := b.Remap("staging", map[string]string{
+		"launch-complex":         "launch-complex-2",
+		"launch-complex-catalog": "launch-complex-2-catalog",
+	})
+	if got.Site.Spec.TemplateRef.Name != "launch-complex-2" {
+		t.Errorf("expected template launch-complex-2, got %s", got.Site.Spec.TemplateRef.Name)
+	}
+	if tpl := got.SiteTemplates[0]; tpl.Name != "launch-complex-2" || tpl.Namespace != "staging" || tpl.Spec.Catalog.ConfigMapRef.Name != "launch-complex-2-catalog" {
+		t.Errorf("expected staging/launch-complex-2 with catalog launch-complex-2-catalog, got %s/%s with %s", tpl.Namespace, tpl.Name, tpl.Spec.Catalog.ConfigMapRef.Name)
+	}
+
+	// The imported site finds its template
+	live := newClient()
+	if _, err := Apply(ctx, live, got); err != nil {
+		t.Fatal(err)
+	}
+	var imported tmv1.SiteTemplate
+	if err := live.Get(ctx, types.NamespacedName{Namespace: "staging", Name: "launch-complex-2"}, &imported); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Plan(ctx, live, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if c.Action != Unchanged {
+			t.Errorf("expected %s %s to be unchanged once applied, got %s\n%s", c.Kind, c.Name, c.Action, c.Diff)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topology
+
+import (
+	"context"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+// Action is what an import does to one object of a bundle.
+type Action string
+
+const (
+	Create    Action = "Create"
+	Update    Action = "Update"
+	Unchanged Action = "Unchanged"
+)
+
+// Change is the planned import of one object of a bundle. Diff is a unified
+// style line diff of the object as exported, empty when Unchanged.
+type Change struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Action    Action
+	Diff      string
+}
+
+// String formats the change as a summary line followed by its diff.
+func (c Change) String() string {
+	s := string(c.Action) + " " + c.Kind + " " + c.Namespace + "/" + c.Name + "\n"
+	return s + c.Diff
+}
+
+// object is one object of a bundle along with an empty object of its type to
+// read the live one into.
+type object struct {
+	kind  string
+	obj   runtime.Object
+	meta  *metav1.ObjectMeta
+	empty runtime.Object
+}
+
+// Plan compares the objects of a bundle to the live ones without changing
+// anything, it is the dry-run of Apply.
+func Plan(ctx context.Context, c client.Reader, b *Bundle) ([]Change, error) {
+	var changes []Change
+	for _, o := range b.objects() {
+		change, _, err := plan(ctx, c, o)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// Apply creates the objects of a bundle that do not exist and updates the
+// ones which differ. It returns the changes it made.
+func Apply(ctx context.Context, c client.Client, b *Bundle) ([]Change, error) {
+	var changes []Change
+	for _, o := range b.objects() {
+		change, live, err := plan(ctx, c, o)
+		if err != nil {
+			return changes, err
+		}
+		obj := o.obj.DeepCopyObject()
+		switch change.Action {
+		case Create:
+			err = c.Create(ctx, obj)
+		case Update:
+			// Only the exported fields are replaced, the status, finalizers and
+			// owners the controllers set on the live object are kept
+			meta, _ := live.(metav1.Object)
+			keepMeta(obj.(metav1.Object), meta)
+			err = c.Update(ctx, obj)
+		}
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// keepMeta copies onto an imported object the metadata of the live one which
+// stripMeta leaves out of bundles but an update must not drop.
+func keepMeta(obj, live metav1.Object) {
+	obj.SetResourceVersion(live.GetResourceVersion())
+	obj.SetFinalizers(live.GetFinalizers())
+	obj.SetOwnerReferences(live.GetOwnerReferences())
+}
+
+// plan reads the live object and compares it to the bundled one.
+func plan(ctx context.Context, c client.Reader, o object) (Change, runtime.Object, error) {
+	change := Change{Kind: o.kind, Namespace: o.meta.Namespace, Name: o.meta.Name}
+	want, err := encode(o.obj)
+	if err != nil {
+		return change, nil, err
+	}
+
+	live := o.empty
+	err = c.Get(ctx, types.NamespacedName{Namespace: o.meta.Namespace, Name: o.meta.Name}, live)
+	if apierrors.IsNotFound(err) {
+		change.Action = Create
+		change.Diff = Diff("", string(want))
+		return change, nil, nil
+	}
+	if err != nil {
+		return change, nil, err
+	}
+
+	got, err := encode(exported(live))
+	if err != nil {
+		return change, nil, err
+	}
+	change.Action = Unchanged
+	if string(got) != string(want) {
+		change.Action = Update
+		change.Diff = Diff(string(got), string(want))
+	}
+	return change, live, nil
+}
+
+// encode formats an object as Marshal does for the diffs.
+func encode(obj runtime.Object) ([]byte, error) {
+	doc, err := document(obj)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// exported returns a copy of a live object as Export writes it.
+func exported(obj runtime.Object) runtime.Object {
+	obj = obj.DeepCopyObject()
+	switch o := obj.(type) {
+	case *tmv1.Site:
+		o.Status = tmv1.SiteStatus{}
+		o.TypeMeta = metav1.TypeMeta{APIVersion: tmv1.GroupVersion.String(), Kind: "Site"}
+		stripMeta(&o.ObjectMeta)
+	case *tmv1.SiteTemplate:
+		o.TypeMeta = metav1.TypeMeta{APIVersion: tmv1.GroupVersion.String(), Kind: "SiteTemplate"}
+		stripMeta(&o.ObjectMeta)
+	case *tmv1.TmSource:
+		o.Status = tmv1.TmSourceStatus{}
+		o.TypeMeta = metav1.TypeMeta{APIVersion: tmv1.GroupVersion.String(), Kind: "TmSource"}
+		stripMeta(&o.ObjectMeta)
+	case *v1.ConfigMap:
+		o.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"}
+		stripMeta(&o.ObjectMeta)
+	}
+	return obj
+}
+
+// Diff returns a line diff from a to b, removed lines prefixed with -, added
+// lines with + and common lines with a space.
+func Diff(a, b string) string {
+	x, y := lines(a), lines(b)
+	// Longest common subsequence, the bundles are small enough for the table
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			sb.WriteString("  " + x[i] + "\n")
+			i++
+			j++
+		case j < len(y) && (i == len(x) || lcs[i][j+1] >= lcs[i+1][j]):
+			sb.WriteString("+ " + y[j] + "\n")
+			j++
+		default:
+			sb.WriteString("- " + x[i] + "\n")
+			i++
+		}
+	}
+	return sb.String()
+}
+
+func lines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
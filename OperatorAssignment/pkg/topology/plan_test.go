@@ -0,0 +1,162 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topology
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	tmv1 "github.com/maxthom/rocketlab-controller/api/v1"
+)
+
+func actions(changes []Change) map[string]Action {
+	got := map[string]Action{}
+	for _, c := range changes {
+		got[c.Kind+"/"+c.Name] = c.Action
+	}
+	return got
+}
+
+func TestPlanAndApply(t *testing.T) {
+	ctx := context.Background()
+	b, err := Export(ctx, newClient(objects()...), "default", "site-lc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = b.Remap("staging", nil)
+	// The target namespace already holds the tmsource, with another metric
+	live := newClient(&tmv1.TmSource{
+		ObjectMeta: meta("staging", "tm-1"),
+		Spec:       tmv1.TmSourceSpec{Site: "site-lc-1", MetricName: "smoke"},
+	})
+
+	changes, err := Plan(ctx, live, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Action{"ConfigMap/site-lc-1-catalog": Create, "TmSource/tm-1": Update, "Site/site-lc-1": Create}
+	if got := actions(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	var kinds []string
+	for _, c := range changes {
+		kinds = append(kinds, c.Kind)
+	}
+	// The site is imported before its tmsources so they do not start without it
+	if want := []string{"ConfigMap", "Site", "TmSource"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("expected the import order %v, got %v", want, kinds)
+	}
+	for _, c := range changes {
+		if c.Name == "tm-1" && (!strings.Contains(c.Diff, "-   metricname: smoke\n") || !strings.Contains(c.Diff, "+   metricname: rock\n")) {
+			t.Errorf("expected the metric change in the diff, got\n%s", c.Diff)
+		}
+	}
+	var site tmv1.Site
+	if err := live.Get(ctx, types.NamespacedName{Namespace: "staging", Name: "site-lc-1"}, &site); err == nil {
+		t.Errorf("expected the dry-run to create nothing")
+	}
+
+	if _, err := Apply(ctx, live, b); err != nil {
+		t.Fatal(err)
+	}
+	var tm tmv1.TmSource
+	if err := live.Get(ctx, types.NamespacedName{Namespace: "staging", Name: "tm-1"}, &tm); err != nil {
+		t.Fatal(err)
+	}
+	if tm.Spec.MetricName != "rock" {
+		t.Errorf("expected tm-1 to be updated to rock, got %s", tm.Spec.MetricName)
+	}
+
+	changes, err = Plan(ctx, live, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if c.Action != Unchanged {
+			t.Errorf("expected %s %s to be unchanged once applied, got %s\n%s", c.Kind, c.Name, c.Action, c.Diff)
+		}
+	}
+}
+
+func TestApplyKeepsFinalizersAndOwners(t *testing.T) {
+	ctx := context.Background()
+	b, err := Export(ctx, newClient(objects()...), "default", "site-lc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The live site is disabled and its tmsource owned by it, both with the
+	// finalizers of the controllers
+	site := &tmv1.Site{ObjectMeta: meta("default", "site-lc-1")}
+	isController := true
+	tm := &tmv1.TmSource{
+		ObjectMeta: meta("default", "tm-1"),
+		Spec:       tmv1.TmSourceSpec{Site: "site-lc-1", MetricName: "smoke"},
+	}
+	tm.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: tmv1.GroupVersion.String(), Kind: "Site", Name: "site-lc-1", UID: "site-lc-1-uid", Controller: &isController,
+	}}
+	live := newClient(site, tm)
+
+	changes, err := Apply(ctx, live, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Action{"ConfigMap/site-lc-1-catalog": Create, "TmSource/tm-1": Update, "Site/site-lc-1": Update}
+	if got := actions(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	var gotSite tmv1.Site
+	if err := live.Get(ctx, types.NamespacedName{Namespace: "default", Name: "site-lc-1"}, &gotSite); err != nil {
+		t.Fatal(err)
+	}
+	if !gotSite.Spec.Enabled {
+		t.Errorf("expected the site to be updated")
+	}
+	if !reflect.DeepEqual(gotSite.Finalizers, site.Finalizers) {
+		t.Errorf("expected the site finalizers %v to be kept, got %v", site.Finalizers, gotSite.Finalizers)
+	}
+	var gotTm tmv1.TmSource
+	if err := live.Get(ctx, types.NamespacedName{Namespace: "default", Name: "tm-1"}, &gotTm); err != nil {
+		t.Fatal(err)
+	}
+	if gotTm.Spec.MetricName != "rock" {
+		t.Errorf("expected tm-1 to be updated to rock, got %s", gotTm.Spec.MetricName)
+	}
+	if !reflect.DeepEqual(gotTm.Finalizers, tm.Finalizers) {
+		t.Errorf("expected the tmsource finalizers %v to be kept, got %v", tm.Finalizers, gotTm.Finalizers)
+	}
+	if !reflect.DeepEqual(gotTm.OwnerReferences, tm.OwnerReferences) {
+		t.Errorf("expected the tmsource owner %v to be kept, got %v", tm.OwnerReferences, gotTm.OwnerReferences)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	got := Diff("a\nb\nc\n", "a\nc\nd\n")
+	want := "  a\n- b\n  c\n+ d\n"
+	if got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+	if got := Diff("", "a\n"); got != "+ a\n" {
+		t.Errorf("expected only an added line, got %q", got)
+	}
+}